@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/enclave"
+)
+
+func main() {
+	label := flag.String("label", "", "Label of the imported key")
+	keyFile := flag.String("key", "", "Private key file in PEM (PKCS#8, PKCS#1, SEC1), JWK or OpenSSH format")
+	dir := flag.String("dir", "", "Directory of the sealed key store")
+	kekFile := flag.String("kek-file", "", "File holding the hex-encoded key-encryption key")
+	passphraseEnv := flag.String("passphrase-env", "", "Environment variable holding the OpenSSH key passphrase")
+	nonExportable := flag.Bool("non-exportable", false, "Import the key as non-exportable, so the key store never returns it and keeps no host copy; the key file is only removed with -wipe")
+	wipe := flag.Bool("wipe", false, "Overwrite the key file with zeros and remove it after a successful import")
+	flag.Parse()
+
+	if *label == "" || *keyFile == "" || *dir == "" || *kekFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Errors are returned rather than fatal, so the key store is destroyed before exiting
+	if err := run(*label, *keyFile, *dir, *kekFile, *passphraseEnv, *nonExportable, *wipe); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run imports the key file into the sealed key store, destroying the key store before it returns
+func run(label, keyFile, dir, kekFile, passphraseEnv string, nonExportable, wipe bool) error {
+	kek, err := readKEK(kekFile)
+	if err != nil {
+		return fmt.Errorf("failed to read key-encryption key: %v", err)
+	}
+	// OpenKeyStore wipes the KEK, but it is never reached if the AXI region cannot be mapped
+	defer clear(kek)
+
+	keyStore, err := enclave.OpenSealedEnclave(enclave.KeyStoreConfig{
+		Dir:           dir,
+		KEK:           kek,
+		NonExportable: nonExportable,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open enclave: %v", err)
+	}
+	defer keyStore.Destroy()
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %v", err)
+	}
+	defer clear(data)
+
+	var passphrase []byte
+	if passphraseEnv != "" {
+		passphrase = []byte(os.Getenv(passphraseEnv))
+		defer clear(passphrase)
+	}
+
+	// The encoded key is wiped once parsed, and the parsed key once it is loaded
+	key, err := keyStore.ImportKey(label, data, enclave.ImportOptions{
+		Passphrase: passphrase,
+		WipeSource: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import key: %v", err)
+	}
+	fmt.Printf("Imported %s key %s: label=%s slot=%d partial-slot=%d exportable=%t\n",
+		key.Algorithm, key.ID, key.Label, key.Slot, key.PartialSlot, key.Exportable)
+
+	if wipe {
+		if err := wipeFile(keyFile); err != nil {
+			return fmt.Errorf("failed to wipe private key file: %v", err)
+		}
+		fmt.Printf("Private key file %s successfully wiped\n", keyFile)
+	}
+	return nil
+}
+
+// readKEK reads a hex-encoded key-encryption key
+func readKEK(path string) ([]byte, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(encoded)
+
+	trimmed := bytes.TrimSpace(encoded)
+	kek := make([]byte, hex.DecodedLen(len(trimmed)))
+	if _, err := hex.Decode(kek, trimmed); err != nil {
+		clear(kek)
+		return nil, err
+	}
+	return kek, nil
+}
+
+// wipeFile overwrites a file with zeros, syncs it to disk and removes it
+func wipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(make([]byte, info.Size())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
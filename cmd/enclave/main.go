@@ -1,4 +1,4 @@
-package enclave
+package main
 
 import (
 	"fmt"
@@ -13,43 +13,56 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to initialize enclave: %v", err)
 	}
+	defer keyStore.Destroy()
+
+	// Print the keys held by the enclave
+	for _, key := range keyStore.ListKeys() {
+		fmt.Printf("Key %s: label=%s algorithm=%s size=%d slot=%d partial-slot=%d exportable=%t\n",
+			key.ID, key.Label, key.Algorithm, key.Size, key.Slot, key.PartialSlot, key.Exportable)
+	}
+
+	// Look up the default keys by label
+	aesKey := mustKey(keyStore, enclave.DefaultAESKeyLabel)
+	rsaKey := mustKey(keyStore, enclave.DefaultRSAKeyLabel)
+	ecdsaKey := mustKey(keyStore, enclave.DefaultECDSAKeyLabel)
+	ed25519Key := mustKey(keyStore, enclave.DefaultEd25519KeyLabel)
 
 	message := []byte("Test message for signing.")
 
 	// Perform RSA signing operations
-	rsaSignature, err := enclave.RSASign(message, keyStore)
+	rsaSignature, err := enclave.RSASign(message, keyStore, rsaKey.ID)
 	if err != nil {
 		log.Fatalf("RSA full signing failed: %v", err)
 	}
 	fmt.Printf("RSA Full Signature: %x\n", rsaSignature)
 
-	rsaPartialSignature, err := enclave.RSAPartialSign(message, keyStore)
+	rsaPartialSignature, err := enclave.RSAPartialSign(message, keyStore, rsaKey.ID)
 	if err != nil {
 		log.Fatalf("RSA partial signing failed: %v", err)
 	}
 	fmt.Printf("RSA Partial Signature: %x\n", rsaPartialSignature)
 
 	// Perform ECDSA signing operations
-	ecdsaSignature, err := enclave.ECDSASign(message, keyStore)
+	ecdsaSignature, err := enclave.ECDSASign(message, keyStore, ecdsaKey.ID)
 	if err != nil {
 		log.Fatalf("ECDSA full signing failed: %v", err)
 	}
 	fmt.Printf("ECDSA Full Signature: %x\n", ecdsaSignature)
 
-	ecdsaPartialSignature, err := enclave.ECDSAPartialSign(message, keyStore)
+	ecdsaPartialSignature, err := enclave.ECDSAPartialSign(message, keyStore, ecdsaKey.ID)
 	if err != nil {
 		log.Fatalf("ECDSA partial signing failed: %v", err)
 	}
 	fmt.Printf("ECDSA Partial Signature: %x\n", ecdsaPartialSignature)
 
 	// Perform Ed25519 signing operations
-	ed25519Signature, err := enclave.Ed25519Sign(message, keyStore)
+	ed25519Signature, err := enclave.Ed25519Sign(message, keyStore, ed25519Key.ID)
 	if err != nil {
 		log.Fatalf("Ed25519 full signing failed: %v", err)
 	}
 	fmt.Printf("Ed25519 Full Signature: %x\n", ed25519Signature)
 
-	ed25519PartialSignature, err := enclave.Ed25519PartialSign(message, keyStore)
+	ed25519PartialSignature, err := enclave.Ed25519PartialSign(message, keyStore, ed25519Key.ID)
 	if err != nil {
 		log.Fatalf("Ed25519 partial signing failed: %v", err)
 	}
@@ -58,15 +71,24 @@ func main() {
 	// Test AES encryption and decryption
 	plaintext := []byte("Test data for AES encryption.")
 
-	ciphertext, err := enclave.AESEncrypt(plaintext, keyStore)
+	ciphertext, err := enclave.AESEncrypt(plaintext, keyStore, aesKey.ID)
 	if err != nil {
 		log.Fatalf("AES encryption failed: %v", err)
 	}
 	fmt.Printf("AES Ciphertext: %x\n", ciphertext)
 
-	decryptedText, err := enclave.AESDecrypt(ciphertext, keyStore)
+	decryptedText, err := enclave.AESDecrypt(ciphertext, keyStore, aesKey.ID)
 	if err != nil {
 		log.Fatalf("AES decryption failed: %v", err)
 	}
 	fmt.Printf("Decrypted Text: %s\n", string(decryptedText))
 }
+
+// mustKey returns the key with the given label or exits
+func mustKey(keyStore *enclave.EnclaveKeyStore, label string) *enclave.KeyHandle {
+	key, err := keyStore.KeyByLabel(label)
+	if err != nil {
+		log.Fatalf("Failed to find %s key: %v", label, err)
+	}
+	return key
+}
@@ -2,10 +2,18 @@ module github.com/jeremyhahn/fpga-secure-enclave
 
 go 1.23.1
 
+require (
+	filippo.io/edwards25519 v1.1.0
+	filippo.io/nistec v0.0.3
+	github.com/hashicorp/vault v1.18.0
+	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.32.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
-	github.com/hashicorp/vault v1.18.0 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,24 @@
+// Package aesgcm creates the AES-256-GCM ciphers shared by image containers, ELF programs and the
+// enclave's sealing, so that every caller gets the same key size check.
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// KeySize is the size of an AES-256 key in bytes
+const KeySize = 32
+
+// New returns an AES-256-GCM cipher with the standard 12-byte nonce and 16-byte tag
+func New(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("AES-256-GCM key must be %d bytes, not %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,20 @@
+package aesgcm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	aead, err := New(make([]byte, KeySize))
+	assert.NoError(t, err)
+	assert.Equal(t, 12, aead.NonceSize())
+	assert.Equal(t, 16, aead.Overhead())
+
+	// Only AES-256 keys are accepted
+	_, err = New(make([]byte, 16))
+	assert.Error(t, err)
+	_, err = New(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,260 @@
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"maps"
+	"slices"
+	"time"
+)
+
+const (
+	QuoteVersion = 1 // Version of the quote format
+
+	imageContext = "fpga-secure-enclave image v1" // Domain separation for image measurements
+	quoteContext = "fpga-secure-enclave quote v1" // Domain separation for quote signatures
+
+	MinNonceSize = 8  // Shortest verifier nonce accepted in a quote
+	MaxNonceSize = 64 // Longest verifier nonce accepted in a quote
+)
+
+// Measurement registers. Registers start as zeros and can only be extended.
+const (
+	RegisterImage       = 0 // Extended with the measurement of each loaded image
+	RegisterConfig      = 1 // Extended with the SHA-256 of each image's load configuration
+	RegisterPolicy      = 2 // Extended with each key policy, signing policy and quorum change
+	RegisterApplication = 3 // First register the host may extend
+	NumRegisters        = 8
+)
+
+var (
+	// ErrInvalidQuote is returned for every quote that fails verification, along with one of the reasons below
+	ErrInvalidQuote = errors.New("invalid attestation quote")
+
+	// ErrBadSignature is the reason for quotes not signed by the attestation key
+	ErrBadSignature = errors.New("bad signature")
+
+	// ErrNonceMismatch is the reason for quotes over a different nonce than the verifier's
+	ErrNonceMismatch = errors.New("nonce mismatch")
+
+	// ErrUnexpectedMeasurement is the reason for quotes of an image the verifier does not expect
+	ErrUnexpectedMeasurement = errors.New("unexpected measurement")
+
+	// ErrStaleQuote is the reason for quotes and key statements older than the verifier accepts
+	ErrStaleQuote = errors.New("stale quote")
+
+	// ErrRegisterMismatch is the reason for quotes whose measurement registers differ from the verifier's
+	ErrRegisterMismatch = errors.New("measurement register mismatch")
+
+	// ErrVersionTooOld is the reason for quotes from devices whose anti-rollback version of an image family is
+	// lower than the verifier requires
+	ErrVersionTooOld = errors.New("image version too old")
+)
+
+// Image is code loaded into the rocket_chip_enclave, as plaintext or AES-256-GCM ciphertext
+type Image struct {
+	Code      []byte // Plaintext code, or ciphertext if Encrypted
+	IV        []byte // GCM IV of an encrypted image
+	Encrypted bool
+	Config    []byte // Load configuration, such as the entry point and memory layout
+}
+
+// Measure returns the SHA-256 measurement of the image: its code, IV and configuration as loaded. An
+// encrypted image is measured as ciphertext, so it can be checked without the image key.
+func (img *Image) Measure() []byte {
+	h := sha256.New()
+	h.Write([]byte(imageContext))
+	if img.Encrypted {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	writeField(h, img.Code)
+	writeField(h, img.IV)
+	writeField(h, img.Config)
+	return h.Sum(nil)
+}
+
+// MeasurementEvent records one extension of a measurement register
+type MeasurementEvent struct {
+	Register    int    `json:"register"`
+	Digest      []byte `json:"digest"`
+	Description string `json:"description"`
+}
+
+// Extend returns the new value of a register extended with a digest: SHA-256 of the old value and the digest
+func Extend(register, digest []byte) []byte {
+	h := sha256.New()
+	h.Write(register)
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+// Replay computes the registers a measurement log should produce, for comparison with a quote
+func Replay(events []MeasurementEvent) ([][]byte, error) {
+	registers := make([][]byte, NumRegisters)
+	for i := range registers {
+		registers[i] = make([]byte, sha256.Size)
+	}
+	for _, event := range events {
+		if event.Register < 0 || event.Register >= NumRegisters {
+			return nil, fmt.Errorf("measurement event %q extends unknown register %d", event.Description, event.Register)
+		}
+		registers[event.Register] = Extend(registers[event.Register], event.Digest)
+	}
+	return registers, nil
+}
+
+// Quote is a statement by the device attestation key that the enclave ran the measured image, with the
+// measurement registers, when it was asked with the nonce
+type Quote struct {
+	Version     int               `json:"version"`
+	Measurement []byte            `json:"measurement"`
+	Registers   [][]byte          `json:"registers"`
+	Versions    map[string]uint32 `json:"versions,omitempty"` // Anti-rollback version of each image family
+	Nonce       []byte            `json:"nonce"`
+	Time        time.Time         `json:"time"`
+	Signature   []byte            `json:"signature"` // ASN.1 ECDSA or Ed25519 signature over Digest
+
+	// DICE certificate chain of the signing key, device identity first. It is not covered by the signature
+	// and is checked by VerifyIdentity instead.
+	Certificates [][]byte `json:"certificates,omitempty"`
+}
+
+// Parse decodes a JSON quote
+func Parse(data []byte) (*Quote, error) {
+	var quote Quote
+	if err := json.Unmarshal(data, &quote); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuote, err)
+	}
+	return &quote, nil
+}
+
+// Digest returns the SHA-256 digest signed by the attestation key
+func (q *Quote) Digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(quoteContext))
+	binary.Write(h, binary.BigEndian, uint32(q.Version))
+	writeField(h, q.Measurement)
+	binary.Write(h, binary.BigEndian, uint32(len(q.Registers)))
+	for _, register := range q.Registers {
+		writeField(h, register)
+	}
+	families := slices.Sorted(maps.Keys(q.Versions))
+	binary.Write(h, binary.BigEndian, uint32(len(families)))
+	for _, family := range families {
+		writeField(h, []byte(family))
+		binary.Write(h, binary.BigEndian, q.Versions[family])
+	}
+	writeField(h, q.Nonce)
+	binary.Write(h, binary.BigEndian, q.Time.UnixNano())
+	return h.Sum(nil)
+}
+
+// Verifier checks quotes from a device against the images it is expected to run
+type Verifier struct {
+	Key          crypto.PublicKey  // Attestation key: *ecdsa.PublicKey or ed25519.PublicKey; unused if Roots is set
+	Roots        *x509.CertPool    // Trusted device identity certificates, anchoring the quote's certificate chain
+	Measurements [][]byte          // Measurements of the images the device may run
+	Registers    map[int][]byte    // Expected values of measurement registers; others are not checked
+	MinVersions  map[string]uint32 // Lowest anti-rollback version accepted for each image family
+	MaxAge       time.Duration     // Oldest quote accepted; any age if zero
+	Now          func() time.Time  // Clock used for MaxAge; time.Now if nil
+}
+
+// Verify checks that the quote is signed by the attestation key, answers the nonce, and reports one of
+// the expected measurements, the expected register values and at least the minimum image versions. With
+// Roots, the attestation key is the last layer of the quote's DICE chain, whose measurement must be the
+// quote's.
+func (v *Verifier) Verify(quote *Quote, nonce []byte) error {
+	if quote.Version != QuoteVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidQuote, quote.Version)
+	}
+	key := v.Key
+	if v.Roots != nil {
+		chain, err := ParseChain(quote.Certificates)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidQuote, err)
+		}
+		identity, err := VerifyIdentity(chain, v.Roots)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidQuote, err)
+		}
+		layers := identity.Measurements
+		if len(layers) == 0 || !bytes.Equal(layers[len(layers)-1], quote.Measurement) {
+			return fmt.Errorf("%w: %w: quote measurement is not the last layer's", ErrInvalidQuote, ErrInvalidIdentity)
+		}
+		key = identity.PublicKey
+	}
+	if err := VerifySignature(key, quote.Digest(), quote.Signature); err != nil {
+		return fmt.Errorf("%w: %w: %v", ErrInvalidQuote, ErrBadSignature, err)
+	}
+	if !bytes.Equal(quote.Nonce, nonce) {
+		return fmt.Errorf("%w: %w", ErrInvalidQuote, ErrNonceMismatch)
+	}
+	if !containsBytes(v.Measurements, quote.Measurement) {
+		return fmt.Errorf("%w: %w: %x", ErrInvalidQuote, ErrUnexpectedMeasurement, quote.Measurement)
+	}
+	for family, min := range v.MinVersions {
+		if quote.Versions[family] < min {
+			return fmt.Errorf("%w: %w: %s is at version %d, not %d", ErrInvalidQuote, ErrVersionTooOld, family, quote.Versions[family], min)
+		}
+	}
+	for index, expected := range v.Registers {
+		if index < 0 || index >= len(quote.Registers) || !bytes.Equal(quote.Registers[index], expected) {
+			return fmt.Errorf("%w: %w: register %d", ErrInvalidQuote, ErrRegisterMismatch, index)
+		}
+	}
+	if v.MaxAge > 0 {
+		now := time.Now
+		if v.Now != nil {
+			now = v.Now
+		}
+		if age := now().Sub(quote.Time); age > v.MaxAge {
+			return fmt.Errorf("%w: %w: quote is %v old", ErrInvalidQuote, ErrStaleQuote, age)
+		}
+	}
+	return nil
+}
+
+// VerifySignature checks an ASN.1 ECDSA or Ed25519 signature over a SHA-256 digest
+func VerifySignature(key crypto.PublicKey, digest, signature []byte) error {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			return fmt.Errorf("ECDSA signature does not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, signature) {
+			return fmt.Errorf("Ed25519 signature does not verify")
+		}
+	default:
+		return fmt.Errorf("unsupported attestation key type %T", key)
+	}
+	return nil
+}
+
+// writeField writes a length-prefixed field to a hash
+func writeField(h hash.Hash, field []byte) {
+	binary.Write(h, binary.BigEndian, uint32(len(field)))
+	h.Write(field)
+}
+
+// containsBytes reports whether list contains b
+func containsBytes(list [][]byte, b []byte) bool {
+	for _, item := range list {
+		if bytes.Equal(item, b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signedQuote returns a quote signed with an ECDSA key
+func signedQuote(t *testing.T, key *ecdsa.PrivateKey, measurement, nonce []byte, at time.Time) *Quote {
+	quote := &Quote{Version: QuoteVersion, Measurement: measurement, Nonce: nonce, Time: at}
+	signature, err := ecdsa.SignASN1(rand.Reader, key, quote.Digest())
+	assert.NoError(t, err)
+	quote.Signature = signature
+	return quote
+}
+
+func TestMeasure(t *testing.T) {
+	image := &Image{Code: []byte("code"), IV: make([]byte, 16), Encrypted: true, Config: []byte(`{"entry":4096}`)}
+	measurement := image.Measure()
+	assert.Len(t, measurement, sha256.Size)
+	assert.Equal(t, measurement, (&Image{Code: []byte("code"), IV: make([]byte, 16), Encrypted: true, Config: []byte(`{"entry":4096}`)}).Measure())
+
+	// Every part of the image is measured, and fields cannot be shifted into each other
+	variants := []*Image{
+		{Code: []byte("code"), IV: make([]byte, 16), Config: []byte(`{"entry":4096}`)},
+		{Code: []byte("code!"), IV: make([]byte, 16), Encrypted: true, Config: []byte(`{"entry":4096}`)},
+		{Code: []byte("code"), IV: make([]byte, 15), Encrypted: true, Config: []byte(`{"entry":4096}`)},
+		{Code: []byte("code"), IV: make([]byte, 16), Encrypted: true, Config: []byte(`{"entry":8192}`)},
+		{Code: []byte("cod"), IV: append([]byte("e"), make([]byte, 16)...), Encrypted: true, Config: []byte(`{"entry":4096}`)},
+	}
+	for _, variant := range variants {
+		assert.NotEqual(t, measurement, variant.Measure())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	measurement := (&Image{Code: []byte("hello")}).Measure()
+	nonce := []byte("verifier-nonce")
+	now := time.Now()
+
+	verifier := &Verifier{
+		Key:          &key.PublicKey,
+		Measurements: [][]byte{measurement},
+		MaxAge:       time.Minute,
+		Now:          func() time.Time { return now },
+	}
+	quote := signedQuote(t, key, measurement, nonce, now)
+	assert.NoError(t, verifier.Verify(quote, nonce))
+
+	// Quotes survive encoding
+	encoded, err := json.Marshal(quote)
+	assert.NoError(t, err)
+	parsed, err := Parse(encoded)
+	assert.NoError(t, err)
+	assert.NoError(t, verifier.Verify(parsed, nonce))
+
+	err = verifier.Verify(quote, []byte("other-nonce"))
+	assert.ErrorIs(t, err, ErrInvalidQuote)
+	assert.ErrorIs(t, err, ErrNonceMismatch)
+
+	other := (&Image{Code: []byte("malware")}).Measure()
+	assert.ErrorIs(t, verifier.Verify(signedQuote(t, key, other, nonce, now), nonce), ErrUnexpectedMeasurement)
+	assert.ErrorIs(t, verifier.Verify(signedQuote(t, key, measurement, nonce, now.Add(-time.Hour)), nonce), ErrStaleQuote)
+
+	// Quotes altered after signing or signed by another key are refused
+	tampered := *quote
+	tampered.Time = now.Add(time.Second)
+	assert.ErrorIs(t, verifier.Verify(&tampered, nonce), ErrBadSignature)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, verifier.Verify(signedQuote(t, otherKey, measurement, nonce, now), nonce), ErrBadSignature)
+
+	tampered = *quote
+	tampered.Version = QuoteVersion + 1
+	assert.ErrorIs(t, verifier.Verify(&tampered, nonce), ErrInvalidQuote)
+	_, err = Parse([]byte("not json"))
+	assert.ErrorIs(t, err, ErrInvalidQuote)
+}
+
+func TestRegisters(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	image := sha256.Sum256([]byte("image"))
+	config := sha256.Sum256([]byte("config"))
+	log := []MeasurementEvent{
+		{Register: RegisterImage, Digest: image[:], Description: "image"},
+		{Register: RegisterConfig, Digest: config[:], Description: "image config"},
+	}
+	registers, err := Replay(log)
+	assert.NoError(t, err)
+	assert.Len(t, registers, NumRegisters)
+	assert.Equal(t, Extend(make([]byte, sha256.Size), image[:]), registers[RegisterImage])
+	assert.Equal(t, make([]byte, sha256.Size), registers[RegisterPolicy])
+
+	// Extending is order dependent
+	reordered, err := Replay([]MeasurementEvent{log[0], {Register: RegisterImage, Digest: config[:]}})
+	assert.NoError(t, err)
+	swapped, err := Replay([]MeasurementEvent{{Register: RegisterImage, Digest: config[:]}, log[0]})
+	assert.NoError(t, err)
+	assert.NotEqual(t, reordered[RegisterImage], swapped[RegisterImage])
+	_, err = Replay([]MeasurementEvent{{Register: NumRegisters}})
+	assert.Error(t, err)
+
+	nonce := []byte("verifier-nonce")
+	quote := &Quote{Version: QuoteVersion, Measurement: image[:], Registers: registers, Nonce: nonce, Time: time.Now()}
+	quote.Signature, err = ecdsa.SignASN1(rand.Reader, key, quote.Digest())
+	assert.NoError(t, err)
+	verifier := &Verifier{
+		Key:          &key.PublicKey,
+		Measurements: [][]byte{image[:]},
+		Registers:    map[int][]byte{RegisterImage: registers[RegisterImage], RegisterConfig: registers[RegisterConfig]},
+	}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+
+	verifier.Registers[RegisterConfig] = reordered[RegisterImage]
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), ErrRegisterMismatch)
+
+	// Registers are covered by the signature
+	delete(verifier.Registers, RegisterConfig)
+	quote.Registers[RegisterPolicy] = image[:]
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), ErrBadSignature)
+}
+
+func TestVerifyVersions(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	measurement := (&Image{Code: []byte("hello")}).Measure()
+	nonce := []byte("verifier-nonce")
+	quote := &Quote{Version: QuoteVersion, Measurement: measurement, Versions: map[string]uint32{"hello": 3, "wallet": 1}, Nonce: nonce, Time: time.Now()}
+	quote.Signature, err = ecdsa.SignASN1(rand.Reader, key, quote.Digest())
+	assert.NoError(t, err)
+
+	verifier := &Verifier{Key: &key.PublicKey, Measurements: [][]byte{measurement}, MinVersions: map[string]uint32{"hello": 3}}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+
+	// Devices that could still load older images, or never installed the family, are rejected
+	verifier.MinVersions["hello"] = 4
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), ErrVersionTooOld)
+	verifier.MinVersions = map[string]uint32{"other": 1}
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), ErrVersionTooOld)
+
+	// Versions are covered by the signature
+	verifier.MinVersions = nil
+	quote.Versions["hello"] = 4
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), ErrBadSignature)
+}
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte("message"))
+	assert.NoError(t, VerifySignature(public, digest[:], ed25519.Sign(private, digest[:])))
+	assert.Error(t, VerifySignature(public, digest[:], make([]byte, ed25519.SignatureSize)))
+	assert.Error(t, VerifySignature("not a key", digest[:], nil))
+}
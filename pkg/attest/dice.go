@@ -0,0 +1,109 @@
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+var (
+	// OIDTCBInfo identifies the TCG DICE TcbInfo extension, which carries the measurement of a layer
+	OIDTCBInfo = asn1.ObjectIdentifier{2, 23, 133, 5, 4, 1}
+
+	// oidSHA256 identifies SHA-256 firmware IDs
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	// ErrInvalidIdentity is returned for DICE certificate chains that do not verify
+	ErrInvalidIdentity = errors.New("invalid device identity")
+)
+
+// TCBInfo is the subset of the TCG DICE TcbInfo extension written by the enclave
+type TCBInfo struct {
+	Layer int    `asn1:"optional,tag:4"`
+	FWIDs []FWID `asn1:"optional,tag:6"`
+}
+
+// FWID is the digest of a layer's firmware
+type FWID struct {
+	HashAlg asn1.ObjectIdentifier
+	Digest  []byte
+}
+
+// NewTCBInfo returns the TcbInfo of a layer with a SHA-256 measurement
+func NewTCBInfo(layer int, measurement []byte) TCBInfo {
+	return TCBInfo{Layer: layer, FWIDs: []FWID{{HashAlg: oidSHA256, Digest: measurement}}}
+}
+
+// Identity is a verified DICE certificate chain
+type Identity struct {
+	DeviceID     *x509.Certificate // Certificate of the device identity key, derived from the device secret
+	Measurements [][]byte          // Measurement of each layer above the device identity, first stage first
+	PublicKey    crypto.PublicKey  // Key of the last layer, which signs quotes
+}
+
+// VerifyIdentity checks a DICE certificate chain, device identity first, against trusted device identity
+// certificates. Every layer must be certified by the layer below it and carry the measurement of its image.
+func VerifyIdentity(chain []*x509.Certificate, roots *x509.CertPool) (*Identity, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%w: empty certificate chain", ErrInvalidIdentity)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, fmt.Errorf("%w: device identity is not trusted: %v", ErrInvalidIdentity, err)
+	}
+
+	identity := &Identity{DeviceID: chain[0], PublicKey: chain[0].PublicKey}
+	for layer := 1; layer < len(chain); layer++ {
+		cert := chain[layer]
+		if err := cert.CheckSignatureFrom(chain[layer-1]); err != nil {
+			return nil, fmt.Errorf("%w: layer %d is not certified by layer %d: %v", ErrInvalidIdentity, layer, layer-1, err)
+		}
+		measurement, err := layerMeasurement(cert, layer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: layer %d: %v", ErrInvalidIdentity, layer, err)
+		}
+		identity.Measurements = append(identity.Measurements, measurement)
+		identity.PublicKey = cert.PublicKey
+	}
+	return identity, nil
+}
+
+// ParseChain parses DER certificates
+func ParseChain(certificates [][]byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, len(certificates))
+	for i, der := range certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("%w: certificate %d: %v", ErrInvalidIdentity, i, err)
+		}
+		chain[i] = cert
+	}
+	return chain, nil
+}
+
+// layerMeasurement returns the SHA-256 FWID of a layer certificate
+func layerMeasurement(cert *x509.Certificate, layer int) ([]byte, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDTCBInfo) {
+			continue
+		}
+		var info TCBInfo
+		rest, err := asn1.Unmarshal(ext.Value, &info)
+		if err != nil || len(rest) > 0 {
+			return nil, fmt.Errorf("malformed TcbInfo")
+		}
+		if info.Layer != layer {
+			return nil, fmt.Errorf("TcbInfo is for layer %d", info.Layer)
+		}
+		for _, fwid := range info.FWIDs {
+			if fwid.HashAlg.Equal(oidSHA256) {
+				return bytes.Clone(fwid.Digest), nil
+			}
+		}
+		return nil, fmt.Errorf("TcbInfo has no SHA-256 FWID")
+	}
+	return nil, fmt.Errorf("certificate has no TcbInfo")
+}
@@ -0,0 +1,93 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLayer issues a DICE layer certificate, self-signed if parent is nil
+func testLayer(t *testing.T, layer int, measurement []byte, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(int64(layer + 1)),
+		Subject:               pkix.Name{CommonName: "layer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if measurement != nil {
+		info, err := asn1.Marshal(NewTCBInfo(layer, measurement))
+		assert.NoError(t, err)
+		template.ExtraExtensions = []pkix.Extension{{Id: OIDTCBInfo, Value: info}}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	deviceID, deviceKey := testLayer(t, 0, nil, nil, nil)
+	first := (&Image{Code: []byte("first stage")}).Measure()
+	second := (&Image{Code: []byte("second stage")}).Measure()
+	layer1, key1 := testLayer(t, 1, first, deviceID, deviceKey)
+	layer2, key2 := testLayer(t, 2, second, layer1, key1)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+
+	identity, err := VerifyIdentity([]*x509.Certificate{deviceID, layer1, layer2}, roots)
+	assert.NoError(t, err)
+	assert.Equal(t, deviceID, identity.DeviceID)
+	assert.Equal(t, [][]byte{first, second}, identity.Measurements)
+	assert.Equal(t, &key2.PublicKey, identity.PublicKey)
+
+	// Quotes are verified with the last layer's key, which must have measured the quoted image
+	nonce := []byte("verifier-nonce")
+	quote := signedQuote(t, key2, second, nonce, time.Now())
+	quote.Certificates = [][]byte{deviceID.Raw, layer1.Raw, layer2.Raw}
+	verifier := &Verifier{Roots: roots, Measurements: [][]byte{second}}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+	forged := signedQuote(t, key2, first, nonce, time.Now())
+	forged.Certificates = quote.Certificates
+	verifier.Measurements = append(verifier.Measurements, first)
+	assert.ErrorIs(t, verifier.Verify(forged, nonce), ErrInvalidIdentity)
+
+	// Chains must start at a trusted device and link every layer
+	otherDevice, otherKey := testLayer(t, 0, nil, nil, nil)
+	foreign, _ := testLayer(t, 1, first, otherDevice, otherKey)
+	skipped, _ := testLayer(t, 2, second, deviceID, deviceKey)
+	renumbered, _ := testLayer(t, 3, first, deviceID, deviceKey)
+	unmeasured, _ := testLayer(t, 1, nil, deviceID, deviceKey)
+	cases := map[string][]*x509.Certificate{
+		"empty":          nil,
+		"untrusted":      {otherDevice, foreign},
+		"foreign layer":  {deviceID, foreign},
+		"reordered":      {deviceID, layer2, layer1},
+		"skipped layer":  {deviceID, skipped},
+		"wrong layer":    {deviceID, renumbered},
+		"no measurement": {deviceID, unmeasured},
+	}
+	for name, chain := range cases {
+		_, err := VerifyIdentity(chain, roots)
+		assert.ErrorIs(t, err, ErrInvalidIdentity, name)
+	}
+
+	quote.Certificates = [][]byte{deviceID.Raw, []byte("not a certificate")}
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), ErrInvalidIdentity)
+}
@@ -0,0 +1,145 @@
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	KeyStatementVersion = 1 // Version of the key statement format
+
+	keyStatementContext = "fpga-secure-enclave key statement v1" // Domain separation for key statement signatures
+
+	KeyOriginGenerated = "generated" // Origin of keys generated inside the FPGA, whose private material never left it
+)
+
+var (
+	// ErrInvalidKeyStatement is returned for every key statement that fails verification, along with a reason
+	// such as ErrBadSignature, ErrNonceMismatch, ErrInvalidIdentity or ErrKeyNotResident
+	ErrInvalidKeyStatement = errors.New("invalid key attestation statement")
+
+	// ErrKeyNotResident is the reason for statements about keys that were not generated in the enclave or
+	// can be exported from it
+	ErrKeyNotResident = errors.New("key is not hardware-resident")
+)
+
+// KeyStatement is a statement by the device identity that a key is held in the enclave, with its
+// algorithm, exportability, origin and policies
+type KeyStatement struct {
+	Version       int             `json:"version"`
+	KeyID         string          `json:"key_id"`
+	Algorithm     string          `json:"algorithm"`
+	PublicKey     []byte          `json:"public_key,omitempty"` // PKIX DER; empty for symmetric keys
+	Exportable    bool            `json:"exportable"`
+	Origin        string          `json:"origin"`                   // Empty if the key predates origin tracking
+	Policy        json.RawMessage `json:"policy,omitempty"`         // Key usage policy, if any
+	SigningPolicy json.RawMessage `json:"signing_policy,omitempty"` // Signing policy, if any
+	Measurement   []byte          `json:"measurement,omitempty"`    // Measurement of the loaded image, if any
+	Nonce         []byte          `json:"nonce"`
+	Time          time.Time       `json:"time"`
+	Signature     []byte          `json:"signature"` // ASN.1 ECDSA or Ed25519 signature over Digest
+
+	// DICE certificate chain of the signing key, device identity first, checked by VerifyIdentity
+	Certificates [][]byte `json:"certificates"`
+}
+
+// ParseKeyStatement decodes a JSON key statement
+func ParseKeyStatement(data []byte) (*KeyStatement, error) {
+	var statement KeyStatement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyStatement, err)
+	}
+	return &statement, nil
+}
+
+// Digest returns the SHA-256 digest signed by the device identity
+func (s *KeyStatement) Digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(keyStatementContext))
+	binary.Write(h, binary.BigEndian, uint32(s.Version))
+	writeField(h, []byte(s.KeyID))
+	writeField(h, []byte(s.Algorithm))
+	writeField(h, s.PublicKey)
+	if s.Exportable {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	writeField(h, []byte(s.Origin))
+	writeField(h, s.Policy)
+	writeField(h, s.SigningPolicy)
+	writeField(h, s.Measurement)
+	writeField(h, s.Nonce)
+	binary.Write(h, binary.BigEndian, s.Time.UnixNano())
+	return h.Sum(nil)
+}
+
+// KeyVerifier checks key statements from enrolled devices, such as before a CA certifies an enclave key
+type KeyVerifier struct {
+	Roots         *x509.CertPool   // Trusted device identity certificates
+	Measurements  [][]byte         // Images the device may be running; any image, or none, if empty
+	AllowHostKeys bool             // Accept keys that were not generated in the enclave or are exportable
+	MaxAge        time.Duration    // Oldest statement accepted; any age if zero
+	Now           func() time.Time // Clock used for MaxAge; time.Now if nil
+}
+
+// Verify checks that the statement is signed by the top layer of a DICE chain anchored in Roots, answers
+// the nonce, and, unless AllowHostKeys is set, is about a non-exportable key generated in the enclave. It
+// returns the attested public key, nil for symmetric keys.
+func (v *KeyVerifier) Verify(statement *KeyStatement, nonce []byte) (crypto.PublicKey, error) {
+	if statement.Version != KeyStatementVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidKeyStatement, statement.Version)
+	}
+	chain, err := ParseChain(statement.Certificates)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyStatement, err)
+	}
+	identity, err := VerifyIdentity(chain, v.Roots)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyStatement, err)
+	}
+	var measurement []byte
+	if layers := identity.Measurements; len(layers) > 0 {
+		measurement = layers[len(layers)-1]
+	}
+	if !bytes.Equal(measurement, statement.Measurement) {
+		return nil, fmt.Errorf("%w: %w: statement measurement is not the last layer's", ErrInvalidKeyStatement, ErrInvalidIdentity)
+	}
+	if err := VerifySignature(identity.PublicKey, statement.Digest(), statement.Signature); err != nil {
+		return nil, fmt.Errorf("%w: %w: %v", ErrInvalidKeyStatement, ErrBadSignature, err)
+	}
+	if !bytes.Equal(statement.Nonce, nonce) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyStatement, ErrNonceMismatch)
+	}
+	if len(v.Measurements) > 0 && !containsBytes(v.Measurements, statement.Measurement) {
+		return nil, fmt.Errorf("%w: %w: %x", ErrInvalidKeyStatement, ErrUnexpectedMeasurement, statement.Measurement)
+	}
+	if !v.AllowHostKeys && (statement.Exportable || statement.Origin != KeyOriginGenerated) {
+		return nil, fmt.Errorf("%w: %w: origin %q, exportable %v", ErrInvalidKeyStatement, ErrKeyNotResident, statement.Origin, statement.Exportable)
+	}
+	if v.MaxAge > 0 {
+		now := time.Now
+		if v.Now != nil {
+			now = v.Now
+		}
+		if age := now().Sub(statement.Time); age > v.MaxAge {
+			return nil, fmt.Errorf("%w: %w: statement is %v old", ErrInvalidKeyStatement, ErrStaleQuote, age)
+		}
+	}
+
+	if len(statement.PublicKey) == 0 {
+		return nil, nil
+	}
+	public, err := x509.ParsePKIXPublicKey(statement.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid public key: %v", ErrInvalidKeyStatement, err)
+	}
+	return public, nil
+}
@@ -0,0 +1,85 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyVerifier(t *testing.T) {
+	deviceID, deviceKey := testLayer(t, 0, nil, nil, nil)
+	measurement := (&Image{Code: []byte("enclave")}).Measure()
+	alias, aliasKey := testLayer(t, 1, measurement, deviceID, deviceKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+
+	attested, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&attested.PublicKey)
+	assert.NoError(t, err)
+	nonce := []byte("ca-challenge")
+	now := time.Now()
+	sign := func(modify func(*KeyStatement)) *KeyStatement {
+		statement := &KeyStatement{
+			Version:      KeyStatementVersion,
+			KeyID:        "key",
+			Algorithm:    "ECDSA-P256",
+			PublicKey:    der,
+			Origin:       KeyOriginGenerated,
+			Policy:       json.RawMessage(`{"operations":["sign"]}`),
+			Measurement:  measurement,
+			Nonce:        nonce,
+			Time:         now,
+			Certificates: [][]byte{deviceID.Raw, alias.Raw},
+		}
+		modify(statement)
+		signature, err := ecdsa.SignASN1(rand.Reader, aliasKey, statement.Digest())
+		assert.NoError(t, err)
+		statement.Signature = signature
+		return statement
+	}
+
+	verifier := &KeyVerifier{
+		Roots:        roots,
+		Measurements: [][]byte{measurement},
+		MaxAge:       time.Minute,
+		Now:          func() time.Time { return now },
+	}
+	public, err := verifier.Verify(sign(func(*KeyStatement) {}), nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, &attested.PublicKey, public)
+
+	// Every field is signed
+	statement := sign(func(*KeyStatement) {})
+	statement.Policy = json.RawMessage(`{}`)
+	_, err = verifier.Verify(statement, nonce)
+	assert.ErrorIs(t, err, ErrBadSignature)
+
+	cases := map[string]struct {
+		modify func(*KeyStatement)
+		reason error
+	}{
+		"exportable":     {func(s *KeyStatement) { s.Exportable = true }, ErrKeyNotResident},
+		"host origin":    {func(s *KeyStatement) { s.Origin = "host" }, ErrKeyNotResident},
+		"unknown origin": {func(s *KeyStatement) { s.Origin = "" }, ErrKeyNotResident},
+		"stale":          {func(s *KeyStatement) { s.Time = now.Add(-time.Hour) }, ErrStaleQuote},
+		"other image":    {func(s *KeyStatement) { s.Measurement = make([]byte, 32) }, ErrInvalidIdentity},
+		"no chain":       {func(s *KeyStatement) { s.Certificates = nil }, ErrInvalidIdentity},
+		"version":        {func(s *KeyStatement) { s.Version = 2 }, ErrInvalidKeyStatement},
+	}
+	for name, c := range cases {
+		_, err := verifier.Verify(sign(c.modify), nonce)
+		assert.ErrorIs(t, err, ErrInvalidKeyStatement, name)
+		assert.ErrorIs(t, err, c.reason, name)
+	}
+
+	verifier.Measurements = [][]byte{make([]byte, 32)}
+	_, err = verifier.Verify(sign(func(*KeyStatement) {}), nonce)
+	assert.ErrorIs(t, err, ErrUnexpectedMeasurement)
+}
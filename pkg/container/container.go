@@ -0,0 +1,393 @@
+// Package container implements the signed and encrypted enclave image container: a header describing how
+// the image is loaded, a vendor signature over the header, and the AES-256-GCM encrypted code.
+package container
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/aesgcm"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+)
+
+const (
+	FormatVersion = 2   // Version of the container format; version 2 added the image family
+	HeaderSize    = 112 // Size of the encoded header
+	MaxFamilySize = 16  // Longest image family name
+	configSize    = 48  // Size of the load configuration at the start of the header
+	ivSize        = 12  // AES-GCM nonce size
+	tagSize       = 16  // AES-GCM tag size
+
+	signatureContext = "fpga-secure-enclave image container v1" // Domain separation for vendor signatures
+)
+
+// FlagProgram marks a container whose code is an elfload program: a segment table followed by segments
+// encrypted separately under the image key. The container does not encrypt it again, so its IV and tag are
+// zero, and its load address and entry point are those of the program.
+const FlagProgram uint16 = 1 << 0
+
+// Magic identifies an enclave image container
+var Magic = [4]byte{'F', 'S', 'E', 'I'}
+
+var (
+	// ErrInvalidContainer is returned for containers that are malformed or whose measurement does not match
+	ErrInvalidContainer = errors.New("invalid image container")
+
+	// ErrBadSignature is returned for containers not signed by the vendor key
+	ErrBadSignature = errors.New("image container signature does not verify")
+
+	// ErrTagMismatch is returned when the encrypted code fails AES-GCM authentication
+	ErrTagMismatch = errors.New("image container tag does not verify")
+)
+
+// Header describes an image and how it is loaded. It is encoded little-endian, as the enclave core reads it.
+//
+//	Offset  Size  Field
+//	0       4     Magic "FSEI"
+//	4       2     FormatVersion
+//	6       2     Flags: FlagProgram, or zero
+//	8       4     ImageVersion
+//	12      4     Size of the code
+//	16      8     LoadAddress
+//	24      8     EntryPoint
+//	32      16    Family, padded with zeros
+//	48      12    IV
+//	60      16    Tag
+//	76      32    Measurement
+//	108     2     Length of the vendor signature that follows the header
+//	110     2     Reserved
+type Header struct {
+	FormatVersion uint16
+	Flags         uint16
+	Family        string // Image family whose versions are checked against each other to prevent rollback
+	ImageVersion  uint32
+	Size          uint32 // Size of the code, plaintext and ciphertext alike
+	LoadAddress   uint64 // Address of the code in enclave memory
+	EntryPoint    uint64 // Address of the first instruction, within the code
+	IV            [ivSize]byte
+	Tag           [tagSize]byte
+	Measurement   [sha256.Size]byte // attest.Image measurement of the encrypted code, IV and load configuration
+	SignatureSize uint16
+}
+
+// Container is a parsed image container
+type Container struct {
+	Header     Header
+	Signature  []byte // Vendor signature: ASN.1 ECDSA P-256 or Ed25519
+	Ciphertext []byte
+}
+
+// Builder encrypts and signs enclave images
+type Builder struct {
+	Family       string // Up to 16 printable ASCII characters
+	ImageVersion uint32
+	LoadAddress  uint64
+	EntryPoint   uint64
+	Key          []byte        // AES-256 image key
+	Signer       crypto.Signer // Vendor key: *ecdsa.PrivateKey on P-256 or ed25519.PrivateKey
+}
+
+// Build encrypts code with the image key and returns the signed container
+func (b *Builder) Build(code []byte) ([]byte, error) {
+	if len(code) == 0 || uint64(len(code)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("invalid code size %d", len(code))
+	}
+	header := b.header(0, len(code))
+	if err := header.checkLayout(); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(header.IV[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %v", err)
+	}
+
+	aead, err := aesgcm.New(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, header.IV[:], code, header.config())
+	copy(header.Tag[:], sealed[len(code):])
+	return b.sign(header, sealed[:len(code)])
+}
+
+// BuildProgram signs an elfload program payload, whose segments are already encrypted under the image key,
+// and marks the container with FlagProgram. Use elfload.Program.Build rather than calling it directly.
+func (b *Builder) BuildProgram(payload []byte) ([]byte, error) {
+	if len(payload) == 0 || uint64(len(payload)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("invalid program size %d", len(payload))
+	}
+	header := b.header(FlagProgram, len(payload))
+	if err := header.checkLayout(); err != nil {
+		return nil, err
+	}
+	return b.sign(header, payload)
+}
+
+// header returns the header of an image of size bytes, before it is encrypted and signed
+func (b *Builder) header(flags uint16, size int) Header {
+	return Header{
+		FormatVersion: FormatVersion,
+		Flags:         flags,
+		Family:        b.Family,
+		ImageVersion:  b.ImageVersion,
+		Size:          uint32(size),
+		LoadAddress:   b.LoadAddress,
+		EntryPoint:    b.EntryPoint,
+	}
+}
+
+// sign measures the encrypted code, signs the header with the vendor key and returns the container
+func (b *Builder) sign(header Header, ciphertext []byte) ([]byte, error) {
+	copy(header.Measurement[:], header.image(ciphertext).Measure())
+
+	switch key := b.Signer.(type) {
+	case ed25519.PrivateKey:
+		header.SignatureSize = ed25519.SignatureSize
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("vendor key must be ECDSA P-256 or Ed25519")
+		}
+		// ASN.1 signatures vary in length, so the header is signed with the maximum and the signature padded
+		header.SignatureSize = 72
+	default:
+		return nil, fmt.Errorf("unsupported vendor key type %T", b.Signer)
+	}
+	encoded := header.Marshal()
+	opts := crypto.Hash(0)
+	if _, ok := b.Signer.(*ecdsa.PrivateKey); ok {
+		opts = crypto.SHA256
+	}
+	signature, err := b.Signer.Sign(rand.Reader, signatureDigest(encoded), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign image: %v", err)
+	}
+	if len(signature) > int(header.SignatureSize) {
+		return nil, fmt.Errorf("signature is longer than %d bytes", header.SignatureSize)
+	}
+
+	out := make([]byte, 0, HeaderSize+int(header.SignatureSize)+len(ciphertext))
+	out = append(out, encoded...)
+	out = append(out, signature...)
+	out = append(out, make([]byte, int(header.SignatureSize)-len(signature))...)
+	return append(out, ciphertext...), nil
+}
+
+// Parse decodes a container and checks that its measurement matches its contents. It does not check the
+// signature or the tag; see Verify and Open.
+func Parse(data []byte) (*Container, error) {
+	header, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	end := HeaderSize + int(header.SignatureSize)
+	if uint64(len(data)) != uint64(end)+uint64(header.Size) {
+		return nil, fmt.Errorf("%w: %d bytes, expected %d", ErrInvalidContainer, len(data), uint64(end)+uint64(header.Size))
+	}
+
+	c := &Container{
+		Header:     header,
+		Signature:  bytes.Clone(data[HeaderSize:end]),
+		Ciphertext: bytes.Clone(data[end:]),
+	}
+	if err := c.checkMeasurement(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseLoaded parses an image as it is loaded into FPGA memory: the header followed by the encrypted code,
+// without the vendor signature. data may extend past the code, as an image slot does. The measurement is
+// checked against the code, but without the signature the image cannot be verified.
+func ParseLoaded(data []byte) (*Container, error) {
+	header, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)-HeaderSize) < uint64(header.Size) {
+		return nil, fmt.Errorf("%w: %d bytes of code, expected %d", ErrInvalidContainer, len(data)-HeaderSize, header.Size)
+	}
+
+	c := &Container{
+		Header:     header,
+		Ciphertext: bytes.Clone(data[HeaderSize : HeaderSize+int(header.Size)]),
+	}
+	if err := c.checkMeasurement(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseHeader decodes the header at the start of data and checks its layout
+func parseHeader(data []byte) (Header, error) {
+	var header Header
+	if len(data) < HeaderSize {
+		return header, fmt.Errorf("%w: %d bytes is shorter than the header", ErrInvalidContainer, len(data))
+	}
+	if err := header.Unmarshal(data[:HeaderSize]); err != nil {
+		return header, err
+	}
+	if err := header.checkLayout(); err != nil {
+		return header, fmt.Errorf("%w: %v", ErrInvalidContainer, err)
+	}
+	return header, nil
+}
+
+// checkMeasurement checks that the header's measurement matches the encrypted code
+func (c *Container) checkMeasurement() error {
+	if !bytes.Equal(c.Header.image(c.Ciphertext).Measure(), c.Header.Measurement[:]) {
+		return fmt.Errorf("%w: measurement does not match the encrypted code", ErrInvalidContainer)
+	}
+	return nil
+}
+
+// Verify checks the vendor signature over the header, which covers the measurement of the encrypted code
+func (c *Container) Verify(vendorKey crypto.PublicKey) error {
+	signature := c.Signature
+	if _, ok := vendorKey.(*ecdsa.PublicKey); ok {
+		// Strip the zero padding after the ASN.1 signature
+		if len(signature) >= 2 && int(signature[1])+2 <= len(signature) {
+			padding := signature[int(signature[1])+2:]
+			if !bytes.Equal(padding, make([]byte, len(padding))) {
+				return fmt.Errorf("%w: signature padding is not zero", ErrBadSignature)
+			}
+			signature = signature[:int(signature[1])+2]
+		}
+	}
+	if err := attest.VerifySignature(vendorKey, signatureDigest(c.Header.Marshal()), signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return nil
+}
+
+// Open decrypts the code with the image key, failing if the tag does not verify. Program containers are
+// decrypted per segment by elfload instead.
+func (c *Container) Open(key []byte) ([]byte, error) {
+	if c.IsProgram() {
+		return nil, fmt.Errorf("%w: program segments are decrypted by elfload", ErrInvalidContainer)
+	}
+	aead, err := aesgcm.New(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := append(bytes.Clone(c.Ciphertext), c.Header.Tag[:]...)
+	code, err := aead.Open(sealed[:0], c.Header.IV[:], sealed, c.Header.config())
+	if err != nil {
+		return nil, ErrTagMismatch
+	}
+	return code, nil
+}
+
+// IsProgram reports whether the container holds an elfload program
+func (c *Container) IsProgram() bool {
+	return c.Header.Flags&FlagProgram != 0
+}
+
+// Image returns the image as measured for attestation
+func (c *Container) Image() *attest.Image {
+	return c.Header.image(c.Ciphertext)
+}
+
+// Marshal encodes the header
+func (h *Header) Marshal() []byte {
+	b := make([]byte, HeaderSize)
+	copy(b, h.config())
+	copy(b[48:60], h.IV[:])
+	copy(b[60:76], h.Tag[:])
+	copy(b[76:108], h.Measurement[:])
+	binary.LittleEndian.PutUint16(b[108:], h.SignatureSize)
+	return b
+}
+
+// Unmarshal decodes a header
+func (h *Header) Unmarshal(b []byte) error {
+	if len(b) != HeaderSize {
+		return fmt.Errorf("%w: header is %d bytes, not %d", ErrInvalidContainer, len(b), HeaderSize)
+	}
+	if !bytes.Equal(b[:4], Magic[:]) {
+		return fmt.Errorf("%w: bad magic %q", ErrInvalidContainer, b[:4])
+	}
+	h.FormatVersion = binary.LittleEndian.Uint16(b[4:])
+	if h.FormatVersion != FormatVersion {
+		return fmt.Errorf("%w: unsupported format version %d", ErrInvalidContainer, h.FormatVersion)
+	}
+	h.Flags = binary.LittleEndian.Uint16(b[6:])
+	if h.Flags&^FlagProgram != 0 || binary.LittleEndian.Uint16(b[110:]) != 0 {
+		return fmt.Errorf("%w: reserved fields are set", ErrInvalidContainer)
+	}
+	h.ImageVersion = binary.LittleEndian.Uint32(b[8:])
+	h.Size = binary.LittleEndian.Uint32(b[12:])
+	h.LoadAddress = binary.LittleEndian.Uint64(b[16:])
+	h.EntryPoint = binary.LittleEndian.Uint64(b[24:])
+	family := b[32:48]
+	h.Family = string(bytes.TrimRight(family, "\x00"))
+	if !bytes.Equal(family[len(h.Family):], make([]byte, MaxFamilySize-len(h.Family))) {
+		return fmt.Errorf("%w: family is not padded with zeros", ErrInvalidContainer)
+	}
+	copy(h.IV[:], b[48:60])
+	copy(h.Tag[:], b[60:76])
+	copy(h.Measurement[:], b[76:108])
+	h.SignatureSize = binary.LittleEndian.Uint16(b[108:])
+	return nil
+}
+
+// config returns the load configuration: the first 48 bytes of the header, authenticated by AES-GCM and
+// measured along with the code
+func (h *Header) config() []byte {
+	b := make([]byte, configSize)
+	copy(b, Magic[:])
+	binary.LittleEndian.PutUint16(b[4:], h.FormatVersion)
+	binary.LittleEndian.PutUint16(b[6:], h.Flags)
+	binary.LittleEndian.PutUint32(b[8:], h.ImageVersion)
+	binary.LittleEndian.PutUint32(b[12:], h.Size)
+	binary.LittleEndian.PutUint64(b[16:], h.LoadAddress)
+	binary.LittleEndian.PutUint64(b[24:], h.EntryPoint)
+	copy(b[32:48], h.Family)
+	return b
+}
+
+// checkLayout checks that the family is valid, and that the code is not empty, fits in the address space,
+// and contains the entry point. The layout of a program is checked against its segment table by elfload.
+func (h *Header) checkLayout() error {
+	if h.Family == "" || len(h.Family) > MaxFamilySize {
+		return fmt.Errorf("image family must be 1 to %d characters", MaxFamilySize)
+	}
+	for _, c := range []byte(h.Family) {
+		if c < 0x21 || c > 0x7e {
+			return fmt.Errorf("image family %q must be printable ASCII without spaces", h.Family)
+		}
+	}
+	if h.Size == 0 {
+		return fmt.Errorf("image is empty")
+	}
+	if h.Flags&FlagProgram != 0 {
+		return nil
+	}
+	end := h.LoadAddress + uint64(h.Size)
+	if end < h.LoadAddress {
+		return fmt.Errorf("image at 0x%x overflows the address space", h.LoadAddress)
+	}
+	if h.EntryPoint < h.LoadAddress || h.EntryPoint >= end {
+		return fmt.Errorf("entry point 0x%x is outside the image at 0x%x-0x%x", h.EntryPoint, h.LoadAddress, end)
+	}
+	return nil
+}
+
+// image returns the attest.Image of encrypted code loaded with this header
+func (h *Header) image(ciphertext []byte) *attest.Image {
+	return &attest.Image{Code: ciphertext, IV: bytes.Clone(h.IV[:]), Encrypted: true, Config: h.config()}
+}
+
+// signatureDigest returns the SHA-256 digest of an encoded header signed by the vendor key
+func signatureDigest(header []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(signatureContext))
+	h.Write(header)
+	return h.Sum(nil)
+}
@@ -0,0 +1,174 @@
+package container
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testKey returns an AES-256 image key
+func testKey() []byte {
+	return []byte("0123456789abcdef0123456789abcdef")
+}
+
+func TestBuildAndOpen(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	code := []byte("enclave program")
+
+	for name, builder := range map[string]*Builder{
+		"ECDSA":   {Family: "hello", ImageVersion: 7, LoadAddress: 0x8000_0000, EntryPoint: 0x8000_0004, Key: testKey(), Signer: ecdsaKey},
+		"Ed25519": {Family: "hello", ImageVersion: 7, LoadAddress: 0x8000_0000, EntryPoint: 0x8000_0004, Key: testKey(), Signer: ed25519Key},
+	} {
+		data, err := builder.Build(code)
+		assert.NoError(t, err, name)
+		c, err := Parse(data)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "hello", c.Header.Family, name)
+		assert.Equal(t, uint32(7), c.Header.ImageVersion, name)
+		assert.Equal(t, uint64(0x8000_0004), c.Header.EntryPoint, name)
+		assert.Equal(t, uint32(len(code)), c.Header.Size, name)
+		assert.Equal(t, c.Image().Measure(), c.Header.Measurement[:], name)
+		assert.NotContains(t, string(data), string(code), name)
+
+		assert.NoError(t, c.Verify(builder.Signer.Public()), name)
+		opened, err := c.Open(testKey())
+		assert.NoError(t, err, name)
+		assert.Equal(t, code, opened, name)
+	}
+}
+
+func TestBuildProgram(t *testing.T) {
+	_, vendorKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	builder := &Builder{Family: "hello", ImageVersion: 2, LoadAddress: 0x8000_0000, EntryPoint: 0x8000_1000, Key: testKey(), Signer: vendorKey}
+	payload := []byte("segment table and encrypted segments")
+	data, err := builder.BuildProgram(payload)
+	assert.NoError(t, err)
+
+	// The payload is signed and measured as it is, and the entry point need not lie within it
+	c, err := Parse(data)
+	assert.NoError(t, err)
+	assert.True(t, c.IsProgram())
+	assert.Equal(t, payload, c.Ciphertext)
+	assert.Equal(t, uint64(0x8000_1000), c.Header.EntryPoint)
+	assert.NoError(t, c.Verify(vendorKey.Public()))
+	_, err = c.Open(testKey())
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+
+	// The flag is measured, so a program cannot be passed off as code
+	data[6] = 0
+	_, err = Parse(data)
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+	_, err = builder.BuildProgram(nil)
+	assert.Error(t, err)
+}
+
+func TestContainerRejected(t *testing.T) {
+	_, vendorKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	builder := &Builder{Family: "hello", ImageVersion: 1, LoadAddress: 0x1000, EntryPoint: 0x1000, Key: testKey(), Signer: vendorKey}
+	data, err := builder.Build([]byte("enclave program"))
+	assert.NoError(t, err)
+
+	// Signatures from other keys do not verify
+	c, err := Parse(data)
+	assert.NoError(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, c.Verify(otherKey.Public()), ErrBadSignature)
+	_, err = c.Open(make([]byte, 32))
+	assert.ErrorIs(t, err, ErrTagMismatch)
+
+	// Changing the code breaks the measurement; changing the header breaks the signature
+	modified := func(modify func([]byte)) []byte {
+		b := append([]byte(nil), data...)
+		modify(b)
+		return b
+	}
+	_, err = Parse(modified(func(b []byte) { b[len(b)-1] ^= 1 }))
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+	_, err = Parse(modified(func(b []byte) { b[20] ^= 1 }))
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+	tagged, err := Parse(modified(func(b []byte) { b[65] ^= 1 }))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, tagged.Verify(vendorKey.Public()), ErrBadSignature)
+	_, err = tagged.Open(testKey())
+	assert.ErrorIs(t, err, ErrTagMismatch)
+
+	cases := map[string][]byte{
+		"short":       data[:HeaderSize-1],
+		"truncated":   data[:len(data)-1],
+		"extended":    append(append([]byte(nil), data...), 0),
+		"magic":       modified(func(b []byte) { b[0] = 'X' }),
+		"version":     modified(func(b []byte) { binary.LittleEndian.PutUint16(b[4:], 1) }),
+		"family":      modified(func(b []byte) { b[40] = 'x' }),
+		"reserved":    modified(func(b []byte) { b[6] = 2 }),
+		"program":     modified(func(b []byte) { b[6] = byte(FlagProgram) }),
+		"entry point": modified(func(b []byte) { binary.LittleEndian.PutUint64(b[24:], 0x2000) }),
+	}
+	for name, data := range cases {
+		_, err := Parse(data)
+		assert.ErrorIs(t, err, ErrInvalidContainer, name)
+	}
+}
+
+func TestParseLoaded(t *testing.T) {
+	_, vendorKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	builder := &Builder{Family: "hello", ImageVersion: 1, LoadAddress: 0x1000, EntryPoint: 0x1000, Key: testKey(), Signer: vendorKey}
+	data, err := builder.Build([]byte("enclave program"))
+	assert.NoError(t, err)
+	c, err := Parse(data)
+	assert.NoError(t, err)
+
+	// An image in FPGA memory has no signature and may be followed by the rest of its slot
+	slot := append(append(c.Header.Marshal(), c.Ciphertext...), make([]byte, 64)...)
+	loaded, err := ParseLoaded(slot)
+	assert.NoError(t, err)
+	assert.Equal(t, c.Header, loaded.Header)
+	assert.Equal(t, c.Ciphertext, loaded.Ciphertext)
+	assert.Empty(t, loaded.Signature)
+	assert.ErrorIs(t, loaded.Verify(vendorKey.Public()), ErrBadSignature)
+
+	// The code must be complete and match the measurement
+	_, err = ParseLoaded(slot[:HeaderSize+len(c.Ciphertext)-1])
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+	slot[HeaderSize] ^= 1
+	_, err = ParseLoaded(slot)
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+	_, err = ParseLoaded(make([]byte, 256))
+	assert.ErrorIs(t, err, ErrInvalidContainer)
+}
+
+func TestBuilderRejected(t *testing.T) {
+	_, vendorKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+
+	builders := map[string]*Builder{
+		"empty entry": {Family: "hello", LoadAddress: 0x1000, EntryPoint: 0x0fff, Key: testKey(), Signer: vendorKey},
+		"past end":    {LoadAddress: 0x1000, EntryPoint: 0x1004, Key: testKey(), Signer: vendorKey},
+		"overflow":    {LoadAddress: ^uint64(0), EntryPoint: ^uint64(0), Key: testKey(), Signer: vendorKey},
+		"short key":   {LoadAddress: 0x1000, EntryPoint: 0x1000, Key: testKey()[:16], Signer: vendorKey},
+		"RSA vendor":  {LoadAddress: 0x1000, EntryPoint: 0x1000, Key: testKey(), Signer: rsaKey},
+		"P-384":       {LoadAddress: 0x1000, EntryPoint: 0x1000, Key: testKey(), Signer: p384Key},
+	}
+	for name, builder := range builders {
+		_, err := builder.Build([]byte("code"))
+		assert.Error(t, err, name)
+	}
+	_, err = (&Builder{Family: "hello", LoadAddress: 0x1000, EntryPoint: 0x1000, Key: testKey(), Signer: vendorKey}).Build(nil)
+	assert.Error(t, err)
+}
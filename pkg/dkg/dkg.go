@@ -0,0 +1,871 @@
+package dkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/share"
+)
+
+const (
+	defaultRoundTimeout = 10 * time.Second // Time to wait for peers before treating missing messages as misbehavior
+
+	generatorContext    = "fpga-secure-enclave dkg pedersen generator" // Label the second Pedersen generator is derived from
+	echoContext         = "fpga-secure-enclave dkg commitments"        // Domain separation for commitment echoes
+	confirmationContext = "fpga-secure-enclave dkg confirmation"       // Domain separation for result confirmations
+	messageContext      = "fpga-secure-enclave dkg message"            // Domain separation for message signatures
+)
+
+var (
+	// ErrTooFewQualified is returned when misbehaving dealers leave fewer qualified dealers than the threshold
+	ErrTooFewQualified = errors.New("dkg: too few qualified participants")
+
+	// ErrDisagreement is returned when qualified participants did not all confirm the same key. Nobody should
+	// use the key; the session must be run again.
+	ErrDisagreement = errors.New("dkg: participants disagree on the result")
+)
+
+// Config describes one participant's view of a distributed key generation session
+type Config struct {
+	SessionID    string        // Identifies the key being generated, used as the share key ID
+	Curve        Curve         // Group the key is generated in
+	Index        int           // This participant's index, from 1 to Participants
+	Participants int           // Total number of participants
+	Threshold    int           // Number of shares required to use the key
+	RoundTimeout time.Duration // Time to wait for each round, defaults to 10 seconds
+
+	// Signer is this participant's identity key, an ECDSA or Ed25519 key that signs every message it sends
+	Signer crypto.Signer
+	// Identities holds the identity public key of every participant, including this one, distributed out of
+	// band. The key of a dkg.NewIdentity certificate can serve as both the TLS and the message identity.
+	Identities map[int]crypto.PublicKey
+}
+
+// MessageType identifies a protocol message
+type MessageType int
+
+const (
+	// MessageCommitments carries a dealer's Pedersen commitments, broadcast
+	MessageCommitments MessageType = iota + 1
+	// MessageShare carries a dealer's secret and blinding shares for one participant, sent privately
+	MessageShare
+	// MessageComplaints carries the dealers a participant accuses of dealing a bad share, the signed share
+	// messages that prove it, and an echo of the commitments it received from every dealer, broadcast
+	MessageComplaints
+	// MessageJustifications carries the shares a dealer reveals in answer to complaints, broadcast
+	MessageJustifications
+	// MessagePublicCommitments carries a qualified dealer's Feldman commitments, broadcast
+	MessagePublicCommitments
+	// MessageExposures carries the shares that prove a dealer's Feldman commitments wrong, broadcast
+	MessageExposures
+	// MessageReconstruction carries a participant's shares of exposed dealers, broadcast
+	MessageReconstruction
+	// MessageConfirmation carries the digest of a participant's result, broadcast
+	MessageConfirmation
+)
+
+// SharePair is a share of a dealer's secret polynomial and the matching share of its blinding polynomial
+type SharePair struct {
+	Share    []byte `json:"share"`
+	Blinding []byte `json:"blinding"`
+}
+
+// Message is a single protocol message exchanged between participants
+type Message struct {
+	Session        string             `json:"session"`
+	Type           MessageType        `json:"type"`
+	From           int                `json:"from"`
+	To             int                `json:"to,omitempty"` // Zero for broadcast messages
+	Commitments    [][]byte           `json:"commitments,omitempty"`
+	Share          *SharePair         `json:"share,omitempty"`
+	Complaints     []int              `json:"complaints,omitempty"`
+	Echoes         map[int][]byte     `json:"echoes,omitempty"`         // Dealer to digest of its commitments as received
+	Evidence       map[int]*Message   `json:"evidence,omitempty"`       // Dealer to the signed share it sent
+	Justifications map[int]*SharePair `json:"justifications,omitempty"` // Accuser to the revealed shares
+	Exposures      map[int]*SharePair `json:"exposures,omitempty"`      // Dealer to the shares it dealt us
+	Digest         []byte             `json:"digest,omitempty"`
+	Signature      []byte             `json:"signature,omitempty"` // Sender's identity signature over the rest
+}
+
+// Result is the outcome of a successful key generation for one participant
+type Result struct {
+	SessionID        string
+	Curve            Curve
+	Index            int
+	Threshold        int
+	Share            []byte           // This participant's secret share, a 32-byte big-endian scalar
+	PublicKey        crypto.PublicKey // Joint public key, *ecdsa.PublicKey or ed25519.PublicKey
+	PublicKeyBytes   []byte           // Encoded joint public key point
+	VerificationKeys map[int][]byte   // Public share of every participant, Share*G
+	Qualified        []int            // Dealers whose contributions make up the key
+	Disqualified     []int            // Dealers excluded for misbehavior
+	Reconstructed    []int            // Qualified dealers whose polynomials were reconstructed from their shares
+}
+
+// KeyShare returns the participant's share in the self-describing share format
+func (r *Result) KeyShare() *share.Share {
+	scheme := share.SchemeFeldmanP256
+	if r.Curve == CurveEd25519 {
+		scheme = share.SchemeFeldmanEd25519
+	}
+	return &share.Share{
+		KeyID:     r.SessionID,
+		Scheme:    scheme,
+		Threshold: uint8(r.Threshold),
+		Index:     uint8(r.Index),
+		Value:     append([]byte(nil), r.Share...),
+	}
+}
+
+// Participant runs one side of the Gennaro-Jarecki-Krawczyk-Rabin DKG: Pedersen verifiable secret sharing with
+// complaints, echoed commitments and justifications decides the qualified dealers, whose Feldman commitments
+// then yield the joint key, and a final confirmation checks that every qualified participant agrees on it.
+// Pedersen commitments reveal nothing about a dealer's secret until the qualified set is fixed, so no dealer
+// can bias the key by choosing whether to be disqualified.
+type Participant struct {
+	cfg           Config
+	group         group
+	h             []byte // Second Pedersen generator, whose discrete logarithm to G is unknown
+	coefficients  []*big.Int
+	blinding      []*big.Int
+	commitments   map[int][][]byte   // Dealer index to Pedersen commitments
+	public        map[int][][]byte   // Qualified dealer index to Feldman commitments
+	shares        map[int]*SharePair // Dealer index to the shares dealt to us
+	dealt         map[int]*Message   // Dealer index to the signed share message it sent us
+	complaints    map[int][]int      // Dealer index to accusing participants
+	disqualified  map[int]bool
+	qualified     []int
+	reconstructed map[int]map[int]*big.Int // Exposed dealer to participant to verified share
+	result        *Result
+	digest        []byte
+}
+
+// NewParticipant validates the session parameters and prepares a participant
+func NewParticipant(cfg Config) (*Participant, error) {
+	g, err := newGroup(cfg.Curve)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Participants < 2 || cfg.Participants > 255 {
+		return nil, fmt.Errorf("participant count %d out of range", cfg.Participants)
+	}
+	if cfg.Threshold < 2 || cfg.Threshold > cfg.Participants {
+		return nil, fmt.Errorf("threshold %d out of range for %d participants", cfg.Threshold, cfg.Participants)
+	}
+	if cfg.Index < 1 || cfg.Index > cfg.Participants {
+		return nil, fmt.Errorf("participant index %d out of range", cfg.Index)
+	}
+	if cfg.RoundTimeout == 0 {
+		cfg.RoundTimeout = defaultRoundTimeout
+	}
+	if cfg.Signer == nil {
+		return nil, fmt.Errorf("participant %d has no identity key", cfg.Index)
+	}
+	for i := 1; i <= cfg.Participants; i++ {
+		switch cfg.Identities[i].(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("participant %d has no ECDSA or Ed25519 identity", i)
+		}
+	}
+	if !publicKeyEqual(cfg.Signer.Public(), cfg.Identities[cfg.Index]) {
+		return nil, fmt.Errorf("identity key does not match the identity of participant %d", cfg.Index)
+	}
+
+	return &Participant{
+		cfg:           cfg,
+		group:         g,
+		h:             g.hashToPoint(generatorContext),
+		commitments:   make(map[int][][]byte),
+		public:        make(map[int][][]byte),
+		shares:        make(map[int]*SharePair),
+		dealt:         make(map[int]*Message),
+		complaints:    make(map[int][]int),
+		disqualified:  make(map[int]bool),
+		reconstructed: make(map[int]map[int]*big.Int),
+	}, nil
+}
+
+// Deal picks random secret and blinding polynomials and returns the signed Pedersen commitment broadcast and
+// one private pair of shares per peer
+func (p *Participant) Deal() ([]*Message, error) {
+	p.coefficients = make([]*big.Int, p.cfg.Threshold)
+	p.blinding = make([]*big.Int, p.cfg.Threshold)
+	commitments := make([][]byte, p.cfg.Threshold)
+	for k := range p.coefficients {
+		a, err := randomScalar(p.group.order())
+		if err != nil {
+			return nil, err
+		}
+		b, err := randomScalar(p.group.order())
+		if err != nil {
+			return nil, err
+		}
+		p.coefficients[k], p.blinding[k] = a, b
+		commitments[k], err = p.pedersen(a, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep our own contribution without going through the transport
+	p.commitments[p.cfg.Index] = commitments
+	p.shares[p.cfg.Index] = p.sharePair(p.cfg.Index)
+
+	msgs := []*Message{{
+		Session:     p.cfg.SessionID,
+		Type:        MessageCommitments,
+		From:        p.cfg.Index,
+		Commitments: commitments,
+	}}
+	for j := 1; j <= p.cfg.Participants; j++ {
+		if j == p.cfg.Index {
+			continue
+		}
+		msgs = append(msgs, &Message{
+			Session: p.cfg.SessionID,
+			Type:    MessageShare,
+			From:    p.cfg.Index,
+			To:      j,
+			Share:   p.sharePair(j),
+		})
+	}
+	for _, msg := range msgs {
+		if _, err := p.sign(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// ProcessDeals verifies the received shares against their commitments and returns our signed complaint
+// broadcast. A complaint about a share carries the dealer's signed share message as proof, and the broadcast
+// echoes the commitments we received so that dealers who sent different commitments to different
+// participants are caught. Messages that are not signed by their sender are ignored.
+func (p *Participant) ProcessDeals(msgs []*Message) (*Message, error) {
+	for _, msg := range msgs {
+		if msg.From == p.cfg.Index || !p.verifySignature(msg) {
+			continue
+		}
+		switch msg.Type {
+		case MessageCommitments:
+			if _, ok := p.commitments[msg.From]; !ok && len(msg.Commitments) == p.cfg.Threshold {
+				p.commitments[msg.From] = msg.Commitments
+			}
+		case MessageShare:
+			if _, ok := p.shares[msg.From]; !ok && msg.To == p.cfg.Index && msg.Share != nil {
+				p.shares[msg.From] = msg.Share
+				p.dealt[msg.From] = msg
+			}
+		}
+	}
+
+	var accused []int
+	evidence := make(map[int]*Message)
+	echoes := make(map[int][]byte)
+	for i := 1; i <= p.cfg.Participants; i++ {
+		if i == p.cfg.Index {
+			echoes[i] = echo(p.commitments[i])
+			continue
+		}
+		if _, ok := p.commitments[i]; !ok {
+			// A dealer that never committed cannot be checked or justified
+			p.disqualified[i] = true
+			continue
+		}
+		echoes[i] = echo(p.commitments[i])
+		pair, ok := p.shares[i]
+		if ok && p.verifyPedersen(i, p.cfg.Index, pair) {
+			continue
+		}
+		accused = append(accused, i)
+		delete(p.shares, i)
+		// Our own broadcast is not echoed back, so act on the complaint here: a signed bad share proves the
+		// dealer faulty, a missing share must be justified
+		if ok {
+			evidence[i] = p.dealt[i]
+			p.disqualified[i] = true
+		} else {
+			p.complaints[i] = append(p.complaints[i], p.cfg.Index)
+		}
+	}
+
+	return p.sign(&Message{
+		Session:    p.cfg.SessionID,
+		Type:       MessageComplaints,
+		From:       p.cfg.Index,
+		Complaints: accused,
+		Evidence:   evidence,
+		Echoes:     echoes,
+	})
+}
+
+// ProcessComplaints resolves the complaints raised by every participant and returns our justification
+// broadcast. Only complaints signed by the complainer count. A complaint that carries the share the dealer
+// signed for the complainer is checked against the dealer's commitments at once: the dealer is disqualified
+// if the share does not match them, and the complaint is dismissed if it does. A complaint without a share
+// is recorded for the dealer to justify. Dealers whose commitments were not echoed identically by everyone
+// are disqualified.
+func (p *Participant) ProcessComplaints(msgs []*Message) (*Message, error) {
+	for _, msg := range msgs {
+		if msg.Type != MessageComplaints || msg.From == p.cfg.Index || !p.verifySignature(msg) {
+			continue
+		}
+		for _, dealer := range msg.Complaints {
+			if dealer == msg.From || dealer < 1 || dealer > p.cfg.Participants {
+				continue
+			}
+			evidence, ok := msg.Evidence[dealer]
+			if !ok {
+				if !contains(p.complaints[dealer], msg.From) {
+					p.complaints[dealer] = append(p.complaints[dealer], msg.From)
+				}
+				continue
+			}
+			if p.provesBadShare(dealer, msg.From, evidence) {
+				p.disqualified[dealer] = true
+			}
+		}
+		for dealer := 1; dealer <= p.cfg.Participants; dealer++ {
+			if dealer == p.cfg.Index || p.disqualified[dealer] {
+				continue
+			}
+			if !bytes.Equal(msg.Echoes[dealer], echo(p.commitments[dealer])) {
+				p.disqualified[dealer] = true
+			}
+		}
+	}
+
+	justifications := make(map[int]*SharePair)
+	for _, accuser := range p.complaints[p.cfg.Index] {
+		justifications[accuser] = p.sharePair(accuser)
+	}
+
+	return p.sign(&Message{
+		Session:        p.cfg.SessionID,
+		Type:           MessageJustifications,
+		From:           p.cfg.Index,
+		Justifications: justifications,
+	})
+}
+
+// provesBadShare reports whether evidence is a share message signed by dealer for accuser whose shares do
+// not match the dealer's commitments
+func (p *Participant) provesBadShare(dealer, accuser int, evidence *Message) bool {
+	if evidence == nil || evidence.Type != MessageShare || evidence.Session != p.cfg.SessionID ||
+		evidence.From != dealer || evidence.To != accuser || !p.verifySignature(evidence) {
+		return false
+	}
+	return !p.verifyPedersen(dealer, accuser, evidence.Share)
+}
+
+// ProcessJustifications resolves complaints, disqualifies misbehaving dealers and returns our Feldman
+// commitment broadcast
+func (p *Participant) ProcessJustifications(msgs []*Message) (*Message, error) {
+	justified := make(map[int]map[int]*SharePair)
+	for _, msg := range msgs {
+		if msg.Type == MessageJustifications && justified[msg.From] == nil {
+			justified[msg.From] = msg.Justifications
+		}
+	}
+
+	for dealer, accusers := range p.complaints {
+		if dealer == p.cfg.Index || p.disqualified[dealer] {
+			continue
+		}
+		// More complaints than the polynomial degree means the dealer is faulty regardless of its answers
+		if len(accusers) >= p.cfg.Threshold {
+			p.disqualified[dealer] = true
+			continue
+		}
+		for _, accuser := range accusers {
+			revealed := justified[dealer][accuser]
+			if revealed == nil || !p.verifyPedersen(dealer, accuser, revealed) {
+				p.disqualified[dealer] = true
+				break
+			}
+			if accuser == p.cfg.Index {
+				p.shares[dealer] = revealed
+			}
+		}
+	}
+
+	p.qualified = nil
+	for i := 1; i <= p.cfg.Participants; i++ {
+		if !p.disqualified[i] {
+			p.qualified = append(p.qualified, i)
+		}
+	}
+	if len(p.qualified) < p.cfg.Threshold {
+		return nil, fmt.Errorf("%w: %d of %d dealers qualified, threshold is %d", ErrTooFewQualified, len(p.qualified), p.cfg.Participants, p.cfg.Threshold)
+	}
+
+	commitments := make([][]byte, len(p.coefficients))
+	for k, a := range p.coefficients {
+		commitments[k] = p.group.scalarBaseMult(a)
+	}
+	p.public[p.cfg.Index] = commitments
+	return p.sign(&Message{
+		Session:     p.cfg.SessionID,
+		Type:        MessagePublicCommitments,
+		From:        p.cfg.Index,
+		Commitments: commitments,
+	})
+}
+
+// ProcessPublicCommitments checks every qualified dealer's Feldman commitments against the share it dealt us
+// and returns our exposure broadcast, which reveals those shares for dealers whose commitments do not match
+func (p *Participant) ProcessPublicCommitments(msgs []*Message) (*Message, error) {
+	for _, msg := range msgs {
+		if msg.Type != MessagePublicCommitments || msg.From == p.cfg.Index || !contains(p.qualified, msg.From) {
+			continue
+		}
+		if _, ok := p.public[msg.From]; !ok && len(msg.Commitments) == p.cfg.Threshold {
+			p.public[msg.From] = msg.Commitments
+		}
+	}
+
+	exposures := make(map[int]*SharePair)
+	for _, dealer := range p.qualified {
+		if dealer == p.cfg.Index {
+			continue
+		}
+		pair, ok := p.shares[dealer]
+		if !ok {
+			continue
+		}
+		if !p.verifyFeldman(dealer, p.cfg.Index, new(big.Int).SetBytes(pair.Share)) {
+			exposures[dealer] = pair
+			// Our own broadcast is not echoed back, so start the reconstruction here
+			p.reconstructed[dealer] = make(map[int]*big.Int)
+		}
+	}
+
+	return p.sign(&Message{
+		Session:   p.cfg.SessionID,
+		Type:      MessageExposures,
+		From:      p.cfg.Index,
+		Exposures: exposures,
+	})
+}
+
+// ProcessExposures checks the exposures of every participant and returns our reconstruction broadcast, which
+// reveals our shares of every dealer whose Feldman commitments were proven wrong
+func (p *Participant) ProcessExposures(msgs []*Message) (*Message, error) {
+	for _, msg := range msgs {
+		if msg.Type != MessageExposures || msg.From == p.cfg.Index || msg.From < 1 || msg.From > p.cfg.Participants {
+			continue
+		}
+		for dealer, pair := range msg.Exposures {
+			if !contains(p.qualified, dealer) || dealer == msg.From || pair == nil {
+				continue
+			}
+			// The exposure must be a share the dealer really dealt, which its Feldman commitments deny
+			if p.verifyPedersen(dealer, msg.From, pair) && !p.verifyFeldman(dealer, msg.From, new(big.Int).SetBytes(pair.Share)) {
+				if p.reconstructed[dealer] == nil {
+					p.reconstructed[dealer] = make(map[int]*big.Int)
+				}
+			}
+		}
+	}
+
+	revealed := make(map[int]*SharePair)
+	for dealer, shares := range p.reconstructed {
+		revealed[dealer] = p.shares[dealer]
+		shares[p.cfg.Index] = new(big.Int).SetBytes(p.shares[dealer].Share)
+	}
+	return p.sign(&Message{
+		Session:   p.cfg.SessionID,
+		Type:      MessageReconstruction,
+		From:      p.cfg.Index,
+		Exposures: revealed,
+	})
+}
+
+// ProcessReconstruction reconstructs the polynomials of exposed dealers from the shares revealed for them,
+// derives the final key share and returns our confirmation broadcast
+func (p *Participant) ProcessReconstruction(msgs []*Message) (*Message, error) {
+	for _, msg := range msgs {
+		if msg.Type != MessageReconstruction || msg.From == p.cfg.Index || msg.From < 1 || msg.From > p.cfg.Participants {
+			continue
+		}
+		for dealer, pair := range msg.Exposures {
+			shares, ok := p.reconstructed[dealer]
+			if ok && pair != nil && p.verifyPedersen(dealer, msg.From, pair) {
+				shares[msg.From] = new(big.Int).SetBytes(pair.Share)
+			}
+		}
+	}
+	for dealer, shares := range p.reconstructed {
+		if len(shares) < p.cfg.Threshold {
+			return nil, fmt.Errorf("%w: only %d shares of exposed dealer %d were revealed", ErrTooFewQualified, len(shares), dealer)
+		}
+	}
+
+	// Sum the shares and constant-term public values of every qualified dealer
+	x := new(big.Int)
+	var publicKey []byte
+	for _, i := range p.qualified {
+		pair, ok := p.shares[i]
+		if !ok {
+			return nil, fmt.Errorf("missing verified share from qualified dealer %d", i)
+		}
+		x.Add(x, new(big.Int).SetBytes(pair.Share))
+		term, err := p.publicValue(i, 0)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err = p.addPoint(publicKey, term)
+		if err != nil {
+			return nil, err
+		}
+	}
+	x.Mod(x, p.group.order())
+
+	verificationKeys := make(map[int][]byte, p.cfg.Participants)
+	for j := 1; j <= p.cfg.Participants; j++ {
+		var vk []byte
+		for _, i := range p.qualified {
+			pub, err := p.publicValue(i, j)
+			if err != nil {
+				return nil, err
+			}
+			vk, err = p.addPoint(vk, pub)
+			if err != nil {
+				return nil, err
+			}
+		}
+		verificationKeys[j] = vk
+	}
+
+	pub, err := p.group.publicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var disqualified, reconstructed []int
+	for i := 1; i <= p.cfg.Participants; i++ {
+		if p.disqualified[i] {
+			disqualified = append(disqualified, i)
+		}
+		if _, ok := p.reconstructed[i]; ok {
+			reconstructed = append(reconstructed, i)
+		}
+	}
+	p.result = &Result{
+		SessionID:        p.cfg.SessionID,
+		Curve:            p.cfg.Curve,
+		Index:            p.cfg.Index,
+		Threshold:        p.cfg.Threshold,
+		Share:            scalarBytes(x, 32),
+		PublicKey:        pub,
+		PublicKeyBytes:   publicKey,
+		VerificationKeys: verificationKeys,
+		Qualified:        p.qualified,
+		Disqualified:     disqualified,
+		Reconstructed:    reconstructed,
+	}
+	p.digest = p.result.digest()
+	return p.sign(&Message{
+		Session: p.cfg.SessionID,
+		Type:    MessageConfirmation,
+		From:    p.cfg.Index,
+		Digest:  p.digest,
+	})
+}
+
+// ProcessConfirmations returns the result once every other qualified participant has confirmed the same
+// qualified set, joint key and verification keys. Any missing or different confirmation fails with
+// ErrDisagreement.
+func (p *Participant) ProcessConfirmations(msgs []*Message) (*Result, error) {
+	if p.result == nil {
+		return nil, fmt.Errorf("no result to confirm")
+	}
+	confirmed := make(map[int][]byte)
+	for _, msg := range msgs {
+		if msg.Type == MessageConfirmation && confirmed[msg.From] == nil {
+			confirmed[msg.From] = msg.Digest
+		}
+	}
+	for _, i := range p.qualified {
+		if i == p.cfg.Index {
+			continue
+		}
+		digest, ok := confirmed[i]
+		if !ok {
+			return nil, fmt.Errorf("%w: participant %d did not confirm", ErrDisagreement, i)
+		}
+		if !bytes.Equal(digest, p.digest) {
+			return nil, fmt.Errorf("%w: participant %d confirmed a different result", ErrDisagreement, i)
+		}
+	}
+	return p.result, nil
+}
+
+// digest returns the SHA-256 digest of what participants must agree on: the session, qualified dealers, joint
+// public key and every verification key
+func (r *Result) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(confirmationContext))
+	writeField(h, []byte(r.SessionID))
+	binary.Write(h, binary.BigEndian, uint32(r.Curve))
+	binary.Write(h, binary.BigEndian, uint32(r.Threshold))
+	binary.Write(h, binary.BigEndian, uint32(len(r.Qualified)))
+	for _, i := range r.Qualified {
+		binary.Write(h, binary.BigEndian, uint32(i))
+	}
+	writeField(h, r.PublicKeyBytes)
+	for j := 1; j <= len(r.VerificationKeys); j++ {
+		writeField(h, r.VerificationKeys[j])
+	}
+	return h.Sum(nil)
+}
+
+// sign sets the signature of a message we send with our identity key and returns it
+func (p *Participant) sign(msg *Message) (*Message, error) {
+	data, err := msg.signedData()
+	if err != nil {
+		return nil, err
+	}
+	opts := crypto.SignerOpts(crypto.Hash(0))
+	if _, ok := p.cfg.Signer.Public().(*ecdsa.PublicKey); ok {
+		digest := sha256.Sum256(data)
+		data, opts = digest[:], crypto.SHA256
+	}
+	msg.Signature, err = p.cfg.Signer.Sign(rand.Reader, data, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %v message: %v", msg.Type, err)
+	}
+	return msg, nil
+}
+
+// verifySignature reports whether a message is signed by the identity key of the participant it claims to
+// be from
+func (p *Participant) verifySignature(msg *Message) bool {
+	if msg == nil || msg.From < 1 || msg.From > p.cfg.Participants {
+		return false
+	}
+	data, err := msg.signedData()
+	if err != nil {
+		return false
+	}
+	switch pub := p.cfg.Identities[msg.From].(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, digest[:], msg.Signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, msg.Signature)
+	default:
+		return false
+	}
+}
+
+// signedData returns the bytes a message signature covers: the message without its signature, in the
+// deterministic JSON encoding, after a domain separation label
+func (m *Message) signedData() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %v message: %v", m.Type, err)
+	}
+	return append([]byte(messageContext), data...), nil
+}
+
+// publicKeyEqual reports whether two identity public keys are the same
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// sharePair returns the shares of our secret and blinding polynomials for participant x
+func (p *Participant) sharePair(x int) *SharePair {
+	return &SharePair{
+		Share:    scalarBytes(evaluate(p.coefficients, x, p.group.order()), 32),
+		Blinding: scalarBytes(evaluate(p.blinding, x, p.group.order()), 32),
+	}
+}
+
+// pedersen returns the Pedersen commitment a*G + b*H
+func (p *Participant) pedersen(a, b *big.Int) ([]byte, error) {
+	blind, err := p.group.scalarMult(p.h, b)
+	if err != nil {
+		return nil, err
+	}
+	return p.group.add(p.group.scalarBaseMult(a), blind)
+}
+
+// evaluateCommitments computes the sum of C_k * x^k over a dealer's commitments, failing if there are none
+func (p *Participant) evaluateCommitments(commitments [][]byte, dealer, x int) ([]byte, error) {
+	var result []byte
+	power := big.NewInt(1)
+	bx := big.NewInt(int64(x))
+	for _, c := range commitments {
+		if power.Sign() == 0 {
+			// At x = 0 only the constant term remains
+			break
+		}
+		term, err := p.group.scalarMult(c, power)
+		if err != nil {
+			return nil, fmt.Errorf("dealer %d: %v", dealer, err)
+		}
+		result, err = p.addPoint(result, term)
+		if err != nil {
+			return nil, fmt.Errorf("dealer %d: %v", dealer, err)
+		}
+		power = new(big.Int).Mod(new(big.Int).Mul(power, bx), p.group.order())
+	}
+	if result == nil {
+		return nil, fmt.Errorf("dealer %d has no commitments", dealer)
+	}
+	return result, nil
+}
+
+// verifyPedersen checks a pair of shares dealt to participant x against the dealer's Pedersen commitments
+func (p *Participant) verifyPedersen(dealer, x int, pair *SharePair) bool {
+	if pair == nil {
+		return false
+	}
+	s, b := new(big.Int).SetBytes(pair.Share), new(big.Int).SetBytes(pair.Blinding)
+	if s.Sign() == 0 || s.Cmp(p.group.order()) >= 0 || b.Cmp(p.group.order()) >= 0 {
+		return false
+	}
+	expected, err := p.evaluateCommitments(p.commitments[dealer], dealer, x)
+	if err != nil {
+		return false
+	}
+	actual, err := p.pedersen(s, b)
+	return err == nil && bytes.Equal(actual, expected)
+}
+
+// verifyFeldman checks a share dealt to participant x against the dealer's Feldman commitments
+func (p *Participant) verifyFeldman(dealer, x int, s *big.Int) bool {
+	commitments, ok := p.public[dealer]
+	if !ok {
+		return false
+	}
+	expected, err := p.evaluateCommitments(commitments, dealer, x)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(p.group.scalarBaseMult(s), expected)
+}
+
+// publicValue returns f(x)*G for a qualified dealer's polynomial f: from its Feldman commitments, or from the
+// shares revealed for it if it was exposed
+func (p *Participant) publicValue(dealer, x int) ([]byte, error) {
+	shares, ok := p.reconstructed[dealer]
+	if !ok {
+		return p.evaluateCommitments(p.public[dealer], dealer, x)
+	}
+	return p.group.scalarBaseMult(interpolate(shares, x, p.cfg.Threshold, p.group.order())), nil
+}
+
+// addPoint adds q to an accumulator that starts out empty
+func (p *Participant) addPoint(acc, q []byte) ([]byte, error) {
+	if acc == nil {
+		return q, nil
+	}
+	return p.group.add(acc, q)
+}
+
+// evaluate computes the polynomial with the given coefficients at x modulo n
+func evaluate(coefficients []*big.Int, x int, n *big.Int) *big.Int {
+	result := new(big.Int)
+	bx := big.NewInt(int64(x))
+	for k := len(coefficients) - 1; k >= 0; k-- {
+		result.Mul(result, bx)
+		result.Add(result, coefficients[k])
+		result.Mod(result, n)
+	}
+	return result
+}
+
+// interpolate evaluates at x the polynomial through the first threshold shares, by participant index
+func interpolate(shares map[int]*big.Int, x, threshold int, n *big.Int) *big.Int {
+	indexes := make([]int, 0, len(shares))
+	for i := range shares {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	indexes = indexes[:threshold]
+
+	result := new(big.Int)
+	for _, i := range indexes {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for _, j := range indexes {
+			if j == i {
+				continue
+			}
+			num.Mod(num.Mul(num, big.NewInt(int64(x-j))), n)
+			den.Mod(den.Mul(den, big.NewInt(int64(i-j))), n)
+		}
+		term := new(big.Int).Mul(shares[i], num)
+		term.Mul(term, new(big.Int).ModInverse(den, n))
+		result.Add(result, term)
+	}
+	return result.Mod(result, n)
+}
+
+// echo returns the digest of a dealer's commitments that participants compare, or nil if there are none
+func echo(commitments [][]byte) []byte {
+	if commitments == nil {
+		return nil
+	}
+	h := sha256.New()
+	h.Write([]byte(echoContext))
+	for _, c := range commitments {
+		writeField(h, c)
+	}
+	return h.Sum(nil)
+}
+
+// writeField writes a length-prefixed field to a hash
+func writeField(h io.Writer, b []byte) {
+	binary.Write(h, binary.BigEndian, uint32(len(b)))
+	h.Write(b)
+}
+
+// randomScalar returns a uniformly random non-zero scalar below n
+func randomScalar(n *big.Int) (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random scalar: %v", err)
+		}
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of a participant map in ascending order
+func sortedKeys(m map[int]*Message) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,448 @@
+package dkg
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"math/big"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/edwards25519"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSigners holds the identity keys of up to five test participants, participant i at index i-1
+var testSigners = func() []crypto.Signer {
+	signers := make([]crypto.Signer, 5)
+	for i := range signers {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		signers[i] = key
+	}
+	return signers
+}()
+
+// testIdentities returns the identity public keys of n test participants
+func testIdentities(n int) map[int]crypto.PublicKey {
+	identities := make(map[int]crypto.PublicKey, n)
+	for i := 1; i <= n; i++ {
+		identities[i] = testSigners[i-1].Public()
+	}
+	return identities
+}
+
+// resign signs a tampered message again as its sender, as a sender that misbehaves on purpose would
+func resign(msg *Message) *Message {
+	p := &Participant{cfg: Config{Signer: testSigners[msg.From-1]}}
+	signed, err := p.sign(msg)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+// runParticipants runs every participant concurrently and returns their results and errors in index order
+func runParticipants(curve Curve, n, threshold int, transports []Transport) ([]*Result, []error) {
+	results := make([]*Result, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := NewParticipant(Config{
+				SessionID:    "test-session",
+				Curve:        curve,
+				Index:        i,
+				Participants: n,
+				Threshold:    threshold,
+				RoundTimeout: 2 * time.Second,
+				Signer:       testSigners[i-1],
+				Identities:   testIdentities(n),
+			})
+			if err != nil {
+				errs[i-1] = err
+				return
+			}
+			results[i-1], errs[i-1] = Run(context.Background(), p, transports[i-1])
+		}(i)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// runSession runs every participant concurrently and returns their results in index order, failing on any error
+func runSession(t *testing.T, curve Curve, n, threshold int, transports []Transport) []*Result {
+	results, errs := runParticipants(curve, n, threshold, transports)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	return results
+}
+
+// recoverSecret interpolates the shares of the given participants at zero
+func recoverSecret(t *testing.T, curve Curve, results []*Result) *big.Int {
+	g, err := newGroup(curve)
+	assert.NoError(t, err)
+	n := g.order()
+
+	secret := new(big.Int)
+	for _, ri := range results {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for _, rj := range results {
+			if rj.Index == ri.Index {
+				continue
+			}
+			num.Mod(num.Mul(num, big.NewInt(int64(-rj.Index))), n)
+			den.Mod(den.Mul(den, big.NewInt(int64(ri.Index-rj.Index))), n)
+		}
+		term := new(big.Int).Mul(new(big.Int).SetBytes(ri.Share), num)
+		term.Mul(term, new(big.Int).ModInverse(den, n))
+		secret.Add(secret, term)
+	}
+	return secret.Mod(secret, n)
+}
+
+// assertConsistent checks that every participant agrees on the joint key and that the shares match it
+func assertConsistent(t *testing.T, curve Curve, results []*Result, threshold int) {
+	g, err := newGroup(curve)
+	assert.NoError(t, err)
+
+	for _, r := range results {
+		assert.Equal(t, results[0].PublicKeyBytes, r.PublicKeyBytes, "participants should agree on the public key")
+		assert.Equal(t, results[0].Qualified, r.Qualified)
+		assert.Equal(t, g.scalarBaseMult(new(big.Int).SetBytes(r.Share)), r.VerificationKeys[r.Index])
+	}
+
+	// Any threshold subset recovers the same secret, matching the joint public key
+	secret := recoverSecret(t, curve, results[:threshold])
+	assert.Equal(t, secret, recoverSecret(t, curve, results[len(results)-threshold:]))
+	assert.Equal(t, results[0].PublicKeyBytes, g.scalarBaseMult(secret))
+}
+
+func TestLocalDKG(t *testing.T) {
+	for _, curve := range []Curve{CurveP256, CurveEd25519} {
+		results := runSession(t, curve, 5, 3, NewLocalNetwork(5))
+		assertConsistent(t, curve, results, 3)
+		assert.Empty(t, results[0].Disqualified)
+		assert.Empty(t, results[0].Reconstructed)
+
+		// Shares carry their metadata in the self-describing format
+		s := results[2].KeyShare()
+		assert.Equal(t, "test-session", s.KeyID)
+		assert.Equal(t, uint8(3), s.Index)
+		assert.Equal(t, uint8(3), s.Threshold)
+	}
+}
+
+func TestDKGJointKeySigns(t *testing.T) {
+	results := runSession(t, CurveP256, 3, 2, NewLocalNetwork(3))
+	pub := results[0].PublicKey.(*ecdsa.PublicKey)
+
+	// Recombining is only done here to prove the joint key is a usable ECDSA key
+	priv := &ecdsa.PrivateKey{PublicKey: *pub, D: recoverSecret(t, CurveP256, results[:2])}
+	digest := sha256.Sum256([]byte("Test message for signing."))
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	assert.NoError(t, err)
+	assert.True(t, ecdsa.VerifyASN1(pub, digest[:], sig))
+}
+
+// faultyTransport lets a participant tamper with the messages it sends
+type faultyTransport struct {
+	Transport
+	modify func(msg *Message) *Message
+}
+
+func (f *faultyTransport) Send(msg *Message) error {
+	return f.Transport.Send(f.modify(msg))
+}
+
+// withholdShare returns a modifier that withholds the share sent to victim, and optionally suppresses
+// justifications
+func withholdShare(victim int, noJustify bool) func(msg *Message) *Message {
+	return func(msg *Message) *Message {
+		switch {
+		case msg.Type == MessageShare && msg.To == victim:
+			empty := *msg
+			empty.Share = nil
+			return resign(&empty)
+		case msg.Type == MessageJustifications && noJustify:
+			empty := *msg
+			empty.Justifications = nil
+			return resign(&empty)
+		}
+		return msg
+	}
+}
+
+// swapCommitments returns a copy of a message with its first two commitments swapped
+func swapCommitments(msg *Message) *Message {
+	swapped := *msg
+	swapped.Commitments = slices.Clone(msg.Commitments)
+	swapped.Commitments[0], swapped.Commitments[1] = swapped.Commitments[1], swapped.Commitments[0]
+	return resign(&swapped)
+}
+
+func TestComplaintResolvedByJustification(t *testing.T) {
+	transports := NewLocalNetwork(4)
+	transports[1] = &faultyTransport{Transport: transports[1], modify: withholdShare(3, false)}
+
+	// The dealer answers the complaint with the correct share, so it stays qualified
+	results := runSession(t, CurveEd25519, 4, 3, transports)
+	assertConsistent(t, CurveEd25519, results, 3)
+	assert.Empty(t, results[0].Disqualified)
+}
+
+func TestMisbehavingDealerDisqualified(t *testing.T) {
+	transports := NewLocalNetwork(4)
+	transports[1] = &faultyTransport{Transport: transports[1], modify: withholdShare(3, true)}
+
+	// Participant 2 believes it justified, so it disagrees with everyone else and gets no key
+	results, errs := runParticipants(CurveP256, 4, 3, transports)
+	assert.ErrorIs(t, errs[1], ErrDisagreement)
+	honest := []*Result{results[0], results[2], results[3]}
+	for _, i := range []int{0, 2, 3} {
+		assert.NoError(t, errs[i])
+	}
+	assertConsistent(t, CurveP256, honest, 3)
+	for _, r := range honest {
+		assert.Equal(t, []int{2}, r.Disqualified)
+		assert.Equal(t, []int{1, 3, 4}, r.Qualified)
+	}
+}
+
+func TestSignedBadShareDisqualifiesDealer(t *testing.T) {
+	transports := NewLocalNetwork(4)
+	transports[1] = &faultyTransport{Transport: transports[1], modify: func(msg *Message) *Message {
+		if msg.Type == MessageShare && msg.To == 3 {
+			bad := *msg
+			bad.Share = &SharePair{Share: bytes.Clone(msg.Share.Share), Blinding: msg.Share.Blinding}
+			bad.Share.Share[31] ^= 0x01
+			return resign(&bad)
+		}
+		return msg
+	}}
+
+	// Participant 3's complaint carries the bad share dealer 2 signed, so everyone disqualifies the dealer
+	// at once without waiting for a justification
+	results, errs := runParticipants(CurveP256, 4, 3, transports)
+	honest := []*Result{results[0], results[2], results[3]}
+	for _, i := range []int{0, 2, 3} {
+		assert.NoError(t, errs[i])
+	}
+	assertConsistent(t, CurveP256, honest, 3)
+	for _, r := range honest {
+		assert.Equal(t, []int{2}, r.Disqualified)
+	}
+}
+
+func TestFalseComplaintsDismissed(t *testing.T) {
+	var dealt *Message
+	transports := NewLocalNetwork(4)
+	transports[0] = &faultyTransport{Transport: transports[0], modify: func(msg *Message) *Message {
+		if msg.Type == MessageShare && msg.To == 3 {
+			dealt = msg
+		}
+		return msg
+	}}
+	transports[2] = &faultyTransport{Transport: transports[2], modify: func(msg *Message) *Message {
+		if msg.Type != MessageComplaints {
+			return msg
+		}
+		// Participant 3 accuses dealer 1 with the valid share dealer 1 signed for it
+		forged := *msg
+		forged.Complaints = []int{1}
+		forged.Evidence = map[int]*Message{1: dealt}
+		return resign(&forged)
+	}}
+
+	// The share matches dealer 1's commitments, so the complaint is dismissed without a justification
+	results := runSession(t, CurveEd25519, 4, 3, transports)
+	assertConsistent(t, CurveEd25519, results, 3)
+	assert.Empty(t, results[0].Disqualified)
+
+	// A complaint in the name of another participant does not carry its signature
+	p, err := NewParticipant(Config{SessionID: "s", Curve: CurveP256, Index: 1, Participants: 4, Threshold: 3, Signer: testSigners[0], Identities: testIdentities(4)})
+	assert.NoError(t, err)
+	complaint := resign(&Message{Session: "s", Type: MessageComplaints, From: 4, Complaints: []int{1}})
+	assert.True(t, p.verifySignature(complaint))
+	complaint.From = 2
+	assert.False(t, p.verifySignature(complaint))
+}
+
+// splitTransport sends a message to victim that differs from the one everyone else gets
+type splitTransport struct {
+	Transport
+	victim int
+	modify func(msg *Message) *Message
+}
+
+func (s *splitTransport) Send(msg *Message) error {
+	if msg.To != 0 || msg.Type != MessageCommitments {
+		return s.Transport.Send(msg)
+	}
+	for j := 1; j <= 4; j++ {
+		if j == msg.From {
+			continue
+		}
+		out := *msg
+		out.To = j
+		if j == s.victim {
+			out = *s.modify(msg)
+			out.To = j
+		}
+		if err := s.Transport.Send(resign(&out)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestEquivocatingDealerDisqualified(t *testing.T) {
+	transports := NewLocalNetwork(4)
+	transports[1] = &splitTransport{Transport: transports[1], victim: 4, modify: swapCommitments}
+
+	// Participant 4 echoes different commitments from dealer 2 than everyone else, so every honest participant
+	// disqualifies the dealer
+	results, errs := runParticipants(CurveEd25519, 4, 2, transports)
+	assert.ErrorIs(t, errs[1], ErrDisagreement)
+	honest := []*Result{results[0], results[2], results[3]}
+	assertConsistent(t, CurveEd25519, honest, 2)
+	for _, r := range honest {
+		assert.Equal(t, []int{2}, r.Disqualified)
+	}
+}
+
+func TestExposedDealerReconstructed(t *testing.T) {
+	transports := NewLocalNetwork(4)
+	transports[1] = &faultyTransport{Transport: transports[1], modify: func(msg *Message) *Message {
+		if msg.Type == MessagePublicCommitments {
+			return swapCommitments(msg)
+		}
+		return msg
+	}}
+
+	// Dealer 2 stays qualified, since dropping it now could bias the key; its polynomial is reconstructed
+	// from the shares it dealt instead of trusted from its Feldman commitments
+	results := runSession(t, CurveP256, 4, 3, transports)
+	assertConsistent(t, CurveP256, results, 3)
+	for _, r := range []*Result{results[0], results[2], results[3]} {
+		assert.Equal(t, []int{2}, r.Reconstructed)
+		assert.Equal(t, []int{1, 2, 3, 4}, r.Qualified)
+	}
+}
+
+func TestDisagreementDetected(t *testing.T) {
+	transports := NewLocalNetwork(3)
+	transports[2] = &faultyTransport{Transport: transports[2], modify: func(msg *Message) *Message {
+		if msg.Type == MessageConfirmation {
+			forged := *msg
+			forged.Digest = make([]byte, len(msg.Digest))
+			return resign(&forged)
+		}
+		return msg
+	}}
+
+	// The others refuse a key that participant 3 does not confirm
+	_, errs := runParticipants(CurveP256, 3, 2, transports)
+	assert.ErrorIs(t, errs[0], ErrDisagreement)
+	assert.ErrorIs(t, errs[1], ErrDisagreement)
+}
+
+func TestEd25519RejectsTorsionPoints(t *testing.T) {
+	g := ed25519Group{}
+	base := g.scalarBaseMult(big.NewInt(1))
+	_, err := ed25519Point(base)
+	assert.NoError(t, err)
+
+	// (0, -1) has order 2, so adding it leaves a point outside the prime-order subgroup
+	order2 := bytes.Repeat([]byte{0xff}, 32)
+	order2[0], order2[31] = 0xec, 0x7f
+	mixed, err := new(edwards25519.Point).SetBytes(base)
+	assert.NoError(t, err)
+	torsion, err := new(edwards25519.Point).SetBytes(order2)
+	assert.NoError(t, err)
+	for _, p := range [][]byte{order2, mixed.Add(mixed, torsion).Bytes()} {
+		_, err = g.scalarMult(p, big.NewInt(3))
+		assert.Error(t, err)
+		_, err = g.add(base, p)
+		assert.Error(t, err)
+		_, err = g.publicKey(p)
+		assert.Error(t, err)
+	}
+}
+
+// listenTCP starts authenticated TCP transports for n participants and connects them to each other
+func listenTCP(t *testing.T, n int) ([]*TCPTransport, map[int]Peer) {
+	transports := make([]*TCPTransport, n)
+	peers := make(map[int]Peer, n)
+	for i := 1; i <= n; i++ {
+		identity, err := NewIdentity()
+		assert.NoError(t, err)
+		tcp, err := ListenTCP(i, "127.0.0.1:0", identity)
+		assert.NoError(t, err)
+		t.Cleanup(func() { tcp.Close() })
+		transports[i-1] = tcp
+		peers[i] = Peer{Addr: tcp.Addr().String(), PublicKey: identity.Leaf.PublicKey}
+	}
+	for _, tr := range transports {
+		tr.SetPeers(peers)
+	}
+	return transports, peers
+}
+
+func TestTCPDKG(t *testing.T) {
+	const n = 3
+
+	tcp, _ := listenTCP(t, n)
+	transports := make([]Transport, n)
+	for i, tr := range tcp {
+		transports[i] = tr
+	}
+	results := runSession(t, CurveEd25519, n, 2, transports)
+	assertConsistent(t, CurveEd25519, results, 2)
+}
+
+func TestTCPTransportAuthenticatesPeers(t *testing.T) {
+	tcp, peers := listenTCP(t, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Participant 2 cannot send messages as participant 3
+	assert.NoError(t, tcp[1].Send(&Message{Session: "s", Type: MessageComplaints, From: 3, To: 1}))
+	assert.NoError(t, tcp[1].Send(&Message{Session: "s", Type: MessageComplaints, From: 2, To: 1}))
+	msg, err := tcp[0].Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, msg.From)
+
+	// A transport with an identity the participants do not know is refused, and a participant whose key
+	// does not match is not dialed
+	identity, err := NewIdentity()
+	assert.NoError(t, err)
+	intruder, err := ListenTCP(3, "127.0.0.1:0", identity)
+	assert.NoError(t, err)
+	defer intruder.Close()
+	intruder.SetPeers(peers)
+	assert.NoError(t, intruder.Send(&Message{Session: "s", Type: MessageComplaints, From: 3, To: 1}))
+	tcp[0].SetPeers(map[int]Peer{2: {Addr: intruder.Addr().String(), PublicKey: peers[2].PublicKey}})
+	assert.Error(t, tcp[0].Send(&Message{Session: "s", Type: MessageComplaints, From: 1, To: 2}))
+
+	short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = tcp[0].Receive(short)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = ListenTCP(1, "127.0.0.1:0", tls.Certificate{})
+	assert.Error(t, err)
+}
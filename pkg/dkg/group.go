@@ -0,0 +1,222 @@
+package dkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"filippo.io/edwards25519"
+	"filippo.io/nistec"
+)
+
+// Curve selects the group the distributed key is generated in
+type Curve int
+
+const (
+	// CurveP256 produces an ECDSA P-256 key
+	CurveP256 Curve = iota + 1
+	// CurveEd25519 produces an Ed25519 key
+	CurveEd25519
+)
+
+// String returns the name of the curve
+func (c Curve) String() string {
+	switch c {
+	case CurveP256:
+		return "P-256"
+	case CurveEd25519:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(c))
+	}
+}
+
+// group is the prime-order group arithmetic needed by the protocol; points are passed around encoded
+type group interface {
+	order() *big.Int
+	scalarBaseMult(k *big.Int) []byte
+	scalarMult(p []byte, k *big.Int) ([]byte, error)
+	add(p, q []byte) ([]byte, error)
+	publicKey(p []byte) (crypto.PublicKey, error)
+	hashToPoint(label string) []byte
+}
+
+func newGroup(c Curve) (group, error) {
+	switch c {
+	case CurveP256:
+		return p256Group{}, nil
+	case CurveEd25519:
+		return ed25519Group{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", c)
+	}
+}
+
+// p256Group implements group on the NIST P-256 curve
+type p256Group struct{}
+
+func (p256Group) order() *big.Int {
+	return elliptic.P256().Params().N
+}
+
+func (p256Group) scalarBaseMult(k *big.Int) []byte {
+	point, err := nistec.NewP256Point().ScalarBaseMult(scalarBytes(k, 32))
+	if err != nil {
+		// Scalars are always 32 bytes, the only length nistec accepts
+		panic(fmt.Sprintf("dkg: invalid P-256 scalar: %v", err))
+	}
+	return point.Bytes()
+}
+
+func (p256Group) scalarMult(p []byte, k *big.Int) ([]byte, error) {
+	point, err := nistec.NewP256Point().SetBytes(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid P-256 point: %v", err)
+	}
+	if _, err := point.ScalarMult(point, scalarBytes(k, 32)); err != nil {
+		return nil, fmt.Errorf("invalid P-256 scalar: %v", err)
+	}
+	return point.Bytes(), nil
+}
+
+func (p256Group) add(p, q []byte) ([]byte, error) {
+	a, err := nistec.NewP256Point().SetBytes(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid P-256 point: %v", err)
+	}
+	b, err := nistec.NewP256Point().SetBytes(q)
+	if err != nil {
+		return nil, fmt.Errorf("invalid P-256 point: %v", err)
+	}
+	return a.Add(a, b).Bytes(), nil
+}
+
+func (p256Group) publicKey(p []byte) (crypto.PublicKey, error) {
+	if _, err := nistec.NewP256Point().SetBytes(p); err != nil || len(p) != 65 {
+		return nil, fmt.Errorf("invalid P-256 public key point")
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(p[1:33]),
+		Y:     new(big.Int).SetBytes(p[33:]),
+	}, nil
+}
+
+// hashToPoint derives a point whose discrete logarithm is unknown by trying successive hashes of label as
+// the x-coordinate until one is on the curve
+func (p256Group) hashToPoint(label string) []byte {
+	for counter := uint32(0); ; counter++ {
+		x := hashCounter(label, counter)
+		if point, err := nistec.NewP256Point().SetBytes(append([]byte{2}, x...)); err == nil {
+			return point.Bytes()
+		}
+	}
+}
+
+// ed25519Order is the order of the Ed25519 prime-order subgroup, 2^252 + 27742317777372353535851937790883648493
+var ed25519Order, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// ed25519Group implements group on the Ed25519 prime-order subgroup
+type ed25519Group struct{}
+
+func (ed25519Group) order() *big.Int {
+	return ed25519Order
+}
+
+func (ed25519Group) scalarBaseMult(k *big.Int) []byte {
+	return new(edwards25519.Point).ScalarBaseMult(ed25519Scalar(k)).Bytes()
+}
+
+func (ed25519Group) scalarMult(p []byte, k *big.Int) ([]byte, error) {
+	point, err := ed25519Point(p)
+	if err != nil {
+		return nil, err
+	}
+	return new(edwards25519.Point).ScalarMult(ed25519Scalar(k), point).Bytes(), nil
+}
+
+func (ed25519Group) add(p, q []byte) ([]byte, error) {
+	a, err := ed25519Point(p)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ed25519Point(q)
+	if err != nil {
+		return nil, err
+	}
+	return new(edwards25519.Point).Add(a, b).Bytes(), nil
+}
+
+func (ed25519Group) publicKey(p []byte) (crypto.PublicKey, error) {
+	if _, err := ed25519Point(p); err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(append([]byte(nil), p...)), nil
+}
+
+// hashToPoint derives a point of the prime-order subgroup whose discrete logarithm is unknown by decoding
+// successive hashes of label and clearing the cofactor
+func (ed25519Group) hashToPoint(label string) []byte {
+	for counter := uint32(0); ; counter++ {
+		point, err := new(edwards25519.Point).SetBytes(hashCounter(label, counter))
+		if err != nil {
+			continue
+		}
+		point.MultByCofactor(point)
+		if point.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return point.Bytes()
+	}
+}
+
+// ed25519CofactorInverse is the inverse of the cofactor 8 modulo the Ed25519 group order
+var ed25519CofactorInverse = ed25519Scalar(new(big.Int).ModInverse(big.NewInt(8), ed25519Order))
+
+// ed25519Point decodes a point received from a peer and checks that it lies in the prime-order subgroup. A
+// point P = Q + T with a torsion component T of order dividing 8 satisfies 8 * (8^-1 * P) = Q, which equals
+// P only when T is the identity.
+func ed25519Point(b []byte) (*edwards25519.Point, error) {
+	point, err := new(edwards25519.Point).SetBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 point: %v", err)
+	}
+	check := new(edwards25519.Point).ScalarMult(ed25519CofactorInverse, point)
+	if check.MultByCofactor(check).Equal(point) != 1 {
+		return nil, fmt.Errorf("invalid Ed25519 point: not in the prime-order subgroup")
+	}
+	return point, nil
+}
+
+// hashCounter returns SHA-256 of label followed by a big-endian counter
+func hashCounter(label string, counter uint32) []byte {
+	h := sha256.New()
+	h.Write([]byte(label))
+	binary.Write(h, binary.BigEndian, counter)
+	return h.Sum(nil)
+}
+
+// ed25519Scalar converts a reduced scalar to its little-endian edwards25519 form
+func ed25519Scalar(k *big.Int) *edwards25519.Scalar {
+	be := scalarBytes(k, 32)
+	le := make([]byte, 32)
+	for i := range be {
+		le[i] = be[31-i]
+	}
+	s, err := new(edwards25519.Scalar).SetCanonicalBytes(le)
+	if err != nil {
+		// Scalars are always reduced modulo the group order before reaching here
+		panic(fmt.Sprintf("dkg: non-canonical Ed25519 scalar: %v", err))
+	}
+	return s
+}
+
+// scalarBytes returns k as a fixed-size big-endian byte string
+func scalarBytes(k *big.Int, size int) []byte {
+	return k.FillBytes(make([]byte, size))
+}
@@ -0,0 +1,181 @@
+package dkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Run drives a participant through every protocol round over the given transport. Peers that stay
+// silent for longer than the round timeout, or whose messages are not signed by their identity key, are
+// treated as misbehaving rather than stalling the session.
+// The result is only returned once every qualified participant has confirmed it; otherwise Run fails with
+// ErrDisagreement and the key must not be used.
+func Run(ctx context.Context, p *Participant, t Transport) (*Result, error) {
+	r := &roundReceiver{
+		participant: p,
+		transport:   t,
+		pending:     make(map[MessageType]map[int]*Message),
+	}
+
+	// Round 1: deal commitments and private shares
+	deals, err := p.Deal()
+	if err != nil {
+		return nil, err
+	}
+	if err := sendAll(t, deals); err != nil {
+		return nil, err
+	}
+	received, err := r.collect(ctx, MessageCommitments, MessageShare)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round 2: broadcast complaints about shares that fail verification
+	complaints, err := p.ProcessDeals(received)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Send(complaints); err != nil {
+		return nil, err
+	}
+	received, err = r.collect(ctx, MessageComplaints)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round 3: answer complaints against us by revealing the disputed shares
+	justifications, err := p.ProcessComplaints(received)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Send(justifications); err != nil {
+		return nil, err
+	}
+	received, err = r.collect(ctx, MessageJustifications)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round 4: fix the qualified dealers and publish our Feldman commitments
+	public, err := p.ProcessJustifications(received)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Send(public); err != nil {
+		return nil, err
+	}
+	received, err = r.collect(ctx, MessagePublicCommitments)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round 5: expose dealers whose Feldman commitments do not match the shares they dealt
+	exposures, err := p.ProcessPublicCommitments(received)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Send(exposures); err != nil {
+		return nil, err
+	}
+	received, err = r.collect(ctx, MessageExposures)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round 6: reveal our shares of exposed dealers so their polynomials can be reconstructed
+	reconstruction, err := p.ProcessExposures(received)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Send(reconstruction); err != nil {
+		return nil, err
+	}
+	received, err = r.collect(ctx, MessageReconstruction)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round 7: confirm the result and check that every qualified participant derived the same one
+	confirmation, err := p.ProcessReconstruction(received)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Send(confirmation); err != nil {
+		return nil, err
+	}
+	received, err = r.collect(ctx, MessageConfirmation)
+	if err != nil {
+		return nil, err
+	}
+	return p.ProcessConfirmations(received)
+}
+
+func sendAll(t Transport, msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := t.Send(msg); err != nil {
+			return fmt.Errorf("failed to send %v message: %v", msg.Type, err)
+		}
+	}
+	return nil
+}
+
+// roundReceiver buffers messages that arrive ahead of the round that consumes them
+type roundReceiver struct {
+	participant *Participant
+	transport   Transport
+	pending     map[MessageType]map[int]*Message // Message type to sender to message
+}
+
+// collect waits until every peer has sent a message of each requested type, or the round times out
+func (r *roundReceiver) collect(ctx context.Context, types ...MessageType) ([]*Message, error) {
+	cfg := r.participant.cfg
+	roundCtx, cancel := context.WithTimeout(ctx, cfg.RoundTimeout)
+	defer cancel()
+
+	complete := func() bool {
+		for _, typ := range types {
+			if len(r.pending[typ]) < cfg.Participants-1 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for !complete() {
+		msg, err := r.transport.Receive(roundCtx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				// Round timed out; continue with what arrived
+				break
+			}
+			return nil, err
+		}
+		if msg.Session != cfg.SessionID || msg.From == cfg.Index || msg.From < 1 || msg.From > cfg.Participants {
+			continue
+		}
+		if msg.To != 0 && msg.To != cfg.Index {
+			continue
+		}
+		// Messages not signed by their sender are dropped as if they never arrived
+		if !r.participant.verifySignature(msg) {
+			continue
+		}
+		if r.pending[msg.Type] == nil {
+			r.pending[msg.Type] = make(map[int]*Message)
+		}
+		// Only the first message of each kind from a sender counts
+		if _, seen := r.pending[msg.Type][msg.From]; !seen {
+			r.pending[msg.Type][msg.From] = msg
+		}
+	}
+
+	var msgs []*Message
+	for _, typ := range types {
+		for _, from := range sortedKeys(r.pending[typ]) {
+			msgs = append(msgs, r.pending[typ][from])
+		}
+		delete(r.pending, typ)
+	}
+	return msgs, nil
+}
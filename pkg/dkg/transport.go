@@ -0,0 +1,361 @@
+package dkg
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const handshakeTimeout = 10 * time.Second // Time a connecting peer has to complete the TLS handshake
+
+// ErrTransportClosed is returned by a transport after Close
+var ErrTransportClosed = errors.New("dkg: transport closed")
+
+// Transport delivers protocol messages between participants
+type Transport interface {
+	// Send delivers msg to msg.To, or to every other participant when msg.To is zero
+	Send(msg *Message) error
+	// Receive blocks until a message addressed to this participant arrives
+	Receive(ctx context.Context) (*Message, error)
+	// Close releases the transport's resources
+	Close() error
+}
+
+// localTransport is an in-process transport backed by channels
+type localTransport struct {
+	index   int
+	inboxes []chan *Message // Indexed by participant, slot zero unused
+}
+
+// NewLocalNetwork returns connected in-process transports for participants 1 to n, at index i-1
+func NewLocalNetwork(n int) []Transport {
+	inboxes := make([]chan *Message, n+1)
+	for i := 1; i <= n; i++ {
+		// Every participant sends at most one message of each kind to each peer
+		inboxes[i] = make(chan *Message, 4*n)
+	}
+
+	transports := make([]Transport, n)
+	for i := 1; i <= n; i++ {
+		transports[i-1] = &localTransport{index: i, inboxes: inboxes}
+	}
+	return transports
+}
+
+func (t *localTransport) Send(msg *Message) error {
+	if msg.To != 0 {
+		if msg.To < 1 || msg.To >= len(t.inboxes) {
+			return fmt.Errorf("unknown participant %d", msg.To)
+		}
+		t.inboxes[msg.To] <- msg
+		return nil
+	}
+	for i := 1; i < len(t.inboxes); i++ {
+		if i != t.index {
+			t.inboxes[i] <- msg
+		}
+	}
+	return nil
+}
+
+func (t *localTransport) Receive(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-t.inboxes[t.index]:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *localTransport) Close() error {
+	return nil
+}
+
+// Peer is another participant reachable over TCP
+type Peer struct {
+	Addr      string           // Listening address
+	PublicKey crypto.PublicKey // Public key of the participant's TLS certificate, distributed out of band
+}
+
+// TCPTransport exchanges JSON-encoded messages with peers over mutually authenticated TLS 1.3. Every
+// participant is identified by the public key of its certificate rather than by a CA, and messages are only
+// accepted from the participant whose key authenticated the connection, so Message.From cannot be forged and
+// private shares are encrypted in transit.
+type TCPTransport struct {
+	index       int
+	certificate tls.Certificate
+	listener    net.Listener
+	inbox       chan *Message
+	closed      chan struct{}
+
+	peersMu sync.RWMutex
+	peers   map[int]Peer
+
+	mu    sync.Mutex // Held while dialing, so must not be needed to accept connections
+	conns map[int]*json.Encoder
+
+	openMu sync.Mutex
+	open   []net.Conn
+}
+
+// NewIdentity generates a self-signed ECDSA P-256 certificate identifying a participant. Its public key,
+// certificate.Leaf.PublicKey, must reach the other participants over an authentic channel. A certificate
+// whose private key is an enclave crypto.Signer can be used instead.
+func NewIdentity() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate identity key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "dkg participant"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create identity certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse identity certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// ListenTCP starts accepting messages for participant index on addr, such as "127.0.0.1:0", authenticating
+// with certificate
+func ListenTCP(index int, addr string, certificate tls.Certificate) (*TCPTransport, error) {
+	if len(certificate.Certificate) == 0 || certificate.PrivateKey == nil {
+		return nil, fmt.Errorf("participant %d has no identity certificate", index)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	t := &TCPTransport{
+		index:       index,
+		certificate: certificate,
+		inbox:       make(chan *Message, 1024),
+		closed:      make(chan struct{}),
+		peers:       make(map[int]Peer),
+		conns:       make(map[int]*json.Encoder),
+	}
+	t.listener = tls.NewListener(listener, &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := t.peerByCertificate(rawCerts)
+			return err
+		},
+	})
+	go t.acceptLoop()
+	return t, nil
+}
+
+// Addr returns the address the transport is listening on
+func (t *TCPTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// SetPeers sets the listening address and identity of every other participant. Connections from keys that
+// are not set here are refused.
+func (t *TCPTransport) SetPeers(peers map[int]Peer) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	for i, peer := range peers {
+		if i != t.index {
+			t.peers[i] = peer
+		}
+	}
+}
+
+func (t *TCPTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if msg.To != 0 {
+		return t.sendLocked(msg.To, msg)
+	}
+	t.peersMu.RLock()
+	peers := make([]int, 0, len(t.peers))
+	for i := range t.peers {
+		peers = append(peers, i)
+	}
+	t.peersMu.RUnlock()
+	for _, i := range peers {
+		if err := t.sendLocked(i, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendLocked writes msg to peer, dialing it on first use
+func (t *TCPTransport) sendLocked(peer int, msg *Message) error {
+	enc, ok := t.conns[peer]
+	if !ok {
+		t.peersMu.RLock()
+		known, ok := t.peers[peer]
+		t.peersMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown participant %d", peer)
+		}
+		conn, err := tls.Dial("tcp", known.Addr, &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{t.certificate},
+			// Peers are authenticated by their pinned public key below rather than by a CA and host name
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyPeerKey(rawCerts, known.PublicKey)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to connect to participant %d: %v", peer, err)
+		}
+		if !t.track(conn) {
+			return ErrTransportClosed
+		}
+		enc = json.NewEncoder(conn)
+		t.conns[peer] = enc
+	}
+	if err := enc.Encode(msg); err != nil {
+		delete(t.conns, peer)
+		return fmt.Errorf("failed to send to participant %d: %v", peer, err)
+	}
+	return nil
+}
+
+func (t *TCPTransport) Receive(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-t.inbox:
+		return msg, nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *TCPTransport) Close() error {
+	t.openMu.Lock()
+	defer t.openMu.Unlock()
+
+	select {
+	case <-t.closed:
+		return nil
+	default:
+	}
+	close(t.closed)
+	for _, conn := range t.open {
+		conn.Close()
+	}
+	return t.listener.Close()
+}
+
+func (t *TCPTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !t.track(conn) {
+			return
+		}
+		go t.readLoop(conn.(*tls.Conn))
+	}
+}
+
+// track records a connection to close with the transport, closing it instead if the transport is closed
+func (t *TCPTransport) track(conn net.Conn) bool {
+	t.openMu.Lock()
+	defer t.openMu.Unlock()
+	select {
+	case <-t.closed:
+		conn.Close()
+		return false
+	default:
+	}
+	t.open = append(t.open, conn)
+	return true
+}
+
+// readLoop authenticates a peer and delivers its messages, dropping any that claim to come from another
+// participant
+func (t *TCPTransport) readLoop(conn *tls.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	err := conn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	from, err := t.peerByCertificate([][]byte{conn.ConnectionState().PeerCertificates[0].Raw})
+	if err != nil {
+		return
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		msg := &Message{}
+		if err := dec.Decode(msg); err != nil {
+			return
+		}
+		if msg.From != from {
+			continue
+		}
+		select {
+		case t.inbox <- msg:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+// peerByCertificate returns the index of the participant whose key is in the leaf certificate
+func (t *TCPTransport) peerByCertificate(rawCerts [][]byte) (int, error) {
+	t.peersMu.RLock()
+	defer t.peersMu.RUnlock()
+	for i, peer := range t.peers {
+		if verifyPeerKey(rawCerts, peer.PublicKey) == nil {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("certificate does not belong to a participant")
+}
+
+// verifyPeerKey checks that the leaf certificate holds the expected public key
+func verifyPeerKey(rawCerts [][]byte, expected crypto.PublicKey) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("peer sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("invalid peer certificate: %v", err)
+	}
+	key, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || expected == nil || !key.Equal(expected) {
+		return fmt.Errorf("peer certificate does not hold the participant's key")
+	}
+	return nil
+}
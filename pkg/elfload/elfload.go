@@ -0,0 +1,373 @@
+// Package elfload loads RISC-V ELF programs for the enclave core: it validates the file, places its
+// loadable segments at their virtual addresses, and encrypts each segment into a signed program container
+// for loading over AXI.
+package elfload
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/aesgcm"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+)
+
+const (
+	ProgramHeaderSize = 16 // Size of the encoded program header
+	SegmentHeaderSize = 56 // Size of an encoded segment header
+
+	ivSize  = 12 // AES-GCM nonce size
+	tagSize = 16 // AES-GCM tag size
+
+	maxSegmentSize = 1 << 30 // Largest segment accepted, in memory
+
+	digestContext = "fpga-secure-enclave program v1" // Domain separation for program digests
+)
+
+// ErrInvalidProgram is returned for ELF files the enclave core cannot run
+var ErrInvalidProgram = errors.New("invalid enclave program")
+
+// Segment is a PT_LOAD segment of a program
+type Segment struct {
+	Addr    uint64       // Virtual address of the segment in enclave memory
+	MemSize uint64       // Size in memory; bytes past Data are zero-filled BSS
+	Flags   elf.ProgFlag // Read, write and execute permissions
+	Data    []byte       // Contents from the file
+}
+
+// Program is a validated RISC-V ELF executable
+type Program struct {
+	Class    elf.Class // elf.ELFCLASS32 for RV32 or elf.ELFCLASS64 for RV64
+	Entry    uint64    // Address of the first instruction, passed to the core before ExecuteDecryptedCode
+	Segments []Segment // In ascending address order, without overlaps
+}
+
+// Open reads a RISC-V ELF executable from a file
+func Open(path string) (*Program, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ELF file: %v", err)
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse reads a RISC-V ELF executable. It must be a little-endian RV32 or RV64 executable whose entry point
+// lies in an executable segment.
+func Parse(r io.ReaderAt) (*Program, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProgram, err)
+	}
+	defer f.Close()
+
+	if f.Machine != elf.EM_RISCV {
+		return nil, fmt.Errorf("%w: machine is %v, not RISC-V", ErrInvalidProgram, f.Machine)
+	}
+	if f.Class != elf.ELFCLASS32 && f.Class != elf.ELFCLASS64 {
+		return nil, fmt.Errorf("%w: unsupported class %v", ErrInvalidProgram, f.Class)
+	}
+	if f.Data != elf.ELFDATA2LSB {
+		return nil, fmt.Errorf("%w: RISC-V programs must be little-endian", ErrInvalidProgram)
+	}
+	if f.Type != elf.ET_EXEC {
+		return nil, fmt.Errorf("%w: file type is %v, not an executable", ErrInvalidProgram, f.Type)
+	}
+
+	program := &Program{Class: f.Class, Entry: f.Entry}
+	for i, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		if prog.Filesz > prog.Memsz || prog.Memsz > maxSegmentSize {
+			return nil, fmt.Errorf("%w: segment %d is %d bytes in the file and %d in memory", ErrInvalidProgram, i, prog.Filesz, prog.Memsz)
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, fmt.Errorf("%w: failed to read segment %d: %v", ErrInvalidProgram, i, err)
+		}
+		program.Segments = append(program.Segments, Segment{Addr: prog.Vaddr, MemSize: prog.Memsz, Flags: prog.Flags, Data: data})
+	}
+	slices.SortFunc(program.Segments, func(a, b Segment) int {
+		return cmp.Compare(a.Addr, b.Addr)
+	})
+	if err := program.check(); err != nil {
+		return nil, err
+	}
+	return program, nil
+}
+
+// check checks the layout of a program whose segments are sorted by address: the segments fit in the address
+// space without overlapping, and the entry point lies in an executable segment
+func (p *Program) check() error {
+	if p.Class != elf.ELFCLASS32 && p.Class != elf.ELFCLASS64 {
+		return fmt.Errorf("%w: unsupported class %v", ErrInvalidProgram, p.Class)
+	}
+	if len(p.Segments) == 0 {
+		return fmt.Errorf("%w: no loadable segments", ErrInvalidProgram)
+	}
+	limit := uint64(1<<32 - 1)
+	if p.Class == elf.ELFCLASS64 {
+		limit = ^uint64(0)
+	}
+	for i, seg := range p.Segments {
+		if seg.MemSize == 0 || uint64(len(seg.Data)) > seg.MemSize || seg.MemSize > maxSegmentSize {
+			return fmt.Errorf("%w: segment at 0x%x is %d bytes in the file and %d in memory", ErrInvalidProgram, seg.Addr, len(seg.Data), seg.MemSize)
+		}
+		if seg.Addr > limit-seg.MemSize+1 {
+			return fmt.Errorf("%w: segment at 0x%x overflows the address space", ErrInvalidProgram, seg.Addr)
+		}
+		if i > 0 && seg.Addr-p.Segments[i-1].Addr < p.Segments[i-1].MemSize {
+			return fmt.Errorf("%w: segments at 0x%x and 0x%x overlap", ErrInvalidProgram, p.Segments[i-1].Addr, seg.Addr)
+		}
+	}
+	entry := p.segmentAt(p.Entry)
+	if entry == nil || entry.Flags&elf.PF_X == 0 {
+		return fmt.Errorf("%w: entry point 0x%x is not in an executable segment", ErrInvalidProgram, p.Entry)
+	}
+	return nil
+}
+
+// segmentAt returns the segment containing an address, if any
+func (p *Program) segmentAt(addr uint64) *Segment {
+	for i := range p.Segments {
+		seg := &p.Segments[i]
+		if addr >= seg.Addr && addr-seg.Addr < seg.MemSize {
+			return seg
+		}
+	}
+	return nil
+}
+
+// EncryptedSegment is a segment encrypted with AES-256-GCM under the image key. Its header is authenticated
+// with the contents, along with the program digest and its index, so a segment cannot be moved, resized,
+// given other permissions, reordered or spliced into another program.
+type EncryptedSegment struct {
+	Addr       uint64
+	MemSize    uint64
+	Flags      elf.ProgFlag
+	IV         [ivSize]byte
+	Tag        [tagSize]byte
+	Ciphertext []byte // Encrypted file contents; BSS is not encrypted
+}
+
+// EncryptedProgram is a program whose segments are encrypted under the image key
+type EncryptedProgram struct {
+	Class    elf.Class
+	Entry    uint64
+	Segments []*EncryptedSegment // In ascending address order, without overlaps
+}
+
+// Encrypt encrypts each segment with AES-256-GCM under a fresh IV
+func (p *Program) Encrypt(key []byte) (*EncryptedProgram, error) {
+	aead, err := aesgcm.New(key)
+	if err != nil {
+		return nil, err
+	}
+	program := &EncryptedProgram{Class: p.Class, Entry: p.Entry, Segments: make([]*EncryptedSegment, len(p.Segments))}
+	for i, seg := range p.Segments {
+		program.Segments[i] = &EncryptedSegment{Addr: seg.Addr, MemSize: seg.MemSize, Flags: seg.Flags, Ciphertext: seg.Data}
+	}
+	digest := program.Digest()
+	for i, seg := range p.Segments {
+		enc := program.Segments[i]
+		if _, err := rand.Read(enc.IV[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate IV: %v", err)
+		}
+		sealed := aead.Seal(nil, enc.IV[:], seg.Data, program.aad(digest, i))
+		enc.Ciphertext = sealed[:len(seg.Data)]
+		copy(enc.Tag[:], sealed[len(seg.Data):])
+	}
+	return program, nil
+}
+
+// Build encrypts the program with the image key of b and returns it signed by the vendor key in a container
+// marked with container.FlagProgram. The container's load address and entry point are set from the program.
+func (p *Program) Build(b container.Builder) ([]byte, error) {
+	program, err := p.Encrypt(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	b.LoadAddress = p.Segments[0].Addr
+	b.EntryPoint = p.Entry
+	return b.BuildProgram(program.Marshal())
+}
+
+// FromContainer returns the program in a container built by Build, checking that its segment table is valid
+// and agrees with the container header. The vendor signature is checked by container.Verify.
+func FromContainer(c *container.Container) (*EncryptedProgram, error) {
+	if !c.IsProgram() {
+		return nil, fmt.Errorf("%w: container does not hold a program", ErrInvalidProgram)
+	}
+	program, err := Unmarshal(c.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if program.Entry != c.Header.EntryPoint || program.Segments[0].Addr != c.Header.LoadAddress {
+		return nil, fmt.Errorf("%w: container header does not match the segment table", ErrInvalidProgram)
+	}
+	return program, nil
+}
+
+// Unmarshal decodes and validates a program encoded by Marshal
+func Unmarshal(b []byte) (*EncryptedProgram, error) {
+	if len(b) < ProgramHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than the program header", ErrInvalidProgram, len(b))
+	}
+	count := binary.LittleEndian.Uint32(b)
+	if count == 0 || uint64(count) > uint64(len(b)-ProgramHeaderSize)/SegmentHeaderSize {
+		return nil, fmt.Errorf("%w: invalid segment count %d", ErrInvalidProgram, count)
+	}
+	if !bytes.Equal(b[5:8], make([]byte, 3)) {
+		return nil, fmt.Errorf("%w: reserved fields are set", ErrInvalidProgram)
+	}
+	program := &EncryptedProgram{Class: elf.Class(b[4]), Entry: binary.LittleEndian.Uint64(b[8:])}
+
+	table := b[ProgramHeaderSize : ProgramHeaderSize+int(count)*SegmentHeaderSize]
+	offset := uint64(ProgramHeaderSize) + uint64(len(table))
+	for i := range int(count) {
+		header := table[i*SegmentHeaderSize : (i+1)*SegmentHeaderSize]
+		if !bytes.Equal(header[52:], make([]byte, 4)) {
+			return nil, fmt.Errorf("%w: reserved fields of segment %d are set", ErrInvalidProgram, i)
+		}
+		size := uint64(binary.LittleEndian.Uint32(header[16:]))
+		if size > uint64(len(b))-offset {
+			return nil, fmt.Errorf("%w: segment %d is truncated", ErrInvalidProgram, i)
+		}
+		seg := &EncryptedSegment{
+			Addr:       binary.LittleEndian.Uint64(header),
+			MemSize:    binary.LittleEndian.Uint64(header[8:]),
+			Flags:      elf.ProgFlag(binary.LittleEndian.Uint32(header[20:])),
+			Ciphertext: bytes.Clone(b[offset : offset+size]),
+		}
+		copy(seg.IV[:], header[24:36])
+		copy(seg.Tag[:], header[36:52])
+		program.Segments = append(program.Segments, seg)
+		offset += size
+	}
+	if offset != uint64(len(b)) {
+		return nil, fmt.Errorf("%w: %d bytes follow the last segment", ErrInvalidProgram, uint64(len(b))-offset)
+	}
+
+	// The layout must be one Parse accepts, sorted by address
+	layout := &Program{Class: program.Class, Entry: program.Entry}
+	for _, seg := range program.Segments {
+		layout.Segments = append(layout.Segments, Segment{Addr: seg.Addr, MemSize: seg.MemSize, Flags: seg.Flags, Data: seg.Ciphertext})
+	}
+	if !slices.IsSortedFunc(layout.Segments, func(a, b Segment) int { return cmp.Compare(a.Addr, b.Addr) }) {
+		return nil, fmt.Errorf("%w: segments are not in address order", ErrInvalidProgram)
+	}
+	if err := layout.check(); err != nil {
+		return nil, err
+	}
+	return program, nil
+}
+
+// Marshal encodes the program as loaded over AXI, little-endian: a program header, the segment table of one
+// header per segment as encoded by MarshalHeader, and the ciphertext of each segment in order.
+//
+//	Offset  Size  Field
+//	0       4     Number of segments
+//	4       1     Class: 1 for RV32, 2 for RV64
+//	5       3     Reserved
+//	8       8     Entry
+//	16      56n   Segment table
+func (p *EncryptedProgram) Marshal() []byte {
+	b := make([]byte, ProgramHeaderSize, ProgramHeaderSize+len(p.Segments)*SegmentHeaderSize)
+	binary.LittleEndian.PutUint32(b, uint32(len(p.Segments)))
+	b[4] = byte(p.Class)
+	binary.LittleEndian.PutUint64(b[8:], p.Entry)
+	for _, seg := range p.Segments {
+		b = append(b, seg.MarshalHeader()...)
+	}
+	for _, seg := range p.Segments {
+		b = append(b, seg.Ciphertext...)
+	}
+	return b
+}
+
+// Digest returns the SHA-256 digest of the program layout: its class, entry point and the address, sizes and
+// permissions of every segment. It is authenticated with each segment.
+func (p *EncryptedProgram) Digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(digestContext))
+	var b [16]byte
+	b[0] = byte(p.Class)
+	binary.LittleEndian.PutUint64(b[4:], p.Entry)
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(p.Segments)))
+	h.Write(b[:])
+	for _, seg := range p.Segments {
+		h.Write(seg.layout())
+	}
+	return h.Sum(nil)
+}
+
+// Decrypt returns the file contents of segment i, failing if its tag does not verify
+func (p *EncryptedProgram) Decrypt(i int, key []byte) ([]byte, error) {
+	if i < 0 || i >= len(p.Segments) {
+		return nil, fmt.Errorf("segment %d does not exist", i)
+	}
+	aead, err := aesgcm.New(key)
+	if err != nil {
+		return nil, err
+	}
+	s := p.Segments[i]
+	sealed := append(bytes.Clone(s.Ciphertext), s.Tag[:]...)
+	data, err := aead.Open(sealed[:0], s.IV[:], sealed, p.aad(p.Digest(), i))
+	if err != nil {
+		return nil, fmt.Errorf("segment at 0x%x does not verify", s.Addr)
+	}
+	return data, nil
+}
+
+// aad returns the data authenticated with segment i: the program digest, the index and number of segments,
+// and the start of the segment header
+//
+//	Offset  Size  Field
+//	0       32    Program digest
+//	32      4     Index
+//	36      4     Number of segments
+//	40      24    Addr, MemSize, file size and Flags, as in the segment header
+func (p *EncryptedProgram) aad(digest []byte, i int) []byte {
+	b := make([]byte, 40, 64)
+	copy(b, digest)
+	binary.LittleEndian.PutUint32(b[32:], uint32(i))
+	binary.LittleEndian.PutUint32(b[36:], uint32(len(p.Segments)))
+	return append(b, p.Segments[i].layout()...)
+}
+
+// MarshalHeader encodes the segment header in the segment table, little-endian:
+//
+//	Offset  Size  Field
+//	0       8     Addr
+//	8       8     MemSize
+//	16      4     File size, the length of the ciphertext
+//	20      4     Flags
+//	24      12    IV
+//	36      16    Tag
+//	52      4     Reserved
+func (s *EncryptedSegment) MarshalHeader() []byte {
+	b := make([]byte, SegmentHeaderSize)
+	copy(b, s.layout())
+	copy(b[24:36], s.IV[:])
+	copy(b[36:52], s.Tag[:])
+	return b
+}
+
+// layout returns the start of the segment header: its address, sizes and permissions
+func (s *EncryptedSegment) layout() []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint64(b, s.Addr)
+	binary.LittleEndian.PutUint64(b[8:], s.MemSize)
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(s.Ciphertext)))
+	binary.LittleEndian.PutUint32(b[20:], uint32(s.Flags))
+	return b
+}
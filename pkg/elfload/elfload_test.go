@@ -0,0 +1,211 @@
+package elfload
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSegment describes a PT_LOAD segment of a test ELF file
+type testSegment struct {
+	addr    uint64
+	data    []byte
+	memSize uint64
+	flags   elf.ProgFlag
+}
+
+// testELF builds a little-endian ELF executable
+func testELF(class elf.Class, machine elf.Machine, typ elf.Type, entry uint64, segments []testSegment) []byte {
+	var buf bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(class), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	if class == elf.ELFCLASS64 {
+		offset := uint64(64 + 56*len(segments))
+		binary.Write(&buf, binary.LittleEndian, elf.Header64{
+			Ident: ident, Type: uint16(typ), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT),
+			Entry: entry, Phoff: 64, Ehsize: 64, Phentsize: 56, Phnum: uint16(len(segments)),
+		})
+		for _, seg := range segments {
+			binary.Write(&buf, binary.LittleEndian, elf.Prog64{
+				Type: uint32(elf.PT_LOAD), Flags: uint32(seg.flags), Off: offset, Vaddr: seg.addr, Paddr: seg.addr,
+				Filesz: uint64(len(seg.data)), Memsz: seg.memSize, Align: 4,
+			})
+			offset += uint64(len(seg.data))
+		}
+	} else {
+		offset := uint32(52 + 32*len(segments))
+		binary.Write(&buf, binary.LittleEndian, elf.Header32{
+			Ident: ident, Type: uint16(typ), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT),
+			Entry: uint32(entry), Phoff: 52, Ehsize: 52, Phentsize: 32, Phnum: uint16(len(segments)),
+		})
+		for _, seg := range segments {
+			binary.Write(&buf, binary.LittleEndian, elf.Prog32{
+				Type: uint32(elf.PT_LOAD), Flags: uint32(seg.flags), Off: offset, Vaddr: uint32(seg.addr), Paddr: uint32(seg.addr),
+				Filesz: uint32(len(seg.data)), Memsz: uint32(seg.memSize), Align: 4,
+			})
+			offset += uint32(len(seg.data))
+		}
+	}
+	for _, seg := range segments {
+		buf.Write(seg.data)
+	}
+	return buf.Bytes()
+}
+
+// helloSegments are the text and data segments of a test program; data is followed by 8 bytes of BSS
+var helloSegments = []testSegment{
+	{addr: 0x8000_1000, data: []byte("data"), memSize: 12, flags: elf.PF_R | elf.PF_W},
+	{addr: 0x8000_0000, data: []byte("text"), memSize: 4, flags: elf.PF_R | elf.PF_X},
+}
+
+func TestParse(t *testing.T) {
+	for _, class := range []elf.Class{elf.ELFCLASS32, elf.ELFCLASS64} {
+		program, err := Parse(bytes.NewReader(testELF(class, elf.EM_RISCV, elf.ET_EXEC, 0x8000_0000, helloSegments)))
+		assert.NoError(t, err, class)
+		assert.Equal(t, class, program.Class)
+		assert.Equal(t, uint64(0x8000_0000), program.Entry)
+
+		// Segments are sorted by address
+		assert.Len(t, program.Segments, 2)
+		assert.Equal(t, Segment{Addr: 0x8000_0000, MemSize: 4, Flags: elf.PF_R | elf.PF_X, Data: []byte("text")}, program.Segments[0])
+		assert.Equal(t, Segment{Addr: 0x8000_1000, MemSize: 12, Flags: elf.PF_R | elf.PF_W, Data: []byte("data")}, program.Segments[1])
+	}
+}
+
+func TestParseRejected(t *testing.T) {
+	text := testSegment{addr: 0x1000, data: []byte("text"), memSize: 4, flags: elf.PF_R | elf.PF_X}
+	cases := map[string][]byte{
+		"not ELF":        []byte("hello"),
+		"x86-64":         testELF(elf.ELFCLASS64, elf.EM_X86_64, elf.ET_EXEC, 0x1000, []testSegment{text}),
+		"relocatable":    testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_REL, 0x1000, []testSegment{text}),
+		"no segments":    testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, 0x1000, nil),
+		"entry outside":  testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, 0x2000, []testSegment{text}),
+		"entry in data":  testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, 0x1000, []testSegment{{addr: 0x1000, data: []byte("data"), memSize: 4, flags: elf.PF_R}}),
+		"file > memory":  testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, 0x1000, []testSegment{{addr: 0x1000, data: []byte("text"), memSize: 2, flags: elf.PF_X}}),
+		"overlapping":    testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, 0x1000, []testSegment{text, {addr: 0x1002, data: []byte("data"), memSize: 4, flags: elf.PF_R}}),
+		"address wraps":  testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, ^uint64(0)-1, []testSegment{{addr: ^uint64(0) - 1, data: []byte("text"), memSize: 4, flags: elf.PF_X}}),
+		"RV32 past 4GiB": testELF(elf.ELFCLASS32, elf.EM_RISCV, elf.ET_EXEC, 0xFFFF_FFFE, []testSegment{{addr: 0xFFFF_FFFE, data: []byte("text"), memSize: 4, flags: elf.PF_X}}),
+	}
+	for name, data := range cases {
+		_, err := Parse(bytes.NewReader(data))
+		assert.ErrorIs(t, err, ErrInvalidProgram, name)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	program, err := Parse(bytes.NewReader(testELF(elf.ELFCLASS32, elf.EM_RISCV, elf.ET_EXEC, 0x8000_0000, helloSegments)))
+	assert.NoError(t, err)
+	key := bytes.Repeat([]byte{7}, 32)
+	encrypted, err := program.Encrypt(key)
+	assert.NoError(t, err)
+	assert.Len(t, encrypted.Segments, 2)
+
+	for i, seg := range encrypted.Segments {
+		assert.Equal(t, program.Segments[i].Addr, seg.Addr)
+		assert.NotEqual(t, program.Segments[i].Data, seg.Ciphertext)
+		data, err := encrypted.Decrypt(i, key)
+		assert.NoError(t, err)
+		assert.Equal(t, program.Segments[i].Data, data)
+
+		header := seg.MarshalHeader()
+		assert.Len(t, header, SegmentHeaderSize)
+		assert.Equal(t, seg.Addr, binary.LittleEndian.Uint64(header))
+		assert.Equal(t, seg.Tag[:], header[36:52])
+	}
+
+	// Segments cannot be moved, have their permissions changed, or be reordered
+	modified := func(modify func(p *EncryptedProgram)) *EncryptedProgram {
+		p, err := Unmarshal(encrypted.Marshal())
+		assert.NoError(t, err)
+		modify(p)
+		return p
+	}
+	for name, p := range map[string]*EncryptedProgram{
+		"moved":     modified(func(p *EncryptedProgram) { p.Segments[0].Addr += 0x100 }),
+		"writable":  modified(func(p *EncryptedProgram) { p.Segments[0].Flags |= elf.PF_W }),
+		"entry":     modified(func(p *EncryptedProgram) { p.Entry += 2 }),
+		"swapped":   modified(func(p *EncryptedProgram) { p.Segments[0], p.Segments[1] = p.Segments[1], p.Segments[0] }),
+		"truncated": modified(func(p *EncryptedProgram) { p.Segments = p.Segments[:1] }),
+	} {
+		_, err = p.Decrypt(0, key)
+		assert.Error(t, err, name)
+	}
+
+	// Nor spliced from a program with another layout under the same key
+	program.Segments[0].Flags |= elf.PF_W
+	other, err := program.Encrypt(key)
+	assert.NoError(t, err)
+	spliced := modified(func(p *EncryptedProgram) { p.Segments[1] = other.Segments[1] })
+	_, err = spliced.Decrypt(1, key)
+	assert.Error(t, err)
+
+	_, err = encrypted.Decrypt(0, make([]byte, 32))
+	assert.Error(t, err)
+	_, err = encrypted.Decrypt(2, key)
+	assert.Error(t, err)
+	_, err = program.Encrypt(key[:16])
+	assert.Error(t, err)
+}
+
+func TestBuild(t *testing.T) {
+	program, err := Parse(bytes.NewReader(testELF(elf.ELFCLASS64, elf.EM_RISCV, elf.ET_EXEC, 0x8000_0000, helloSegments)))
+	assert.NoError(t, err)
+	_, vendorKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key := bytes.Repeat([]byte{7}, 32)
+	data, err := program.Build(container.Builder{Family: "hello", ImageVersion: 3, Key: key, Signer: vendorKey})
+	assert.NoError(t, err)
+
+	// The container is signed and carries the entry point and the lowest segment address
+	c, err := container.Parse(data)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Verify(vendorKey.Public()))
+	assert.True(t, c.IsProgram())
+	assert.Equal(t, uint64(0x8000_0000), c.Header.EntryPoint)
+	assert.Equal(t, uint64(0x8000_0000), c.Header.LoadAddress)
+
+	encrypted, err := FromContainer(c)
+	assert.NoError(t, err)
+	assert.Equal(t, elf.ELFCLASS64, encrypted.Class)
+	for i := range program.Segments {
+		data, err := encrypted.Decrypt(i, key)
+		assert.NoError(t, err)
+		assert.Equal(t, program.Segments[i].Data, data)
+	}
+
+	// The segment table must match the header and be a valid layout
+	c.Header.EntryPoint += 4
+	_, err = FromContainer(c)
+	assert.ErrorIs(t, err, ErrInvalidProgram)
+	payload := encrypted.Marshal()
+	cases := map[string][]byte{
+		"short":     payload[:ProgramHeaderSize-1],
+		"no table":  payload[:ProgramHeaderSize],
+		"truncated": payload[:len(payload)-1],
+		"extended":  append(bytes.Clone(payload), 0),
+		"reserved":  append(append(bytes.Clone(payload[:5]), 1), payload[6:]...),
+		"class":     append(append(bytes.Clone(payload[:4]), 3), payload[5:]...),
+		"unsorted": func() []byte {
+			b := bytes.Clone(payload)
+			first := bytes.Clone(b[ProgramHeaderSize : ProgramHeaderSize+SegmentHeaderSize])
+			copy(b[ProgramHeaderSize:], b[ProgramHeaderSize+SegmentHeaderSize:ProgramHeaderSize+2*SegmentHeaderSize])
+			copy(b[ProgramHeaderSize+SegmentHeaderSize:], first)
+			return b
+		}(),
+	}
+	for name, payload := range cases {
+		_, err := Unmarshal(payload)
+		assert.ErrorIs(t, err, ErrInvalidProgram, name)
+	}
+	code, err := (&container.Builder{Family: "hello", LoadAddress: 0x1000, EntryPoint: 0x1000, Key: key, Signer: vendorKey}).Build([]byte("code"))
+	assert.NoError(t, err)
+	c, err = container.Parse(code)
+	assert.NoError(t, err)
+	_, err = FromContainer(c)
+	assert.ErrorIs(t, err, ErrInvalidProgram)
+}
@@ -1,38 +1,37 @@
 package enclave
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 
-	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/aesgcm"
 )
 
-// InitializeAESKey generates a random AES-256 key and loads it into the FPGA
-func InitializeAESKey(mappedMem []byte) ([]byte, error) {
+// ErrCodeIntegrity is returned when encrypted code fails authentication
+var ErrCodeIntegrity = errors.New("code failed integrity check")
+
+// generateAESKey generates a random AES-256 key
+func generateAESKey() ([]byte, error) {
 	// Generate a random AES-256 key (32 bytes)
 	aesKey := make([]byte, keySize)
 	_, err := rand.Read(aesKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate AES key: %v", err)
 	}
-
-	// Load the AES key into FPGA memory using the AXI interface
-	err = fpga.LoadKeyToFPGA(aesKey, 0x1000, mappedMem)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AES key to FPGA: %v", err)
-	}
-
-	fmt.Println("AES-256 key successfully loaded into the FPGA")
 	return aesKey, nil
 }
 
 // AESEncrypt encrypts data using AES-256 in CTR mode
-func AESEncrypt(plaintext []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+func AESEncrypt(plaintext []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	key, err := keyStore.activeKey(keyID, AlgorithmAES256, Usage{Operation: OperationEncrypt})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load AES key into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.AESKey, 0x1000, nil)
+	err = keyStore.loadFullKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AES key: %v", err)
 	}
@@ -41,14 +40,18 @@ func AESEncrypt(plaintext []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
 	ciphertext := make([]byte, len(plaintext)) // Placeholder for encrypted data
 	copy(ciphertext, plaintext)                // Just copying for now
 
-	fmt.Println("Performing AES encryption")
 	return ciphertext, nil
 }
 
 // AESDecrypt decrypts data using AES-256 in CTR mode
-func AESDecrypt(ciphertext []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+func AESDecrypt(ciphertext []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	key, err := keyStore.activeKey(keyID, AlgorithmAES256, Usage{Operation: OperationDecrypt})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load AES key into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.AESKey, 0x1000, nil)
+	err = keyStore.loadFullKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AES key: %v", err)
 	}
@@ -57,28 +60,42 @@ func AESDecrypt(ciphertext []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
 	plaintext := make([]byte, len(ciphertext)) // Placeholder for decrypted data
 	copy(plaintext, ciphertext)                // Just copying for now
 
-	fmt.Println("Performing AES decryption")
 	return plaintext, nil
 }
 
-// EncryptCodeAES encrypts the code using AES-256 in CTR mode
+// EncryptCodeAES encrypts the code using AES-256-GCM, returning the ciphertext with the 16-byte tag appended
+// and the 12-byte IV. The enclave's tag unit, aes256_gcm_tag, checks the tag over the whole image before
+// any instruction is executed.
 func EncryptCodeAES(code []byte, key []byte) ([]byte, []byte, error) {
-	// Create AES block cipher
-	block, err := aes.NewCipher(key)
+	if len(key) != keySize {
+		return nil, nil, fmt.Errorf("code key must be %d bytes, not %d", keySize, len(key))
+	}
+	aead, err := aesgcm.New(key)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create AES cipher: %v", err)
+		return nil, nil, err
 	}
 
 	// Generate a random IV
-	iv := make([]byte, aes.BlockSize)
+	iv := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return nil, nil, fmt.Errorf("failed to generate IV: %v", err)
 	}
 
-	// Encrypt the code using AES in CTR mode
-	stream := cipher.NewCTR(block, iv)
-	ciphertext := make([]byte, len(code))
-	stream.XORKeyStream(ciphertext, code)
+	return aead.Seal(nil, iv, code, nil), iv, nil
+}
 
-	return ciphertext, iv, nil
+// DecryptCodeAES decrypts code encrypted by EncryptCodeAES, failing with ErrCodeIntegrity if it was modified
+func DecryptCodeAES(ciphertext []byte, iv []byte, key []byte) ([]byte, error) {
+	aead, err := aesgcm.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("IV must be %d bytes, not %d", aead.NonceSize(), len(iv))
+	}
+	code, err := aead.Open(nil, iv, ciphertext, nil)
+	if err != nil {
+		return nil, ErrCodeIntegrity
+	}
+	return code, nil
 }
@@ -0,0 +1,230 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/elfload"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+)
+
+// ErrNoImage is returned when a quote is requested before an image is loaded
+var ErrNoImage = errors.New("no enclave image is loaded")
+
+// LoadImage loads a signed image container for the rocket_chip_enclave over AXI at axiOffset of mappedMem
+// and records its measurement for attestation quotes. The image is decrypted inside the FPGA with the
+// AES key imageKeyID, which must not be exportable, so the image key never exists on the host. Images not
+// signed by the vendor key, whose tag does not verify under the image key, or older than the installed
+// version of their family, are refused. Images are measured as ciphertext along with their IV and header.
+func (ks *EnclaveKeyStore) LoadImage(image *container.Container, vendorKey crypto.PublicKey, imageKeyID string, mappedMem []byte, axiOffset uint32) error {
+	if image.IsProgram() {
+		return fmt.Errorf("%w: container holds an ELF program; load it with LoadProgram", container.ErrInvalidContainer)
+	}
+	return ks.loadContainer(image, vendorKey, imageKeyID, mappedMem, axiOffset)
+}
+
+// LoadProgram loads a signed ELF program container built by elfload.Program.Build, as LoadImage loads an
+// image: programs not signed by the vendor key, whose segment table is invalid, or older than the installed
+// version of their family, are refused, and the FPGA checks each segment's tag with the image key. Programs
+// are measured as their segment table and encrypted segments along with their header.
+func (ks *EnclaveKeyStore) LoadProgram(program *container.Container, vendorKey crypto.PublicKey, imageKeyID string, mappedMem []byte, axiOffset uint32) error {
+	if !program.IsProgram() {
+		return fmt.Errorf("%w: container does not hold an ELF program; load it with LoadImage", container.ErrInvalidContainer)
+	}
+	return ks.loadContainer(program, vendorKey, imageKeyID, mappedMem, axiOffset)
+}
+
+// loadContainer checks the version of an image or program, loads it, measures it and advances the version
+// of its family
+func (ks *EnclaveKeyStore) loadContainer(image *container.Container, vendorKey crypto.PublicKey, imageKeyID string, mappedMem []byte, axiOffset uint32) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	if err := ks.checkVersionLocked(image.Header.Family, image.Header.ImageVersion); err != nil {
+		return err
+	}
+	if err := ks.loadImageLocked(image, vendorKey, imageKeyID, mappedMem, axiOffset); err != nil {
+		return err
+	}
+	measurement, err := ks.measureImageLocked(image)
+	if err != nil {
+		return err
+	}
+	if err := ks.advanceVersionLocked(image.Header.Family, image.Header.ImageVersion); err != nil {
+		return err
+	}
+
+	return ks.auditLocked(AuditEvent{Type: "image.load", Details: imageDetails(image, measurement)})
+}
+
+// loadImageLocked checks the signature of an image, and the segment table of a program, on the host, writes
+// it to FPGA memory and points the FPGA at the slot of the image key, which checks the tags with it. Tag failures match
+// fpga.ErrIntegrityFailure.
+func (ks *EnclaveKeyStore) loadImageLocked(image *container.Container, vendorKey crypto.PublicKey, imageKeyID string, mappedMem []byte, axiOffset uint32) error {
+	key, err := ks.activeKeyLocked(imageKeyID, AlgorithmAES256, Usage{Operation: OperationDecrypt})
+	if err != nil {
+		return err
+	}
+	if key.handle.Exportable {
+		return fmt.Errorf("image key %s is exportable; import it with ImportWrappedKey", imageKeyID)
+	}
+	if err := image.Verify(vendorKey); err != nil {
+		return err
+	}
+	if image.IsProgram() {
+		if _, err := elfload.FromContainer(image); err != nil {
+			return err
+		}
+	}
+	if err := fpga.LoadEncryptedCode(image.Header.Marshal(), image.Ciphertext, axiOffset, mappedMem); err != nil {
+		return fmt.Errorf("failed to load image to FPGA: %w", err)
+	}
+	if err := fpga.SelectImageKey(uint32(key.handle.Slot), imageKeyOffset, ks.mappedMem); err != nil {
+		return err
+	}
+	if err := ks.device.checkImage(key.handle.Slot, image, axiOffset); err != nil {
+		return fmt.Errorf("failed to load image to FPGA: %w", err)
+	}
+	return nil
+}
+
+// measureImageLocked records an image as the loaded image and extends the measurement registers and
+// device identity with it, before it can run
+func (ks *EnclaveKeyStore) measureImageLocked(image *container.Container) ([]byte, error) {
+	if err := ks.resetImageLocked(); err != nil {
+		return nil, err
+	}
+	measured := image.Image()
+	measurement := measured.Measure()
+	ks.image = measurement
+
+	configDigest := sha256.Sum256(measured.Config)
+	if err := ks.extendLocked(attest.RegisterImage, measurement, "image"); err != nil {
+		return nil, err
+	}
+	if err := ks.extendLocked(attest.RegisterConfig, configDigest[:], "image config"); err != nil {
+		return nil, err
+	}
+	if err := ks.extendIdentityLocked(measurement); err != nil {
+		return nil, err
+	}
+	return measurement, nil
+}
+
+// resetImageLocked forgets the loaded image as the enclave core does when it boots another one: the image
+// and image config registers return to zero, their extensions leave the measurement log so that it still
+// replays to the registers, and the DICE layer of the image is discarded
+func (ks *EnclaveKeyStore) resetImageLocked() error {
+	if ks.image == nil && len(ks.identity) <= 1 {
+		return nil
+	}
+	ks.image = nil
+	for _, index := range []int{attest.RegisterImage, attest.RegisterConfig} {
+		if err := ks.device.resetRegister(index); err != nil {
+			return fmt.Errorf("failed to reset measurement register %d: %v", index, err)
+		}
+	}
+	ks.measurements = slices.DeleteFunc(ks.measurements, func(event attest.MeasurementEvent) bool {
+		return event.Register == attest.RegisterImage || event.Register == attest.RegisterConfig
+	})
+	if len(ks.identity) > 1 {
+		if err := ks.device.truncateIdentity(1); err != nil {
+			return fmt.Errorf("failed to discard image identity: %v", err)
+		}
+		ks.identity = ks.identity[:1]
+	}
+	return ks.auditLocked(AuditEvent{Type: "register.reset", Details: map[string]any{
+		"registers": []int{attest.RegisterImage, attest.RegisterConfig},
+	}})
+}
+
+// imageDetails returns the audit details of an image
+func imageDetails(image *container.Container, measurement []byte) map[string]any {
+	return map[string]any{
+		"measurement": hex.EncodeToString(measurement),
+		"family":      image.Header.Family,
+		"version":     image.Header.ImageVersion,
+		"entry_point": image.Header.EntryPoint,
+		"size":        image.Header.Size,
+		"program":     image.IsProgram(),
+	}
+}
+
+// Measurement returns the measurement of the loaded image
+func (ks *EnclaveKeyStore) Measurement() ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.image == nil {
+		return nil, ErrNoImage
+	}
+	return append([]byte(nil), ks.image...), nil
+}
+
+// AttestationPublicKey returns the key that signs quotes: the identity key of the top DICE layer, which
+// changes with every loaded image
+func (ks *EnclaveKeyStore) AttestationPublicKey() (crypto.PublicKey, error) {
+	chain, err := ks.IdentityChain()
+	if err != nil {
+		return nil, err
+	}
+	return chain[len(chain)-1].PublicKey, nil
+}
+
+// Quote has the top DICE layer's identity key sign the measurement of the loaded image and the measurement
+// registers along with a verifier's nonce, which must be between 8 and 64 bytes. The quote carries the
+// DICE certificate chain.
+func (ks *EnclaveKeyStore) Quote(nonce []byte) (*attest.Quote, error) {
+	if len(nonce) < attest.MinNonceSize || len(nonce) > attest.MaxNonceSize {
+		return nil, fmt.Errorf("nonce must be %d to %d bytes, not %d", attest.MinNonceSize, attest.MaxNonceSize, len(nonce))
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	if ks.image == nil {
+		return nil, ErrNoImage
+	}
+	registers, err := ks.device.readRegisters()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read measurement registers: %v", err)
+	}
+	quote := &attest.Quote{
+		Version:     attest.QuoteVersion,
+		Measurement: append([]byte(nil), ks.image...),
+		Registers:   registers,
+		Versions:    maps.Clone(ks.versions),
+		Nonce:       append([]byte(nil), nonce...),
+		Time:        policyClock().UTC(),
+	}
+	signature, err := ks.device.signIdentity(quote.Digest())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign quote: %v", err)
+	}
+	quote.Signature = signature
+	for _, cert := range ks.identity {
+		quote.Certificates = append(quote.Certificates, cert.Raw)
+	}
+
+	err = ks.auditLocked(AuditEvent{Type: "attest.quote", Details: map[string]any{
+		"measurement": hex.EncodeToString(quote.Measurement),
+		"nonce":       hex.EncodeToString(nonce),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
@@ -0,0 +1,158 @@
+package enclave
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"debug/elf"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/elfload"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/stretchr/testify/assert"
+)
+
+// testVendorKey signs test images
+var testVendorKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+// buildTestImage encrypts and signs code into a test image container of the given family and version
+func buildTestImage(t *testing.T, family string, version uint32, code []byte) *container.Container {
+	builder := &container.Builder{Family: family, ImageVersion: version, LoadAddress: 0x8000_0000, EntryPoint: 0x8000_0000, Key: make([]byte, keySize), Signer: testVendorKey}
+	data, err := builder.Build(code)
+	assert.NoError(t, err)
+	image, err := container.Parse(data)
+	assert.NoError(t, err)
+	return image
+}
+
+// importImageKey unwraps the all-zero key test images are encrypted with into the FPGA, returning its ID
+func importImageKey(t *testing.T, keyStore *EnclaveKeyStore) string {
+	if key, err := keyStore.KeyByLabel("image"); err == nil {
+		return key.ID
+	}
+	transport, err := keyStore.TransportKey(TransportECDHP256)
+	assert.NoError(t, err)
+	wrapped, err := WrapKey(transport, "image", make([]byte, keySize))
+	assert.NoError(t, err)
+	key, err := keyStore.ImportWrappedKey(wrapped)
+	assert.NoError(t, err)
+	return key.ID
+}
+
+// loadTestImage builds and loads a test image, returning its measurement
+func loadTestImage(t *testing.T, keyStore *EnclaveKeyStore) []byte {
+	image := buildTestImage(t, "hello", 1, []byte("hello from the enclave"))
+	assert.NoError(t, keyStore.LoadImage(image, testVendorKey.Public(), importImageKey(t, keyStore), make([]byte, 4096), 0))
+	return image.Image().Measure()
+}
+
+func TestQuote(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	nonce := []byte("0123456789abcdef")
+	_, err := keyStore.Quote(nonce)
+	assert.ErrorIs(t, err, ErrNoImage)
+
+	measurement := loadTestImage(t, keyStore)
+	loaded, err := keyStore.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, measurement, loaded)
+
+	// Images that fail verification are not loaded or measured
+	image := buildTestImage(t, "hello", 1, []byte("unsigned"))
+	_, otherVendor, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	imageKey := importImageKey(t, keyStore)
+	err = keyStore.LoadImage(image, otherVendor.Public(), imageKey, make([]byte, 4096), 0)
+	assert.ErrorIs(t, err, container.ErrBadSignature)
+
+	// The FPGA checks the tag with the image key in its slot
+	transport, err := keyStore.TransportKey(TransportECDHP256)
+	assert.NoError(t, err)
+	wrapped, err := WrapKey(transport, "other image", []byte("0123456789abcdef0123456789abcdef"))
+	assert.NoError(t, err)
+	otherKey, err := keyStore.ImportWrappedKey(wrapped)
+	assert.NoError(t, err)
+	err = keyStore.LoadImage(image, testVendorKey.Public(), otherKey.ID, make([]byte, 4096), 0)
+	assert.ErrorIs(t, err, fpga.ErrIntegrityFailure)
+
+	// Image keys the host holds in the clear are refused
+	err = keyStore.LoadImage(image, testVendorKey.Public(), keyID(t, keyStore, DefaultAESKeyLabel), make([]byte, 4096), 0)
+	assert.ErrorContains(t, err, "exportable")
+	loaded, err = keyStore.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, measurement, loaded)
+
+	quote, err := keyStore.Quote(nonce)
+	assert.NoError(t, err)
+	public, err := keyStore.AttestationPublicKey()
+	assert.NoError(t, err)
+	verifier := &attest.Verifier{Key: public, Measurements: [][]byte{measurement}}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+
+	// Loading another image changes what is attested and the key that signs quotes, which verifiers
+	// follow through the device identity certificate
+	deviceID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+	verifier = &attest.Verifier{Roots: roots, Measurements: [][]byte{measurement}}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+	other := loadTestImage(t, keyStore)
+	quote, err = keyStore.Quote(nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, other, quote.Measurement)
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), attest.ErrUnexpectedMeasurement)
+
+	_, err = keyStore.Quote([]byte("short"))
+	assert.Error(t, err)
+	_, err = keyStore.Quote(make([]byte, attest.MaxNonceSize+1))
+	assert.Error(t, err)
+
+	types := eventTypes(log.Events())
+	assert.Contains(t, types, "image.load")
+	assert.Contains(t, types, "attest.quote")
+}
+
+func TestLoadProgram(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	imageKey := importImageKey(t, keyStore)
+	buildProgram := func(version uint32, key []byte) *container.Container {
+		program := &elfload.Program{Class: elf.ELFCLASS64, Entry: 0x8000_0000, Segments: []elfload.Segment{
+			{Addr: 0x8000_0000, MemSize: 4, Flags: elf.PF_R | elf.PF_X, Data: []byte("text")},
+			{Addr: 0x8000_1000, MemSize: 12, Flags: elf.PF_R | elf.PF_W, Data: []byte("data")},
+		}}
+		data, err := program.Build(container.Builder{Family: "hello-elf", ImageVersion: version, Key: key, Signer: testVendorKey})
+		assert.NoError(t, err)
+		image, err := container.Parse(data)
+		assert.NoError(t, err)
+		return image
+	}
+
+	// Programs are measured and their version installed like images
+	program := buildProgram(2, make([]byte, keySize))
+	assert.NoError(t, keyStore.LoadProgram(program, testVendorKey.Public(), imageKey, make([]byte, 4096), 0))
+	measurement, err := keyStore.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, program.Image().Measure(), measurement)
+	assert.Equal(t, uint32(2), keyStore.ImageVersions()["hello-elf"])
+
+	err = keyStore.LoadProgram(buildProgram(1, make([]byte, keySize)), testVendorKey.Public(), imageKey, make([]byte, 4096), 0)
+	assert.ErrorIs(t, err, ErrRollback)
+	_, otherVendor, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	mappedMem := make([]byte, 4096)
+	err = keyStore.LoadProgram(program, otherVendor.Public(), imageKey, mappedMem, 0)
+	assert.ErrorIs(t, err, container.ErrBadSignature)
+	assert.Equal(t, make([]byte, 4096), mappedMem, "unsigned programs are refused before anything is written")
+	err = keyStore.LoadProgram(buildProgram(3, make([]byte, keySize)), testVendorKey.Public(), imageKey, make([]byte, 64), 0)
+	assert.ErrorContains(t, err, "exceeds mapped memory")
+	err = keyStore.LoadProgram(buildProgram(3, []byte("0123456789abcdef0123456789abcdef")), testVendorKey.Public(), imageKey, make([]byte, 4096), 0)
+	assert.ErrorIs(t, err, fpga.ErrIntegrityFailure)
+
+	// Programs and images are not interchangeable
+	err = keyStore.LoadImage(program, testVendorKey.Public(), imageKey, make([]byte, 4096), 0)
+	assert.ErrorIs(t, err, container.ErrInvalidContainer)
+	err = keyStore.LoadProgram(buildTestImage(t, "hello", 1, []byte("code")), testVendorKey.Public(), imageKey, make([]byte, 4096), 0)
+	assert.ErrorIs(t, err, container.ErrInvalidContainer)
+}
@@ -0,0 +1,496 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+)
+
+const (
+	auditCheckpointInterval = 64                            // Events between automatic checkpoints
+	auditCheckpointContext  = "enclave audit checkpoint v1" // Domain separation for checkpoint signatures
+	auditStoragePrefix      = "audit/"                      // Storage prefix of StorageAuditLog events
+)
+
+// ErrAuditLogInvalid is returned when an audit log has been truncated, reordered or edited
+var ErrAuditLogInvalid = errors.New("audit log is invalid")
+
+// AuditEvent records a security-relevant event in the key store. Events form a hash chain: each event's
+// hash covers its contents and the hash of the event before it.
+type AuditEvent struct {
+	Seq      uint64         `json:"seq"`
+	Time     time.Time      `json:"time"`
+	Type     string         `json:"type"`
+	KeyID    string         `json:"key_id,omitempty"`
+	Details  map[string]any `json:"details,omitempty"`
+	PrevHash []byte         `json:"prev_hash,omitempty"` // Empty for the first event
+	Hash     []byte         `json:"hash"`
+}
+
+// AuditCheckpoint is the audit key's signature over the chain up to and including event Seq. Keeping the
+// latest checkpoint outside the log lets a verifier detect events removed from its end.
+type AuditCheckpoint struct {
+	Seq       uint64    `json:"seq"`
+	Hash      []byte    `json:"hash"`
+	Time      time.Time `json:"time"`
+	Signature []byte    `json:"signature"` // ASN.1 ECDSA P-256 signature
+}
+
+// AuditLog receives audit events. Append must be safe for concurrent use.
+type AuditLog interface {
+	Append(event AuditEvent) error
+}
+
+// MemoryAuditLog keeps audit events in memory
+type MemoryAuditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// NewMemoryAuditLog returns an empty in-memory audit log
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{}
+}
+
+// Append adds an event to the log
+func (l *MemoryAuditLog) Append(event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	return nil
+}
+
+// Events returns the events recorded so far
+func (l *MemoryAuditLog) Events() []AuditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditEvent(nil), l.events...)
+}
+
+// DurableAuditLog is an audit log that keeps its events across restarts. SetAuditLog continues the chain
+// from the log's last event instead of starting a new one, so the whole log verifies as one chain.
+type DurableAuditLog interface {
+	AuditLog
+	Head() (seq uint64, hash []byte) // Sequence number and hash of the last event, or zero and nil
+}
+
+// StorageAuditLog keeps audit events in a storage backend, one value per event under its sequence number
+type StorageAuditLog struct {
+	mu      sync.Mutex
+	backend storage.Backend
+	seq     uint64
+	head    []byte
+}
+
+// OpenStorageAuditLog opens the audit log kept in backend, creating it if the backend holds no events.
+// The caller closes the backend.
+func OpenStorageAuditLog(backend storage.Backend) (*StorageAuditLog, error) {
+	keys, err := backend.List(auditStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %v", err)
+	}
+	log := &StorageAuditLog{backend: backend}
+	if len(keys) == 0 {
+		return log, nil
+	}
+	last, err := log.read(keys[len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	if last.Seq != uint64(len(keys)) {
+		return nil, fmt.Errorf("%w: storage holds %d events but the last is event %d", ErrAuditLogInvalid, len(keys), last.Seq)
+	}
+	log.seq, log.head = last.Seq, last.Hash
+	return log, nil
+}
+
+// Append writes an event to storage. Events must be appended in sequence.
+func (l *StorageAuditLog) Append(event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if event.Seq != l.seq+1 {
+		return fmt.Errorf("audit event %d does not follow event %d", event.Seq, l.seq)
+	}
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %v", err)
+	}
+	if err := l.backend.Put(auditStorageKey(event.Seq), encoded); err != nil {
+		return fmt.Errorf("failed to store audit event: %v", err)
+	}
+	l.seq, l.head = event.Seq, event.Hash
+	return nil
+}
+
+// Head returns the sequence number and hash of the last event in the log
+func (l *StorageAuditLog) Head() (uint64, []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.head
+}
+
+// Events reads every event in the log, in order
+func (l *StorageAuditLog) Events() ([]AuditEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys, err := l.backend.List(auditStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %v", err)
+	}
+	events := make([]AuditEvent, 0, len(keys))
+	for _, key := range keys {
+		event, err := l.read(key)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	return events, nil
+}
+
+// read reads a stored event. Numbers in its details are decoded as json.Number, as they were when the event
+// was hashed.
+func (l *StorageAuditLog) read(key string) (*AuditEvent, error) {
+	encoded, err := l.backend.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit event %s: %v", key, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var event AuditEvent
+	if err := decoder.Decode(&event); err != nil {
+		return nil, fmt.Errorf("%w: event %s cannot be decoded: %v", ErrAuditLogInvalid, key, err)
+	}
+	return &event, nil
+}
+
+// auditStorageKey returns the storage key of an event. Sequence numbers are zero-padded so the backend
+// lists events in order.
+func auditStorageKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", auditStoragePrefix, seq)
+}
+
+// auditChain is the head of the key store's audit hash chain
+type auditChain struct {
+	seq     uint64 // Sequence number of the last event
+	head    []byte // Hash of the last event
+	pending int    // Events since the last checkpoint
+}
+
+// SetAuditLog sends the key store's audit events to log, starting a new hash chain with an audit.start
+// event that carries the audit key certificate. A DurableAuditLog's chain is continued from its last event
+// rather than started afresh. A nil log stops auditing. The chain of the log being
+// replaced is first closed with an audit.stop event and a signed checkpoint, and the new chain's
+// audit.start event records the closed chain's last sequence number and hash. If the old chain cannot be
+// closed, the log is not replaced.
+func (ks *EnclaveKeyStore) SetAuditLog(log AuditLog) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		if log == nil {
+			return nil
+		}
+		return ErrKeyStoreDestroyed
+	}
+	previous := ks.audit
+	if ks.auditLog != nil {
+		if err := ks.auditLocked(AuditEvent{Type: "audit.stop"}); err != nil {
+			return err
+		}
+		if _, err := ks.checkpointLocked(); err != nil {
+			return err
+		}
+		previous = ks.audit
+	}
+
+	// The closed chain's head is kept while auditing is stopped, so the next chain can link to it
+	ks.auditLog = log
+	if log == nil {
+		return nil
+	}
+	ks.audit = auditChain{}
+	if durable, ok := log.(DurableAuditLog); ok {
+		ks.audit.seq, ks.audit.head = durable.Head()
+	}
+	cert, err := ks.auditCertificateLocked()
+	if err != nil {
+		return err
+	}
+	details := map[string]any{"audit_certificate": hex.EncodeToString(cert.Raw)}
+	if previous.seq > 0 {
+		details["previous_seq"] = previous.seq
+		details["previous_hash"] = hex.EncodeToString(previous.head)
+	}
+	return ks.auditLocked(AuditEvent{Type: "audit.start", Details: details})
+}
+
+// AuditPublicKey returns the public half of the audit key that signs checkpoints. The key is derived from
+// the device root key inside the FPGA, so it stays the same across restarts of a key store with the same
+// device secret.
+func (ks *EnclaveKeyStore) AuditPublicKey() (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	return ks.device.auditKey()
+}
+
+// AuditKeyCertificate returns the audit key's certificate, issued by the device identity, so verifiers that
+// trust the DeviceID certificate can check that checkpoints were signed inside this device's FPGA
+func (ks *EnclaveKeyStore) AuditKeyCertificate() (*x509.Certificate, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	return ks.auditCertificateLocked()
+}
+
+// auditCertificateLocked has the device identity certify the audit key
+func (ks *EnclaveKeyStore) auditCertificateLocked() (*x509.Certificate, error) {
+	if err := ks.deviceIdentityLocked(); err != nil {
+		return nil, err
+	}
+	public, err := ks.device.auditKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit key: %v", err)
+	}
+	certDER, err := ks.device.certify(0, keyTemplate("FPGA Secure Enclave Audit Key", der), ks.identity[0], public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue audit key certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse audit key certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// VerifyAuditKeyCertificate checks that an audit key certificate was issued by a device identity and
+// returns the audit public key
+func VerifyAuditKeyCertificate(cert, deviceID *x509.Certificate) (crypto.PublicKey, error) {
+	if err := cert.CheckSignatureFrom(deviceID); err != nil {
+		return nil, fmt.Errorf("%w: audit key certificate: %v", ErrAuditLogInvalid, err)
+	}
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("%w: audit key is %T, not *ecdsa.PublicKey", ErrAuditLogInvalid, cert.PublicKey)
+	}
+	return cert.PublicKey, nil
+}
+
+// AuditCheckpoint signs the audit chain up to the latest event and appends the checkpoint to the log.
+// Checkpoints are also written every 64 events and when the key store is destroyed.
+func (ks *EnclaveKeyStore) AuditCheckpoint() (*AuditCheckpoint, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	if ks.auditLog == nil {
+		return nil, fmt.Errorf("no audit log is set")
+	}
+	return ks.checkpointLocked()
+}
+
+// auditLocked chains an event to the audit log, if there is one. The chain only advances once the log has
+// accepted the event.
+func (ks *EnclaveKeyStore) auditLocked(event AuditEvent) error {
+	if ks.auditLog == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = policyClock().UTC()
+	}
+	details, err := normalizeDetails(event.Details)
+	if err != nil {
+		return err
+	}
+	event.Details = details
+	event.Seq = ks.audit.seq + 1
+	event.PrevHash = ks.audit.head
+	hash, err := event.digest()
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+	if err := ks.auditLog.Append(event); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	ks.audit.seq, ks.audit.head = event.Seq, hash
+
+	ks.audit.pending++
+	if ks.audit.pending >= auditCheckpointInterval && event.Type != "audit.checkpoint" {
+		_, err = ks.checkpointLocked()
+	}
+	return err
+}
+
+// checkpointLocked signs the chain head and records the signature as an audit.checkpoint event, which
+// covers every event before it
+func (ks *EnclaveKeyStore) checkpointLocked() (*AuditCheckpoint, error) {
+	checkpoint := &AuditCheckpoint{
+		Seq:  ks.audit.seq,
+		Hash: ks.audit.head,
+		Time: policyClock().UTC(),
+	}
+	if _, err := ks.device.auditKey(); err != nil {
+		return nil, err
+	}
+	signature, err := ks.device.signAudit(checkpoint.digest())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign audit checkpoint: %v", err)
+	}
+	checkpoint.Signature = signature
+
+	ks.audit.pending = 0
+	err = ks.auditLocked(AuditEvent{Time: checkpoint.Time, Type: "audit.checkpoint", Details: map[string]any{
+		"signature": hex.EncodeToString(signature),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// digest returns the chain hash of an event: SHA-256 over the previous hash and the event's JSON encoding
+func (e *AuditEvent) digest() ([]byte, error) {
+	encoded, err := json.Marshal(struct {
+		Seq      uint64         `json:"seq"`
+		Time     time.Time      `json:"time"`
+		Type     string         `json:"type"`
+		KeyID    string         `json:"key_id"`
+		Details  map[string]any `json:"details"`
+		PrevHash []byte         `json:"prev_hash"`
+	}{e.Seq, e.Time, e.Type, e.KeyID, e.Details, e.PrevHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit event: %v", err)
+	}
+	h := sha256.New()
+	h.Write(e.PrevHash)
+	h.Write(encoded)
+	return h.Sum(nil), nil
+}
+
+// normalizeDetails round-trips details through JSON, so events hash the same once written out and read
+// back. Numbers are kept as json.Number.
+func normalizeDetails(details map[string]any) (map[string]any, error) {
+	if details == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit event: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var normalized map[string]any
+	if err := decoder.Decode(&normalized); err != nil {
+		return nil, fmt.Errorf("failed to encode audit event: %v", err)
+	}
+	return normalized, nil
+}
+
+// checkpoint returns the checkpoint recorded by an audit.checkpoint event
+func (e *AuditEvent) checkpoint() (*AuditCheckpoint, error) {
+	encoded, ok := e.Details["signature"].(string)
+	if !ok {
+		return nil, fmt.Errorf("checkpoint has no signature")
+	}
+	signature, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint signature: %v", err)
+	}
+	return &AuditCheckpoint{Seq: e.Seq - 1, Hash: e.PrevHash, Time: e.Time, Signature: signature}, nil
+}
+
+// digest returns the SHA-256 digest signed by the audit key
+func (c *AuditCheckpoint) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(auditCheckpointContext))
+	binary.Write(h, binary.BigEndian, c.Seq)
+	binary.Write(h, binary.BigEndian, c.Time.UnixNano())
+	h.Write(c.Hash)
+	return h.Sum(nil)
+}
+
+// Verify checks the checkpoint's signature with the audit public key
+func (c *AuditCheckpoint) Verify(auditKey crypto.PublicKey) error {
+	public, ok := auditKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("audit key is %T, not *ecdsa.PublicKey", auditKey)
+	}
+	if !ecdsa.VerifyASN1(public, c.digest(), c.Signature) {
+		return fmt.Errorf("%w: checkpoint %d has an invalid signature", ErrAuditLogInvalid, c.Seq)
+	}
+	return nil
+}
+
+// VerifyAuditLog checks that events form an unbroken hash chain from the start of the log and that every
+// checkpoint in it was signed by the audit key. Events removed from the end of the log can only be detected
+// against a checkpoint kept elsewhere: if latest is not nil, the log must reach it and agree with it.
+func VerifyAuditLog(events []AuditEvent, auditKey crypto.PublicKey, latest *AuditCheckpoint) error {
+	var head []byte
+	for i := range events {
+		event := &events[i]
+		if event.Seq != uint64(i)+1 {
+			return fmt.Errorf("%w: event %d has sequence number %d", ErrAuditLogInvalid, i+1, event.Seq)
+		}
+		if !bytes.Equal(event.PrevHash, head) {
+			return fmt.Errorf("%w: event %d does not follow event %d", ErrAuditLogInvalid, event.Seq, event.Seq-1)
+		}
+		hash, err := event.digest()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(event.Hash, hash) {
+			return fmt.Errorf("%w: event %d has been modified", ErrAuditLogInvalid, event.Seq)
+		}
+		head = hash
+
+		if event.Type == "audit.checkpoint" {
+			checkpoint, err := event.checkpoint()
+			if err != nil {
+				return fmt.Errorf("%w: event %d: %v", ErrAuditLogInvalid, event.Seq, err)
+			}
+			if err := checkpoint.Verify(auditKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	if latest == nil {
+		return nil
+	}
+	if err := latest.Verify(auditKey); err != nil {
+		return err
+	}
+	if latest.Seq > uint64(len(events)) {
+		return fmt.Errorf("%w: log ends at event %d before checkpoint %d", ErrAuditLogInvalid, len(events), latest.Seq)
+	}
+	if latest.Seq > 0 && !bytes.Equal(events[latest.Seq-1].Hash, latest.Hash) {
+		return fmt.Errorf("%w: event %d does not match checkpoint", ErrAuditLogInvalid, latest.Seq)
+	}
+	return nil
+}
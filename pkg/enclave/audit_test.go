@@ -0,0 +1,308 @@
+package enclave
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// auditedKeyStore returns a test key store writing to an in-memory audit log
+func auditedKeyStore(t *testing.T) (*EnclaveKeyStore, *MemoryAuditLog) {
+	keyStore := newTestKeyStore(t)
+	log := NewMemoryAuditLog()
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	return keyStore, log
+}
+
+// eventTypes returns the type of every event
+func eventTypes(events []AuditEvent) []string {
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestAuditLogRecordsOperations(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	key, err := keyStore.CreateKey("signing", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetKeyPolicy(key.ID, &KeyPolicy{Operations: []Operation{OperationVerify}}))
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.ErrorIs(t, err, ErrOperationNotAllowed)
+	assert.NoError(t, keyStore.DisableKey(key.ID))
+	_, err = keyStore.ExportKeyShard(key.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.DeleteKey(key.ID))
+
+	events := log.Events()
+	assert.Equal(t, []string{
+		"audit.start", "key.create", "key.sign", "register.extend", "key.policy", "key.sign", "key.state", "key.export_shard", "key.delete",
+	}, eventTypes(events))
+
+	// Signatures record the digest of the message and whether they were allowed
+	assert.Equal(t, key.ID, events[2].KeyID)
+	assert.Equal(t, true, events[2].Details["allowed"])
+	assert.Equal(t, "SHA-256", events[2].Details["hash"])
+	assert.Len(t, events[2].Details["message_sha256"], 64)
+	assert.Equal(t, false, events[5].Details["allowed"])
+	assert.Contains(t, events[5].Details["error"], "operation not allowed")
+
+	public, err := keyStore.AuditPublicKey()
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyAuditLog(events, public, nil))
+}
+
+func TestAuditLogCheckpoints(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	public, err := keyStore.AuditPublicKey()
+	assert.NoError(t, err)
+
+	// Checkpoints are written periodically
+	for i := 0; i < auditCheckpointInterval; i++ {
+		_, err := AESEncrypt([]byte("data"), keyStore, aesKey)
+		assert.NoError(t, err)
+	}
+	assert.Contains(t, eventTypes(log.Events()), "audit.checkpoint")
+
+	checkpoint, err := keyStore.AuditCheckpoint()
+	assert.NoError(t, err)
+	assert.NoError(t, checkpoint.Verify(public))
+	events := log.Events()
+	assert.Equal(t, uint64(len(events)-1), checkpoint.Seq)
+	assert.NoError(t, VerifyAuditLog(events, public, checkpoint))
+
+	// Destroying the key store closes the log with a checkpoint
+	assert.NoError(t, keyStore.Destroy())
+	events = log.Events()
+	assert.Equal(t, []string{"keystore.destroy", "audit.checkpoint"}, eventTypes(events[len(events)-2:]))
+	assert.NoError(t, VerifyAuditLog(events, public, nil))
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	for i := 0; i < 3; i++ {
+		_, err := AESDecrypt([]byte("data"), keyStore, aesKey)
+		assert.NoError(t, err)
+	}
+	checkpoint, err := keyStore.AuditCheckpoint()
+	assert.NoError(t, err)
+	public, err := keyStore.AuditPublicKey()
+	assert.NoError(t, err)
+	events := log.Events()
+	assert.NoError(t, VerifyAuditLog(events, public, checkpoint))
+
+	// Events survive being written out and read back
+	encoded, err := json.Marshal(events)
+	assert.NoError(t, err)
+	var decoded []AuditEvent
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.NoError(t, VerifyAuditLog(decoded, public, checkpoint))
+
+	tampered := func(modify func([]AuditEvent) []AuditEvent) []AuditEvent {
+		var copied []AuditEvent
+		assert.NoError(t, json.Unmarshal(encoded, &copied))
+		return modify(copied)
+	}
+	cases := map[string][]AuditEvent{
+		"edited": tampered(func(e []AuditEvent) []AuditEvent {
+			e[2].Details["allowed"] = false
+			return e
+		}),
+		"reordered": tampered(func(e []AuditEvent) []AuditEvent {
+			e[2], e[3] = e[3], e[2]
+			return e
+		}),
+		"removed": tampered(func(e []AuditEvent) []AuditEvent {
+			return append(e[:2], e[3:]...)
+		}),
+		"truncated": tampered(func(e []AuditEvent) []AuditEvent {
+			return e[:len(e)-2]
+		}),
+		"prefix removed": tampered(func(e []AuditEvent) []AuditEvent {
+			return e[1:]
+		}),
+	}
+	for name, events := range cases {
+		err := VerifyAuditLog(events, public, checkpoint)
+		assert.ErrorIs(t, err, ErrAuditLogInvalid, name)
+	}
+
+	// Checkpoints must be signed by the audit key
+	forged := *checkpoint
+	forged.Seq--
+	forged.Hash = events[forged.Seq-1].Hash
+	assert.ErrorIs(t, VerifyAuditLog(events, public, &forged), ErrAuditLogInvalid)
+	other, _ := auditedKeyStore(t)
+	otherPublic, err := other.AuditPublicKey()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, VerifyAuditLog(events, otherPublic, checkpoint), ErrAuditLogInvalid)
+}
+
+func TestAuditLogHandoff(t *testing.T) {
+	keyStore, first := auditedKeyStore(t)
+	public, err := keyStore.AuditPublicKey()
+	assert.NoError(t, err)
+
+	// Replacing the log closes its chain with a signed checkpoint
+	second := NewMemoryAuditLog()
+	assert.NoError(t, keyStore.SetAuditLog(second))
+	closed := first.Events()
+	last := closed[len(closed)-1]
+	assert.Equal(t, []string{"audit.stop", "audit.checkpoint"}, eventTypes(closed[len(closed)-2:]))
+	checkpoint, err := last.checkpoint()
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyAuditLog(closed, public, checkpoint))
+
+	// and the new chain starts from the closed chain's head
+	start := second.Events()[0]
+	assert.Equal(t, "audit.start", start.Type)
+	assert.Equal(t, json.Number(fmt.Sprint(last.Seq)), start.Details["previous_seq"])
+	assert.Equal(t, hex.EncodeToString(last.Hash), start.Details["previous_hash"])
+
+	// Detaching the log closes it too, and the next chain links to it
+	_, err = AESEncrypt([]byte("data"), keyStore, keyID(t, keyStore, DefaultAESKeyLabel))
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetAuditLog(nil))
+	closed = second.Events()
+	last = closed[len(closed)-1]
+	assert.Equal(t, []string{"audit.stop", "audit.checkpoint"}, eventTypes(closed[len(closed)-2:]))
+	assert.NoError(t, VerifyAuditLog(closed, public, nil))
+	third := NewMemoryAuditLog()
+	assert.NoError(t, keyStore.SetAuditLog(third))
+	assert.Equal(t, hex.EncodeToString(last.Hash), third.Events()[0].Details["previous_hash"])
+
+	// A log that cannot be closed is not replaced
+	log := &switchableAuditLog{}
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	log.fail = true
+	assert.ErrorContains(t, keyStore.SetAuditLog(nil), "disk full")
+	assert.Equal(t, log, keyStore.auditLog)
+}
+
+func TestStorageAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	config := func() KeyStoreConfig {
+		return KeyStoreConfig{Dir: dir, KEK: testKEK(), DeviceSecret: testDeviceSecret()}
+	}
+	backend := storage.NewMemoryBackend()
+
+	log, err := OpenStorageAuditLog(backend)
+	assert.NoError(t, err)
+	keyStore, err := OpenKeyStore(mappedMem, config())
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	key, err := keyStore.CreateKey("signing", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+	closed, err := log.Events()
+	assert.NoError(t, err)
+
+	// After a restart the log picks up where it stopped, and the key store continues its chain
+	log, err = OpenStorageAuditLog(backend)
+	assert.NoError(t, err)
+	seq, head := log.Head()
+	assert.Equal(t, uint64(len(closed)), seq)
+	assert.Equal(t, closed[len(closed)-1].Hash, head)
+	keyStore, err = OpenKeyStore(mappedMem, config())
+	assert.NoError(t, err)
+	t.Cleanup(func() { keyStore.Destroy() })
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+	checkpoint, err := keyStore.AuditCheckpoint()
+	assert.NoError(t, err)
+
+	events, err := log.Events()
+	assert.NoError(t, err)
+	assert.Equal(t, closed, events[:len(closed)])
+	assert.Equal(t, "audit.start", events[len(closed)].Type)
+	public, err := keyStore.AuditPublicKey()
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyAuditLog(events, public, checkpoint))
+
+	// Events must be appended in sequence
+	assert.ErrorContains(t, log.Append(AuditEvent{Seq: 1}), "does not follow")
+
+	// A log with an event removed from the middle is refused
+	assert.NoError(t, backend.Delete(auditStorageKey(2)))
+	_, err = OpenStorageAuditLog(backend)
+	assert.ErrorIs(t, err, ErrAuditLogInvalid)
+}
+
+func TestAuditKeyCertificate(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	deviceID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+
+	// The audit key is certified by the device identity, and its certificate starts every chain
+	cert, err := keyStore.AuditKeyCertificate()
+	assert.NoError(t, err)
+	public, err := VerifyAuditKeyCertificate(cert, deviceID)
+	assert.NoError(t, err)
+	auditKey, err := keyStore.AuditPublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, auditKey, public)
+	logged, err := hex.DecodeString(log.Events()[0].Details["audit_certificate"].(string))
+	assert.NoError(t, err)
+	loggedCert, err := x509.ParseCertificate(logged)
+	assert.NoError(t, err)
+	public, err = VerifyAuditKeyCertificate(loggedCert, deviceID)
+	assert.NoError(t, err)
+	assert.Equal(t, auditKey, public)
+	otherID, err := newTestKeyStore(t).DeviceIDCertificate()
+	assert.NoError(t, err)
+	_, err = VerifyAuditKeyCertificate(cert, otherID)
+	assert.ErrorIs(t, err, ErrAuditLogInvalid)
+
+	// The audit key is derived from the device secret, so it survives a restart
+	first, err := newDeviceKeyStore(t).AuditPublicKey()
+	assert.NoError(t, err)
+	second, err := newDeviceKeyStore(t).AuditPublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, auditKey, first)
+}
+
+// failingAuditLog refuses every event
+type failingAuditLog struct{}
+
+func (failingAuditLog) Append(AuditEvent) error {
+	return errors.New("disk full")
+}
+
+func TestAuditLogFailureBlocksOperations(t *testing.T) {
+	keyStore, _ := auditedKeyStore(t)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	log := &switchableAuditLog{}
+	assert.NoError(t, keyStore.SetAuditLog(log))
+
+	log.fail = true
+	_, err := AESEncrypt([]byte("data"), keyStore, aesKey)
+	assert.ErrorContains(t, err, "disk full")
+	assert.Error(t, keyStore.SetAuditLog(failingAuditLog{}))
+}
+
+// switchableAuditLog keeps events until it is told to fail
+type switchableAuditLog struct {
+	MemoryAuditLog
+	fail bool
+}
+
+func (l *switchableAuditLog) Append(event AuditEvent) error {
+	if l.fail {
+		return failingAuditLog{}.Append(event)
+	}
+	return l.MemoryAuditLog.Append(event)
+}
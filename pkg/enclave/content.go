@@ -0,0 +1,228 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/expr"
+)
+
+// PayloadFormat is how a message is parsed for signing rules
+type PayloadFormat string
+
+const (
+	PayloadRaw  PayloadFormat = ""     // Rules only see the message bytes
+	PayloadJSON PayloadFormat = "json" // The message must be JSON, available to rules as payload
+)
+
+// ErrContentNotAllowed is the policy denial reason when a message does not satisfy the signing policy
+var ErrContentNotAllowed = errors.New("content not allowed")
+
+// SigningPolicy restricts what a key may sign. A message is signed only if it starts with one of the
+// prefixes, the signature uses one of the digests, and every rule evaluates to true.
+type SigningPolicy struct {
+	Format   PayloadFormat `json:"format,omitempty"`
+	Prefixes [][]byte      `json:"prefixes,omitempty"`
+	Digests  []crypto.Hash `json:"digests,omitempty"`
+	Rules    []SigningRule `json:"rules,omitempty"`
+
+	programs []*expr.Program
+}
+
+// SigningRule is a named expression over the message; see package expr for the syntax. Rules see the
+// variables message (the message as a string), payload (the parsed JSON payload, or null), hash (the
+// signature digest name, such as "SHA-256") and key (a map of id, label and algorithm).
+type SigningRule struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// Decision is the outcome of evaluating a signing policy
+type Decision struct {
+	Allowed bool
+	Rule    string // Name of the rule, or "prefix", "digest" or "format", that denied the message
+	Reason  string
+}
+
+// compile parses the policy's rules
+func (p *SigningPolicy) compile() error {
+	switch p.Format {
+	case PayloadRaw, PayloadJSON:
+	default:
+		return fmt.Errorf("invalid signing policy: unknown payload format %q", p.Format)
+	}
+	for _, hash := range p.Digests {
+		if !hash.Available() {
+			return fmt.Errorf("invalid signing policy: unknown digest %v", hash)
+		}
+	}
+
+	programs := make([]*expr.Program, len(p.Rules))
+	for i, rule := range p.Rules {
+		program, err := expr.Compile(rule.Expr)
+		if err != nil {
+			return fmt.Errorf("invalid signing policy rule %q: %v", rule.Name, err)
+		}
+		programs[i] = program
+	}
+	p.programs = programs
+	return nil
+}
+
+// Evaluate checks a message against the policy without a key, for testing policies before they are
+// attached. The key variable is empty.
+func (p *SigningPolicy) Evaluate(message []byte, hash crypto.Hash) (*Decision, error) {
+	c := p.clone()
+	if err := c.compile(); err != nil {
+		return nil, err
+	}
+	return c.evaluate(message, hash, nil), nil
+}
+
+// evaluate checks a message against a compiled policy
+func (p *SigningPolicy) evaluate(message []byte, hash crypto.Hash, handle *KeyHandle) *Decision {
+	deny := func(rule, format string, args ...any) *Decision {
+		return &Decision{Rule: rule, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if len(p.Prefixes) > 0 && !slices.ContainsFunc(p.Prefixes, func(prefix []byte) bool {
+		return bytes.HasPrefix(message, prefix)
+	}) {
+		return deny("prefix", "message does not start with an allowed prefix")
+	}
+	if len(p.Digests) > 0 && !slices.Contains(p.Digests, hash) {
+		return deny("digest", "%v is not an allowed digest", hash)
+	}
+
+	var payload any
+	if p.Format == PayloadJSON {
+		var err error
+		if payload, err = expr.DecodeJSON(message); err != nil {
+			return deny("format", "message is not JSON: %v", err)
+		}
+	}
+	key := map[string]any{}
+	if handle != nil {
+		key = map[string]any{"id": handle.ID, "label": handle.Label, "algorithm": string(handle.Algorithm)}
+	}
+	vars := map[string]any{
+		"message": string(message),
+		"payload": payload,
+		"hash":    hash.String(),
+		"key":     key,
+	}
+
+	// Rules that fail to evaluate deny the message
+	for i, program := range p.programs {
+		allowed, err := program.EvalBool(vars)
+		if err != nil {
+			return deny(p.Rules[i].Name, "%v", err)
+		}
+		if !allowed {
+			return deny(p.Rules[i].Name, "rule %q is false", program)
+		}
+	}
+	return &Decision{Allowed: true}
+}
+
+// clone returns a deep copy of a policy's configuration
+func (p *SigningPolicy) clone() *SigningPolicy {
+	if p == nil {
+		return nil
+	}
+	c := &SigningPolicy{
+		Format:   p.Format,
+		Prefixes: make([][]byte, len(p.Prefixes)),
+		Digests:  slices.Clone(p.Digests),
+		Rules:    slices.Clone(p.Rules),
+		programs: p.programs,
+	}
+	for i, prefix := range p.Prefixes {
+		c.Prefixes[i] = bytes.Clone(prefix)
+	}
+	return c
+}
+
+// SetSigningPolicy attaches a signing policy to a key, checked before every full or partial signature; a
+// nil policy removes it
+func (ks *EnclaveKeyStore) SetSigningPolicy(id string, policy *SigningPolicy) error {
+	if err := ks.requireQuorum(QuorumSetSigningPolicy); err != nil {
+		return err
+	}
+	return ks.setSigningPolicy(id, policy)
+}
+
+// setSigningPolicy replaces a signing policy without the quorum check
+func (ks *EnclaveKeyStore) setSigningPolicy(id string, policy *SigningPolicy) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.setSigningPolicyLocked(id, policy)
+}
+
+// setSigningPolicyLocked replaces a signing policy with the key store locked
+func (ks *EnclaveKeyStore) setSigningPolicyLocked(id string, policy *SigningPolicy) error {
+	policy = policy.clone()
+	if policy != nil {
+		if err := policy.compile(); err != nil {
+			return err
+		}
+	}
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if key.handle.Algorithm == AlgorithmAES256 {
+		return fmt.Errorf("key %s is %s and cannot sign", id, key.handle.Algorithm)
+	}
+	previous := key.signing
+	key.signing = policy
+	if err := ks.persistLocked(key); err != nil {
+		key.signing = previous
+		return err
+	}
+
+	// The policy in effect must be the one measured, so an unmeasured policy is rolled back
+	if err := ks.extendPolicyLocked("signing policy", id, policy); err != nil {
+		key.signing = previous
+		if restoreErr := ks.persistLocked(key); restoreErr != nil {
+			return fmt.Errorf("%v; failed to restore the previous signing policy: %v", err, restoreErr)
+		}
+		return err
+	}
+	return ks.auditLocked(AuditEvent{Type: "key.signing_policy", KeyID: id, Details: map[string]any{"policy": policy}})
+}
+
+// SigningPolicy returns the signing policy of a key, or nil if it has none
+func (ks *EnclaveKeyStore) SigningPolicy(id string) (*SigningPolicy, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return key.signing.clone(), nil
+}
+
+// EvaluateSigningPolicy is a dry run of the key's signing policy: it reports whether the message would be
+// signed with the digest, without signing or counting a use. A key without a signing policy allows
+// every message.
+func (ks *EnclaveKeyStore) EvaluateSigningPolicy(id string, message []byte, hash crypto.Hash) (*Decision, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if key.signing == nil {
+		return &Decision{Allowed: true}, nil
+	}
+	return key.signing.evaluate(message, hash, &key.handle), nil
+}
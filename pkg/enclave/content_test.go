@@ -0,0 +1,143 @@
+package enclave
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// releasePolicy only allows stable releases that list a SHA-256 digest for every artifact
+func releasePolicy() *SigningPolicy {
+	return &SigningPolicy{
+		Format:   PayloadJSON,
+		Prefixes: [][]byte{[]byte(`{"release"`)},
+		Digests:  []crypto.Hash{crypto.SHA256},
+		Rules: []SigningRule{
+			{Name: "stable", Expr: `payload.release.channel == "stable"`},
+			{Name: "digests", Expr: `payload.artifacts.all(a, has(a.sha256) && a.sha256.matches("^[0-9a-f]{64}$"))`},
+			{Name: "key", Expr: `key.label == "" || key.label.startsWith("release")`},
+		},
+	}
+}
+
+const (
+	stableRelease = `{"release":{"channel":"stable","version":"1.4.2"},"artifacts":[{"name":"enclave.bit","sha256":"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}]}`
+	betaRelease   = `{"release":{"channel":"beta","version":"1.5.0"},"artifacts":[]}`
+)
+
+func TestSigningPolicy(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	key, err := keyStore.CreateKey("release-signing", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetSigningPolicy(key.ID, releasePolicy()))
+
+	_, err = ECDSASign([]byte(stableRelease), keyStore, key.ID)
+	assert.NoError(t, err)
+	_, err = ECDSAPartialSign([]byte(stableRelease), keyStore, key.ID)
+	assert.NoError(t, err)
+
+	_, err = ECDSASign([]byte(betaRelease), keyStore, key.ID)
+	assert.ErrorIs(t, err, ErrPolicyDenied)
+	assert.ErrorIs(t, err, ErrContentNotAllowed)
+	assert.Contains(t, err.Error(), "stable")
+
+	_, err = ECDSAPartialSign([]byte("arbitrary bytes"), keyStore, key.ID)
+	assert.ErrorIs(t, err, ErrContentNotAllowed)
+
+	// The digest allow-list rejects Ed25519's SHA-512
+	edKey, err := keyStore.CreateKey("release-ed25519", AlgorithmEd25519)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetSigningPolicy(edKey.ID, releasePolicy()))
+	_, err = Ed25519Sign([]byte(stableRelease), keyStore, edKey.ID)
+	assert.ErrorIs(t, err, ErrContentNotAllowed)
+	assert.Contains(t, err.Error(), "digest")
+
+	// Rules can depend on the key
+	otherKey, err := keyStore.CreateKey("ci", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetSigningPolicy(otherKey.ID, releasePolicy()))
+	_, err = ECDSASign([]byte(stableRelease), keyStore, otherKey.ID)
+	assert.ErrorIs(t, err, ErrContentNotAllowed)
+
+	// Removing the policy allows any message
+	assert.NoError(t, keyStore.SetSigningPolicy(key.ID, nil))
+	_, err = ECDSASign([]byte("arbitrary bytes"), keyStore, key.ID)
+	assert.NoError(t, err)
+}
+
+func TestSigningPolicyDryRun(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	key, err := keyStore.CreateKey("release-signing", AlgorithmRSA2048)
+	assert.NoError(t, err)
+
+	// Policies can be tried out before they are attached
+	decision, err := releasePolicy().Evaluate([]byte(betaRelease), crypto.SHA256)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "stable", decision.Rule)
+
+	decision, err = releasePolicy().Evaluate([]byte(`{"release" is not JSON`), crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, "format", decision.Rule)
+
+	// A dry run neither signs nor uses up the key
+	assert.NoError(t, keyStore.SetKeyPolicy(key.ID, &KeyPolicy{MaxUses: 1}))
+	assert.NoError(t, keyStore.SetSigningPolicy(key.ID, releasePolicy()))
+	decision, err = keyStore.EvaluateSigningPolicy(key.ID, []byte(stableRelease), crypto.SHA256)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	decision, err = keyStore.EvaluateSigningPolicy(key.ID, []byte(stableRelease), crypto.SHA512)
+	assert.NoError(t, err)
+	assert.Equal(t, "digest", decision.Rule)
+	uses, err := keyStore.KeyUses(key.ID)
+	assert.NoError(t, err)
+	assert.Zero(t, uses)
+
+	// Denied messages do not count as uses either
+	_, err = RSASign([]byte(betaRelease), keyStore, key.ID)
+	assert.ErrorIs(t, err, ErrContentNotAllowed)
+	_, err = RSASign([]byte(stableRelease), keyStore, key.ID)
+	assert.NoError(t, err)
+}
+
+func TestSigningPolicyValidation(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+
+	invalid := []*SigningPolicy{
+		{Format: "xml"},
+		{Digests: []crypto.Hash{crypto.Hash(99)}},
+		{Rules: []SigningRule{{Name: "broken", Expr: `payload.`}}},
+	}
+	for _, policy := range invalid {
+		assert.Error(t, keyStore.SetSigningPolicy(ecdsaKey, policy))
+	}
+	assert.Error(t, keyStore.SetSigningPolicy(keyID(t, keyStore, DefaultAESKeyLabel), releasePolicy()))
+
+	_, err := (&SigningPolicy{Rules: []SigningRule{{Name: "broken", Expr: `(`}}}).Evaluate(nil, crypto.SHA256)
+	assert.Error(t, err)
+}
+
+func TestSigningPolicySurvivesReload(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("release-signing", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetSigningPolicy(key.ID, releasePolicy()))
+	assert.NoError(t, keyStore.Destroy())
+
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	policy, err := keyStore.SigningPolicy(key.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, releasePolicy().Rules, policy.Rules)
+
+	_, err = ECDSASign([]byte(betaRelease), keyStore, key.ID)
+	assert.ErrorIs(t, err, ErrContentNotAllowed)
+	_, err = ECDSASign([]byte(stableRelease), keyStore, key.ID)
+	assert.NoError(t, err)
+}
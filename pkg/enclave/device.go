@@ -0,0 +1,354 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/secmem"
+)
+
+// keyDevice is the key RAM and key engine inside the FPGA. Keys generated, unwrapped, unsealed or derived
+// by the device stay in it; the host only gets public keys, signatures, tags and sealed blobs, and the
+// material of exportable keys it asks for.
+type keyDevice interface {
+	load(slot int, material []byte) error                                                       // Write material to a slot
+	generate(alg Algorithm, slot, partialSlot int) (crypto.PublicKey, error)                    // Generate a key into slots
+	unwrap(wrapped *WrappedKey, alg Algorithm, slot, partialSlot int) (crypto.PublicKey, error) // Unwrap a key into slots
+	clear(slot int)                                                                             // Zeroize a slot
+	loadKEK(kek []byte) error                                                                   // Write the KEK register
+	clearKEK()                                                                                  // Zeroize the KEK register
+
+	// seal wraps a slot under the KEK along with a binding digest, and unseal unwraps a blob into a slot
+	// after checking it, returning the material only if export is set
+	seal(slot int, binding []byte) ([]byte, error)
+	unseal(slot int, blob, binding []byte, export bool) ([]byte, error)
+	tag(data []byte) ([]byte, error) // Authenticate data under the KEK
+	checkTag(data, tag []byte) bool  // Verify a tag made by tag
+
+	transportKey(alg TransportAlgorithm) (crypto.PublicKey, error) // Public transport key, generated on first use
+	clearTransport()
+	auditKey() (crypto.PublicKey, error) // Public audit key, derived from the device root key on first use
+	signAudit(digest []byte) ([]byte, error)
+	clearAudit()
+
+	// deviceIdentity returns the device identity key, the first DICE layer; extendIdentity adds a layer for
+	// a measurement and returns its alias key; certify signs a certificate with the key of a layer, and
+	// signIdentity signs a SHA-256 digest with the key of the top layer
+	deviceIdentity(alg Algorithm) (crypto.PublicKey, error)
+	extendIdentity(alg Algorithm, measurement []byte) (crypto.PublicKey, error)
+	certify(layer int, template, parent *x509.Certificate, public crypto.PublicKey) ([]byte, error)
+	signIdentity(digest []byte) ([]byte, error)
+	truncateIdentity(n int) error // Discard the layers above the first n
+	clearIdentity()
+
+	extend(index int, digest []byte) error // Extend a measurement register
+	resetRegister(index int) error         // Return a measurement register to zero
+	readRegisters() ([][]byte, error)
+
+	loadRoot(secret []byte) error // Load the device root key
+	sealRoot() ([]byte, error)    // Wrap the device root key under the KEK
+	unsealRoot(blob []byte) error // Unwrap a device root key sealed with sealRoot
+	clearRoot()                   // Zeroize the device root key
+	sealData(salt, info, nonce, data, aad []byte) ([]byte, error)
+	unsealData(salt, info, nonce, ciphertext, aad []byte) ([]byte, error)
+
+	// present reports whether the key engine is in the FPGA. Keys are only generated and used inside the
+	// device when it is, so nothing is attested as resident otherwise.
+	present() bool
+
+	// checkImage has the code loader check the tags of the image loaded at axiOffset with the image key in
+	// a slot, failing with fpga.ErrIntegrityFailure
+	checkImage(slot int, image *container.Container, axiOffset uint32) error
+}
+
+// newKeyDevice returns the key device behind an AXI mapping. Tests replace it with an emulated device.
+var newKeyDevice = newAXIDevice
+
+// Argument values for key engine commands
+const (
+	noSlot   = ^uint32(0) // No partial key slot
+	topLayer = ^uint32(0) // The top DICE layer
+)
+
+// deviceAlgorithms are the key engine's codes for key algorithms
+var deviceAlgorithms = map[Algorithm]uint32{
+	AlgorithmAES256:    1,
+	AlgorithmRSA2048:   2,
+	AlgorithmECDSAP256: 3,
+	AlgorithmEd25519:   4,
+}
+
+// deviceTransports are the key engine's codes for transport algorithms
+var deviceTransports = map[TransportAlgorithm]uint32{
+	TransportRSAOAEP256: 1,
+	TransportECDHP256:   2,
+}
+
+// axiDevice runs the key engine over AXI. Key slots and the KEK register are written directly; everything
+// else is a key engine command.
+type axiDevice struct {
+	mappedMem []byte
+}
+
+// newAXIDevice returns the key device behind mappedMem
+func newAXIDevice(mappedMem []byte) keyDevice {
+	return &axiDevice{mappedMem: mappedMem}
+}
+
+func (d *axiDevice) present() bool {
+	return fpga.KeyEnginePresent(keyEngineOffset, d.mappedMem)
+}
+
+// execute runs a key engine command. Byte strings are passed in the data buffer, each preceded by its
+// 32-bit little-endian length.
+func (d *axiDevice) execute(command fpga.KeyCommand, args []uint32, fields ...[]byte) ([]byte, error) {
+	var input []byte
+	for _, field := range fields {
+		input = binary.LittleEndian.AppendUint32(input, uint32(len(field)))
+		input = append(input, field...)
+	}
+	defer wipe(input)
+	return fpga.ExecuteKeyCommand(command, args, input, keyEngineOffset, d.mappedMem)
+}
+
+// publicKey runs a command that returns a PKIX public key
+func (d *axiDevice) publicKey(command fpga.KeyCommand, args []uint32, fields ...[]byte) (crypto.PublicKey, error) {
+	der, err := d.execute(command, args, fields...)
+	if err != nil || len(der) == 0 {
+		return nil, err
+	}
+	public, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("key engine returned an invalid public key: %v", err)
+	}
+	return public, nil
+}
+
+func (d *axiDevice) load(slot int, material []byte) error {
+	return fpga.LoadKeyToFPGA(material, slotOffset(slot), d.mappedMem)
+}
+
+func (d *axiDevice) generate(alg Algorithm, slot, partialSlot int) (crypto.PublicKey, error) {
+	code, ok := deviceAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+	return d.publicKey(fpga.KeyGenerate, []uint32{code, uint32(slot), slotArg(partialSlot)})
+}
+
+func (d *axiDevice) unwrap(wrapped *WrappedKey, alg Algorithm, slot, partialSlot int) (crypto.PublicKey, error) {
+	code, ok := deviceAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+	transport, ok := deviceTransports[wrapped.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transport algorithm %q", wrapped.Algorithm)
+	}
+	args := []uint32{code, uint32(slot), slotArg(partialSlot), transport}
+	return d.publicKey(fpga.KeyUnwrap, args, wrapped.EncryptedKey, wrapped.EphemeralPublicKey, wrapped.WrappedKey, wrapped.aad())
+}
+
+// clear sends the zeroize command for a slot and overwrites it with zeros
+func (d *axiDevice) clear(slot int) {
+	if slot < 0 {
+		return
+	}
+	fpga.ZeroizeKeySlots(1<<slot, keyControlOffset, d.mappedMem)
+	fpga.LoadKeyToFPGA(make([]byte, keySlotStride/4), slotOffset(slot), d.mappedMem)
+}
+
+func (d *axiDevice) loadKEK(kek []byte) error {
+	return fpga.LoadKeyToFPGA(kek, kekOffset, d.mappedMem)
+}
+
+func (d *axiDevice) clearKEK() {
+	fpga.LoadKeyToFPGA(make([]byte, keySize), kekOffset, d.mappedMem)
+}
+
+func (d *axiDevice) seal(slot int, binding []byte) ([]byte, error) {
+	return d.execute(fpga.KeySeal, []uint32{uint32(slot)}, binding)
+}
+
+func (d *axiDevice) unseal(slot int, blob, binding []byte, export bool) ([]byte, error) {
+	var exportArg uint32
+	if export {
+		exportArg = 1
+	}
+	material, err := d.execute(fpga.KeyUnseal, []uint32{uint32(slot), exportArg}, blob, binding)
+	if err != nil || !export {
+		wipe(material)
+		return nil, err
+	}
+	return material, nil
+}
+
+func (d *axiDevice) tag(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return d.execute(fpga.KeyTag, nil, digest[:])
+}
+
+func (d *axiDevice) checkTag(data, tag []byte) bool {
+	digest := sha256.Sum256(data)
+	_, err := d.execute(fpga.KeyCheckTag, nil, digest[:], tag)
+	return err == nil
+}
+
+func (d *axiDevice) transportKey(alg TransportAlgorithm) (crypto.PublicKey, error) {
+	code, ok := deviceTransports[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transport algorithm %q", alg)
+	}
+	return d.publicKey(fpga.KeyTransport, []uint32{code})
+}
+
+func (d *axiDevice) clearTransport() {
+	d.execute(fpga.KeyClearTransport, nil)
+}
+
+func (d *axiDevice) auditKey() (crypto.PublicKey, error) {
+	return d.publicKey(fpga.KeyAudit, nil)
+}
+
+func (d *axiDevice) signAudit(digest []byte) ([]byte, error) {
+	return d.execute(fpga.KeySignAudit, nil, digest)
+}
+
+func (d *axiDevice) clearAudit() {
+	d.execute(fpga.KeyClearAudit, nil)
+}
+
+func (d *axiDevice) deviceIdentity(alg Algorithm) (crypto.PublicKey, error) {
+	code, ok := deviceAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported identity key algorithm %q", alg)
+	}
+	return d.publicKey(fpga.KeyDeviceIdentity, []uint32{code})
+}
+
+func (d *axiDevice) extendIdentity(alg Algorithm, measurement []byte) (crypto.PublicKey, error) {
+	code, ok := deviceAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported identity key algorithm %q", alg)
+	}
+	return d.publicKey(fpga.KeyExtendIdentity, []uint32{code}, measurement)
+}
+
+// certify has the key engine sign the certificate. A self-signed certificate is signed by the key it
+// certifies, and any other by the key of its parent.
+func (d *axiDevice) certify(layer int, template, parent *x509.Certificate, public crypto.PublicKey) ([]byte, error) {
+	signer := &identitySigner{device: d, layer: uint32(layer), public: parent.PublicKey}
+	if signer.public == nil {
+		signer.public = public
+	}
+	return x509.CreateCertificate(rand.Reader, template, parent, public, signer)
+}
+
+func (d *axiDevice) signIdentity(digest []byte) ([]byte, error) {
+	return d.execute(fpga.KeySignIdentity, []uint32{topLayer}, digest)
+}
+
+func (d *axiDevice) truncateIdentity(n int) error {
+	_, err := d.execute(fpga.KeyTruncateIdentity, []uint32{uint32(n)})
+	return err
+}
+
+func (d *axiDevice) clearIdentity() {
+	d.truncateIdentity(0)
+}
+
+func (d *axiDevice) extend(index int, digest []byte) error {
+	_, err := d.execute(fpga.KeyExtend, []uint32{uint32(index)}, digest)
+	return err
+}
+
+func (d *axiDevice) resetRegister(index int) error {
+	_, err := d.execute(fpga.KeyResetRegister, []uint32{uint32(index)})
+	return err
+}
+
+func (d *axiDevice) readRegisters() ([][]byte, error) {
+	values, err := d.execute(fpga.KeyReadRegisters, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != attest.NumRegisters*sha256.Size {
+		return nil, fmt.Errorf("key engine returned %d bytes of measurement registers", len(values))
+	}
+	registers := make([][]byte, attest.NumRegisters)
+	for i := range registers {
+		registers[i] = values[i*sha256.Size : (i+1)*sha256.Size]
+	}
+	return registers, nil
+}
+
+func (d *axiDevice) loadRoot(secret []byte) error {
+	_, err := d.execute(fpga.KeyLoadRoot, nil, secret)
+	return err
+}
+
+func (d *axiDevice) sealRoot() ([]byte, error) {
+	return d.execute(fpga.KeySealRoot, nil)
+}
+
+func (d *axiDevice) unsealRoot(blob []byte) error {
+	_, err := d.execute(fpga.KeyUnsealRoot, nil, blob)
+	return err
+}
+
+func (d *axiDevice) clearRoot() {
+	d.execute(fpga.KeyClearRoot, nil)
+}
+
+func (d *axiDevice) sealData(salt, info, nonce, data, aad []byte) ([]byte, error) {
+	return d.execute(fpga.KeySealData, nil, salt, info, nonce, data, aad)
+}
+
+func (d *axiDevice) unsealData(salt, info, nonce, ciphertext, aad []byte) ([]byte, error) {
+	return d.execute(fpga.KeyUnsealData, nil, salt, info, nonce, ciphertext, aad)
+}
+
+func (d *axiDevice) checkImage(slot int, image *container.Container, axiOffset uint32) error {
+	_, err := d.execute(fpga.KeyCheckImage, []uint32{uint32(slot), axiOffset})
+	if errors.Is(err, fpga.ErrKeyRejected) {
+		return fpga.ErrIntegrityFailure
+	}
+	return err
+}
+
+// identitySigner signs with the identity key of a DICE layer inside the key engine
+type identitySigner struct {
+	device *axiDevice
+	layer  uint32
+	public crypto.PublicKey
+}
+
+func (s *identitySigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *identitySigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return s.device.execute(fpga.KeySignIdentity, []uint32{s.layer}, digest)
+}
+
+// slotArg returns the argument value of a slot that may be unused
+func slotArg(slot int) uint32 {
+	if slot < 0 {
+		return noSlot
+	}
+	return uint32(slot)
+}
+
+// wipe overwrites a buffer with zeros
+func wipe(b []byte) {
+	secmem.Wipe(b)
+}
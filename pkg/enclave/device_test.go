@@ -0,0 +1,47 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/stretchr/testify/assert"
+)
+
+// axiBytes reads n bytes written by LoadKeyToFPGA, which stores one byte per 32-bit word
+func axiBytes(mappedMem []byte, offset uint32, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(binary.LittleEndian.Uint32(mappedMem[int(offset)+4*i:]))
+	}
+	return data
+}
+
+func TestAXIDeviceSlots(t *testing.T) {
+	mappedMem := make([]byte, axiWindowSize)
+	device := &axiDevice{mappedMem: mappedMem}
+	offset := slotOffset(3)
+
+	// Key material goes to the slot over AXI, and the device keeps no copy of it
+	material := bytes.Repeat([]byte{0xAB}, keySize)
+	assert.NoError(t, device.load(3, material))
+	assert.Equal(t, material, axiBytes(mappedMem, offset, keySize))
+	assert.Equal(t, axiDevice{mappedMem: mappedMem}, *device)
+
+	// Clearing zeroizes the slot and overwrites it
+	device.clear(3)
+	assert.Equal(t, byte(fpga.ZeroizeCommand), mappedMem[keyControlOffset])
+	assert.Equal(t, make([]byte, keySlotStride), mappedMem[offset:offset+keySlotStride])
+
+	// The key-encryption key is written the same way
+	assert.NoError(t, device.loadKEK(material))
+	assert.Equal(t, material, axiBytes(mappedMem, kekOffset, keySize))
+	device.clearKEK()
+	assert.Equal(t, make([]byte, keySize), axiBytes(mappedMem, kekOffset, keySize))
+
+	// The key engine is present once its identification register reads its ID
+	assert.False(t, device.present())
+	binary.LittleEndian.PutUint32(mappedMem[keyEngineOffset+fpga.KeyIDOffset:], fpga.KeyEngineID)
+	assert.True(t, device.present())
+}
@@ -0,0 +1,175 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+)
+
+var (
+	// DICE certificates are valid from a fixed date and never expire (RFC 5280 section 4.1.2.5)
+	diceNotBefore = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	diceNotAfter  = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// SetIdentityAlgorithm chooses ECDSA P-256, the default, or Ed25519 for the device identity and alias keys.
+// It must be called before the identity is first used.
+func (ks *EnclaveKeyStore) SetIdentityAlgorithm(alg Algorithm) error {
+	if alg != AlgorithmECDSAP256 && alg != AlgorithmEd25519 {
+		return fmt.Errorf("unsupported identity key algorithm %q", alg)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if len(ks.identity) > 0 {
+		return fmt.Errorf("device identity has already been derived")
+	}
+	ks.identityAlg = alg
+	return nil
+}
+
+// IdentityChain returns the DICE certificate chain: the self-signed device identity certificate, then one
+// alias certificate per loaded image, each certified by the layer below it. The last certificate's key signs
+// attestation quotes.
+func (ks *EnclaveKeyStore) IdentityChain() ([]*x509.Certificate, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	if err := ks.deviceIdentityLocked(); err != nil {
+		return nil, err
+	}
+	return append([]*x509.Certificate(nil), ks.identity...), nil
+}
+
+// DeviceIDCertificate returns the self-signed device identity certificate, which verifiers trust as the
+// root of the device's DICE chains. It is derived from the device secret and does not change while the
+// secret does not.
+func (ks *EnclaveKeyStore) DeviceIDCertificate() (*x509.Certificate, error) {
+	chain, err := ks.IdentityChain()
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+// deviceIdentityLocked derives the device identity and issues its certificate, if not done yet
+func (ks *EnclaveKeyStore) deviceIdentityLocked() error {
+	if len(ks.identity) > 0 {
+		return nil
+	}
+	public, err := ks.device.deviceIdentity(ks.identityAlgorithm())
+	if err != nil {
+		return err
+	}
+	template, err := diceTemplate(0, public, nil)
+	if err != nil {
+		return err
+	}
+	der, err := ks.device.certify(0, template, template, public)
+	if err != nil {
+		return fmt.Errorf("failed to issue device identity certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse device identity certificate: %v", err)
+	}
+	ks.identity = []*x509.Certificate{cert}
+	return nil
+}
+
+// extendIdentityLocked adds a DICE layer for a measured image, certified by the device identity. The image
+// is the first stage above the device identity, so the layers of any image loaded before are discarded.
+func (ks *EnclaveKeyStore) extendIdentityLocked(measurement []byte) error {
+	if err := ks.deviceIdentityLocked(); err != nil {
+		return err
+	}
+	if err := ks.device.truncateIdentity(1); err != nil {
+		return fmt.Errorf("failed to discard image identity: %v", err)
+	}
+	ks.identity = ks.identity[:1]
+	public, err := ks.device.extendIdentity(ks.identityAlgorithm(), measurement)
+	if err != nil {
+		return err
+	}
+	layer := len(ks.identity)
+	template, err := diceTemplate(layer, public, measurement)
+	if err != nil {
+		return err
+	}
+	der, err := ks.device.certify(layer-1, template, ks.identity[layer-1], public)
+	if err != nil {
+		return fmt.Errorf("failed to issue layer %d certificate: %v", layer, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse layer %d certificate: %v", layer, err)
+	}
+	ks.identity = append(ks.identity, cert)
+	return ks.auditLocked(AuditEvent{Type: "identity.extend", Details: map[string]any{
+		"layer":       layer,
+		"measurement": hex.EncodeToString(measurement),
+		"key_id":      hex.EncodeToString(cert.SubjectKeyId),
+	}})
+}
+
+// identityAlgorithm returns the algorithm of the identity keys
+func (ks *EnclaveKeyStore) identityAlgorithm() Algorithm {
+	if ks.identityAlg == "" {
+		return AlgorithmECDSAP256
+	}
+	return ks.identityAlg
+}
+
+// diceTemplate returns the certificate template of a DICE layer. Layers above the device identity carry
+// their measurement in a TcbInfo extension.
+func diceTemplate(layer int, public crypto.PublicKey, measurement []byte) (*x509.Certificate, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity key: %v", err)
+	}
+	name := "FPGA Secure Enclave DeviceID"
+	if layer > 0 {
+		name = fmt.Sprintf("FPGA Secure Enclave Alias L%d", layer)
+	}
+	template := keyTemplate(name, der)
+	template.KeyUsage |= x509.KeyUsageCertSign
+	template.IsCA = true
+	if layer > 0 {
+		info, err := asn1.Marshal(attest.NewTCBInfo(layer, measurement))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode TcbInfo: %v", err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: attest.OIDTCBInfo, Value: info}}
+	}
+	return template, nil
+}
+
+// keyTemplate returns the template of a certificate for a key held in the FPGA, named after the key and
+// with a serial number and subject key ID derived from its PKIX encoding
+func keyTemplate(name string, der []byte) *x509.Certificate {
+	keyID := sha256.Sum256(der)
+	serial := new(big.Int).SetBytes(keyID[:16])
+	serial.SetBit(serial, 127, 0)
+	return &x509.Certificate{
+		SerialNumber:          serial.Add(serial, big.NewInt(1)),
+		Subject:               pkix.Name{CommonName: name, SerialNumber: hex.EncodeToString(keyID[:20])},
+		NotBefore:             diceNotBefore,
+		NotAfter:              diceNotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		SubjectKeyId:          bytes.Clone(keyID[:20]),
+	}
+}
@@ -0,0 +1,95 @@
+package enclave
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityChain(t *testing.T) {
+	keyStore := newDeviceKeyStore(t)
+	chain, err := keyStore.IdentityChain()
+	assert.NoError(t, err)
+	assert.Len(t, chain, 1)
+	deviceID := chain[0]
+
+	// The device identity is derived from the device secret, so every key store on the device shares it
+	other := newDeviceKeyStore(t)
+	otherID, err := other.DeviceIDCertificate()
+	assert.NoError(t, err)
+	assert.Equal(t, deviceID.PublicKey, otherID.PublicKey)
+
+	// A loaded image adds a layer certified by the device identity
+	image := buildTestImage(t, "hello", 1, []byte("hello from the enclave"))
+	assert.NoError(t, keyStore.LoadImage(image, testVendorKey.Public(), importImageKey(t, keyStore), make([]byte, 4096), 0))
+	chain, err = keyStore.IdentityChain()
+	assert.NoError(t, err)
+	assert.Len(t, chain, 2)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+	identity, err := attest.VerifyIdentity(chain, roots)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{image.Image().Measure()}, identity.Measurements)
+	public, err := keyStore.AttestationPublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, public, identity.PublicKey)
+
+	// Loading an image replaces the layer of the one before, so the same image gets the same alias key
+	assert.NoError(t, keyStore.LoadImage(image, testVendorKey.Public(), importImageKey(t, keyStore), make([]byte, 4096), 0))
+	reloaded, err := keyStore.IdentityChain()
+	assert.NoError(t, err)
+	assert.Len(t, reloaded, 2)
+	assert.Equal(t, chain[1].PublicKey, reloaded[1].PublicKey)
+
+	// Alias keys depend on the measurement
+	measurement := loadTestImage(t, keyStore)
+	replaced, err := keyStore.IdentityChain()
+	assert.NoError(t, err)
+	assert.Len(t, replaced, 2)
+	assert.NotEqual(t, chain[1].PublicKey, replaced[1].PublicKey)
+	identity, err = attest.VerifyIdentity(replaced, roots)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{measurement}, identity.Measurements)
+
+	emulated(other).dice = nil
+	other.identity = nil
+	emulated(other).root = make([]byte, keySize)
+	foreign, err := other.DeviceIDCertificate()
+	assert.NoError(t, err)
+	assert.NotEqual(t, deviceID.PublicKey, foreign.PublicKey)
+	foreignRoots := x509.NewCertPool()
+	foreignRoots.AddCert(foreign)
+	_, err = attest.VerifyIdentity(chain, foreignRoots)
+	assert.ErrorIs(t, err, attest.ErrInvalidIdentity)
+
+	assert.Error(t, keyStore.SetIdentityAlgorithm(AlgorithmEd25519))
+	assert.NoError(t, keyStore.Destroy())
+	_, err = keyStore.IdentityChain()
+	assert.ErrorIs(t, err, ErrKeyStoreDestroyed)
+}
+
+func TestIdentityEd25519(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	assert.Error(t, keyStore.SetIdentityAlgorithm(AlgorithmAES256))
+	assert.NoError(t, keyStore.SetIdentityAlgorithm(AlgorithmEd25519))
+	measurement := loadTestImage(t, keyStore)
+
+	deviceID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+	assert.IsType(t, ed25519.PublicKey{}, deviceID.PublicKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+
+	nonce := []byte("0123456789abcdef")
+	quote, err := keyStore.Quote(nonce)
+	assert.NoError(t, err)
+	verifier := &attest.Verifier{Roots: roots, Measurements: [][]byte{measurement}}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+
+	// Quotes must carry the layer that measured the image
+	quote.Certificates = quote.Certificates[:1]
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), attest.ErrInvalidIdentity)
+}
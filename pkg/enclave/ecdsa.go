@@ -1,51 +1,89 @@
 package enclave
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"fmt"
+	"math/big"
 
 	"github.com/hashicorp/vault/shamir"
-	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/dkg"
 )
 
-// InitializeECDSAKey generates a random ECDSA key, splits it using Shamir Secret Sharing, and loads both full and partial keys into FPGA
-func InitializeECDSAKey(mappedMem []byte) ([]byte, []byte, error) {
-	// Generate a random ECDSA key (256 bytes for 256-bit curve)
-	ecdsaFullKey := make([]byte, rsaKeySize)
-	_, err := rand.Read(ecdsaFullKey)
+// generateECDSAKey generates a P-256 ECDSA key and splits its private scalar using Shamir Secret Sharing
+func generateECDSAKey() ([]byte, []byte, crypto.PublicKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate ECDSA key: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to generate ECDSA key: %v", err)
 	}
 
+	// The key slot holds the 32-byte private scalar
+	ecdsaFullKey := key.D.FillBytes(make([]byte, keySize))
+
 	// Split the ECDSA key using Shamir Secret Sharing
 	shares, err := shamir.Split(ecdsaFullKey, numShares, threshold)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to split ECDSA key using Shamir: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to split ECDSA key using Shamir: %v", err)
 	}
 
 	// Use the first share as the partial key shard
-	ecdsaPartialKey := shares[0]
+	return ecdsaFullKey, shares[0], &key.PublicKey, nil
+}
 
-	// Load the full ECDSA key into the FPGA
-	err = fpga.LoadKeyToFPGA(ecdsaFullKey, 0x3000, mappedMem)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load ECDSA full key to FPGA: %v", err)
+// ecdsaPrivateKey rebuilds a P-256 private key from the scalar held in its key slot
+func ecdsaPrivateKey(material []byte) (*ecdsa.PrivateKey, error) {
+	if len(material) != keySize {
+		return nil, fmt.Errorf("invalid ECDSA key material length %d", len(material))
 	}
 
-	// Load the partial ECDSA key into the FPGA
-	err = fpga.LoadKeyToFPGA(ecdsaPartialKey, 0x3100, mappedMem)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load ECDSA partial key to FPGA: %v", err)
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(material)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid ECDSA private scalar")
+	}
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(material)
+	return key, nil
+}
+
+// InitializeECDSAKeyShare loads a P-256 share from distributed key generation into a partial key slot; the full key
+// never exists on any host. The share is storage-only: it can be backed up and later combined with threshold other
+// shares, but signing with it returns ErrStorageOnly because no threshold signing protocol is implemented.
+func InitializeECDSAKeyShare(result *dkg.Result, keyStore *EnclaveKeyStore, label string) (*KeyHandle, error) {
+	if result.Curve != dkg.CurveP256 {
+		return nil, fmt.Errorf("DKG result is for %s, not P-256", result.Curve)
 	}
 
-	fmt.Println("ECDSA full and partial keys successfully loaded into the FPGA")
-	return ecdsaFullKey, ecdsaPartialKey, nil
+	// Only the partial key slot is used; the joint public key is kept for verifiers
+	return keyStore.addKey(KeyHandle{
+		Label:     label,
+		Algorithm: AlgorithmECDSAP256,
+		Size:      keySize * 8,
+		PublicKey: result.PublicKey,
+		Origin:    KeyOriginDKG,
+	}, nil, result.Share)
+}
+
+// ECDSASign performs a full ECDSA signature over the SHA-256 digest of a message using the complete private key
+func ECDSASign(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	return ECDSASignHash(message, crypto.SHA256, keyStore, keyID)
 }
 
-// ECDSASign performs a full ECDSA signature using the complete private key
-func ECDSASign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+// ECDSASignHash performs a full ECDSA signature over the digest of a message with SHA-256, SHA-384 or SHA-512
+func ECDSASignHash(message []byte, hash crypto.Hash, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	if err := checkSignatureHash(hash); err != nil {
+		return nil, err
+	}
+	key, err := keyStore.activeKey(keyID, AlgorithmECDSAP256, Usage{Operation: OperationSign, Hash: hash, Message: message})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load full ECDSA private key into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.ECDSAFull, 0x3000, nil)
+	err = keyStore.loadFullKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load full ECDSA key: %v", err)
 	}
@@ -54,14 +92,18 @@ func ECDSASign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
 	signature := make([]byte, 256) // Placeholder for actual signature
 	copy(signature, message)       // Just copying message for testing
 
-	fmt.Println("Performing ECDSA full signing")
 	return signature, nil
 }
 
 // ECDSAPartialSign performs a partial ECDSA signature using a key shard
-func ECDSAPartialSign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+func ECDSAPartialSign(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	key, err := keyStore.activeKey(keyID, AlgorithmECDSAP256, Usage{Operation: OperationSign, Hash: crypto.SHA256, Message: message})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load ECDSA partial key shard into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.ECDSAPartial, 0x3100, nil)
+	err = keyStore.loadPartialKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load ECDSA partial key: %v", err)
 	}
@@ -70,6 +112,27 @@ func ECDSAPartialSign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error)
 	partialSignature := make([]byte, 256) // Placeholder for partial signature
 	copy(partialSignature, message)       // Just copying message for testing
 
-	fmt.Println("Performing ECDSA partial signing")
 	return partialSignature, nil
 }
+
+// ECDSAVerify verifies an ASN.1 ECDSA signature over the digest of a message with the key's public key
+func ECDSAVerify(message, signature []byte, hash crypto.Hash, keyStore *EnclaveKeyStore, keyID string) error {
+	if err := checkSignatureHash(hash); err != nil {
+		return err
+	}
+	key, err := keyStore.activeKey(keyID, AlgorithmECDSAP256, Usage{Operation: OperationVerify, Hash: hash, Message: message})
+	if err != nil {
+		return err
+	}
+	public, ok := key.handle.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoPublicKey, keyID)
+	}
+
+	digest := hash.New()
+	digest.Write(message)
+	if !ecdsa.VerifyASN1(public, digest.Sum(nil), signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -1,51 +1,70 @@
 package enclave
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
 
 	"github.com/hashicorp/vault/shamir"
-	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/dkg"
 )
 
-// InitializeEd25519Key generates a random Ed25519 key, splits it using Shamir Secret Sharing, and loads both full and partial keys into FPGA
-func InitializeEd25519Key(mappedMem []byte) ([]byte, []byte, error) {
-	// Generate a random Ed25519 key (256 bytes for Ed25519)
-	ed25519FullKey := make([]byte, rsaKeySize)
-	_, err := rand.Read(ed25519FullKey)
+// generateEd25519Key generates an Ed25519 key and splits its seed using Shamir Secret Sharing
+func generateEd25519Key() ([]byte, []byte, crypto.PublicKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate Ed25519 key: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to generate Ed25519 key: %v", err)
 	}
 
+	// The key slot holds the 32-byte seed the private key is derived from
+	ed25519FullKey := append([]byte(nil), private.Seed()...)
+
 	// Split the Ed25519 key using Shamir Secret Sharing
 	shares, err := shamir.Split(ed25519FullKey, numShares, threshold)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to split Ed25519 key using Shamir: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to split Ed25519 key using Shamir: %v", err)
 	}
 
 	// Use the first share as the partial key shard
-	ed25519PartialKey := shares[0]
+	return ed25519FullKey, shares[0], public, nil
+}
 
-	// Load the full Ed25519 key into the FPGA
-	err = fpga.LoadKeyToFPGA(ed25519FullKey, 0x4000, mappedMem)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load Ed25519 full key to FPGA: %v", err)
+// ed25519PrivateKey rebuilds an Ed25519 private key from the seed held in its key slot
+func ed25519PrivateKey(material []byte) (ed25519.PrivateKey, error) {
+	if len(material) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid Ed25519 key material length %d", len(material))
 	}
+	return ed25519.NewKeyFromSeed(material), nil
+}
 
-	// Load the partial Ed25519 key into the FPGA
-	err = fpga.LoadKeyToFPGA(ed25519PartialKey, 0x4100, mappedMem)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load Ed25519 partial key to FPGA: %v", err)
+// InitializeEd25519KeyShare loads an Ed25519 share from distributed key generation into a partial key slot; the full
+// key never exists on any host. The share is storage-only: it can be backed up and later combined with threshold
+// other shares, but signing with it returns ErrStorageOnly because no threshold signing protocol is implemented.
+func InitializeEd25519KeyShare(result *dkg.Result, keyStore *EnclaveKeyStore, label string) (*KeyHandle, error) {
+	if result.Curve != dkg.CurveEd25519 {
+		return nil, fmt.Errorf("DKG result is for %s, not Ed25519", result.Curve)
 	}
 
-	fmt.Println("Ed25519 full and partial keys successfully loaded into the FPGA")
-	return ed25519FullKey, ed25519PartialKey, nil
+	// Only the partial key slot is used; the joint public key is kept for verifiers
+	return keyStore.addKey(KeyHandle{
+		Label:     label,
+		Algorithm: AlgorithmEd25519,
+		Size:      keySize * 8,
+		PublicKey: result.PublicKey,
+		Origin:    KeyOriginDKG,
+	}, nil, result.Share)
 }
 
 // Ed25519Sign performs a full Ed25519 signature using the complete private key
-func Ed25519Sign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+func Ed25519Sign(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	key, err := keyStore.activeKey(keyID, AlgorithmEd25519, Usage{Operation: OperationSign, Hash: crypto.SHA512, Message: message})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load full Ed25519 private key into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.Ed25519Full, 0x4000, nil)
+	err = keyStore.loadFullKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load full Ed25519 key: %v", err)
 	}
@@ -54,14 +73,18 @@ func Ed25519Sign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
 	signature := make([]byte, 256) // Placeholder for actual signature
 	copy(signature, message)       // Just copying message for testing
 
-	fmt.Println("Performing Ed25519 full signing")
 	return signature, nil
 }
 
 // Ed25519PartialSign performs a partial Ed25519 signature using a key shard
-func Ed25519PartialSign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+func Ed25519PartialSign(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	key, err := keyStore.activeKey(keyID, AlgorithmEd25519, Usage{Operation: OperationSign, Hash: crypto.SHA512, Message: message})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load Ed25519 partial key shard into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.Ed25519Partial, 0x4100, nil)
+	err = keyStore.loadPartialKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load Ed25519 partial key: %v", err)
 	}
@@ -70,6 +93,21 @@ func Ed25519PartialSign(message []byte, keyStore *EnclaveKeyStore) ([]byte, erro
 	partialSignature := make([]byte, 256) // Placeholder for partial signature
 	copy(partialSignature, message)       // Just copying message for testing
 
-	fmt.Println("Performing Ed25519 partial signing")
 	return partialSignature, nil
 }
+
+// Ed25519Verify verifies an Ed25519 signature of a message with the key's public key
+func Ed25519Verify(message, signature []byte, keyStore *EnclaveKeyStore, keyID string) error {
+	key, err := keyStore.activeKey(keyID, AlgorithmEd25519, Usage{Operation: OperationVerify, Hash: crypto.SHA512, Message: message})
+	if err != nil {
+		return err
+	}
+	public, ok := key.handle.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoPublicKey, keyID)
+	}
+	if !ed25519.Verify(public, message, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/vault/shamir"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/aesgcm"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/elfload"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/keywrap"
+	"golang.org/x/crypto/hkdf"
+)
+
+// keySlotRAM emulates the key RAM and key engine inside the FPGA for tests. It writes slots and the KEK
+// register over AXI as the hardware device does, but keeps their contents, and every key the key engine
+// would hold, in host memory.
+type keySlotRAM struct {
+	mappedMem []byte
+	slots     [numKeySlots][]byte
+	kek       []byte                                   // Key-encryption key register used to seal slot contents
+	transport map[TransportAlgorithm]crypto.PrivateKey // Transport keys for wrapped key import
+	audit     *ecdsa.PrivateKey                        // Audit key signing log checkpoints
+	dice      []diceLayer                              // DICE layers, the device identity first
+	registers [attest.NumRegisters][]byte              // Measurement registers, nil until first extended
+	root      []byte                                   // Device root key, nil until loaded or first used
+	extendErr error                                    // Returned by extend, to test failed measurements
+}
+
+func init() {
+	newKeyDevice = func(mappedMem []byte) keyDevice {
+		return &keySlotRAM{mappedMem: mappedMem}
+	}
+}
+
+// emulated returns the emulated device of a key store
+func emulated(ks *EnclaveKeyStore) *keySlotRAM {
+	return ks.device.(*keySlotRAM)
+}
+
+// diceLayer is a DICE layer's Compound Device Identifier and the identity key derived from it
+type diceLayer struct {
+	cdi []byte
+	key crypto.Signer
+}
+
+// deviceSecretBinding is wrapped along with the device root key when it is sealed under the KEK, so no
+// other blob wrapped under the KEK can be unsealed as the root key
+var deviceSecretBinding = sha256.Sum256([]byte("fpga-secure-enclave device secret"))
+
+// load writes material to a slot over AXI and keeps it for the emulated cores
+func (r *keySlotRAM) load(slot int, material []byte) error {
+	if err := fpga.LoadKeyToFPGA(material, slotOffset(slot), r.mappedMem); err != nil {
+		return err
+	}
+	r.fill(slot, material)
+	return nil
+}
+
+// fill has the emulated key engine fill a slot, which is not visible over AXI
+func (r *keySlotRAM) fill(slot int, material []byte) {
+	r.forget(slot)
+	r.slots[slot] = append([]byte(nil), material...)
+}
+
+// generate runs the FPGA key generator for alg, filling the key slot and, for asymmetric keys, the
+// partial key slot. Only the public key is returned to the host.
+func (r *keySlotRAM) generate(alg Algorithm, slot, partialSlot int) (crypto.PublicKey, error) {
+	material, partial, public, err := generateKeyMaterial(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.forget(slot)
+	r.slots[slot] = material
+	if partialSlot >= 0 {
+		r.forget(partialSlot)
+		r.slots[partialSlot] = partial
+	}
+	return public, nil
+}
+
+// unwrap recovers a key-encryption key with the transport key, unwraps key material with it into a key
+// slot, derives the key shard into the partial key slot, and returns the public key
+func (r *keySlotRAM) unwrap(wrapped *WrappedKey, alg Algorithm, slot, partialSlot int) (crypto.PublicKey, error) {
+	key, ok := r.transport[wrapped.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("no %s transport key", wrapped.Algorithm)
+	}
+	material, err := unwrapMaterial(key, wrapped, wrapped.aad())
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(material)
+	if alg == AlgorithmAES256 && len(material) != keySize {
+		return nil, fmt.Errorf("AES key must be %d bytes", keySize)
+	}
+
+	var public crypto.PublicKey
+	if alg != AlgorithmAES256 {
+		private, err := privateKeyFromMaterial(alg, material)
+		if err != nil {
+			return nil, err
+		}
+		public = private.(crypto.Signer).Public()
+	}
+
+	if partialSlot >= 0 {
+		shares, err := shamir.Split(material, numShares, threshold)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split %s key using Shamir: %v", alg, err)
+		}
+		r.forget(partialSlot)
+		r.slots[partialSlot] = shares[0]
+		for _, share := range shares[1:] {
+			wipe(share)
+		}
+	}
+	r.fill(slot, material)
+	return public, nil
+}
+
+// transportKey returns the public half of the FPGA's transport key for alg, generating it on first use.
+// The private half never leaves the FPGA.
+func (r *keySlotRAM) transportKey(alg TransportAlgorithm) (crypto.PublicKey, error) {
+	if key, ok := r.transport[alg]; ok {
+		return key.(crypto.Signer).Public(), nil
+	}
+
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case TransportRSAOAEP256:
+		key, err = rsa.GenerateKey(rand.Reader, rsaKeySize*8)
+	case TransportECDHP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported transport algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s transport key: %v", alg, err)
+	}
+
+	if r.transport == nil {
+		r.transport = make(map[TransportAlgorithm]crypto.PrivateKey)
+	}
+	r.transport[alg] = key
+	return key.Public(), nil
+}
+
+// clearTransport discards the transport keys
+func (r *keySlotRAM) clearTransport() {
+	r.transport = nil
+}
+
+// auditKey returns the public half of the FPGA's audit key, deriving it from the device root key on first
+// use. The private half never leaves the FPGA.
+func (r *keySlotRAM) auditKey() (crypto.PublicKey, error) {
+	if r.audit == nil {
+		root, err := r.rootKey()
+		if err != nil {
+			return nil, err
+		}
+		key, err := deriveIdentityKey(AlgorithmECDSAP256, root, "Audit")
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive audit key: %v", err)
+		}
+		r.audit = key.(*ecdsa.PrivateKey)
+	}
+	return r.audit.Public(), nil
+}
+
+// signAudit signs a SHA-256 digest with the audit key
+func (r *keySlotRAM) signAudit(digest []byte) ([]byte, error) {
+	if r.audit == nil {
+		return nil, fmt.Errorf("no audit key")
+	}
+	return ecdsa.SignASN1(rand.Reader, r.audit, digest)
+}
+
+// clearAudit discards the audit key
+func (r *keySlotRAM) clearAudit() {
+	r.audit = nil
+}
+
+// deviceIdentity derives the device identity key from the device root key and returns its public half. Key stores with the same device secret share it.
+func (r *keySlotRAM) deviceIdentity(alg Algorithm) (crypto.PublicKey, error) {
+	if len(r.dice) == 0 {
+		root, err := r.rootKey()
+		if err != nil {
+			return nil, err
+		}
+		cdi := bytes.Clone(root)
+		key, err := deriveIdentityKey(alg, cdi, "DeviceID")
+		if err != nil {
+			return nil, err
+		}
+		r.dice = []diceLayer{{cdi: cdi, key: key}}
+	}
+	return r.dice[0].key.Public(), nil
+}
+
+// extendIdentity adds a DICE layer for a measured image: its CDI is an HMAC of the measurement under the
+// CDI of the layer below, and its alias key is derived from the CDI
+func (r *keySlotRAM) extendIdentity(alg Algorithm, measurement []byte) (crypto.PublicKey, error) {
+	if _, err := r.deviceIdentity(alg); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, r.dice[len(r.dice)-1].cdi)
+	mac.Write(measurement)
+	cdi := mac.Sum(nil)
+	key, err := deriveIdentityKey(alg, cdi, "Alias")
+	if err != nil {
+		return nil, err
+	}
+	r.dice = append(r.dice, diceLayer{cdi: cdi, key: key})
+	return key.Public(), nil
+}
+
+// certify signs a certificate for a public key with the identity key of a layer
+func (r *keySlotRAM) certify(layer int, template, parent *x509.Certificate, public crypto.PublicKey) ([]byte, error) {
+	if layer >= len(r.dice) {
+		return nil, fmt.Errorf("no DICE layer %d", layer)
+	}
+	return x509.CreateCertificate(rand.Reader, template, parent, public, r.dice[layer].key)
+}
+
+// signIdentity signs a SHA-256 digest with the identity key of the top DICE layer
+func (r *keySlotRAM) signIdentity(digest []byte) ([]byte, error) {
+	if len(r.dice) == 0 {
+		return nil, fmt.Errorf("no device identity")
+	}
+	key := r.dice[len(r.dice)-1].key
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// truncateIdentity discards the DICE layers above the first n
+func (r *keySlotRAM) truncateIdentity(n int) error {
+	if n >= len(r.dice) {
+		return nil
+	}
+	for _, layer := range r.dice[n:] {
+		wipe(layer.cdi)
+	}
+	clear(r.dice[n:])
+	r.dice = r.dice[:n]
+	return nil
+}
+
+// clearIdentity discards the DICE layers
+func (r *keySlotRAM) clearIdentity() {
+	r.truncateIdentity(0)
+	r.dice = nil
+}
+
+// extend extends a measurement register with a digest. Registers cannot be written any other way.
+func (r *keySlotRAM) extend(index int, digest []byte) error {
+	if r.extendErr != nil {
+		return r.extendErr
+	}
+	current := r.registers[index]
+	if current == nil {
+		current = make([]byte, sha256.Size)
+	}
+	r.registers[index] = attest.Extend(current, digest)
+	return nil
+}
+
+// resetRegister returns a measurement register to zero, as when the enclave core boots another image
+func (r *keySlotRAM) resetRegister(index int) error {
+	r.registers[index] = nil
+	return nil
+}
+
+// readRegisters returns the value of every measurement register
+func (r *keySlotRAM) readRegisters() ([][]byte, error) {
+	registers := make([][]byte, attest.NumRegisters)
+	for i, register := range r.registers {
+		if register == nil {
+			register = make([]byte, sha256.Size)
+		}
+		registers[i] = append([]byte(nil), register...)
+	}
+	return registers, nil
+}
+
+// rootKey returns the device root key. A key store that was never given the device secret gets a random
+// one, so its identity and sealed data only last as long as the key store.
+func (r *keySlotRAM) rootKey() ([]byte, error) {
+	if r.root == nil {
+		root := make([]byte, keySize)
+		if _, err := rand.Read(root); err != nil {
+			return nil, fmt.Errorf("failed to generate device secret: %v", err)
+		}
+		r.root = root
+	}
+	return r.root, nil
+}
+
+// loadRoot stores a device secret as the device root key
+func (r *keySlotRAM) loadRoot(secret []byte) error {
+	r.clearRoot()
+	r.root = append([]byte(nil), secret...)
+	return nil
+}
+
+// sealRoot wraps the device root key under the key-encryption key with AES-KWP
+func (r *keySlotRAM) sealRoot() ([]byte, error) {
+	if r.kek == nil {
+		return nil, fmt.Errorf("no key-encryption key loaded")
+	}
+	root, err := r.rootKey()
+	if err != nil {
+		return nil, err
+	}
+	plaintext := append(bytes.Clone(deviceSecretBinding[:]), root...)
+	defer wipe(plaintext)
+	return keywrap.WrapPad(r.kek, plaintext)
+}
+
+// unsealRoot unwraps a device root key sealed with sealRoot
+func (r *keySlotRAM) unsealRoot(blob []byte) error {
+	if r.kek == nil {
+		return fmt.Errorf("no key-encryption key loaded")
+	}
+	plaintext, err := keywrap.UnwrapPad(r.kek, blob)
+	if err != nil {
+		return err
+	}
+	defer wipe(plaintext)
+
+	binding := deviceSecretBinding[:]
+	if len(plaintext) != len(binding)+keySize || subtle.ConstantTimeCompare(plaintext[:len(binding)], binding) != 1 {
+		return keywrap.ErrUnwrap
+	}
+	return r.loadRoot(plaintext[len(binding):])
+}
+
+// clearRoot zeroes the device root key
+func (r *keySlotRAM) clearRoot() {
+	wipe(r.root)
+	r.root = nil
+}
+
+// deriveKey derives a key from the device root key with HKDF-SHA256. Derived keys are only used by the
+// FPGA's own cores.
+func (r *keySlotRAM) deriveKey(salt, info []byte) ([]byte, error) {
+	root, err := r.rootKey()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, root, salt, info), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	return key, nil
+}
+
+// sealData encrypts data with AES-256-GCM under a key derived from the device root key and info
+func (r *keySlotRAM) sealData(salt, info, nonce, data, aad []byte) ([]byte, error) {
+	key, err := r.deriveKey(salt, info)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	aead, err := aesgcm.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, data, aad), nil
+}
+
+// unsealData decrypts data sealed with sealData
+func (r *keySlotRAM) unsealData(salt, info, nonce, ciphertext, aad []byte) ([]byte, error) {
+	key, err := r.deriveKey(salt, info)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+	aead, err := aesgcm.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+// read returns the contents of a slot to the emulated cryptographic cores
+func (r *keySlotRAM) read(slot int) ([]byte, error) {
+	if slot < 0 || r.slots[slot] == nil {
+		return nil, fmt.Errorf("key slot %d is empty", slot)
+	}
+	return r.slots[slot], nil
+}
+
+// present reports the emulated key engine as present, so tests can exercise key attestation
+func (r *keySlotRAM) present() bool {
+	return true
+}
+
+// checkImage has the emulated code loader check the tag of an image, or of every segment of a program, with
+// the image key in a slot
+func (r *keySlotRAM) checkImage(slot int, image *container.Container, axiOffset uint32) error {
+	key, err := r.read(slot)
+	if err != nil {
+		return err
+	}
+	if !image.IsProgram() {
+		code, err := image.Open(key)
+		if err != nil {
+			return fpga.ErrIntegrityFailure
+		}
+		wipe(code)
+		return nil
+	}
+	program, err := elfload.FromContainer(image)
+	if err != nil {
+		return err
+	}
+	for i := range program.Segments {
+		data, err := program.Decrypt(i, key)
+		if err != nil {
+			return fpga.ErrIntegrityFailure
+		}
+		wipe(data)
+	}
+	return nil
+}
+
+// clear zeroizes a slot over AXI and forgets its contents
+func (r *keySlotRAM) clear(slot int) {
+	if slot < 0 {
+		return
+	}
+	fpga.ZeroizeKeySlots(1<<slot, keyControlOffset, r.mappedMem)
+	fpga.LoadKeyToFPGA(make([]byte, keySlotStride/4), slotOffset(slot), r.mappedMem)
+	r.forget(slot)
+}
+
+// forget zeroes the kept contents of a slot
+func (r *keySlotRAM) forget(slot int) {
+	wipe(r.slots[slot])
+	r.slots[slot] = nil
+}
+
+// loadKEK writes the key-encryption key register over AXI and keeps the key
+func (r *keySlotRAM) loadKEK(kek []byte) error {
+	if err := fpga.LoadKeyToFPGA(kek, kekOffset, r.mappedMem); err != nil {
+		return err
+	}
+	wipe(r.kek)
+	r.kek = append([]byte(nil), kek...)
+	return nil
+}
+
+// clearKEK zeroizes the key-encryption key register
+func (r *keySlotRAM) clearKEK() {
+	fpga.LoadKeyToFPGA(make([]byte, keySize), kekOffset, r.mappedMem)
+	wipe(r.kek)
+	r.kek = nil
+}
+
+// seal wraps a slot's contents under the key-encryption key with AES-KWP. The binding digest is wrapped
+// along with the key so the blob cannot be attached to different metadata.
+func (r *keySlotRAM) seal(slot int, binding []byte) ([]byte, error) {
+	if r.kek == nil {
+		return nil, fmt.Errorf("no key-encryption key loaded")
+	}
+	material, err := r.read(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := append(append([]byte(nil), binding...), material...)
+	defer wipe(plaintext)
+	return keywrap.WrapPad(r.kek, plaintext)
+}
+
+// unseal unwraps a sealed blob into a slot after checking its binding digest. The key is only released
+// to the host when export is set, which the key store does for exportable keys.
+func (r *keySlotRAM) unseal(slot int, blob, binding []byte, export bool) ([]byte, error) {
+	if r.kek == nil {
+		return nil, fmt.Errorf("no key-encryption key loaded")
+	}
+	plaintext, err := keywrap.UnwrapPad(r.kek, blob)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+
+	if len(plaintext) <= len(binding) || subtle.ConstantTimeCompare(plaintext[:len(binding)], binding) != 1 {
+		return nil, keywrap.ErrUnwrap
+	}
+	material := plaintext[len(binding):]
+	r.fill(slot, material)
+	if !export {
+		return nil, nil
+	}
+	return append([]byte(nil), material...), nil
+}
+
+// tag authenticates data under the key-encryption key by wrapping its digest with AES-KW
+func (r *keySlotRAM) tag(data []byte) ([]byte, error) {
+	if r.kek == nil {
+		return nil, fmt.Errorf("no key-encryption key loaded")
+	}
+	digest := sha256.Sum256(data)
+	return keywrap.Wrap(r.kek, digest[:])
+}
+
+// checkTag verifies a tag made by tag
+func (r *keySlotRAM) checkTag(data, tag []byte) bool {
+	expected, err := r.tag(data)
+	return err == nil && subtle.ConstantTimeCompare(expected, tag) == 1
+}
+
+// deriveIdentityKey deterministically derives an Ed25519 or ECDSA P-256 identity key from a CDI
+func deriveIdentityKey(alg Algorithm, cdi []byte, label string) (crypto.Signer, error) {
+	seeds := hkdf.New(sha256.New, cdi, nil, []byte("fpga-secure-enclave DICE "+label))
+	seed := make([]byte, keySize)
+	defer wipe(seed)
+
+	switch alg {
+	case AlgorithmEd25519:
+		if _, err := io.ReadFull(seeds, seed); err != nil {
+			return nil, fmt.Errorf("failed to derive %s key: %v", label, err)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	case AlgorithmECDSAP256:
+		// Candidates outside the P-256 scalar range are skipped
+		for {
+			if _, err := io.ReadFull(seeds, seed); err != nil {
+				return nil, fmt.Errorf("failed to derive %s key: %v", label, err)
+			}
+			if key, err := ecdsaPrivateKey(seed); err == nil {
+				return key, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported identity key algorithm %q", alg)
+	}
+}
@@ -7,27 +7,62 @@ import (
 )
 
 const (
-	keySize     = 32  // AES-256 key size in bytes
-	rsaKeySize  = 256 // RSA key size in bytes
-	numShares   = 5   // Number of shares for secret sharing
-	threshold   = 3   // Threshold for secret sharing
-	axiBaseAddr = 0xA0000000
-	pageSize    = 4096
+	keySize          = 32  // AES-256 key size in bytes
+	rsaKeySize       = 256 // RSA key size in bytes
+	numShares        = 5   // Number of shares for secret sharing
+	threshold        = 3   // Threshold for secret sharing
+	axiBaseAddr      = 0xA0000000
+	keyControlOffset = 0x0100 // AXI offset of the key control register
+	fuseOffset       = 0x0200 // AXI offset of the one-time programmable fuse register
+	counterOffset    = 0x0204 // AXI offset of the monotonic counter register
+	imageKeyOffset   = 0x0208 // AXI offset of the image key slot register
+	keyEngineOffset  = 0x0400 // AXI offset of the key engine command register
+	kekOffset        = 0x0800 // AXI offset of the key-encryption key register
+	keySlotBase      = 0x1000 // AXI offset of the first hardware key slot
+	keySlotStride    = 0x800  // Each key byte occupies a 32-bit AXI word
+	numKeySlots      = 16     // Number of hardware key slots
+	axiWindowSize    = keySlotBase + numKeySlots*keySlotStride
 )
 
-// EnclaveKeyStore holds the keys for AES, RSA, ECDSA, and Ed25519
-type EnclaveKeyStore struct {
-	AESKey         []byte
-	RSAFullKey     []byte
-	RSAPartial     []byte
-	ECDSAFull      []byte
-	ECDSAPartial   []byte
-	Ed25519Full    []byte
-	Ed25519Partial []byte
-}
+// Labels of the keys created by InitializeEnclave
+const (
+	DefaultAESKeyLabel     = "aes"
+	DefaultRSAKeyLabel     = "rsa"
+	DefaultECDSAKeyLabel   = "ecdsa"
+	DefaultEd25519KeyLabel = "ed25519"
+)
 
-// Initialize the secure enclave by calling each key initializer
+// Initialize the secure enclave by mapping the AXI region and creating the default keys
 func InitializeEnclave() (*EnclaveKeyStore, error) {
+	return initializeEnclave(InitializeKeyStore)
+}
+
+// InitializeNonExportableEnclave initializes the secure enclave with keys generated inside the FPGA
+func InitializeNonExportableEnclave() (*EnclaveKeyStore, error) {
+	return initializeEnclave(InitializeNonExportableKeyStore)
+}
+
+// InitializeSealedEnclave initializes the secure enclave from the sealed key store in config.Dir, creating
+// any default key that has not been persisted yet
+func InitializeSealedEnclave(config KeyStoreConfig) (*EnclaveKeyStore, error) {
+	return initializeEnclave(func(mappedMem []byte) (*EnclaveKeyStore, error) {
+		keyStore, err := OpenKeyStore(mappedMem, config)
+		if err != nil {
+			return nil, err
+		}
+		return createDefaultKeys(keyStore)
+	})
+}
+
+// OpenSealedEnclave maps the AXI region and opens the sealed key store in config without creating any keys
+func OpenSealedEnclave(config KeyStoreConfig) (*EnclaveKeyStore, error) {
+	return initializeEnclave(func(mappedMem []byte) (*EnclaveKeyStore, error) {
+		return OpenKeyStore(mappedMem, config)
+	})
+}
+
+// initializeEnclave maps the AXI region and hands it to the key store initializer
+func initializeEnclave(initialize func([]byte) (*EnclaveKeyStore, error)) (*EnclaveKeyStore, error) {
 	// Map memory for loading keys into FPGA
 	memFile, err := os.OpenFile("/dev/mem", os.O_RDWR|os.O_SYNC, 0666)
 	if err != nil {
@@ -35,44 +70,55 @@ func InitializeEnclave() (*EnclaveKeyStore, error) {
 	}
 	defer memFile.Close()
 
-	mappedMem, err := syscall.Mmap(int(memFile.Fd()), axiBaseAddr, pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	// The mapping stays alive for the key store, which keeps using the key slots
+	mappedMem, err := syscall.Mmap(int(memFile.Fd()), axiBaseAddr, axiWindowSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 	if err != nil {
 		return nil, fmt.Errorf("failed to memory-map the AXI address region: %v", err)
 	}
-	defer syscall.Munmap(mappedMem)
 
-	// Load AES key
-	aesKey, err := InitializeAESKey(mappedMem)
+	keyStore, err := initialize(mappedMem)
 	if err != nil {
+		syscall.Munmap(mappedMem)
 		return nil, err
 	}
-
-	// Load RSA full and partial keys
-	rsaFullKey, rsaPartial, err := InitializeRSAKey(mappedMem)
-	if err != nil {
-		return nil, err
+	keyStore.release = func() error {
+		return syscall.Munmap(mappedMem)
 	}
+	return keyStore, nil
+}
 
-	// Load ECDSA full and partial keys
-	ecdsaFullKey, ecdsaPartial, err := InitializeECDSAKey(mappedMem)
-	if err != nil {
-		return nil, err
-	}
+// InitializeKeyStore creates a key store on an already mapped AXI region and loads one key of each algorithm
+func InitializeKeyStore(mappedMem []byte) (*EnclaveKeyStore, error) {
+	return createDefaultKeys(NewKeyStore(mappedMem))
+}
 
-	// Load Ed25519 full and partial keys
-	ed25519FullKey, ed25519Partial, err := InitializeEd25519Key(mappedMem)
-	if err != nil {
-		return nil, err
+// InitializeNonExportableKeyStore creates a non-exportable key store on an already mapped AXI region and
+// has the FPGA generate one key of each algorithm
+func InitializeNonExportableKeyStore(mappedMem []byte) (*EnclaveKeyStore, error) {
+	return createDefaultKeys(NewNonExportableKeyStore(mappedMem))
+}
+
+// createDefaultKeys creates one key of each algorithm under each default label that is not in use. The key
+// store is destroyed if any key cannot be created, so no key material is left behind.
+func createDefaultKeys(keyStore *EnclaveKeyStore) (*EnclaveKeyStore, error) {
+	defaults := []struct {
+		label string
+		alg   Algorithm
+	}{
+		{DefaultAESKeyLabel, AlgorithmAES256},
+		{DefaultRSAKeyLabel, AlgorithmRSA2048},
+		{DefaultECDSAKeyLabel, AlgorithmECDSAP256},
+		{DefaultEd25519KeyLabel, AlgorithmEd25519},
+	}
+	for _, d := range defaults {
+		if _, err := keyStore.KeyByLabel(d.label); err == nil {
+			continue
+		}
+		if _, err := keyStore.CreateKey(d.label, d.alg); err != nil {
+			keyStore.Destroy()
+			return nil, err
+		}
 	}
 
-	// Return the initialized EnclaveKeyStore
-	return &EnclaveKeyStore{
-		AESKey:         aesKey,
-		RSAFullKey:     rsaFullKey,
-		RSAPartial:     rsaPartial,
-		ECDSAFull:      ecdsaFullKey,
-		ECDSAPartial:   ecdsaPartial,
-		Ed25519Full:    ed25519FullKey,
-		Ed25519Partial: ed25519Partial,
-	}, nil
+	return keyStore, nil
 }
@@ -6,98 +6,143 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// newTestKeyStore initializes the default keys on simulated FPGA memory
+func newTestKeyStore(t *testing.T) *EnclaveKeyStore {
+	keyStore, err := InitializeKeyStore(make([]byte, axiWindowSize))
+	assert.NoError(t, err, "Key store initialization should not return an error")
+	return keyStore
+}
+
+// keyID returns the ID of the key with the given label
+func keyID(t *testing.T, keyStore *EnclaveKeyStore, label string) string {
+	key, err := keyStore.KeyByLabel(label)
+	assert.NoError(t, err, "Key %q should exist", label)
+	return key.ID
+}
+
 func TestEnclaveInitialization(t *testing.T) {
-	// Initialize the secure enclave
-	keyStore, err := InitializeEnclave()
+	// Initialize the secure enclave on simulated FPGA memory
+	keyStore, err := InitializeKeyStore(make([]byte, axiWindowSize))
 
 	// Use Testify to assert the initialization
 	assert.NoError(t, err, "Enclave initialization should not return an error")
 	assert.NotNil(t, keyStore, "KeyStore should be initialized")
+	assert.Len(t, keyStore.ListKeys(), 4, "One key of each algorithm should be generated")
 
 	// Check if the AES key was generated
-	assert.NotNil(t, keyStore.AESKey, "AES key should be generated")
-	assert.Len(t, keyStore.AESKey, keySize, "AES key should have the correct size")
+	aesKey, err := keyStore.KeyByLabel(DefaultAESKeyLabel)
+	assert.NoError(t, err, "AES key should be generated")
+	assert.Equal(t, AlgorithmAES256, aesKey.Algorithm)
+	assert.Equal(t, keySize*8, aesKey.Size, "AES key should have the correct size")
+	assert.Equal(t, -1, aesKey.PartialSlot, "AES key should not have a partial key")
 
 	// Check RSA full and partial keys
-	assert.NotNil(t, keyStore.RSAFullKey, "RSA full key should be generated")
-	assert.Len(t, keyStore.RSAFullKey, rsaKeySize, "RSA full key should have the correct size")
-	assert.NotNil(t, keyStore.RSAPartial, "RSA partial key should be generated")
+	rsaKey, err := keyStore.KeyByLabel(DefaultRSAKeyLabel)
+	assert.NoError(t, err, "RSA key should be generated")
+	assert.Equal(t, rsaKeySize*8, rsaKey.Size, "RSA full key should have the correct size")
+	assert.NotEqual(t, -1, rsaKey.PartialSlot, "RSA partial key should be generated")
+	assert.NotNil(t, rsaKey.PublicKey, "RSA public key should be available")
 
 	// Check ECDSA full and partial keys
-	assert.NotNil(t, keyStore.ECDSAFull, "ECDSA full key should be generated")
-	assert.Len(t, keyStore.ECDSAFull, rsaKeySize, "ECDSA full key should have the correct size")
-	assert.NotNil(t, keyStore.ECDSAPartial, "ECDSA partial key should be generated")
+	ecdsaKey, err := keyStore.KeyByLabel(DefaultECDSAKeyLabel)
+	assert.NoError(t, err, "ECDSA key should be generated")
+	assert.Equal(t, keySize*8, ecdsaKey.Size, "ECDSA full key should have the correct size")
+	assert.NotEqual(t, -1, ecdsaKey.PartialSlot, "ECDSA partial key should be generated")
 
 	// Check Ed25519 full and partial keys
-	assert.NotNil(t, keyStore.Ed25519Full, "Ed25519 full key should be generated")
-	assert.Len(t, keyStore.Ed25519Full, rsaKeySize, "Ed25519 full key should have the correct size")
-	assert.NotNil(t, keyStore.Ed25519Partial, "Ed25519 partial key should be generated")
+	ed25519Key, err := keyStore.KeyByLabel(DefaultEd25519KeyLabel)
+	assert.NoError(t, err, "Ed25519 key should be generated")
+	assert.Equal(t, keySize*8, ed25519Key.Size, "Ed25519 full key should have the correct size")
+	assert.NotEqual(t, -1, ed25519Key.PartialSlot, "Ed25519 partial key should be generated")
 }
 
 func TestRSAOperations(t *testing.T) {
-	keyStore, err := InitializeEnclave()
-	assert.NoError(t, err, "Enclave initialization should not return an error")
+	keyStore := newTestKeyStore(t)
+	rsaKey := keyID(t, keyStore, DefaultRSAKeyLabel)
 
 	message := []byte("Test message for signing.")
 
 	// Test RSA full signing
-	signature, err := RSASign(message, keyStore)
+	signature, err := RSASign(message, keyStore, rsaKey)
 	assert.NoError(t, err, "RSA signature operation should succeed")
 	assert.NotNil(t, signature, "RSA signature should be generated")
 
 	// Test RSA partial signing
-	partialSig, err := RSAPartialSign(message, keyStore)
+	partialSig, err := RSAPartialSign(message, keyStore, rsaKey)
 	assert.NoError(t, err, "RSA partial signature operation should succeed")
 	assert.NotNil(t, partialSig, "RSA partial signature should be generated")
 }
 
 func TestECDSAOperations(t *testing.T) {
-	keyStore, err := InitializeEnclave()
-	assert.NoError(t, err, "Enclave initialization should not return an error")
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
 
 	message := []byte("Test message for signing.")
 
 	// Test ECDSA full signing
-	signature, err := ECDSASign(message, keyStore)
+	signature, err := ECDSASign(message, keyStore, ecdsaKey)
 	assert.NoError(t, err, "ECDSA signature operation should succeed")
 	assert.NotNil(t, signature, "ECDSA signature should be generated")
 
 	// Test ECDSA partial signing
-	partialSig, err := ECDSAPartialSign(message, keyStore)
+	partialSig, err := ECDSAPartialSign(message, keyStore, ecdsaKey)
 	assert.NoError(t, err, "ECDSA partial signature operation should succeed")
 	assert.NotNil(t, partialSig, "ECDSA partial signature should be generated")
 }
 
 func TestEd25519Operations(t *testing.T) {
-	keyStore, err := InitializeEnclave()
-	assert.NoError(t, err, "Enclave initialization should not return an error")
+	keyStore := newTestKeyStore(t)
+	ed25519Key := keyID(t, keyStore, DefaultEd25519KeyLabel)
 
 	message := []byte("Test message for signing.")
 
 	// Test Ed25519 full signing
-	signature, err := Ed25519Sign(message, keyStore)
+	signature, err := Ed25519Sign(message, keyStore, ed25519Key)
 	assert.NoError(t, err, "Ed25519 signature operation should succeed")
 	assert.NotNil(t, signature, "Ed25519 signature should be generated")
 
 	// Test Ed25519 partial signing
-	partialSig, err := Ed25519PartialSign(message, keyStore)
+	partialSig, err := Ed25519PartialSign(message, keyStore, ed25519Key)
 	assert.NoError(t, err, "Ed25519 partial signature operation should succeed")
 	assert.NotNil(t, partialSig, "Ed25519 partial signature should be generated")
 }
 
 func TestAESOperations(t *testing.T) {
-	keyStore, err := InitializeEnclave()
-	assert.NoError(t, err, "Enclave initialization should not return an error")
+	keyStore := newTestKeyStore(t)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
 
 	plaintext := []byte("Test data for AES encryption.")
 
 	// Test AES encryption
-	ciphertext, err := AESEncrypt(plaintext, keyStore)
+	ciphertext, err := AESEncrypt(plaintext, keyStore, aesKey)
 	assert.NoError(t, err, "AES encryption operation should succeed")
 	assert.NotNil(t, ciphertext, "AES ciphertext should be generated")
 
 	// Test AES decryption
-	decrypted, err := AESDecrypt(ciphertext, keyStore)
+	decrypted, err := AESDecrypt(ciphertext, keyStore, aesKey)
 	assert.NoError(t, err, "AES decryption operation should succeed")
 	assert.Equal(t, plaintext, decrypted, "Decrypted data should match the original plaintext")
 }
+
+func TestEncryptCodeAES(t *testing.T) {
+	key := make([]byte, keySize)
+	code := []byte("enclave program")
+
+	// Test authenticated code encryption
+	ciphertext, iv, err := EncryptCodeAES(code, key)
+	assert.NoError(t, err, "Code encryption should succeed")
+	assert.Len(t, iv, 12, "IV should be a 12-byte GCM nonce")
+	assert.Len(t, ciphertext, len(code)+16, "Ciphertext should carry a 16-byte tag")
+
+	decrypted, err := DecryptCodeAES(ciphertext, iv, key)
+	assert.NoError(t, err, "Code decryption should succeed")
+	assert.Equal(t, code, decrypted, "Decrypted code should match the original")
+
+	// Flipped bits in the encrypted program are detected
+	ciphertext[0] ^= 1
+	_, err = DecryptCodeAES(ciphertext, iv, key)
+	assert.ErrorIs(t, err, ErrCodeIntegrity, "Modified code should fail the integrity check")
+
+	_, _, err = EncryptCodeAES(code, key[:16])
+	assert.Error(t, err, "Only AES-256 keys should be accepted")
+}
@@ -0,0 +1,142 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/jwk"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoPublicKey is returned when a public key is requested for a symmetric key
+var ErrNoPublicKey = errors.New("key has no public key")
+
+// PublicKey returns the public key of an asymmetric key
+func (ks *EnclaveKeyStore) PublicKey(id string) (crypto.PublicKey, error) {
+	key, err := ks.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.PublicKey == nil {
+		return nil, fmt.Errorf("%w: %s is %s", ErrNoPublicKey, id, key.Algorithm)
+	}
+	return key.PublicKey, nil
+}
+
+// ExportPublicKeyDER returns the public key as a PKIX SubjectPublicKeyInfo in DER form
+func (ks *EnclaveKeyStore) ExportPublicKeyDER(id string) ([]byte, error) {
+	public, err := ks.PublicKey(id)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key of %s: %v", id, err)
+	}
+	return der, nil
+}
+
+// ExportPublicKeyPEM returns the public key as a PEM "PUBLIC KEY" block
+func (ks *EnclaveKeyStore) ExportPublicKeyPEM(id string) ([]byte, error) {
+	der, err := ks.ExportPublicKeyDER(id)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ExportPublicKeyJWK returns the public key as a JWK for signature verification, identified by its
+// RFC 7638 thumbprint
+func (ks *EnclaveKeyStore) ExportPublicKeyJWK(id string) (*jwk.Key, error) {
+	key, err := ks.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return publicJWK(key)
+}
+
+// ExportJWKS returns a JWK set of the public keys of every active asymmetric key
+func (ks *EnclaveKeyStore) ExportJWKS() (*jwk.Set, error) {
+	set := &jwk.Set{Keys: []*jwk.Key{}}
+	for _, key := range ks.ListKeys() {
+		if key.State != KeyStateActive || key.PublicKey == nil {
+			continue
+		}
+		k, err := publicJWK(key)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, k)
+	}
+	return set, nil
+}
+
+// ExportAuthorizedKey returns the public key as an SSH authorized_keys line, commented with the key label
+func (ks *EnclaveKeyStore) ExportAuthorizedKey(id string) ([]byte, error) {
+	key, err := ks.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.PublicKey == nil {
+		return nil, fmt.Errorf("%w: %s is %s", ErrNoPublicKey, id, key.Algorithm)
+	}
+	public, err := ssh.NewPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode SSH public key of %s: %v", id, err)
+	}
+
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(public), []byte("\n"))
+	if key.Label != "" {
+		line = append(append(line, ' '), key.Label...)
+	}
+	return append(line, '\n'), nil
+}
+
+// KeyThumbprint returns the RFC 7638 JWK thumbprint of a key's public key, a stable identifier that
+// verifiers can compute on their own
+func (ks *EnclaveKeyStore) KeyThumbprint(id string) (string, error) {
+	public, err := ks.PublicKey(id)
+	if err != nil {
+		return "", err
+	}
+	k, err := jwk.FromPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	return k.Thumbprint()
+}
+
+// publicJWK returns the JWK of a key's public key with its thumbprint as key ID
+func publicJWK(key *KeyHandle) (*jwk.Key, error) {
+	if key.PublicKey == nil {
+		return nil, fmt.Errorf("%w: %s is %s", ErrNoPublicKey, key.ID, key.Algorithm)
+	}
+	k, err := jwk.FromPublicKey(key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if k.Kid, err = k.Thumbprint(); err != nil {
+		return nil, err
+	}
+	k.Use = "sig"
+	k.Alg = key.Algorithm.jwsAlgorithm()
+	return k, nil
+}
+
+// jwsAlgorithm returns the JWS algorithm name for signatures made with the key
+func (a Algorithm) jwsAlgorithm() string {
+	switch a {
+	case AlgorithmRSA2048:
+		return "RS256"
+	case AlgorithmECDSAP256:
+		return "ES256"
+	case AlgorithmEd25519:
+		return "EdDSA"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,115 @@
+package enclave
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/jwk"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExportPublicKeys(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+
+	for _, key := range keyStore.ListKeys() {
+		if key.Algorithm == AlgorithmAES256 {
+			_, err := keyStore.ExportPublicKeyPEM(key.ID)
+			assert.ErrorIs(t, err, ErrNoPublicKey)
+			_, err = keyStore.ExportAuthorizedKey(key.ID)
+			assert.ErrorIs(t, err, ErrNoPublicKey)
+			continue
+		}
+
+		// PKIX DER and PEM
+		der, err := keyStore.ExportPublicKeyDER(key.ID)
+		assert.NoError(t, err)
+		public, err := x509.ParsePKIXPublicKey(der)
+		assert.NoError(t, err)
+		assert.Equal(t, key.PublicKey, public)
+
+		encoded, err := keyStore.ExportPublicKeyPEM(key.ID)
+		assert.NoError(t, err)
+		block, _ := pem.Decode(encoded)
+		assert.Equal(t, "PUBLIC KEY", block.Type)
+		assert.Equal(t, der, block.Bytes)
+
+		// JWK, identified by its thumbprint
+		k, err := keyStore.ExportPublicKeyJWK(key.ID)
+		assert.NoError(t, err)
+		thumbprint, err := keyStore.KeyThumbprint(key.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, thumbprint, k.Kid)
+		assert.Equal(t, "sig", k.Use)
+		assert.Empty(t, k.D)
+		public, err = k.PublicKey()
+		assert.NoError(t, err)
+		assert.Equal(t, key.PublicKey, public)
+
+		// SSH authorized_keys
+		line, err := keyStore.ExportAuthorizedKey(key.ID)
+		assert.NoError(t, err)
+		sshKey, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		assert.NoError(t, err)
+		assert.Equal(t, key.Label, comment)
+		expected, err := ssh.NewPublicKey(key.PublicKey)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.Marshal(), sshKey.Marshal())
+	}
+}
+
+func TestExportJWKS(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+	thumbprint, err := keyStore.KeyThumbprint(ecdsaKey)
+	assert.NoError(t, err)
+
+	// Every active asymmetric key is published
+	set, err := keyStore.ExportJWKS()
+	assert.NoError(t, err)
+	assert.Len(t, set.Keys, 3)
+	algs := make([]string, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		algs = append(algs, k.Alg)
+	}
+	assert.ElementsMatch(t, []string{"RS256", "ES256", "EdDSA"}, algs)
+
+	// Disabled keys are left out
+	assert.NoError(t, keyStore.DisableKey(ecdsaKey))
+	set, err = keyStore.ExportJWKS()
+	assert.NoError(t, err)
+	assert.Len(t, set.Keys, 2)
+	for _, k := range set.Keys {
+		assert.NotEqual(t, thumbprint, k.Kid)
+	}
+
+	// The set round-trips as JSON
+	encoded, err := json.Marshal(set)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(encoded), `{"keys":[`))
+	var decoded jwk.Set
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, set, &decoded)
+}
+
+func TestKeyThumbprintStable(t *testing.T) {
+	// The thumbprint depends only on the public key, so it survives a reload from sealed storage
+	dir := t.TempDir()
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("signing", AlgorithmEd25519)
+	assert.NoError(t, err)
+	before, err := keyStore.KeyThumbprint(key.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	after, err := keyStore.KeyThumbprint(key.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+	assert.NoError(t, keyStore.Destroy())
+}
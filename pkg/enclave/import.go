@@ -0,0 +1,203 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/vault/shamir"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/jwk"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUnsupportedKey is returned when an imported key is not supported by the hardware key slots
+var ErrUnsupportedKey = errors.New("key is not supported by the enclave")
+
+// ImportOptions control how a private key is imported
+type ImportOptions struct {
+	Passphrase []byte // Passphrase of an encrypted OpenSSH private key
+	WipeSource bool   // Overwrite the encoded key with zeros once it is parsed
+}
+
+// ImportKey parses a private key in PEM (PKCS#8, PKCS#1 or SEC1), JWK or OpenSSH format and loads it into
+// hardware slots under label. The parsed key is wiped once it is loaded.
+func (ks *EnclaveKeyStore) ImportKey(label string, data []byte, opts ImportOptions) (*KeyHandle, error) {
+	key, err := ParsePrivateKey(data, opts.Passphrase)
+	if opts.WipeSource {
+		wipe(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer wipePrivateKey(key)
+	return ks.ImportPrivateKey(label, key)
+}
+
+// ImportPrivateKey loads a private key into hardware slots under label. Supported keys are RSA-2048 with
+// exponent 65537, ECDSA P-256, Ed25519, and 32-byte []byte AES keys.
+func (ks *EnclaveKeyStore) ImportPrivateKey(label string, key crypto.PrivateKey) (*KeyHandle, error) {
+	handle, material, partial, err := importMaterial(label, key)
+	if err != nil {
+		return nil, err
+	}
+	return ks.addKey(handle, material, partial)
+}
+
+// importMaterial returns the handle, slot material and Shamir key shard of a private key to import
+func importMaterial(label string, key crypto.PrivateKey) (KeyHandle, []byte, []byte, error) {
+	alg, material, public, err := materialFromPrivateKey(key)
+	if err != nil {
+		return KeyHandle{}, nil, nil, err
+	}
+	size, err := alg.keySizeBits()
+	if err != nil {
+		wipe(material)
+		return KeyHandle{}, nil, nil, err
+	}
+
+	var partial []byte
+	if alg != AlgorithmAES256 {
+		// Split the key using Shamir Secret Sharing, using the first share as the partial key shard
+		shares, err := shamir.Split(material, numShares, threshold)
+		if err != nil {
+			wipe(material)
+			return KeyHandle{}, nil, nil, fmt.Errorf("failed to split %s key using Shamir: %v", alg, err)
+		}
+		partial = shares[0]
+		for _, s := range shares[1:] {
+			wipe(s)
+		}
+	}
+
+	return KeyHandle{
+		Label:     label,
+		Algorithm: alg,
+		Size:      size,
+		PublicKey: public,
+		Origin:    KeyOriginImported,
+	}, material, partial, nil
+}
+
+// ParsePrivateKey parses a private key in PEM (PKCS#8, PKCS#1 or SEC1), JWK or OpenSSH format. AES keys
+// are only supported as JWK "oct" keys and are returned as a []byte.
+func ParsePrivateKey(data []byte, passphrase []byte) (crypto.PrivateKey, error) {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		key, err := jwk.Parse(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		return key.PrivateKey()
+	}
+
+	block, _ := pem.Decode(trimmed)
+	if block == nil {
+		return nil, fmt.Errorf("private key is neither PEM nor JWK")
+	}
+	defer wipe(block.Bytes)
+	if _, encrypted := block.Headers["Proc-Type"]; encrypted {
+		return nil, fmt.Errorf("encrypted PEM private keys are not supported")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		if len(passphrase) > 0 {
+			return ssh.ParseRawPrivateKeyWithPassphrase(trimmed, passphrase)
+		}
+		return ssh.ParseRawPrivateKey(trimmed)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// wipePrivateKey overwrites the private parts of a parsed key with zeros. Public parts are kept, since key
+// handles may share them.
+func wipePrivateKey(key crypto.PrivateKey) {
+	switch k := key.(type) {
+	case []byte:
+		wipe(k)
+	case *rsa.PrivateKey:
+		wipeInt(k.D)
+		for _, prime := range k.Primes {
+			wipeInt(prime)
+		}
+		wipeInt(k.Precomputed.Dp)
+		wipeInt(k.Precomputed.Dq)
+		wipeInt(k.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		wipeInt(k.D)
+	case ed25519.PrivateKey:
+		wipe(k)
+	case *ed25519.PrivateKey:
+		wipe(*k)
+	}
+}
+
+// wipeInt overwrites a big integer with zeros
+func wipeInt(x *big.Int) {
+	if x != nil {
+		clear(x.Bits())
+		x.SetInt64(0)
+	}
+}
+
+// materialFromPrivateKey validates a private key against the hardware capabilities and returns its key slot
+// material, the inverse of privateKeyFromMaterial
+func materialFromPrivateKey(key crypto.PrivateKey) (Algorithm, []byte, crypto.PublicKey, error) {
+	switch k := key.(type) {
+	case []byte:
+		if len(k) != keySize {
+			return "", nil, nil, fmt.Errorf("%w: AES keys must be %d bits, got %d", ErrUnsupportedKey, keySize*8, len(k)*8)
+		}
+		return AlgorithmAES256, append([]byte(nil), k...), nil, nil
+
+	case *rsa.PrivateKey:
+		if k.N.BitLen() != rsaKeySize*8 {
+			return "", nil, nil, fmt.Errorf("%w: RSA keys must be %d bits, got %d", ErrUnsupportedKey, rsaKeySize*8, k.N.BitLen())
+		}
+		if k.E != 65537 {
+			return "", nil, nil, fmt.Errorf("%w: RSA public exponent must be 65537", ErrUnsupportedKey)
+		}
+		if len(k.Primes) != 2 {
+			return "", nil, nil, fmt.Errorf("%w: multi-prime RSA keys are not supported", ErrUnsupportedKey)
+		}
+		if err := k.Validate(); err != nil {
+			return "", nil, nil, fmt.Errorf("invalid RSA key: %v", err)
+		}
+		if k.Primes[0].BitLen() > rsaKeySize*4 || k.Primes[1].BitLen() > rsaKeySize*4 {
+			return "", nil, nil, fmt.Errorf("%w: RSA primes must be %d bits", ErrUnsupportedKey, rsaKeySize*4)
+		}
+		material := make([]byte, rsaKeySize)
+		k.Primes[0].FillBytes(material[:rsaKeySize/2])
+		k.Primes[1].FillBytes(material[rsaKeySize/2:])
+		return AlgorithmRSA2048, material, &k.PublicKey, nil
+
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", nil, nil, fmt.Errorf("%w: ECDSA keys must use P-256, got %s", ErrUnsupportedKey, k.Curve.Params().Name)
+		}
+		return AlgorithmECDSAP256, k.D.FillBytes(make([]byte, keySize)), &k.PublicKey, nil
+
+	case ed25519.PrivateKey:
+		return AlgorithmEd25519, append([]byte(nil), k.Seed()...), k.Public(), nil
+	case *ed25519.PrivateKey:
+		return materialFromPrivateKey(*k)
+
+	default:
+		return "", nil, nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	}
+}
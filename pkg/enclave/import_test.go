@@ -0,0 +1,167 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// encodePEM returns a PEM block
+func encodePEM(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestImportKeyFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	pkcs8 := func(key crypto.PrivateKey) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+		return encodePEM("PRIVATE KEY", der)
+	}
+	openSSH := func(key crypto.PrivateKey, passphrase string) []byte {
+		var block *pem.Block
+		var err error
+		if passphrase == "" {
+			block, err = ssh.MarshalPrivateKey(key, "imported")
+		} else {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "imported", []byte(passphrase))
+		}
+		assert.NoError(t, err)
+		return pem.EncodeToMemory(block)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecdsaKey)
+	assert.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	ecdsaJWK := fmt.Sprintf(`{"kty":"EC","crv":"P-256","x":"%s","y":"%s","d":"%s"}`,
+		b64(ecdsaKey.X.FillBytes(make([]byte, 32))), b64(ecdsaKey.Y.FillBytes(make([]byte, 32))), b64(ecdsaKey.D.FillBytes(make([]byte, 32))))
+	ed25519JWK := fmt.Sprintf(`{"kty":"OKP","crv":"Ed25519","x":"%s","d":"%s"}`,
+		b64(ed25519Key.Public().(ed25519.PublicKey)), b64(ed25519Key.Seed()))
+	aesKey := make([]byte, keySize)
+	_, err = rand.Read(aesKey)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		alg        Algorithm
+		public     crypto.PublicKey
+	}{
+		{"PKCS#8 RSA", pkcs8(rsaKey), "", AlgorithmRSA2048, &rsaKey.PublicKey},
+		{"PKCS#1 RSA", encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), "", AlgorithmRSA2048, &rsaKey.PublicKey},
+		{"PKCS#8 ECDSA", pkcs8(ecdsaKey), "", AlgorithmECDSAP256, &ecdsaKey.PublicKey},
+		{"SEC1 ECDSA", encodePEM("EC PRIVATE KEY", sec1), "", AlgorithmECDSAP256, &ecdsaKey.PublicKey},
+		{"PKCS#8 Ed25519", pkcs8(ed25519Key), "", AlgorithmEd25519, ed25519Key.Public()},
+		{"OpenSSH RSA", openSSH(rsaKey, ""), "", AlgorithmRSA2048, &rsaKey.PublicKey},
+		{"OpenSSH ECDSA", openSSH(ecdsaKey, ""), "", AlgorithmECDSAP256, &ecdsaKey.PublicKey},
+		{"OpenSSH Ed25519", openSSH(ed25519Key, "secret"), "secret", AlgorithmEd25519, ed25519Key.Public()},
+		{"JWK ECDSA", []byte(ecdsaJWK), "", AlgorithmECDSAP256, &ecdsaKey.PublicKey},
+		{"JWK Ed25519", []byte(ed25519JWK), "", AlgorithmEd25519, ed25519Key.Public()},
+		{"JWK AES", []byte(fmt.Sprintf(`{"kty":"oct","k":"%s"}`, b64(aesKey))), "", AlgorithmAES256, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			keyStore := NewKeyStore(make([]byte, axiWindowSize))
+			key, err := keyStore.ImportKey("imported", c.data, ImportOptions{Passphrase: []byte(c.passphrase)})
+			assert.NoError(t, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, c.alg, key.Algorithm)
+
+			// The exported key is the imported one
+			exported, err := keyStore.ExportPrivateKey(key.ID)
+			assert.NoError(t, err)
+			if c.public == nil {
+				assert.Equal(t, aesKey, exported)
+				return
+			}
+			assert.True(t, c.public.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.PublicKey))
+			assert.True(t, c.public.(interface{ Equal(crypto.PublicKey) bool }).Equal(exported.(crypto.Signer).Public()))
+		})
+	}
+}
+
+func TestImportKeyValidation(t *testing.T) {
+	keyStore := NewKeyStore(make([]byte, axiWindowSize))
+
+	// Keys the hardware cannot hold are refused
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	_, err = keyStore.ImportPrivateKey("rsa-1024", rsa1024)
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(p384)
+	assert.NoError(t, err)
+	_, err = keyStore.ImportKey("p384", encodePEM("PRIVATE KEY", der), ImportOptions{})
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	_, err = keyStore.ImportPrivateKey("aes-128", make([]byte, 16))
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	_, err = keyStore.ImportKey("garbage", []byte("not a key"), ImportOptions{})
+	assert.Error(t, err)
+	assert.Empty(t, keyStore.ListKeys())
+}
+
+func TestImportKeyWipe(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	assert.NoError(t, err)
+	data := encodePEM("PRIVATE KEY", der)
+
+	// A non-exportable key store keeps nothing, and the encoded source is wiped
+	keyStore := NewNonExportableKeyStore(make([]byte, axiWindowSize))
+	key, err := keyStore.ImportKey("imported", data, ImportOptions{WipeSource: true})
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, len(data)), data)
+	assert.False(t, key.Exportable)
+	assert.True(t, ecdsaKey.PublicKey.Equal(key.PublicKey))
+
+	_, err = keyStore.ExportPrivateKey(key.ID)
+	assert.ErrorIs(t, err, ErrKeyNotExportable)
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+}
+
+func TestWipePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// Private parts are zeroed and public parts kept
+	wipePrivateKey(rsaKey)
+	assert.Zero(t, rsaKey.D.Sign())
+	assert.Zero(t, rsaKey.Primes[0].Sign())
+	assert.Zero(t, rsaKey.Precomputed.Qinv.Sign())
+	assert.Equal(t, 2048, rsaKey.N.BitLen())
+	wipePrivateKey(ecdsaKey)
+	assert.Zero(t, ecdsaKey.D.Sign())
+	assert.NotZero(t, ecdsaKey.X.Sign())
+	wipePrivateKey(ed25519Key)
+	assert.Equal(t, make(ed25519.PrivateKey, ed25519.PrivateKeySize), ed25519Key)
+}
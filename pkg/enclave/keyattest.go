@@ -0,0 +1,145 @@
+package enclave
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+)
+
+// AttestKey has the device identity sign a statement that a key is held in this enclave, with its public
+// key, algorithm, exportability, origin and policies, for a verifier's nonce of 8 to 64 bytes. The
+// statement is signed by the top DICE layer and carries the certificate chain, so a CA can check it with
+// an attest.KeyVerifier before certifying the key. Keys are only resident in the device when the FPGA has a
+// key engine, so without one AttestKey fails with ErrNoKeyEngine.
+func (ks *EnclaveKeyStore) AttestKey(id string, nonce []byte) (*attest.KeyStatement, error) {
+	if len(nonce) < attest.MinNonceSize || len(nonce) > attest.MaxNonceSize {
+		return nil, fmt.Errorf("nonce must be %d to %d bytes, not %d", attest.MinNonceSize, attest.MaxNonceSize, len(nonce))
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	if !ks.device.present() {
+		return nil, ErrNoKeyEngine
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if err := ks.deviceIdentityLocked(); err != nil {
+		return nil, err
+	}
+
+	handle := key.handle
+	statement := &attest.KeyStatement{
+		Version:     attest.KeyStatementVersion,
+		KeyID:       handle.ID,
+		Algorithm:   string(handle.Algorithm),
+		Exportable:  handle.Exportable,
+		Origin:      string(handle.Origin),
+		Measurement: append([]byte(nil), ks.image...),
+		Nonce:       append([]byte(nil), nonce...),
+		Time:        policyClock().UTC(),
+	}
+	var err error
+	if handle.PublicKey != nil {
+		if statement.PublicKey, err = x509.MarshalPKIXPublicKey(handle.PublicKey); err != nil {
+			return nil, fmt.Errorf("failed to encode public key of %s: %v", id, err)
+		}
+	}
+	if key.policy != nil {
+		if statement.Policy, err = json.Marshal(key.policy); err != nil {
+			return nil, fmt.Errorf("failed to encode policy of %s: %v", id, err)
+		}
+	}
+	if key.signing != nil {
+		if statement.SigningPolicy, err = json.Marshal(key.signing); err != nil {
+			return nil, fmt.Errorf("failed to encode signing policy of %s: %v", id, err)
+		}
+	}
+
+	if err := ks.signStatementLocked(statement); err != nil {
+		return nil, err
+	}
+	err = ks.auditLocked(AuditEvent{Type: "key.attest", KeyID: id, Details: map[string]any{
+		"nonce": hex.EncodeToString(nonce),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// AttestTransportKey has the device identity sign a statement that the transport key for alg is held in
+// this enclave, for a verifier's nonce of 8 to 64 bytes. The statement's KeyID is the transport key ID and
+// its Algorithm the transport algorithm, so a provisioning server can check it with an attest.KeyVerifier
+// before wrapping keys to the transport key. Like AttestKey, it fails with ErrNoKeyEngine without a key
+// engine.
+func (ks *EnclaveKeyStore) AttestTransportKey(alg TransportAlgorithm, nonce []byte) (*attest.KeyStatement, error) {
+	if len(nonce) < attest.MinNonceSize || len(nonce) > attest.MaxNonceSize {
+		return nil, fmt.Errorf("nonce must be %d to %d bytes, not %d", attest.MinNonceSize, attest.MaxNonceSize, len(nonce))
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	if !ks.device.present() {
+		return nil, ErrNoKeyEngine
+	}
+	public, err := ks.device.transportKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransportKey(alg, public)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.deviceIdentityLocked(); err != nil {
+		return nil, err
+	}
+
+	// Transport keys are generated inside the FPGA and never leave it
+	statement := &attest.KeyStatement{
+		Version:     attest.KeyStatementVersion,
+		KeyID:       transport.ID,
+		Algorithm:   string(alg),
+		PublicKey:   transport.PublicKey,
+		Origin:      string(KeyOriginGenerated),
+		Measurement: append([]byte(nil), ks.image...),
+		Nonce:       append([]byte(nil), nonce...),
+		Time:        policyClock().UTC(),
+	}
+	if err := ks.signStatementLocked(statement); err != nil {
+		return nil, err
+	}
+	err = ks.auditLocked(AuditEvent{Type: "transport.attest", KeyID: transport.ID, Details: map[string]any{
+		"algorithm": string(alg),
+		"nonce":     hex.EncodeToString(nonce),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// signStatementLocked signs a key statement with the top DICE layer and attaches the certificate chain
+func (ks *EnclaveKeyStore) signStatementLocked(statement *attest.KeyStatement) error {
+	signature, err := ks.device.signIdentity(statement.Digest())
+	if err != nil {
+		return fmt.Errorf("failed to sign key statement: %v", err)
+	}
+	statement.Signature = signature
+	for _, cert := range ks.identity {
+		statement.Certificates = append(statement.Certificates, cert.Raw)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package enclave
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/stretchr/testify/assert"
+)
+
+// keyVerifier returns a key statement verifier trusting the key store's device identity
+func keyVerifier(t *testing.T, keyStore *EnclaveKeyStore) *attest.KeyVerifier {
+	deviceID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+	return &attest.KeyVerifier{Roots: roots}
+}
+
+func TestAttestKey(t *testing.T) {
+	keyStore := NewNonExportableKeyStore(make([]byte, axiWindowSize))
+	log := NewMemoryAuditLog()
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	key, err := keyStore.CreateKey("signing", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.Equal(t, KeyOriginGenerated, key.Origin)
+	assert.NoError(t, keyStore.SetKeyPolicy(key.ID, &KeyPolicy{Operations: []Operation{OperationSign}}))
+	measurement := loadTestImage(t, keyStore)
+
+	nonce := []byte("ca-challenge-0001")
+	statement, err := keyStore.AttestKey(key.ID, nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, measurement, statement.Measurement)
+	assert.JSONEq(t, `{"operations":["sign"],"not_before":"0001-01-01T00:00:00Z","not_after":"0001-01-01T00:00:00Z"}`, string(statement.Policy))
+
+	// Statements survive encoding, and the verifier returns the attested key for the CA to certify
+	encoded, err := json.Marshal(statement)
+	assert.NoError(t, err)
+	decoded, err := attest.ParseKeyStatement(encoded)
+	assert.NoError(t, err)
+	verifier := keyVerifier(t, keyStore)
+	verifier.Measurements = [][]byte{measurement}
+	verifier.MaxAge = time.Minute
+	public, err := verifier.Verify(decoded, nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey, public)
+
+	// Any change to the statement breaks its signature
+	decoded.Exportable = true
+	_, err = verifier.Verify(decoded, nonce)
+	assert.ErrorIs(t, err, attest.ErrBadSignature)
+	_, err = verifier.Verify(statement, []byte("ca-challenge-0002"))
+	assert.ErrorIs(t, err, attest.ErrNonceMismatch)
+
+	_, err = keyStore.AttestKey("missing", nonce)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = keyStore.AttestKey(key.ID, []byte("short"))
+	assert.Error(t, err)
+	assert.Contains(t, eventTypes(log.Events()), "key.attest")
+}
+
+func TestAttestKeyOrigins(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	nonce := []byte("ca-challenge-0001")
+	verifier := keyVerifier(t, keyStore)
+
+	// Keys generated on the host or imported are reported as such, and rejected unless allowed
+	key, err := keyStore.CreateKey("host", AlgorithmEd25519)
+	assert.NoError(t, err)
+	statement, err := keyStore.AttestKey(key.ID, nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, string(KeyOriginHost), statement.Origin)
+	assert.True(t, statement.Exportable)
+	assert.Empty(t, statement.Measurement)
+	_, err = verifier.Verify(statement, nonce)
+	assert.ErrorIs(t, err, attest.ErrKeyNotResident)
+	verifier.AllowHostKeys = true
+	_, err = verifier.Verify(statement, nonce)
+	assert.NoError(t, err)
+
+	transport, err := keyStore.TransportKey(TransportECDHP256)
+	assert.NoError(t, err)
+	wrapped, err := WrapKey(transport, "wrapped", make([]byte, keySize))
+	assert.NoError(t, err)
+	key, err = keyStore.ImportWrappedKey(wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, KeyOriginUnwrapped, key.Origin)
+	statement, err = keyStore.AttestKey(key.ID, nonce)
+	assert.NoError(t, err)
+	public, err := verifier.Verify(statement, nonce)
+	assert.NoError(t, err)
+	assert.Nil(t, public)
+
+	// Statements from another device are rejected
+	other := NewNonExportableKeyStore(make([]byte, axiWindowSize))
+	emulated(other).root = make([]byte, keySize)
+	key, err = other.CreateKey("other", AlgorithmEd25519)
+	assert.NoError(t, err)
+	statement, err = other.AttestKey(key.ID, nonce)
+	assert.NoError(t, err)
+	_, err = verifier.Verify(statement, nonce)
+	assert.ErrorIs(t, err, attest.ErrInvalidIdentity)
+}
+
+func TestAttestKeyWithoutKeyEngine(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	key, err := keyStore.CreateKey("signing", AlgorithmEd25519)
+	assert.NoError(t, err)
+
+	// Without a key engine in the FPGA, keys are not resident in the device and are not attested
+	emulator := keyStore.device
+	keyStore.device = newAXIDevice(keyStore.mappedMem)
+	nonce := []byte("ca-challenge-0001")
+	_, err = keyStore.AttestKey(key.ID, nonce)
+	assert.ErrorIs(t, err, ErrNoKeyEngine)
+	_, err = keyStore.AttestTransportKey(TransportECDHP256, nonce)
+	assert.ErrorIs(t, err, ErrNoKeyEngine)
+	keyStore.device = emulator
+}
+
+func TestAttestTransportKey(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	nonce := []byte("server-nonce-0001")
+	verifier := keyVerifier(t, keyStore)
+
+	// Transport keys are attested as non-exportable keys generated in the enclave
+	for _, alg := range []TransportAlgorithm{TransportRSAOAEP256, TransportECDHP256} {
+		transport, err := keyStore.TransportKey(alg)
+		assert.NoError(t, err)
+		statement, err := keyStore.AttestTransportKey(alg, nonce)
+		assert.NoError(t, err)
+		assert.Equal(t, transport.ID, statement.KeyID)
+		assert.Equal(t, string(alg), statement.Algorithm)
+		assert.Equal(t, transport.PublicKey, statement.PublicKey)
+		public, err := verifier.Verify(statement, nonce)
+		assert.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(public)
+		assert.NoError(t, err)
+		assert.Equal(t, transport.PublicKey, der)
+	}
+
+	_, err := keyStore.AttestTransportKey("A128KW", nonce)
+	assert.Error(t, err)
+	_, err = keyStore.AttestTransportKey(TransportECDHP256, []byte("short"))
+	assert.Error(t, err)
+	assert.Contains(t, eventTypes(log.Events()), "transport.attest")
+}
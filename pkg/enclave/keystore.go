@@ -0,0 +1,761 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/secmem"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+)
+
+var (
+	// ErrKeyNotFound is returned when no key has the requested ID or label
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrKeySlotsExhausted is returned when every hardware key slot is in use
+	ErrKeySlotsExhausted = errors.New("no free hardware key slots")
+
+	// ErrKeyNotActive is returned when a disabled key is used
+	ErrKeyNotActive = errors.New("key is not active")
+
+	// ErrKeyNotExportable is returned when private material of a non-exportable key is requested
+	ErrKeyNotExportable = errors.New("key is not exportable")
+
+	// ErrKeyStoreDestroyed is returned when a destroyed key store is used
+	ErrKeyStoreDestroyed = errors.New("key store has been destroyed")
+
+	// ErrStorageOnly is returned when a DKG share is used to sign: no threshold signing protocol is implemented
+	ErrStorageOnly = errors.New("key share is storage-only")
+
+	// ErrInvalidSignature is returned when a signature does not verify under a key
+	ErrInvalidSignature = errors.New("signature is invalid")
+
+	// ErrNoKeyEngine is returned when attesting keys on an FPGA without a key engine, whose keys are not
+	// resident in the device
+	ErrNoKeyEngine = errors.New("no key engine in the FPGA")
+)
+
+// Algorithm identifies the type of a key held by the enclave
+type Algorithm string
+
+const (
+	AlgorithmAES256    Algorithm = "AES-256"
+	AlgorithmRSA2048   Algorithm = "RSA-2048"
+	AlgorithmECDSAP256 Algorithm = "ECDSA-P256"
+	AlgorithmEd25519   Algorithm = "Ed25519"
+)
+
+// keySizeBits returns the key size for an algorithm supported by the hardware
+func (a Algorithm) keySizeBits() (int, error) {
+	switch a {
+	case AlgorithmAES256, AlgorithmECDSAP256, AlgorithmEd25519:
+		return keySize * 8, nil
+	case AlgorithmRSA2048:
+		return rsaKeySize * 8, nil
+	default:
+		return 0, fmt.Errorf("unsupported key algorithm %q", a)
+	}
+}
+
+// KeyState is the lifecycle state of a key
+type KeyState string
+
+const (
+	KeyStateActive    KeyState = "active"
+	KeyStateDisabled  KeyState = "disabled"
+	KeyStateDestroyed KeyState = "destroyed"
+)
+
+// KeyOrigin records where a key's private material came from
+type KeyOrigin string
+
+const (
+	KeyOriginGenerated KeyOrigin = attest.KeyOriginGenerated // Generated inside the FPGA; never left it
+	KeyOriginHost      KeyOrigin = "host"                    // Generated on the host and loaded into the FPGA
+	KeyOriginImported  KeyOrigin = "imported"                // Imported by the host in plaintext
+	KeyOriginUnwrapped KeyOrigin = "unwrapped"               // Unwrapped inside the FPGA from a transport-wrapped key
+	KeyOriginDKG       KeyOrigin = "dkg"                     // Share from distributed key generation
+)
+
+// KeyHandle describes a key held by the enclave
+type KeyHandle struct {
+	ID          string
+	Label       string
+	Algorithm   Algorithm
+	Size        int // Key size in bits
+	CreatedAt   time.Time
+	State       KeyState
+	Slot        int              // Hardware slot holding the full key, -1 if none
+	PartialSlot int              // Hardware slot holding the key shard, -1 if none
+	PublicKey   crypto.PublicKey // Nil for symmetric keys
+	Exportable  bool             // Whether the host keeps a copy of the private material
+	Origin      KeyOrigin        // Empty for keys sealed before origins were recorded
+}
+
+// enclaveKey is a key along with the host copy of its slot material, which is nil for non-exportable keys.
+// Host copies are held in locked buffers outside the Go heap.
+type enclaveKey struct {
+	handle   KeyHandle
+	material *secmem.Buffer // Full key as loaded into the key slot
+	partial  *secmem.Buffer // Key shard as loaded into the partial key slot
+	policy   *KeyPolicy     // Nil if the key is unrestricted
+	signing  *SigningPolicy // Nil if the key may sign any message
+	uses     uint64         // Operations counted against the policy's MaxUses
+	recent   []time.Time    // Operations within the policy's rate limit window
+}
+
+// EnclaveKeyStore holds the keys loaded into the enclave, addressed by key ID
+type EnclaveKeyStore struct {
+	mu           sync.RWMutex
+	mappedMem    []byte
+	exportable   bool
+	slots        [numKeySlots]string // Key ID occupying each hardware slot
+	device       keyDevice           // Key slots and key engine in the FPGA
+	keys         map[string]*enclaveKey
+	blobs        storage.Backend           // Sealed key persistence, nil for an in-memory key store
+	closeStorage func() error              // Closes blobs on Destroy, if the key store opened it
+	auditLog     AuditLog                  // Receives audit events, if set
+	quorum       *quorumState              // Nil until quorum is enabled
+	audit        auditChain                // Head of the audit hash chain
+	image        []byte                    // Measurement of the loaded enclave image, nil if none
+	measurements []attest.MeasurementEvent // Every extension of the measurement registers, in order
+	identityAlg  Algorithm                 // Algorithm of the DICE identity keys, ECDSA P-256 if empty
+	identity     []*x509.Certificate       // DICE certificate chain, device identity first
+	versions     map[string]uint32         // Anti-rollback version of each image family
+	sealed       map[string]string         // Checksum of each sealed key blob, anchored to the monotonic counter
+	destroyed    bool
+	release      func() error // Releases the AXI mapping on Destroy, if the key store owns it
+}
+
+// NewKeyStore returns an empty key store backed by the mapped AXI region. Keys are generated on the
+// host, loaded into the FPGA, and the host keeps a copy of the private material.
+func NewKeyStore(mappedMem []byte) *EnclaveKeyStore {
+	return &EnclaveKeyStore{
+		mappedMem:  mappedMem,
+		exportable: true,
+		device:     newKeyDevice(mappedMem),
+		keys:       make(map[string]*enclaveKey),
+	}
+}
+
+// NewNonExportableKeyStore returns an empty key store in which keys are generated inside the FPGA, or
+// injected once and wiped from the host. The host only keeps handles and public keys.
+func NewNonExportableKeyStore(mappedMem []byte) *EnclaveKeyStore {
+	ks := NewKeyStore(mappedMem)
+	ks.exportable = false
+	return ks
+}
+
+// CreateKey generates a new key for the algorithm and loads it into free hardware slots
+func (ks *EnclaveKeyStore) CreateKey(label string, alg Algorithm) (*KeyHandle, error) {
+	size, err := alg.keySizeBits()
+	if err != nil {
+		return nil, err
+	}
+	handle := KeyHandle{
+		Label:     label,
+		Algorithm: alg,
+		Size:      size,
+	}
+
+	if !ks.exportable {
+		handle.Origin = KeyOriginGenerated
+		return ks.generateKey(handle)
+	}
+	handle.Origin = KeyOriginHost
+
+	material, partial, public, err := generateKeyMaterial(alg)
+	if err != nil {
+		return nil, err
+	}
+	handle.PublicKey = public
+	return ks.addKey(handle, material, partial)
+}
+
+// generateKey has the FPGA generate a key directly into its slots; no private material reaches the host
+func (ks *EnclaveKeyStore) generateKey(handle KeyHandle) (*KeyHandle, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	err := ks.reserveSlotsLocked(&handle, true, handle.Algorithm != AlgorithmAES256)
+	if err != nil {
+		return nil, err
+	}
+
+	handle.PublicKey, err = ks.device.generate(handle.Algorithm, handle.Slot, handle.PartialSlot)
+	if err != nil {
+		ks.releaseSlotLocked(handle.Slot)
+		ks.releaseSlotLocked(handle.PartialSlot)
+		return nil, err
+	}
+
+	key := &enclaveKey{handle: handle}
+	ks.keys[handle.ID] = key
+	if err := ks.persistLocked(key); err != nil {
+		ks.destroyKeyLocked(key)
+		delete(ks.keys, handle.ID)
+		return nil, err
+	}
+
+	h := handle
+	return &h, ks.auditLocked(keyEvent("key.generate", &handle))
+}
+
+// addKey allocates slots for a key and loads host-supplied material into the FPGA. The key store takes
+// ownership of the material: the caller's buffers are wiped, and exportable keys keep a locked copy.
+func (ks *EnclaveKeyStore) addKey(handle KeyHandle, material, partial []byte) (*KeyHandle, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.addKeyLocked(handle, material, partial)
+}
+
+// addKeyLocked adds a key with the key store locked
+func (ks *EnclaveKeyStore) addKeyLocked(handle KeyHandle, material, partial []byte) (*KeyHandle, error) {
+	err := ks.reserveSlotsLocked(&handle, material != nil, partial != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if material != nil {
+		if err := ks.injectLocked(handle.Slot, material); err != nil {
+			ks.releaseSlotLocked(handle.Slot)
+			ks.releaseSlotLocked(handle.PartialSlot)
+			return nil, fmt.Errorf("failed to load %s key to FPGA: %v", handle.Algorithm, err)
+		}
+	}
+	if partial != nil {
+		if err := ks.injectLocked(handle.PartialSlot, partial); err != nil {
+			ks.releaseSlotLocked(handle.Slot)
+			ks.releaseSlotLocked(handle.PartialSlot)
+			return nil, fmt.Errorf("failed to load %s partial key to FPGA: %v", handle.Algorithm, err)
+		}
+	}
+
+	key := &enclaveKey{handle: handle}
+	if ks.exportable {
+		if key.material, err = lockedCopy(material); err == nil {
+			key.partial, err = lockedCopy(partial)
+		}
+		if err != nil {
+			ks.destroyKeyLocked(key)
+			return nil, err
+		}
+	}
+	wipe(material)
+	wipe(partial)
+	ks.keys[handle.ID] = key
+	if err := ks.persistLocked(key); err != nil {
+		ks.destroyKeyLocked(key)
+		delete(ks.keys, handle.ID)
+		return nil, err
+	}
+
+	h := handle
+	return &h, ks.auditLocked(keyEvent("key.create", &handle))
+}
+
+// reserveSlotsLocked assigns an ID, state and the requested hardware slots to a key
+func (ks *EnclaveKeyStore) reserveSlotsLocked(handle *KeyHandle, full, partial bool) error {
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+
+	// Keys restored from sealed blobs keep their ID, creation time and state
+	if handle.ID == "" {
+		id, err := newKeyID()
+		if err != nil {
+			return err
+		}
+		handle.ID = id
+		handle.CreatedAt = time.Now().UTC()
+		handle.State = KeyStateActive
+	}
+
+	needed := 0
+	if full {
+		needed++
+	}
+	if partial {
+		needed++
+	}
+	free := ks.freeSlotsLocked(needed)
+	if free == nil {
+		return fmt.Errorf("%w: key %q needs %d slots", ErrKeySlotsExhausted, handle.Label, needed)
+	}
+
+	handle.Exportable = ks.exportable
+	handle.Slot = -1
+	handle.PartialSlot = -1
+
+	if full {
+		handle.Slot, free = free[0], free[1:]
+		ks.slots[handle.Slot] = handle.ID
+	}
+	if partial {
+		handle.PartialSlot = free[0]
+		ks.slots[handle.PartialSlot] = handle.ID
+	}
+	return nil
+}
+
+// GetKey returns the handle of the key with the given ID
+func (ks *EnclaveKeyStore) GetKey(id string) (*KeyHandle, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	h := key.handle
+	return &h, nil
+}
+
+// KeyByLabel returns the handle of the oldest key with the given label
+func (ks *EnclaveKeyStore) KeyByLabel(label string) (*KeyHandle, error) {
+	for _, h := range ks.ListKeys() {
+		if h.Label == label {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no key labelled %q", ErrKeyNotFound, label)
+}
+
+// ListKeys returns the handles of every key, oldest first
+func (ks *EnclaveKeyStore) ListKeys() []*KeyHandle {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	handles := make([]*KeyHandle, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		h := key.handle
+		handles = append(handles, &h)
+	}
+	sort.Slice(handles, func(i, j int) bool {
+		if handles[i].CreatedAt.Equal(handles[j].CreatedAt) {
+			return handles[i].ID < handles[j].ID
+		}
+		return handles[i].CreatedAt.Before(handles[j].CreatedAt)
+	})
+	return handles
+}
+
+// DisableKey prevents a key from being used until it is enabled again
+func (ks *EnclaveKeyStore) DisableKey(id string) error {
+	return ks.setState(id, KeyStateDisabled)
+}
+
+// EnableKey allows a disabled key to be used again
+func (ks *EnclaveKeyStore) EnableKey(id string) error {
+	return ks.setState(id, KeyStateActive)
+}
+
+// setState changes the state of a key once quorum allows it
+func (ks *EnclaveKeyStore) setState(id string, state KeyState) error {
+	if err := ks.requireQuorum(QuorumSetKeyState); err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.setStateLocked(id, state)
+}
+
+// setStateLocked changes the state of a key with the key store locked
+func (ks *EnclaveKeyStore) setStateLocked(id string, state KeyState) error {
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	previous := key.handle.State
+	key.handle.State = state
+	if err := ks.persistLocked(key); err != nil {
+		key.handle.State = previous
+		return err
+	}
+	return ks.auditLocked(AuditEvent{Type: "key.state", KeyID: id, Details: map[string]any{
+		"previous": string(previous),
+		"state":    string(state),
+	}})
+}
+
+// DeleteKey clears a key's hardware slots and removes it from the key store
+func (ks *EnclaveKeyStore) DeleteKey(id string) error {
+	if err := ks.requireQuorum(QuorumDeleteKey); err != nil {
+		return err
+	}
+	return ks.deleteKey(id)
+}
+
+// deleteKey deletes a key without the quorum check
+func (ks *EnclaveKeyStore) deleteKey(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.deleteKeyLocked(id)
+}
+
+// deleteKeyLocked deletes a key with the key store locked
+func (ks *EnclaveKeyStore) deleteKeyLocked(id string) error {
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if ks.blobs != nil {
+		if err := ks.unpersistLocked(id); err != nil {
+			return err
+		}
+	}
+
+	ks.destroyKeyLocked(key)
+	delete(ks.keys, id)
+	return ks.auditLocked(AuditEvent{Type: "key.delete", KeyID: id})
+}
+
+// Destroy zeroizes every key: host copies are wiped and every hardware key slot is sent the zeroize
+// command. The key store cannot be used afterwards, and the AXI mapping is released if the key store
+// owns it. Sealed key blobs are left in place.
+func (ks *EnclaveKeyStore) Destroy() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil
+	}
+
+	// Close the audit chain with a signed checkpoint before the audit key is zeroized
+	var auditErr error
+	if ks.auditLog != nil {
+		if auditErr = ks.auditLocked(AuditEvent{Type: "keystore.destroy"}); auditErr == nil {
+			_, auditErr = ks.checkpointLocked()
+		}
+	}
+	ks.device.clearAudit()
+	ks.device.clearIdentity()
+	ks.identity = nil
+
+	for id, key := range ks.keys {
+		ks.destroyKeyLocked(key)
+		delete(ks.keys, id)
+	}
+
+	// Zeroize every slot, including any left over from before this key store was created
+	for slot := range ks.slots {
+		ks.device.clear(slot)
+		ks.slots[slot] = ""
+	}
+	ks.device.clearTransport()
+	ks.device.clearRoot()
+	ks.device.clearKEK()
+	err := fpga.ZeroizeKeySlots(1<<numKeySlots-1, keyControlOffset, ks.mappedMem)
+	if err != nil {
+		err = fmt.Errorf("failed to zeroize key slots: %v", err)
+	}
+
+	ks.destroyed = true
+	if ks.release != nil {
+		if releaseErr := ks.release(); releaseErr != nil && err == nil {
+			err = fmt.Errorf("failed to release the AXI mapping: %v", releaseErr)
+		}
+		ks.release = nil
+	}
+	ks.mappedMem = nil
+	if ks.closeStorage != nil {
+		if closeErr := ks.closeStorage(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close key storage: %v", closeErr)
+		}
+		ks.closeStorage = nil
+	}
+	ks.blobs = nil
+	if auditErr != nil && err == nil {
+		err = auditErr
+	}
+
+	return err
+}
+
+// destroyKeyLocked zeroizes a key's hardware slots and host copies
+func (ks *EnclaveKeyStore) destroyKeyLocked(key *enclaveKey) {
+	ks.releaseSlotLocked(key.handle.Slot)
+	ks.releaseSlotLocked(key.handle.PartialSlot)
+	if key.material != nil {
+		key.material.Destroy()
+	}
+	if key.partial != nil {
+		key.partial.Destroy()
+	}
+	key.handle.State = KeyStateDestroyed
+}
+
+// activeKey returns an active key of the expected algorithm, or of any algorithm if alg is empty, once its
+// policy allows the usage
+func (ks *EnclaveKeyStore) activeKey(id string, alg Algorithm, usage Usage) (*enclaveKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.activeKeyLocked(id, alg, usage)
+}
+
+// activeKeyLocked checks and logs a key usage with the key store locked
+func (ks *EnclaveKeyStore) activeKeyLocked(id string, alg Algorithm, usage Usage) (*enclaveKey, error) {
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+
+	// Operations are logged whether or not they are allowed, and do not run unless they were logged
+	var err error
+	switch {
+	case alg != "" && key.handle.Algorithm != alg:
+		err = fmt.Errorf("key %s is %s, not %s", id, key.handle.Algorithm, alg)
+	case key.handle.State != KeyStateActive:
+		err = fmt.Errorf("%w: %s is %s", ErrKeyNotActive, id, key.handle.State)
+	case key.handle.Origin == KeyOriginDKG && usage.Operation == OperationSign:
+		// A signature from one share is not a partial signature of the joint key; it would leak the share
+		err = fmt.Errorf("%w: %s cannot sign without a threshold signing protocol", ErrStorageOnly, id)
+	default:
+		err = ks.authorizeLocked(key, usage)
+	}
+	if auditErr := ks.auditLocked(usage.event(&key.handle, err)); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyEvent is the audit event for a key entering the key store
+func keyEvent(eventType string, handle *KeyHandle) AuditEvent {
+	return AuditEvent{Type: eventType, KeyID: handle.ID, Details: map[string]any{
+		"label":      handle.Label,
+		"algorithm":  string(handle.Algorithm),
+		"exportable": handle.Exportable,
+		"origin":     string(handle.Origin),
+	}}
+}
+
+// ExportPrivateKey returns the private key of an exportable key: a []byte for AES keys, otherwise an
+// *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey. The returned key lives on the Go heap.
+func (ks *EnclaveKeyStore) ExportPrivateKey(id string) (crypto.PrivateKey, error) {
+	if err := ks.requireQuorum(QuorumExportKey); err != nil {
+		return nil, err
+	}
+	return ks.exportPrivateKey(id)
+}
+
+// exportPrivateKey exports a private key without the quorum check
+func (ks *EnclaveKeyStore) exportPrivateKey(id string) (crypto.PrivateKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.exportPrivateKeyLocked(id)
+}
+
+// exportPrivateKeyLocked exports a private key with the key store locked
+func (ks *EnclaveKeyStore) exportPrivateKeyLocked(id string) (crypto.PrivateKey, error) {
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if !key.handle.Exportable {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotExportable, id)
+	}
+	if key.material == nil {
+		return nil, fmt.Errorf("key %s has no full private key", id)
+	}
+	if err := ks.auditLocked(AuditEvent{Type: "key.export", KeyID: id}); err != nil {
+		return nil, err
+	}
+	var private crypto.PrivateKey
+	err := key.material.WithBytes(func(material []byte) (err error) {
+		private, err = privateKeyFromMaterial(key.handle.Algorithm, material)
+		return err
+	})
+	return private, err
+}
+
+// ExportKeyShard returns the Shamir key shard of an exportable key
+func (ks *EnclaveKeyStore) ExportKeyShard(id string) ([]byte, error) {
+	if err := ks.requireQuorum(QuorumExportShard); err != nil {
+		return nil, err
+	}
+	return ks.exportKeyShard(id)
+}
+
+// exportKeyShard exports a key shard without the quorum check
+func (ks *EnclaveKeyStore) exportKeyShard(id string) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.exportKeyShardLocked(id)
+}
+
+// exportKeyShardLocked exports a key shard with the key store locked
+func (ks *EnclaveKeyStore) exportKeyShardLocked(id string) ([]byte, error) {
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if !key.handle.Exportable {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotExportable, id)
+	}
+	if key.partial == nil {
+		return nil, fmt.Errorf("key %s has no partial key", id)
+	}
+	if err := ks.auditLocked(AuditEvent{Type: "key.export_shard", KeyID: id}); err != nil {
+		return nil, err
+	}
+	return key.partial.Copy()
+}
+
+// loadFullKey re-sends an exportable key's full private key to its hardware slot before an operation;
+// non-exportable keys stay resident in their slot
+func (ks *EnclaveKeyStore) loadFullKey(key *enclaveKey) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := ks.checkLoadedLocked(key); err != nil {
+		return err
+	}
+	if key.handle.Slot < 0 {
+		return fmt.Errorf("key %s has no full private key", key.handle.ID)
+	}
+	if !key.handle.Exportable {
+		return nil
+	}
+	return ks.injectBufferLocked(key.handle.Slot, key.material)
+}
+
+// loadPartialKey re-sends an exportable key's shard to its hardware slot before an operation
+func (ks *EnclaveKeyStore) loadPartialKey(key *enclaveKey) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := ks.checkLoadedLocked(key); err != nil {
+		return err
+	}
+	if key.handle.PartialSlot < 0 {
+		return fmt.Errorf("key %s has no partial key", key.handle.ID)
+	}
+	if !key.handle.Exportable {
+		return nil
+	}
+	return ks.injectBufferLocked(key.handle.PartialSlot, key.partial)
+}
+
+// checkLoadedLocked fails if a key looked up before the lock was taken has since been deleted, so that its
+// slots, which may now belong to another key, are not written
+func (ks *EnclaveKeyStore) checkLoadedLocked(key *enclaveKey) error {
+	if ks.keys[key.handle.ID] != key {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key.handle.ID)
+	}
+	return nil
+}
+
+// injectBufferLocked writes the material held in a locked buffer into a hardware key slot
+func (ks *EnclaveKeyStore) injectBufferLocked(slot int, buf *secmem.Buffer) error {
+	return buf.WithBytes(func(material []byte) error {
+		return ks.injectLocked(slot, material)
+	})
+}
+
+// injectLocked writes material into a hardware key slot over AXI
+func (ks *EnclaveKeyStore) injectLocked(slot int, material []byte) error {
+	return ks.device.load(slot, material)
+}
+
+// freeSlotsLocked returns n free slot numbers, or nil if there are not enough
+func (ks *EnclaveKeyStore) freeSlotsLocked(n int) []int {
+	var free []int
+	for i, id := range ks.slots {
+		if len(free) == n {
+			break
+		}
+		if id == "" {
+			free = append(free, i)
+		}
+	}
+	if len(free) < n {
+		return nil
+	}
+	return free
+}
+
+// releaseSlotLocked sends the zeroize command for a slot, overwrites it with zeros and marks it free
+func (ks *EnclaveKeyStore) releaseSlotLocked(slot int) {
+	if slot < 0 {
+		return
+	}
+	ks.device.clear(slot)
+	ks.slots[slot] = ""
+}
+
+// lockedCopy moves material into a locked buffer, or returns nil for no material
+func lockedCopy(material []byte) (*secmem.Buffer, error) {
+	if material == nil {
+		return nil, nil
+	}
+	buf, err := secmem.FromBytes(material)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock key material: %v", err)
+	}
+	return buf, nil
+}
+
+// generateKeyMaterial generates slot material for an algorithm; symmetric keys have no shard or public key
+func generateKeyMaterial(alg Algorithm) ([]byte, []byte, crypto.PublicKey, error) {
+	switch alg {
+	case AlgorithmAES256:
+		material, err := generateAESKey()
+		return material, nil, nil, err
+	case AlgorithmRSA2048:
+		return generateRSAKey()
+	case AlgorithmECDSAP256:
+		return generateECDSAKey()
+	case AlgorithmEd25519:
+		return generateEd25519Key()
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+}
+
+// privateKeyFromMaterial rebuilds a private key from its slot material
+func privateKeyFromMaterial(alg Algorithm, material []byte) (crypto.PrivateKey, error) {
+	switch alg {
+	case AlgorithmAES256:
+		return append([]byte(nil), material...), nil
+	case AlgorithmRSA2048:
+		return rsaPrivateKey(material)
+	case AlgorithmECDSAP256:
+		return ecdsaPrivateKey(material)
+	case AlgorithmEd25519:
+		return ed25519PrivateKey(material)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+}
+
+// slotOffset returns the AXI offset of a hardware key slot
+func slotOffset(slot int) uint32 {
+	return uint32(keySlotBase + slot*keySlotStride)
+}
+
+// newKeyID returns a random 128-bit key identifier
+func newKeyID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate key ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
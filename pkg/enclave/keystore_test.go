@@ -0,0 +1,274 @@
+package enclave
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/dkg"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyStoreLifecycle(t *testing.T) {
+	keyStore := NewKeyStore(make([]byte, axiWindowSize))
+
+	// Create keys for two tenants
+	tenantA, err := keyStore.CreateKey("tenant-a", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	tenantB, err := keyStore.CreateKey("tenant-b", AlgorithmEd25519)
+	assert.NoError(t, err)
+	assert.NotEqual(t, tenantA.ID, tenantB.ID, "Key IDs should be unique")
+	assert.Equal(t, KeyStateActive, tenantA.State)
+	assert.False(t, tenantA.CreatedAt.IsZero())
+
+	// List and get return the same handles
+	keys := keyStore.ListKeys()
+	assert.Len(t, keys, 2)
+	got, err := keyStore.GetKey(tenantB.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-b", got.Label)
+	assert.Equal(t, AlgorithmEd25519, got.Algorithm)
+
+	// Keys are bound to their algorithm
+	_, err = RSASign([]byte("message"), keyStore, tenantA.ID)
+	assert.Error(t, err, "An ECDSA key should not be usable for RSA signing")
+
+	// Disabled keys cannot be used
+	assert.NoError(t, keyStore.DisableKey(tenantA.ID))
+	_, err = ECDSASign([]byte("message"), keyStore, tenantA.ID)
+	assert.ErrorIs(t, err, ErrKeyNotActive)
+	assert.NoError(t, keyStore.EnableKey(tenantA.ID))
+	_, err = ECDSASign([]byte("message"), keyStore, tenantA.ID)
+	assert.NoError(t, err)
+
+	// Deleting a key frees its slots and makes it unknown
+	assert.NoError(t, keyStore.DeleteKey(tenantA.ID))
+	_, err = keyStore.GetKey(tenantA.ID)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.ErrorIs(t, keyStore.DeleteKey(tenantA.ID), ErrKeyNotFound)
+	assert.Len(t, keyStore.ListKeys(), 1)
+}
+
+func TestKeyStoreSlotExhaustion(t *testing.T) {
+	keyStore := NewKeyStore(make([]byte, axiWindowSize))
+
+	// Every AES key occupies a single slot
+	var first *KeyHandle
+	for i := 0; i < numKeySlots; i++ {
+		key, err := keyStore.CreateKey("aes", AlgorithmAES256)
+		assert.NoError(t, err)
+		if first == nil {
+			first = key
+		}
+	}
+
+	_, err := keyStore.CreateKey("one-too-many", AlgorithmAES256)
+	assert.ErrorIs(t, err, ErrKeySlotsExhausted)
+
+	// Freeing a slot makes room again, and the slot is wiped
+	assert.NoError(t, keyStore.DeleteKey(first.ID))
+	offset := slotOffset(first.Slot)
+	assert.Equal(t, make([]byte, keySize*4), keyStore.mappedMem[offset:offset+keySize*4])
+
+	key, err := keyStore.CreateKey("replacement", AlgorithmAES256)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Slot, key.Slot)
+
+	// Asymmetric keys need a second slot for their shard
+	assert.NoError(t, keyStore.DeleteKey(key.ID))
+	_, err = keyStore.CreateKey("ecdsa", AlgorithmECDSAP256)
+	assert.ErrorIs(t, err, ErrKeySlotsExhausted)
+}
+
+func TestNonExportableKeyStore(t *testing.T) {
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := InitializeNonExportableKeyStore(mappedMem)
+	assert.NoError(t, err)
+
+	for _, key := range keyStore.ListKeys() {
+		assert.False(t, key.Exportable)
+
+		// Private material is neither exportable nor kept on the host
+		_, err := keyStore.ExportPrivateKey(key.ID)
+		assert.ErrorIs(t, err, ErrKeyNotExportable)
+		_, err = keyStore.ExportKeyShard(key.ID)
+		assert.ErrorIs(t, err, ErrKeyNotExportable)
+		assert.Nil(t, keyStore.keys[key.ID].material)
+		assert.Nil(t, keyStore.keys[key.ID].partial)
+
+		if key.Algorithm != AlgorithmAES256 {
+			assert.NotNil(t, key.PublicKey, "Public keys should be returned to the host")
+		}
+	}
+
+	// Keys were generated inside the FPGA, so nothing was written over AXI
+	assert.Equal(t, make([]byte, axiWindowSize), mappedMem)
+
+	// Keys are still usable from their slots
+	_, err = ECDSASign([]byte("message"), keyStore, keyID(t, keyStore, DefaultECDSAKeyLabel))
+	assert.NoError(t, err)
+	_, err = ECDSAPartialSign([]byte("message"), keyStore, keyID(t, keyStore, DefaultECDSAKeyLabel))
+	assert.NoError(t, err)
+}
+
+func TestNonExportableKeyInjection(t *testing.T) {
+	keyStore := NewNonExportableKeyStore(make([]byte, axiWindowSize))
+
+	// Injected material is wiped from the host once loaded
+	share := []byte{1, 2, 3, 4}
+	key, err := keyStore.addKey(KeyHandle{Label: "share", Algorithm: AlgorithmEd25519, Size: keySize * 8}, nil, share)
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, 4), share)
+	assert.Equal(t, []byte{1, 2, 3, 4}, emulated(keyStore).slots[key.PartialSlot])
+}
+
+func TestExportPrivateKey(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+
+	for _, key := range keyStore.ListKeys() {
+		assert.True(t, key.Exportable)
+		private, err := keyStore.ExportPrivateKey(key.ID)
+		assert.NoError(t, err)
+
+		if key.Algorithm == AlgorithmAES256 {
+			assert.Len(t, private, keySize)
+			continue
+		}
+		signer, ok := private.(crypto.Signer)
+		assert.True(t, ok)
+		assert.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.PublicKey),
+			"Exported %s key should match the public key", key.Algorithm)
+
+		shard, err := keyStore.ExportKeyShard(key.ID)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, shard)
+	}
+}
+
+func TestKeyStoreDestroy(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	rsaKey := keyID(t, keyStore, DefaultRSAKeyLabel)
+
+	// Host copies are held in locked buffers
+	material := keyStore.keys[rsaKey].material
+	partial := keyStore.keys[rsaKey].partial
+	assert.False(t, material.Destroyed())
+	assert.False(t, partial.Destroyed())
+
+	mappedMem := keyStore.mappedMem
+	assert.NoError(t, keyStore.Destroy())
+	assert.NoError(t, keyStore.Destroy(), "Destroy should be idempotent")
+
+	// Host buffers are wiped and every key slot is zeroized
+	assert.True(t, material.Destroyed())
+	assert.True(t, partial.Destroyed())
+	assert.Equal(t, make([]byte, numKeySlots*keySlotStride), mappedMem[keySlotBase:])
+	assert.Equal(t, byte(fpga.ZeroizeCommand), mappedMem[keyControlOffset])
+	assert.Equal(t, []byte{0xff, 0xff}, mappedMem[keyControlOffset+4:keyControlOffset+6])
+	assert.Empty(t, keyStore.ListKeys())
+
+	// The key store cannot be used afterwards
+	_, err := RSASign([]byte("message"), keyStore, rsaKey)
+	assert.ErrorIs(t, err, ErrKeyStoreDestroyed)
+	_, err = keyStore.CreateKey("aes", AlgorithmAES256)
+	assert.ErrorIs(t, err, ErrKeyStoreDestroyed)
+}
+
+func TestDeleteKeyDestroysHostCopy(t *testing.T) {
+	keyStore := NewKeyStore(make([]byte, axiWindowSize))
+	key, err := keyStore.CreateKey("aes", AlgorithmAES256)
+	assert.NoError(t, err)
+
+	material := keyStore.keys[key.ID].material
+	assert.Equal(t, keySize, material.Len())
+	assert.NoError(t, keyStore.DeleteKey(key.ID))
+	assert.True(t, material.Destroyed())
+	assert.Equal(t, byte(fpga.ZeroizeCommand), keyStore.mappedMem[keyControlOffset])
+}
+
+func TestDefaultKeysFailureDestroysKeyStore(t *testing.T) {
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore := NewKeyStore(mappedMem)
+	for i := 0; i < numKeySlots-2; i++ {
+		_, err := keyStore.CreateKey(fmt.Sprintf("filler-%d", i), AlgorithmAES256)
+		assert.NoError(t, err)
+	}
+
+	// The default RSA key needs two more slots than are left, and the keys already created are destroyed
+	_, err := createDefaultKeys(keyStore)
+	assert.ErrorIs(t, err, ErrKeySlotsExhausted)
+	_, err = keyStore.CreateKey("aes", AlgorithmAES256)
+	assert.ErrorIs(t, err, ErrKeyStoreDestroyed)
+	assert.Equal(t, make([]byte, numKeySlots*keySlotStride), mappedMem[keySlotBase:])
+}
+
+func TestLoadDeletedKey(t *testing.T) {
+	keyStore := NewKeyStore(make([]byte, axiWindowSize))
+	handle, err := keyStore.CreateKey("aes", AlgorithmAES256)
+	assert.NoError(t, err)
+	key, err := keyStore.activeKey(handle.ID, AlgorithmAES256, Usage{Operation: OperationEncrypt})
+	assert.NoError(t, err)
+
+	// A key deleted between the lookup and the load is not written to the slot it no longer owns
+	assert.NoError(t, keyStore.DeleteKey(handle.ID))
+	_, err = keyStore.CreateKey("other", AlgorithmAES256)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, keyStore.loadFullKey(key), ErrKeyNotFound)
+}
+
+func TestDKGShareIsStorageOnly(t *testing.T) {
+	signers := make([]crypto.Signer, 2)
+	identities := make(map[int]crypto.PublicKey, 2)
+	for i := range signers {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		signers[i], identities[i+1] = key, key.Public()
+	}
+
+	for _, curve := range []dkg.Curve{dkg.CurveP256, dkg.CurveEd25519} {
+		transports := dkg.NewLocalNetwork(2)
+		results := make([]*dkg.Result, 2)
+		errs := make([]error, 2)
+		var wg sync.WaitGroup
+		for i := range transports {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				p, err := dkg.NewParticipant(dkg.Config{SessionID: "share", Curve: curve, Index: i + 1, Participants: 2, Threshold: 2, Signer: signers[i], Identities: identities})
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				results[i], errs[i] = dkg.Run(context.Background(), p, transports[i])
+			}(i)
+		}
+		wg.Wait()
+		assert.NoError(t, errs[0])
+		assert.NoError(t, errs[1])
+
+		// The share loads, but neither a full nor a partial signature may be made with it
+		keyStore := NewKeyStore(make([]byte, axiWindowSize))
+		var err error
+		if curve == dkg.CurveP256 {
+			var key *KeyHandle
+			key, err = InitializeECDSAKeyShare(results[0], keyStore, "share")
+			assert.NoError(t, err)
+			_, err = ECDSAPartialSign([]byte("message"), keyStore, key.ID)
+			assert.ErrorIs(t, err, ErrStorageOnly)
+			_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+		} else {
+			var key *KeyHandle
+			key, err = InitializeEd25519KeyShare(results[0], keyStore, "share")
+			assert.NoError(t, err)
+			_, err = Ed25519PartialSign([]byte("message"), keyStore, key.ID)
+			assert.ErrorIs(t, err, ErrStorageOnly)
+			_, err = Ed25519Sign([]byte("message"), keyStore, key.ID)
+		}
+		assert.ErrorIs(t, err, ErrStorageOnly)
+	}
+}
@@ -0,0 +1,303 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Operation is a use of a key checked against its policy
+type Operation string
+
+const (
+	OperationSign    Operation = "sign"
+	OperationVerify  Operation = "verify"
+	OperationEncrypt Operation = "encrypt"
+	OperationDecrypt Operation = "decrypt"
+	OperationWrap    Operation = "wrap" // Export the key wrapped to a transport key
+)
+
+// Padding is an RSA signature padding scheme
+type Padding string
+
+const (
+	PaddingPKCS1v15 Padding = "PKCS1v15"
+	PaddingPSS      Padding = "PSS"
+)
+
+var (
+	// ErrPolicyDenied is returned, along with one of the reasons below, when a key policy denies an operation
+	ErrPolicyDenied = errors.New("key policy denied operation")
+
+	ErrOperationNotAllowed = errors.New("operation not allowed")
+	ErrHashNotAllowed      = errors.New("hash not allowed")
+	ErrPaddingNotAllowed   = errors.New("padding not allowed")
+	ErrKeyNotYetValid      = errors.New("key not yet valid")
+	ErrKeyExpired          = errors.New("key expired")
+	ErrUsageLimitExceeded  = errors.New("usage limit exceeded")
+	ErrRateLimitExceeded   = errors.New("rate limit exceeded")
+)
+
+// KeyPolicy restricts how a key may be used. Empty lists and zero values place no restriction.
+type KeyPolicy struct {
+	Operations []Operation   `json:"operations,omitempty"`
+	Hashes     []crypto.Hash `json:"hashes,omitempty"`   // Only checked for operations that hash
+	Paddings   []Padding     `json:"paddings,omitempty"` // Only checked for operations that pad
+	NotBefore  time.Time     `json:"not_before"`
+	NotAfter   time.Time     `json:"not_after"`
+	MaxUses    uint64        `json:"max_uses,omitempty"` // Uses over the key's lifetime, kept across restarts
+	RateLimit  *RateLimit    `json:"rate_limit,omitempty"`
+}
+
+// RateLimit allows at most Uses operations in any window of length Per
+type RateLimit struct {
+	Uses int           `json:"uses"`
+	Per  time.Duration `json:"per"`
+}
+
+// signatureHashes are the hashes ECDSA and RSA keys sign and verify with
+var signatureHashes = []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// checkSignatureHash refuses a hash ECDSA and RSA keys cannot sign with
+func checkSignatureHash(hash crypto.Hash) error {
+	if !slices.Contains(signatureHashes, hash) {
+		return fmt.Errorf("unsupported signature hash %v", hash)
+	}
+	return nil
+}
+
+// Usage describes an operation about to be performed with a key
+type Usage struct {
+	Operation Operation
+	Hash      crypto.Hash // Zero if the operation does not hash
+	Padding   Padding     // Empty if the operation does not pad
+	Message   []byte      // Message to be signed, checked against the key's signing policy
+}
+
+// PolicyError reports why a key policy denied an operation. It matches ErrPolicyDenied and its Reason
+// with errors.Is.
+type PolicyError struct {
+	KeyID  string
+	Usage  Usage
+	Reason error
+	Detail string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%v: %s with key %s: %v (%s)", ErrPolicyDenied, e.Usage.Operation, e.KeyID, e.Reason, e.Detail)
+}
+
+// Unwrap returns ErrPolicyDenied and the reason
+func (e *PolicyError) Unwrap() []error {
+	return []error{ErrPolicyDenied, e.Reason}
+}
+
+// policyClock returns the time policies are checked against; tests replace it
+var policyClock = time.Now
+
+// validate checks that a policy is well formed
+func (p *KeyPolicy) validate() error {
+	for _, op := range p.Operations {
+		switch op {
+		case OperationSign, OperationVerify, OperationEncrypt, OperationDecrypt, OperationWrap:
+		default:
+			return fmt.Errorf("invalid key policy: unknown operation %q", op)
+		}
+	}
+	for _, hash := range p.Hashes {
+		if !hash.Available() {
+			return fmt.Errorf("invalid key policy: unknown hash %v", hash)
+		}
+	}
+	for _, padding := range p.Paddings {
+		if padding != PaddingPKCS1v15 && padding != PaddingPSS {
+			return fmt.Errorf("invalid key policy: unknown padding %q", padding)
+		}
+	}
+	if !p.NotBefore.IsZero() && !p.NotAfter.IsZero() && !p.NotAfter.After(p.NotBefore) {
+		return fmt.Errorf("invalid key policy: not after %v is not later than not before %v", p.NotAfter, p.NotBefore)
+	}
+	if p.RateLimit != nil && (p.RateLimit.Uses <= 0 || p.RateLimit.Per <= 0) {
+		return fmt.Errorf("invalid key policy: rate limit needs positive uses and period")
+	}
+	return nil
+}
+
+// clone returns a deep copy of a policy
+func (p *KeyPolicy) clone() *KeyPolicy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Operations = slices.Clone(p.Operations)
+	c.Hashes = slices.Clone(p.Hashes)
+	c.Paddings = slices.Clone(p.Paddings)
+	if p.RateLimit != nil {
+		limit := *p.RateLimit
+		c.RateLimit = &limit
+	}
+	return &c
+}
+
+// SetKeyPolicy replaces the policy of a key; a nil policy removes every restriction. The use count is
+// kept, so lowering MaxUses below it blocks the key.
+func (ks *EnclaveKeyStore) SetKeyPolicy(id string, policy *KeyPolicy) error {
+	if err := ks.requireQuorum(QuorumSetKeyPolicy); err != nil {
+		return err
+	}
+	return ks.setKeyPolicy(id, policy)
+}
+
+// setKeyPolicy replaces a key policy without the quorum check
+func (ks *EnclaveKeyStore) setKeyPolicy(id string, policy *KeyPolicy) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.setKeyPolicyLocked(id, policy)
+}
+
+// setKeyPolicyLocked replaces a key policy with the key store locked
+func (ks *EnclaveKeyStore) setKeyPolicyLocked(id string, policy *KeyPolicy) error {
+	if policy != nil {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	previous := key.policy
+	key.policy = policy.clone()
+	key.recent = nil
+	if err := ks.persistLocked(key); err != nil {
+		key.policy = previous
+		return err
+	}
+
+	// The policy in effect must be the one measured, so an unmeasured policy is rolled back
+	if err := ks.extendPolicyLocked("key policy", id, key.policy); err != nil {
+		key.policy = previous
+		if restoreErr := ks.persistLocked(key); restoreErr != nil {
+			return fmt.Errorf("%v; failed to restore the previous key policy: %v", err, restoreErr)
+		}
+		return err
+	}
+	return ks.auditLocked(AuditEvent{Type: "key.policy", KeyID: id, Details: map[string]any{"policy": key.policy}})
+}
+
+// KeyPolicy returns the policy of a key, or nil if it has none
+func (ks *EnclaveKeyStore) KeyPolicy(id string) (*KeyPolicy, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return key.policy.clone(), nil
+}
+
+// KeyUses returns the number of operations a key has performed under a use-limited policy
+func (ks *EnclaveKeyStore) KeyUses(id string) (uint64, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	return key.uses, nil
+}
+
+// event is the audit event for a usage of a key, along with the reason it was refused, if it was
+func (u Usage) event(handle *KeyHandle, err error) AuditEvent {
+	details := map[string]any{
+		"algorithm": string(handle.Algorithm),
+		"allowed":   err == nil,
+	}
+	if u.Hash != 0 {
+		details["hash"] = u.Hash.String()
+	}
+	if u.Padding != "" {
+		details["padding"] = string(u.Padding)
+	}
+	if u.Message != nil {
+		digest := sha256.Sum256(u.Message)
+		details["message_sha256"] = hex.EncodeToString(digest[:])
+	}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	return AuditEvent{Type: "key." + string(u.Operation), KeyID: handle.ID, Details: details}
+}
+
+// authorizeLocked checks a usage against the key's policy and, if it is allowed, records it
+func (ks *EnclaveKeyStore) authorizeLocked(key *enclaveKey, usage Usage) error {
+	p := key.policy
+	if p == nil {
+		p = &KeyPolicy{}
+	}
+	deny := func(reason error, format string, args ...any) error {
+		return &PolicyError{KeyID: key.handle.ID, Usage: usage, Reason: reason, Detail: fmt.Sprintf(format, args...)}
+	}
+
+	if len(p.Operations) > 0 && !slices.Contains(p.Operations, usage.Operation) {
+		return deny(ErrOperationNotAllowed, "allowed operations are %v", p.Operations)
+	}
+	if usage.Hash != 0 && len(p.Hashes) > 0 && !slices.Contains(p.Hashes, usage.Hash) {
+		return deny(ErrHashNotAllowed, "%v is not allowed", usage.Hash)
+	}
+	if usage.Padding != "" && len(p.Paddings) > 0 && !slices.Contains(p.Paddings, usage.Padding) {
+		return deny(ErrPaddingNotAllowed, "%s is not allowed", usage.Padding)
+	}
+	if usage.Operation == OperationSign && key.signing != nil {
+		if decision := key.signing.evaluate(usage.Message, usage.Hash, &key.handle); !decision.Allowed {
+			return deny(ErrContentNotAllowed, "%s: %s", decision.Rule, decision.Reason)
+		}
+	}
+
+	now := policyClock()
+	if !p.NotBefore.IsZero() && now.Before(p.NotBefore) {
+		return deny(ErrKeyNotYetValid, "valid from %v", p.NotBefore)
+	}
+	if !p.NotAfter.IsZero() && now.After(p.NotAfter) {
+		return deny(ErrKeyExpired, "expired at %v", p.NotAfter)
+	}
+	if p.MaxUses > 0 && key.uses >= p.MaxUses {
+		return deny(ErrUsageLimitExceeded, "used %d of %d times", key.uses, p.MaxUses)
+	}
+
+	if limit := p.RateLimit; limit != nil {
+		window := now.Add(-limit.Per)
+		recent := key.recent[:0]
+		for _, used := range key.recent {
+			if used.After(window) {
+				recent = append(recent, used)
+			}
+		}
+		key.recent = recent
+		if len(recent) >= limit.Uses {
+			return deny(ErrRateLimitExceeded, "%d uses per %v", limit.Uses, limit.Per)
+		}
+	}
+
+	// A use-limited key persists its count before the operation, so a crash cannot hand out extra uses
+	if p.MaxUses > 0 {
+		key.uses++
+		if err := ks.persistLocked(key); err != nil {
+			key.uses--
+			return err
+		}
+	}
+	if p.RateLimit != nil {
+		key.recent = append(key.recent, now)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setClock fixes the policy clock for the rest of the test
+func setClock(t *testing.T, now *time.Time) {
+	policyClock = func() time.Time { return *now }
+	t.Cleanup(func() { policyClock = time.Now })
+}
+
+func TestKeyPolicyOperations(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	rsaKey := keyID(t, keyStore, DefaultRSAKeyLabel)
+
+	assert.NoError(t, keyStore.SetKeyPolicy(aesKey, &KeyPolicy{Operations: []Operation{OperationDecrypt}}))
+	_, err := AESDecrypt([]byte("ciphertext"), keyStore, aesKey)
+	assert.NoError(t, err)
+	_, err = AESEncrypt([]byte("plaintext"), keyStore, aesKey)
+	assert.ErrorIs(t, err, ErrPolicyDenied)
+	assert.ErrorIs(t, err, ErrOperationNotAllowed)
+
+	var policyErr *PolicyError
+	assert.True(t, errors.As(err, &policyErr))
+	assert.Equal(t, aesKey, policyErr.KeyID)
+	assert.Equal(t, OperationEncrypt, policyErr.Usage.Operation)
+
+	// Hash and padding restrictions
+	assert.NoError(t, keyStore.SetKeyPolicy(rsaKey, &KeyPolicy{
+		Operations: []Operation{OperationSign},
+		Hashes:     []crypto.Hash{crypto.SHA256},
+		Paddings:   []Padding{PaddingPSS},
+	}))
+	_, err = RSASignPSS([]byte("message"), keyStore, rsaKey)
+	assert.NoError(t, err)
+	_, err = RSASign([]byte("message"), keyStore, rsaKey)
+	assert.ErrorIs(t, err, ErrPaddingNotAllowed)
+
+	assert.NoError(t, keyStore.SetKeyPolicy(rsaKey, &KeyPolicy{Hashes: []crypto.Hash{crypto.SHA384}}))
+	_, err = RSASign([]byte("message"), keyStore, rsaKey)
+	assert.ErrorIs(t, err, ErrHashNotAllowed)
+	_, err = RSASignHash([]byte("message"), crypto.SHA384, PaddingPKCS1v15, keyStore, rsaKey)
+	assert.NoError(t, err)
+	_, err = RSASignHash([]byte("message"), crypto.MD5, PaddingPKCS1v15, keyStore, rsaKey)
+	assert.Error(t, err)
+
+	// Removing the policy lifts the restrictions
+	assert.NoError(t, keyStore.SetKeyPolicy(rsaKey, nil))
+	_, err = RSASign([]byte("message"), keyStore, rsaKey)
+	assert.NoError(t, err)
+}
+
+func TestKeyPolicyVerifyAndWrap(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+
+	// Signatures are verified with the key's public key, under the hash the policy allows
+	private, err := keyStore.ExportPrivateKey(ecdsaKey)
+	assert.NoError(t, err)
+	digest := sha512.Sum384([]byte("message"))
+	signature, err := ecdsa.SignASN1(rand.Reader, private.(*ecdsa.PrivateKey), digest[:])
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetKeyPolicy(ecdsaKey, &KeyPolicy{Operations: []Operation{OperationVerify}, Hashes: []crypto.Hash{crypto.SHA384}}))
+	assert.NoError(t, ECDSAVerify([]byte("message"), signature, crypto.SHA384, keyStore, ecdsaKey))
+	assert.ErrorIs(t, ECDSAVerify([]byte("other"), signature, crypto.SHA384, keyStore, ecdsaKey), ErrInvalidSignature)
+	assert.ErrorIs(t, ECDSAVerify([]byte("message"), signature, crypto.SHA256, keyStore, ecdsaKey), ErrHashNotAllowed)
+	_, err = ECDSASignHash([]byte("message"), crypto.SHA384, keyStore, ecdsaKey)
+	assert.ErrorIs(t, err, ErrOperationNotAllowed)
+
+	// Exports wrapped to a transport key are the wrap operation
+	recipientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	recipient, err := NewTransportKey(&recipientKey.PublicKey)
+	assert.NoError(t, err)
+	params, err := json.Marshal(ExportParams{Recipient: recipient})
+	assert.NoError(t, err)
+	export := func() error {
+		keyStore.mu.Lock()
+		defer keyStore.mu.Unlock()
+		_, err := keyStore.exportWrappedLocked(&QuorumRequest{Operation: QuorumExportKey, KeyID: aesKey, Params: params}, false)
+		return err
+	}
+	assert.NoError(t, export())
+	assert.NoError(t, keyStore.SetKeyPolicy(aesKey, &KeyPolicy{Operations: []Operation{OperationEncrypt}}))
+	assert.ErrorIs(t, export(), ErrOperationNotAllowed)
+}
+
+func TestKeyPolicyMeasurementFailure(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+
+	// A policy that could not be measured does not take effect
+	emulated(keyStore).extendErr = errors.New("extend failed")
+	assert.Error(t, keyStore.SetKeyPolicy(ecdsaKey, &KeyPolicy{MaxUses: 1}))
+	assert.Error(t, keyStore.SetSigningPolicy(ecdsaKey, releasePolicy()))
+	policy, err := keyStore.KeyPolicy(ecdsaKey)
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+	signing, err := keyStore.SigningPolicy(ecdsaKey)
+	assert.NoError(t, err)
+	assert.Nil(t, signing)
+}
+
+func TestKeyPolicyValidity(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	setClock(t, &now)
+	assert.NoError(t, keyStore.SetKeyPolicy(ecdsaKey, &KeyPolicy{
+		NotBefore: now.Add(time.Hour),
+		NotAfter:  now.Add(2 * time.Hour),
+	}))
+
+	_, err := ECDSASign([]byte("message"), keyStore, ecdsaKey)
+	assert.ErrorIs(t, err, ErrKeyNotYetValid)
+	now = now.Add(90 * time.Minute)
+	_, err = ECDSASign([]byte("message"), keyStore, ecdsaKey)
+	assert.NoError(t, err)
+	now = now.Add(time.Hour)
+	_, err = ECDSASign([]byte("message"), keyStore, ecdsaKey)
+	assert.ErrorIs(t, err, ErrKeyExpired)
+}
+
+func TestKeyPolicyLimits(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ed25519Key := keyID(t, keyStore, DefaultEd25519KeyLabel)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+
+	// Partial signing counts as a use
+	assert.NoError(t, keyStore.SetKeyPolicy(ed25519Key, &KeyPolicy{MaxUses: 2}))
+	_, err := Ed25519Sign([]byte("message"), keyStore, ed25519Key)
+	assert.NoError(t, err)
+	_, err = Ed25519PartialSign([]byte("message"), keyStore, ed25519Key)
+	assert.NoError(t, err)
+	_, err = Ed25519Sign([]byte("message"), keyStore, ed25519Key)
+	assert.ErrorIs(t, err, ErrUsageLimitExceeded)
+	uses, err := keyStore.KeyUses(ed25519Key)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), uses)
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	setClock(t, &now)
+	assert.NoError(t, keyStore.SetKeyPolicy(ecdsaKey, &KeyPolicy{RateLimit: &RateLimit{Uses: 2, Per: time.Minute}}))
+	for i := 0; i < 2; i++ {
+		_, err = ECDSASign([]byte("message"), keyStore, ecdsaKey)
+		assert.NoError(t, err)
+	}
+	_, err = ECDSASign([]byte("message"), keyStore, ecdsaKey)
+	assert.ErrorIs(t, err, ErrRateLimitExceeded)
+	now = now.Add(time.Minute)
+	_, err = ECDSASign([]byte("message"), keyStore, ecdsaKey)
+	assert.NoError(t, err)
+}
+
+func TestKeyPolicyValidation(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	now := time.Now()
+
+	invalid := []*KeyPolicy{
+		{Operations: []Operation{"launch"}},
+		{Paddings: []Padding{"OAEP"}},
+		{Hashes: []crypto.Hash{crypto.Hash(99)}},
+		{NotBefore: now, NotAfter: now},
+		{RateLimit: &RateLimit{Uses: 1}},
+	}
+	for _, policy := range invalid {
+		assert.Error(t, keyStore.SetKeyPolicy(aesKey, policy))
+	}
+	assert.ErrorIs(t, keyStore.SetKeyPolicy("missing", &KeyPolicy{}), ErrKeyNotFound)
+
+	// The returned policy is a copy
+	assert.NoError(t, keyStore.SetKeyPolicy(aesKey, &KeyPolicy{Operations: []Operation{OperationEncrypt}}))
+	policy, err := keyStore.KeyPolicy(aesKey)
+	assert.NoError(t, err)
+	policy.Operations[0] = OperationDecrypt
+	_, err = AESDecrypt([]byte("ciphertext"), keyStore, aesKey)
+	assert.ErrorIs(t, err, ErrOperationNotAllowed)
+}
+
+func TestKeyPolicySurvivesReload(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("limited", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetKeyPolicy(key.ID, &KeyPolicy{Operations: []Operation{OperationSign}, MaxUses: 2}))
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// The policy and the use count are restored, so a restart does not reset the limit
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	policy, err := keyStore.KeyPolicy(key.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{OperationSign}, policy.Operations)
+
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+	_, err = ECDSASign([]byte("message"), keyStore, key.ID)
+	assert.ErrorIs(t, err, ErrUsageLimitExceeded)
+}
@@ -0,0 +1,119 @@
+package enclave_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/enclave"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/provision"
+	"github.com/stretchr/testify/assert"
+)
+
+// The provisioning client and server are tested here, as an external test of the enclave package, because
+// their key stores run on the key device emulated by the enclave tests
+
+// testServer returns a provisioning server serving ecdsaKey as device-identity to the key store's device
+func testServer(t *testing.T, keyStore *enclave.EnclaveKeyStore, ecdsaKey *ecdsa.PrivateKey) *httptest.Server {
+	deviceID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(deviceID)
+	server, err := provision.NewServer(&attest.KeyVerifier{Roots: roots})
+	assert.NoError(t, err)
+	server.AddKey("device-identity", ecdsaKey)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return httpServer
+}
+
+func TestProvision(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	keyStore, err := enclave.InitializeKeyStore(make([]byte, 0x9000))
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	httpServer := testServer(t, keyStore, ecdsaKey)
+
+	client := provision.NewClient(httpServer.URL)
+	for _, alg := range []enclave.TransportAlgorithm{enclave.TransportRSAOAEP256, enclave.TransportECDHP256} {
+		key, err := client.Provision(context.Background(), keyStore, "device-identity", alg)
+		assert.NoError(t, err)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, "device-identity", key.Label)
+		assert.False(t, key.Exportable)
+		assert.True(t, ecdsaKey.PublicKey.Equal(key.PublicKey))
+
+		_, err = enclave.ECDSASign([]byte("message"), keyStore, key.ID)
+		assert.NoError(t, err)
+	}
+
+	_, err = client.Provision(context.Background(), keyStore, "unknown", enclave.TransportECDHP256)
+	assert.ErrorIs(t, err, provision.ErrKeyNotFound)
+	_, err = provision.NewServer(&attest.KeyVerifier{})
+	assert.Error(t, err)
+}
+
+func TestProvisionRequiresAttestation(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	keyStore, err := enclave.InitializeKeyStore(make([]byte, 0x9000))
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	httpServer := testServer(t, keyStore, ecdsaKey)
+
+	post := func(path string, request any) *http.Response {
+		body, err := json.Marshal(request)
+		assert.NoError(t, err)
+		resp, err := http.Post(httpServer.URL+path, "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	nonce := func() []byte {
+		resp, err := http.Post(httpServer.URL+"/nonces", "application/json", nil)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var nonce provision.Nonce
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&nonce))
+		return nonce.Nonce
+	}
+	transport, err := keyStore.TransportKey(enclave.TransportECDHP256)
+	assert.NoError(t, err)
+
+	// A bare transport key, or one attested for a nonce the server did not issue, is refused
+	assert.Equal(t, http.StatusBadRequest, post("/keys/device-identity", &provision.Request{TransportKey: transport}).StatusCode)
+	statement, err := keyStore.AttestTransportKey(enclave.TransportECDHP256, []byte("chosen-by-host-0001"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, post("/keys/device-identity", &provision.Request{TransportKey: transport, Statement: statement}).StatusCode)
+
+	// Nonces are single use
+	statement, err = keyStore.AttestTransportKey(enclave.TransportECDHP256, nonce())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, post("/keys/device-identity", &provision.Request{TransportKey: transport, Statement: statement}).StatusCode)
+	assert.Equal(t, http.StatusForbidden, post("/keys/device-identity", &provision.Request{TransportKey: transport, Statement: statement}).StatusCode)
+
+	// The statement must be about the transport key the server wraps to
+	other, err := keyStore.TransportKey(enclave.TransportRSAOAEP256)
+	assert.NoError(t, err)
+	statement, err = keyStore.AttestTransportKey(enclave.TransportECDHP256, nonce())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, post("/keys/device-identity", &provision.Request{TransportKey: other, Statement: statement}).StatusCode)
+
+	// Devices the verifier does not trust are refused
+	untrusted, err := enclave.InitializeKeyStore(make([]byte, 0x9000))
+	assert.NoError(t, err)
+	defer untrusted.Destroy()
+	_, err = provision.NewClient(httpServer.URL).Provision(context.Background(), untrusted, "device-identity", enclave.TransportECDHP256)
+	assert.ErrorIs(t, err, provision.ErrTransportKeyNotAttested)
+}
@@ -0,0 +1,708 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/share"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+)
+
+// QuorumOperation is a sensitive operation that can be placed under M-of-N operator approval
+type QuorumOperation string
+
+const (
+	QuorumExportKey        QuorumOperation = "export-key"         // ExportPrivateKey
+	QuorumExportShard      QuorumOperation = "export-shard"       // ExportKeyShard
+	QuorumRecoverKey       QuorumOperation = "recover-key"        // RecoverKey
+	QuorumDeleteKey        QuorumOperation = "delete-key"         // DeleteKey
+	QuorumSetKeyPolicy     QuorumOperation = "set-key-policy"     // SetKeyPolicy
+	QuorumSetSigningPolicy QuorumOperation = "set-signing-policy" // SetSigningPolicy
+	QuorumSetKeyState      QuorumOperation = "set-key-state"      // DisableKey, EnableKey
+)
+
+// quorumOperations lists every operation that can require approval
+var quorumOperations = []QuorumOperation{
+	QuorumExportKey, QuorumExportShard, QuorumRecoverKey, QuorumDeleteKey, QuorumSetKeyPolicy, QuorumSetSigningPolicy,
+	QuorumSetKeyState,
+}
+
+// quorumStorageKey is where the quorum configuration of a sealed key store is kept
+const quorumStorageKey = "quorum"
+
+// quorumFuse is the fuse blown once a sealed key store enables quorum, so that deleting the persisted
+// configuration cannot silently disable it
+const quorumFuse = 1 << 0
+
+// defaultRequestTTL is how long a request collects approvals when the configuration does not say
+const defaultRequestTTL = time.Hour
+
+var (
+	// ErrQuorumRequired is returned when an operation must go through RequestOperation and ExecuteRequest
+	ErrQuorumRequired = errors.New("operation requires quorum approval")
+
+	// ErrQuorumNotReached is returned when a request has fewer valid approvals than the threshold
+	ErrQuorumNotReached = errors.New("quorum not reached")
+
+	// ErrApprovalInvalid is returned for approvals from unknown operators, with bad signatures, or expired
+	ErrApprovalInvalid = errors.New("invalid approval")
+
+	// ErrRequestNotFound is returned for unknown, expired or already executed requests
+	ErrRequestNotFound = errors.New("quorum request not found")
+)
+
+// Operator is a person who can approve sensitive operations with their own key
+type Operator struct {
+	ID        string
+	PublicKey crypto.PublicKey // *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+}
+
+// QuorumConfig places operations under M-of-N approval
+type QuorumConfig struct {
+	Threshold  int
+	Operators  []Operator
+	Operations []QuorumOperation // Operations that need approval; all of them if empty
+	RequestTTL time.Duration     // How long a request can collect approvals; an hour if zero
+}
+
+// QuorumRequest is a pending sensitive operation. Operators approve its Digest.
+type QuorumRequest struct {
+	ID        string          `json:"id"`
+	Operation QuorumOperation `json:"operation"`
+	KeyID     string          `json:"key_id,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// Approval is an operator's signature over a request, valid until ExpiresAt
+type Approval struct {
+	OperatorID string    `json:"operator_id"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Signature  []byte    `json:"signature"`
+}
+
+// RecoverParams are the parameters of a recover-key request
+type RecoverParams struct {
+	Label     string    `json:"label"`
+	Algorithm Algorithm `json:"algorithm"`
+	Shares    []string  `json:"shares"` // Armored shares; see share.EncodeArmor
+}
+
+// ExportParams are the parameters of an export-key or export-shard request. The operators approve the
+// recipient along with the request, and the exported material is only released wrapped to it.
+type ExportParams struct {
+	Recipient *TransportKey `json:"recipient"` // See NewTransportKey
+}
+
+// QuorumResult is the outcome of an executed request
+type QuorumResult struct {
+	Wrapped *WrappedKey // export-key and export-shard, wrapped to the recipient; see UnwrapKey
+	Key     *KeyHandle  // recover-key
+}
+
+// quorumState is the quorum configuration and the requests collecting approvals
+type quorumState struct {
+	config    QuorumConfig
+	requests  map[string]*QuorumRequest
+	approvals map[string]map[string]*Approval // Request ID to operator ID
+}
+
+// quorumRecord is the persisted quorum configuration, authenticated under the KEK
+type quorumRecord struct {
+	Threshold  int               `json:"threshold"`
+	Operators  map[string][]byte `json:"operators"` // Operator ID to PKIX DER
+	Operations []QuorumOperation `json:"operations"`
+	RequestTTL time.Duration     `json:"request_ttl"`
+	Tag        []byte            `json:"tag,omitempty"`
+}
+
+// Digest returns what operators sign to approve the request
+func (r *QuorumRequest) Digest() []byte {
+	encoded, _ := json.Marshal(r)
+	sum := sha256.Sum256(append([]byte("enclave-quorum-request:"), encoded...))
+	return sum[:]
+}
+
+// approvalDigest binds an approval to the request, the operator and the approval's expiry
+func approvalDigest(request *QuorumRequest, operatorID string, expiresAt time.Time) []byte {
+	digest := sha256.New()
+	digest.Write(request.Digest())
+	fmt.Fprintf(digest, "%d:%s", len(operatorID), operatorID)
+	digest.Write([]byte(expiresAt.UTC().Format(time.RFC3339Nano)))
+	return digest.Sum(nil)
+}
+
+// SignApproval signs an approval of a request with an operator's key: RSA PKCS #1 v1.5 or ECDSA over
+// SHA-256, or Ed25519
+func SignApproval(request *QuorumRequest, operatorID string, signer crypto.Signer, expiresAt time.Time) (*Approval, error) {
+	digest := approvalDigest(request, operatorID, expiresAt)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	signature, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign approval: %v", err)
+	}
+	return &Approval{OperatorID: operatorID, ExpiresAt: expiresAt.UTC(), Signature: signature}, nil
+}
+
+// verifyApproval checks an approval signature with the operator's public key
+func verifyApproval(public crypto.PublicKey, digest, signature []byte) bool {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest, signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, digest, signature)
+	default:
+		return false
+	}
+}
+
+// validate checks a quorum configuration and fills in defaults
+func (c *QuorumConfig) validate() error {
+	if len(c.Operators) == 0 {
+		return fmt.Errorf("invalid quorum: no operators")
+	}
+	if c.Threshold < 2 || c.Threshold > len(c.Operators) {
+		return fmt.Errorf("invalid quorum: threshold %d of %d operators", c.Threshold, len(c.Operators))
+	}
+	seen := make(map[string]bool)
+	for _, operator := range c.Operators {
+		if operator.ID == "" || seen[operator.ID] {
+			return fmt.Errorf("invalid quorum: missing or duplicate operator ID %q", operator.ID)
+		}
+		seen[operator.ID] = true
+		switch operator.PublicKey.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return fmt.Errorf("invalid quorum: operator %s has unsupported key %T", operator.ID, operator.PublicKey)
+		}
+	}
+	if len(c.Operations) == 0 {
+		c.Operations = slices.Clone(quorumOperations)
+	}
+	for _, op := range c.Operations {
+		if !slices.Contains(quorumOperations, op) {
+			return fmt.Errorf("invalid quorum: unknown operation %q", op)
+		}
+	}
+	if c.RequestTTL <= 0 {
+		c.RequestTTL = defaultRequestTTL
+	}
+	return nil
+}
+
+// EnableQuorum places operations under M-of-N operator approval. Once enabled, the quorum cannot be
+// changed or disabled through the key store; a sealed key store keeps it across restarts.
+func (ks *EnclaveKeyStore) EnableQuorum(config QuorumConfig) error {
+	config.Operators = slices.Clone(config.Operators)
+	config.Operations = slices.Clone(config.Operations)
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	if ks.quorum != nil {
+		return fmt.Errorf("quorum is already enabled")
+	}
+	record, err := newQuorumRecord(&config)
+	if err != nil {
+		return err
+	}
+	if ks.blobs != nil {
+		if err := ks.storeQuorumLocked(record); err != nil {
+			return err
+		}
+		if err := fpga.BlowFuses(quorumFuse, fuseOffset, ks.mappedMem); err != nil {
+			return fmt.Errorf("failed to blow quorum fuse: %v", err)
+		}
+	}
+	ks.quorum = newQuorumState(config)
+	if err := ks.extendQuorumLocked(record); err != nil {
+		return err
+	}
+
+	operators := make([]string, len(config.Operators))
+	for i, operator := range config.Operators {
+		operators[i] = operator.ID
+	}
+	return ks.auditLocked(AuditEvent{Type: "quorum.enable", Details: map[string]any{
+		"threshold":  config.Threshold,
+		"operators":  operators,
+		"operations": config.Operations,
+	}})
+}
+
+func newQuorumState(config QuorumConfig) *quorumState {
+	return &quorumState{
+		config:    config,
+		requests:  make(map[string]*QuorumRequest),
+		approvals: make(map[string]map[string]*Approval),
+	}
+}
+
+// requireQuorum fails if the operation needs quorum approval
+func (ks *EnclaveKeyStore) requireQuorum(op QuorumOperation) error {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.quorum != nil && slices.Contains(ks.quorum.config.Operations, op) {
+		return fmt.Errorf("%w: %s", ErrQuorumRequired, op)
+	}
+	return nil
+}
+
+// RequestOperation creates a request for an operation under quorum. params are the operation's other
+// arguments: ExportParams for export-key and export-shard, a *KeyPolicy for set-key-policy, a
+// *SigningPolicy for set-signing-policy, the KeyState for set-key-state, RecoverParams for recover-key, and
+// nil otherwise.
+func (ks *EnclaveKeyStore) RequestOperation(op QuorumOperation, keyID string, params any) (*QuorumRequest, error) {
+	if !slices.Contains(quorumOperations, op) {
+		return nil, fmt.Errorf("unknown quorum operation %q", op)
+	}
+	var encoded json.RawMessage
+	if params != nil {
+		var err error
+		if encoded, err = json.Marshal(params); err != nil {
+			return nil, fmt.Errorf("failed to encode %s parameters: %v", op, err)
+		}
+	}
+	if op == QuorumExportKey || op == QuorumExportShard {
+		if _, err := exportRecipient(&QuorumRequest{Operation: op, Params: encoded}); err != nil {
+			return nil, err
+		}
+	}
+	if op == QuorumSetKeyState {
+		if _, err := requestedState(&QuorumRequest{Operation: op, Params: encoded}); err != nil {
+			return nil, err
+		}
+	}
+	id, err := newKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	if ks.quorum == nil {
+		return nil, fmt.Errorf("quorum is not enabled")
+	}
+	if op != QuorumRecoverKey {
+		if _, ok := ks.keys[keyID]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+		}
+	}
+
+	now := policyClock().UTC()
+	request := &QuorumRequest{
+		ID:        id,
+		Operation: op,
+		KeyID:     keyID,
+		Params:    encoded,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ks.quorum.config.RequestTTL),
+	}
+	ks.quorum.requests[id] = request
+	ks.quorum.approvals[id] = make(map[string]*Approval)
+
+	if err := ks.auditLocked(AuditEvent{Type: "quorum.request", KeyID: keyID, Details: map[string]any{
+		"request_id": id,
+		"operation":  op,
+		"digest":     hex.EncodeToString(request.Digest()),
+	}}); err != nil {
+		return nil, err
+	}
+	c := *request
+	return &c, nil
+}
+
+// QuorumRequest returns a pending request, for operators to review and approve
+func (ks *EnclaveKeyStore) QuorumRequest(id string) (*QuorumRequest, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	request, err := ks.pendingRequestLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	c := *request
+	return &c, nil
+}
+
+// pendingRequestLocked returns an unexpired request, dropping it if it has expired
+func (ks *EnclaveKeyStore) pendingRequestLocked(id string) (*QuorumRequest, error) {
+	if ks.quorum == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRequestNotFound, id)
+	}
+	request, ok := ks.quorum.requests[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRequestNotFound, id)
+	}
+	if !policyClock().Before(request.ExpiresAt) {
+		delete(ks.quorum.requests, id)
+		delete(ks.quorum.approvals, id)
+		return nil, fmt.Errorf("%w: %s expired at %v", ErrRequestNotFound, id, request.ExpiresAt)
+	}
+	return request, nil
+}
+
+// Approve adds an operator's approval to a request. The signature is checked immediately.
+func (ks *EnclaveKeyStore) Approve(requestID string, approval *Approval) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	request, err := ks.pendingRequestLocked(requestID)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(ks.quorum.config.Operators, func(o Operator) bool { return o.ID == approval.OperatorID })
+	if i < 0 {
+		return fmt.Errorf("%w: unknown operator %q", ErrApprovalInvalid, approval.OperatorID)
+	}
+	if !policyClock().Before(approval.ExpiresAt) {
+		return fmt.Errorf("%w: approval by %s expired at %v", ErrApprovalInvalid, approval.OperatorID, approval.ExpiresAt)
+	}
+	digest := approvalDigest(request, approval.OperatorID, approval.ExpiresAt)
+	if !verifyApproval(ks.quorum.config.Operators[i].PublicKey, digest, approval.Signature) {
+		return fmt.Errorf("%w: bad signature by %s", ErrApprovalInvalid, approval.OperatorID)
+	}
+
+	c := *approval
+	ks.quorum.approvals[requestID][approval.OperatorID] = &c
+	return ks.auditLocked(AuditEvent{Type: "quorum.approve", KeyID: request.KeyID, Details: map[string]any{
+		"request_id":  requestID,
+		"operator_id": approval.OperatorID,
+	}})
+}
+
+// ExecuteRequest runs a request once the threshold of operators have valid, unexpired approvals. The
+// request is consumed whether or not the operation succeeds, and the approval set is recorded in the
+// audit log. The key store stays locked from the approval check to the audit event.
+func (ks *EnclaveKeyStore) ExecuteRequest(requestID string) (*QuorumResult, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	request, err := ks.pendingRequestLocked(requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := policyClock()
+	var approvals []map[string]any
+	for _, operator := range ks.quorum.config.Operators {
+		approval, ok := ks.quorum.approvals[requestID][operator.ID]
+		if !ok || !now.Before(approval.ExpiresAt) {
+			continue
+		}
+		approvals = append(approvals, map[string]any{
+			"operator_id": operator.ID,
+			"expires_at":  approval.ExpiresAt,
+			"signature":   hex.EncodeToString(approval.Signature),
+		})
+	}
+	if len(approvals) < ks.quorum.config.Threshold {
+		return nil, fmt.Errorf("%w: %d of %d approvals", ErrQuorumNotReached, len(approvals), ks.quorum.config.Threshold)
+	}
+
+	// Consume the request before running it so it cannot run twice
+	delete(ks.quorum.requests, requestID)
+	delete(ks.quorum.approvals, requestID)
+
+	result, err := ks.executeOperationLocked(request)
+	details := map[string]any{
+		"request_id": requestID,
+		"operation":  request.Operation,
+		"digest":     hex.EncodeToString(request.Digest()),
+		"approvals":  approvals,
+	}
+	if result != nil && result.Wrapped != nil {
+		details["recipient"] = result.Wrapped.TransportKeyID
+	}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	if auditErr := ks.auditLocked(AuditEvent{Type: "quorum.execute", KeyID: request.KeyID, Details: details}); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// executeOperationLocked runs an approved request
+func (ks *EnclaveKeyStore) executeOperationLocked(request *QuorumRequest) (*QuorumResult, error) {
+	result := &QuorumResult{}
+	var err error
+	switch request.Operation {
+	case QuorumExportKey:
+		result.Wrapped, err = ks.exportWrappedLocked(request, false)
+	case QuorumExportShard:
+		result.Wrapped, err = ks.exportWrappedLocked(request, true)
+	case QuorumDeleteKey:
+		err = ks.deleteKeyLocked(request.KeyID)
+	case QuorumSetKeyPolicy:
+		var policy *KeyPolicy
+		if err = decodeParams(request, &policy); err == nil {
+			err = ks.setKeyPolicyLocked(request.KeyID, policy)
+		}
+	case QuorumSetSigningPolicy:
+		var policy *SigningPolicy
+		if err = decodeParams(request, &policy); err == nil {
+			err = ks.setSigningPolicyLocked(request.KeyID, policy)
+		}
+	case QuorumSetKeyState:
+		var state KeyState
+		if state, err = requestedState(request); err == nil {
+			err = ks.setStateLocked(request.KeyID, state)
+		}
+	case QuorumRecoverKey:
+		var params RecoverParams
+		if err = decodeParams(request, &params); err == nil {
+			result.Key, err = ks.recoverKeyLocked(params)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// exportWrappedLocked exports a private key or key shard wrapped to the recipient of an approved request.
+// The plaintext is wiped once it is wrapped.
+func (ks *EnclaveKeyStore) exportWrappedLocked(request *QuorumRequest, shard bool) (*WrappedKey, error) {
+	recipient, err := exportRecipient(request)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ks.activeKeyLocked(request.KeyID, "", Usage{Operation: OperationWrap})
+	if err != nil {
+		return nil, err
+	}
+	header := &WrappedKey{KeyAlgorithm: key.handle.Algorithm, Label: key.handle.Label, Shard: shard}
+
+	if shard {
+		material, err := ks.exportKeyShardLocked(request.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(material)
+		return wrapMaterial(recipient, header, material)
+	}
+	private, err := ks.exportPrivateKeyLocked(request.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer wipePrivateKey(private)
+	return WrapKey(recipient, key.handle.Label, private)
+}
+
+// requestedState returns the state a set-key-state request moves its key to
+func requestedState(request *QuorumRequest) (KeyState, error) {
+	var state KeyState
+	if err := decodeParams(request, &state); err != nil {
+		return "", err
+	}
+	if state != KeyStateActive && state != KeyStateDisabled {
+		return "", fmt.Errorf("invalid %s parameters: state must be %s or %s", request.Operation, KeyStateActive, KeyStateDisabled)
+	}
+	return state, nil
+}
+
+// exportRecipient returns the recipient transport key of an export request
+func exportRecipient(request *QuorumRequest) (*TransportKey, error) {
+	var params ExportParams
+	if err := decodeParams(request, &params); err != nil {
+		return nil, err
+	}
+	if params.Recipient == nil {
+		return nil, fmt.Errorf("invalid %s parameters: no recipient key", request.Operation)
+	}
+	if _, err := params.Recipient.Public(); err != nil {
+		return nil, fmt.Errorf("invalid %s parameters: %v", request.Operation, err)
+	}
+	return params.Recipient, nil
+}
+
+// decodeParams decodes a request's parameters
+func decodeParams(request *QuorumRequest, v any) error {
+	if len(request.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(request.Params, v); err != nil {
+		return fmt.Errorf("invalid %s parameters: %v", request.Operation, err)
+	}
+	return nil
+}
+
+// RecoverKey rebuilds a key from armored Shamir shares of its slot material, as written by share.Split,
+// and imports it under a new key ID
+func (ks *EnclaveKeyStore) RecoverKey(params RecoverParams) (*KeyHandle, error) {
+	if err := ks.requireQuorum(QuorumRecoverKey); err != nil {
+		return nil, err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.recoverKeyLocked(params)
+}
+
+// recoverKeyLocked recovers a key without the quorum check, with the key store locked
+func (ks *EnclaveKeyStore) recoverKeyLocked(params RecoverParams) (*KeyHandle, error) {
+	shares := make([]*share.Share, len(params.Shares))
+	for i, armored := range params.Shares {
+		s, err := share.DecodeArmor([]byte(armored))
+		if err != nil {
+			return nil, err
+		}
+		if s.Scheme != share.SchemeShamirGF256 {
+			return nil, fmt.Errorf("share %d is %s and cannot be recombined", i, s.Scheme)
+		}
+		shares[i] = s
+	}
+	material, err := share.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(material)
+
+	var key crypto.PrivateKey = bytes.Clone(material)
+	if params.Algorithm != AlgorithmAES256 {
+		if key, err = privateKeyFromMaterial(params.Algorithm, material); err != nil {
+			return nil, fmt.Errorf("recovered %s key is invalid: %v", params.Algorithm, err)
+		}
+	}
+	defer wipePrivateKey(key)
+	handle, keyMaterial, partial, err := importMaterial(params.Label, key)
+	if err != nil {
+		return nil, err
+	}
+	return ks.addKeyLocked(handle, keyMaterial, partial)
+}
+
+// newQuorumRecord returns the persisted form of a quorum configuration, without its tag
+func newQuorumRecord(config *QuorumConfig) (*quorumRecord, error) {
+	record := &quorumRecord{
+		Threshold:  config.Threshold,
+		Operators:  make(map[string][]byte),
+		Operations: config.Operations,
+		RequestTTL: config.RequestTTL,
+	}
+	for _, operator := range config.Operators {
+		der, err := x509.MarshalPKIXPublicKey(operator.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode key of operator %s: %v", operator.ID, err)
+		}
+		record.Operators[operator.ID] = der
+	}
+	return record, nil
+}
+
+// storeQuorumLocked persists the quorum configuration, authenticated under the KEK
+func (ks *EnclaveKeyStore) storeQuorumLocked(record *quorumRecord) error {
+	tag, err := ks.device.tag(record.authenticated())
+	if err != nil {
+		return fmt.Errorf("failed to authenticate quorum configuration: %v", err)
+	}
+	record.Tag = tag
+
+	encoded, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quorum configuration: %v", err)
+	}
+	if err := ks.blobs.Put(quorumStorageKey, encoded); err != nil {
+		return fmt.Errorf("failed to store quorum configuration: %v", err)
+	}
+	return nil
+}
+
+// loadQuorumLocked restores a persisted quorum configuration, if there is one. Once the quorum fuse is
+// blown the configuration must be there.
+func (ks *EnclaveKeyStore) loadQuorumLocked(blobs storage.Backend) error {
+	fuses, err := fpga.ReadFuses(fuseOffset, ks.mappedMem)
+	if err != nil {
+		return err
+	}
+	encoded, err := blobs.Get(quorumStorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		if fuses&quorumFuse != 0 {
+			return fmt.Errorf("%w: quorum was enabled on this device but its configuration is missing", ErrSealedKeyCorrupt)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read quorum configuration: %v", err)
+	}
+
+	var record quorumRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return fmt.Errorf("%w: quorum configuration: %v", ErrSealedKeyCorrupt, err)
+	}
+	if !ks.device.checkTag(record.authenticated(), record.Tag) {
+		return fmt.Errorf("%w: quorum configuration failed authentication", ErrSealedKeyCorrupt)
+	}
+
+	config := QuorumConfig{
+		Threshold:  record.Threshold,
+		Operations: record.Operations,
+		RequestTTL: record.RequestTTL,
+	}
+	for id, der := range record.Operators {
+		public, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return fmt.Errorf("%w: key of operator %s: %v", ErrSealedKeyCorrupt, id, err)
+		}
+		config.Operators = append(config.Operators, Operator{ID: id, PublicKey: public})
+	}
+	slices.SortFunc(config.Operators, func(a, b Operator) int { return strings.Compare(a.ID, b.ID) })
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSealedKeyCorrupt, err)
+	}
+	ks.quorum = newQuorumState(config)
+	return ks.extendQuorumLocked(&record)
+}
+
+// extendQuorumLocked measures the quorum configuration into the policy register
+func (ks *EnclaveKeyStore) extendQuorumLocked(record *quorumRecord) error {
+	digest := sha256.Sum256(record.authenticated())
+	return ks.extendLocked(attest.RegisterPolicy, digest[:], "quorum")
+}
+
+// authenticated returns the encoding of the record covered by its tag
+func (record *quorumRecord) authenticated() []byte {
+	untagged := *record
+	untagged.Tag = nil
+	encoded, _ := json.Marshal(&untagged)
+	return encoded
+}
@@ -0,0 +1,277 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/share"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// testOperators returns three operators with Ed25519 and ECDSA keys
+func testOperators(t *testing.T) ([]Operator, map[string]crypto.Signer) {
+	signers := make(map[string]crypto.Signer)
+	_, alice, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signers["alice"] = alice
+	bob, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	signers["bob"] = bob
+	_, carol, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signers["carol"] = carol
+
+	var operators []Operator
+	for _, id := range []string{"alice", "bob", "carol"} {
+		operators = append(operators, Operator{ID: id, PublicKey: signers[id].Public()})
+	}
+	return operators, signers
+}
+
+// approve has an operator approve a request for an hour
+func approve(t *testing.T, keyStore *EnclaveKeyStore, request *QuorumRequest, operatorID string, signer crypto.Signer) error {
+	approval, err := SignApproval(request, operatorID, signer, policyClock().Add(time.Hour))
+	assert.NoError(t, err)
+	return keyStore.Approve(request.ID, approval)
+}
+
+func TestQuorumExport(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	log := NewMemoryAuditLog()
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	operators, signers := testOperators(t)
+	assert.Error(t, keyStore.EnableQuorum(QuorumConfig{Threshold: 1, Operators: operators}))
+	assert.NoError(t, keyStore.EnableQuorum(QuorumConfig{Threshold: 2, Operators: operators}))
+
+	// A single caller can no longer export, delete or change policies
+	_, err := keyStore.ExportPrivateKey(aesKey)
+	assert.ErrorIs(t, err, ErrQuorumRequired)
+	assert.ErrorIs(t, keyStore.DeleteKey(aesKey), ErrQuorumRequired)
+	assert.ErrorIs(t, keyStore.SetKeyPolicy(aesKey, nil), ErrQuorumRequired)
+
+	// Exports must name the recipient the material is wrapped to
+	_, err = keyStore.RequestOperation(QuorumExportKey, aesKey, nil)
+	assert.Error(t, err)
+	_, err = keyStore.RequestOperation(QuorumExportKey, aesKey, ExportParams{Recipient: &TransportKey{Algorithm: TransportECDHP256}})
+	assert.Error(t, err)
+	recipientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	recipient, err := NewTransportKey(&recipientKey.PublicKey)
+	assert.NoError(t, err)
+
+	request, err := keyStore.RequestOperation(QuorumExportKey, aesKey, ExportParams{Recipient: recipient})
+	assert.NoError(t, err)
+	assert.NoError(t, approve(t, keyStore, request, "alice", signers["alice"]))
+	_, err = keyStore.ExecuteRequest(request.ID)
+	assert.ErrorIs(t, err, ErrQuorumNotReached)
+
+	// Approving twice does not count twice
+	assert.NoError(t, approve(t, keyStore, request, "alice", signers["alice"]))
+	_, err = keyStore.ExecuteRequest(request.ID)
+	assert.ErrorIs(t, err, ErrQuorumNotReached)
+
+	assert.NoError(t, approve(t, keyStore, request, "bob", signers["bob"]))
+	result, err := keyStore.ExecuteRequest(request.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, recipient.ID, result.Wrapped.TransportKeyID)
+	exported, err := UnwrapKey(result.Wrapped, recipientKey)
+	assert.NoError(t, err)
+	assert.Len(t, exported, keySize)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, err = UnwrapKey(result.Wrapped, otherKey)
+	assert.ErrorIs(t, err, ErrWrappedKeyInvalid)
+
+	// Requests run once
+	_, err = keyStore.ExecuteRequest(request.ID)
+	assert.ErrorIs(t, err, ErrRequestNotFound)
+
+	// The approval set is in the audit log
+	events := log.Events()
+	last := events[len(events)-1]
+	assert.Equal(t, "quorum.execute", last.Type)
+	assert.Equal(t, aesKey, last.KeyID)
+	assert.Equal(t, recipient.ID, last.Details["recipient"])
+	approvals := last.Details["approvals"].([]any)
+	assert.Len(t, approvals, 2)
+	assert.Equal(t, "alice", approvals[0].(map[string]any)["operator_id"])
+	assert.Equal(t, "bob", approvals[1].(map[string]any)["operator_id"])
+
+	// Shards are wrapped too, and cannot be imported as keys
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+	request, err = keyStore.RequestOperation(QuorumExportShard, ecdsaKey, ExportParams{Recipient: recipient})
+	assert.NoError(t, err)
+	assert.NoError(t, approve(t, keyStore, request, "bob", signers["bob"]))
+	assert.NoError(t, approve(t, keyStore, request, "carol", signers["carol"]))
+	result, err = keyStore.ExecuteRequest(request.ID)
+	assert.NoError(t, err)
+	assert.True(t, result.Wrapped.Shard)
+	shard, err := UnwrapKey(result.Wrapped, recipientKey)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, shard)
+	_, err = keyStore.ImportWrappedKey(result.Wrapped)
+	assert.ErrorIs(t, err, ErrWrappedKeyInvalid)
+}
+
+func TestQuorumApprovals(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	rsaKey := keyID(t, keyStore, DefaultRSAKeyLabel)
+	operators, signers := testOperators(t)
+	assert.NoError(t, keyStore.EnableQuorum(QuorumConfig{
+		Threshold:  2,
+		Operators:  operators,
+		Operations: []QuorumOperation{QuorumDeleteKey},
+		RequestTTL: time.Hour,
+	}))
+	assert.Error(t, keyStore.EnableQuorum(QuorumConfig{Threshold: 1, Operators: operators}))
+
+	// Operations outside the quorum are unaffected
+	_, err := keyStore.ExportKeyShard(rsaKey)
+	assert.NoError(t, err)
+
+	request, err := keyStore.RequestOperation(QuorumDeleteKey, rsaKey, nil)
+	assert.NoError(t, err)
+
+	// Unknown operators, signatures by the wrong key, tampered requests and expired approvals are refused
+	assert.ErrorIs(t, approve(t, keyStore, request, "mallory", signers["alice"]), ErrApprovalInvalid)
+	assert.ErrorIs(t, approve(t, keyStore, request, "bob", signers["alice"]), ErrApprovalInvalid)
+	tampered := *request
+	tampered.KeyID = keyID(t, keyStore, DefaultAESKeyLabel)
+	assert.ErrorIs(t, approve(t, keyStore, &tampered, "alice", signers["alice"]), ErrApprovalInvalid)
+	expired, err := SignApproval(request, "carol", signers["carol"], policyClock().Add(-time.Second))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, keyStore.Approve(request.ID, expired), ErrApprovalInvalid)
+
+	// Approvals that expire before execution no longer count
+	now := time.Now()
+	setClock(t, &now)
+	short, err := SignApproval(request, "alice", signers["alice"], now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Approve(request.ID, short))
+	assert.NoError(t, approve(t, keyStore, request, "carol", signers["carol"]))
+	now = now.Add(2 * time.Minute)
+	_, err = keyStore.ExecuteRequest(request.ID)
+	assert.ErrorIs(t, err, ErrQuorumNotReached)
+
+	assert.NoError(t, approve(t, keyStore, request, "bob", signers["bob"]))
+	_, err = keyStore.ExecuteRequest(request.ID)
+	assert.NoError(t, err)
+	_, err = keyStore.GetKey(rsaKey)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// Requests expire
+	request, err = keyStore.RequestOperation(QuorumDeleteKey, keyID(t, keyStore, DefaultAESKeyLabel), nil)
+	assert.NoError(t, err)
+	now = now.Add(2 * time.Hour)
+	_, err = keyStore.QuorumRequest(request.ID)
+	assert.ErrorIs(t, err, ErrRequestNotFound)
+}
+
+func TestQuorumPolicyAndRecovery(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+	operators, signers := testOperators(t)
+	assert.NoError(t, keyStore.EnableQuorum(QuorumConfig{Threshold: 2, Operators: operators}))
+
+	execute := func(op QuorumOperation, keyID string, params any) *QuorumResult {
+		request, err := keyStore.RequestOperation(op, keyID, params)
+		assert.NoError(t, err)
+		assert.NoError(t, approve(t, keyStore, request, "bob", signers["bob"]))
+		assert.NoError(t, approve(t, keyStore, request, "carol", signers["carol"]))
+		result, err := keyStore.ExecuteRequest(request.ID)
+		assert.NoError(t, err)
+		return result
+	}
+
+	execute(QuorumSetKeyPolicy, ecdsaKey, &KeyPolicy{Operations: []Operation{OperationVerify}})
+	_, err := ECDSASign([]byte("message"), keyStore, ecdsaKey)
+	assert.ErrorIs(t, err, ErrOperationNotAllowed)
+
+	// Disabling or enabling a key needs approval too
+	assert.ErrorIs(t, keyStore.DisableKey(ecdsaKey), ErrQuorumRequired)
+	assert.ErrorIs(t, keyStore.EnableKey(ecdsaKey), ErrQuorumRequired)
+	_, err = keyStore.RequestOperation(QuorumSetKeyState, ecdsaKey, KeyStateDestroyed)
+	assert.Error(t, err)
+	execute(QuorumSetKeyState, ecdsaKey, KeyStateDisabled)
+	handle, err := keyStore.GetKey(ecdsaKey)
+	assert.NoError(t, err)
+	assert.Equal(t, KeyStateDisabled, handle.State)
+	execute(QuorumSetKeyState, ecdsaKey, KeyStateActive)
+	handle, err = keyStore.GetKey(ecdsaKey)
+	assert.NoError(t, err)
+	assert.Equal(t, KeyStateActive, handle.State)
+
+	// Recover a key from armored backup shares
+	original, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	shares, err := share.Split("backup", original.D.FillBytes(make([]byte, keySize)), 5, 3)
+	assert.NoError(t, err)
+	var armored []string
+	for _, s := range shares[:3] {
+		encoded, err := share.EncodeArmor(s)
+		assert.NoError(t, err)
+		armored = append(armored, string(encoded))
+	}
+	params := RecoverParams{Label: "recovered", Algorithm: AlgorithmECDSAP256, Shares: armored}
+	_, err = keyStore.RecoverKey(params)
+	assert.ErrorIs(t, err, ErrQuorumRequired)
+
+	result := execute(QuorumRecoverKey, "", params)
+	assert.Equal(t, "recovered", result.Key.Label)
+	assert.True(t, original.PublicKey.Equal(result.Key.PublicKey))
+}
+
+func TestQuorumSurvivesReload(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("guarded", AlgorithmEd25519)
+	assert.NoError(t, err)
+	operators, signers := testOperators(t)
+	assert.NoError(t, keyStore.EnableQuorum(QuorumConfig{Threshold: 2, Operators: operators}))
+	assert.NoError(t, keyStore.Destroy())
+
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, keyStore.DeleteKey(key.ID), ErrQuorumRequired)
+	request, err := keyStore.RequestOperation(QuorumDeleteKey, key.ID, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, approve(t, keyStore, request, "alice", signers["alice"]))
+	assert.NoError(t, approve(t, keyStore, request, "bob", signers["bob"]))
+	_, err = keyStore.ExecuteRequest(request.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// Lowering the threshold on disk is detected
+	backend, err := storage.OpenFileBackend(dir)
+	assert.NoError(t, err)
+	data, err := backend.Get(quorumStorageKey)
+	assert.NoError(t, err)
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(data, &record))
+	record["threshold"] = 1
+	data, err = json.Marshal(record)
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Put(quorumStorageKey, data))
+	assert.NoError(t, backend.Close())
+
+	_, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+
+	// Deleting the configuration does not disable the quorum once its fuse is blown
+	backend, err = storage.OpenFileBackend(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Delete(quorumStorageKey))
+	assert.NoError(t, backend.Close())
+	_, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+}
@@ -0,0 +1,72 @@
+package enclave
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+)
+
+// ExtendRegister extends an application measurement register, from attest.RegisterApplication up, with a
+// SHA-256 digest. The registers below are extended by the enclave itself.
+func (ks *EnclaveKeyStore) ExtendRegister(index int, digest []byte, description string) error {
+	if index < attest.RegisterApplication || index >= attest.NumRegisters {
+		return fmt.Errorf("register %d cannot be extended by the host", index)
+	}
+	if len(digest) != sha256.Size {
+		return fmt.Errorf("measurement digest must be %d bytes, not %d", sha256.Size, len(digest))
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	return ks.extendLocked(index, digest, description)
+}
+
+// Registers returns the value of every measurement register
+func (ks *EnclaveKeyStore) Registers() ([][]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.device.readRegisters()
+}
+
+// MeasurementLog returns every extension of the measurement registers, in order. attest.Replay computes
+// the registers from it.
+func (ks *EnclaveKeyStore) MeasurementLog() []attest.MeasurementEvent {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return append([]attest.MeasurementEvent(nil), ks.measurements...)
+}
+
+// extendLocked extends a register and records the extension in the measurement and audit logs
+func (ks *EnclaveKeyStore) extendLocked(index int, digest []byte, description string) error {
+	digest = append([]byte(nil), digest...)
+	if err := ks.device.extend(index, digest); err != nil {
+		return fmt.Errorf("failed to extend measurement register %d: %v", index, err)
+	}
+	ks.measurements = append(ks.measurements, attest.MeasurementEvent{
+		Register:    index,
+		Digest:      digest,
+		Description: description,
+	})
+	return ks.auditLocked(AuditEvent{Type: "register.extend", Details: map[string]any{
+		"register":    index,
+		"digest":      hex.EncodeToString(digest),
+		"description": description,
+	}})
+}
+
+// extendPolicyLocked measures a policy attached to a key into the policy register
+func (ks *EnclaveKeyStore) extendPolicyLocked(kind, keyID string, policy any) error {
+	encoded, err := json.Marshal(map[string]any{"kind": kind, "key_id": keyID, "policy": policy})
+	if err != nil {
+		return fmt.Errorf("failed to measure %s: %v", kind, err)
+	}
+	digest := sha256.Sum256(encoded)
+	return ks.extendLocked(attest.RegisterPolicy, digest[:], kind+" "+keyID)
+}
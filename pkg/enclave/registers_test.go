@@ -0,0 +1,87 @@
+package enclave
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasurementRegisters(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	zero := make([]byte, sha256.Size)
+	for _, register := range readRegisters(t, keyStore) {
+		assert.Equal(t, zero, register)
+	}
+
+	// Images, their configuration and policy changes are measured
+	measurement := loadTestImage(t, keyStore)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+	assert.NoError(t, keyStore.SetKeyPolicy(ecdsaKey, &KeyPolicy{MaxUses: 10}))
+	assert.NoError(t, keyStore.SetSigningPolicy(ecdsaKey, releasePolicy()))
+	operators, _ := testOperators(t)
+	assert.NoError(t, keyStore.EnableQuorum(QuorumConfig{Threshold: 2, Operators: operators, Operations: []QuorumOperation{QuorumDeleteKey}}))
+
+	registers := readRegisters(t, keyStore)
+	assert.Equal(t, attest.Extend(zero, measurement), registers[attest.RegisterImage])
+	assert.NotEqual(t, zero, registers[attest.RegisterConfig])
+	assert.NotEqual(t, zero, registers[attest.RegisterPolicy])
+
+	// Only application registers can be extended by the host
+	digest := sha256.Sum256([]byte("application state"))
+	assert.Error(t, keyStore.ExtendRegister(attest.RegisterImage, digest[:], "forged image"))
+	assert.Error(t, keyStore.ExtendRegister(attest.NumRegisters, digest[:], "unknown"))
+	assert.Error(t, keyStore.ExtendRegister(attest.RegisterApplication, digest[:16], "short"))
+	assert.NoError(t, keyStore.ExtendRegister(attest.RegisterApplication, digest[:], "application state"))
+
+	// The measurement log replays to the registers
+	log := keyStore.MeasurementLog()
+	assert.Len(t, log, 6)
+	replayed, err := attest.Replay(log)
+	assert.NoError(t, err)
+	assert.Equal(t, readRegisters(t, keyStore), replayed)
+
+	// Quotes carry the registers
+	nonce := []byte("0123456789abcdef")
+	quote, err := keyStore.Quote(nonce)
+	assert.NoError(t, err)
+	public, err := keyStore.AttestationPublicKey()
+	assert.NoError(t, err)
+	verifier := &attest.Verifier{
+		Key:          public,
+		Measurements: [][]byte{measurement},
+		Registers:    map[int][]byte{attest.RegisterPolicy: replayed[attest.RegisterPolicy]},
+	}
+	assert.NoError(t, verifier.Verify(quote, nonce))
+
+	assert.NoError(t, keyStore.SetKeyPolicy(ecdsaKey, nil))
+	quote, err = keyStore.Quote(nonce)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, verifier.Verify(quote, nonce), attest.ErrRegisterMismatch)
+}
+
+func TestMeasurementRegistersAfterReload(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("release-signing", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetSigningPolicy(key.ID, releasePolicy()))
+	policyRegister := readRegisters(t, keyStore)[attest.RegisterPolicy]
+	assert.NoError(t, keyStore.Destroy())
+
+	// Restored policies are measured the same way
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	assert.Equal(t, policyRegister, readRegisters(t, keyStore)[attest.RegisterPolicy])
+}
+
+// readRegisters returns the measurement registers of a key store
+func readRegisters(t *testing.T, keyStore *EnclaveKeyStore) [][]byte {
+	registers, err := keyStore.Registers()
+	assert.NoError(t, err)
+	return registers
+}
@@ -0,0 +1,182 @@
+package enclave
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+)
+
+// stateStorageKey is where the anti-rollback state of a sealed key store is kept
+const stateStorageKey = "state"
+
+// ErrRollback is returned when an image is older than the newest installed image of its family, or a
+// sealed key blob is older than the one last written
+var ErrRollback = errors.New("rollback to an older version")
+
+// stateRecord is the persisted anti-rollback state, authenticated under the KEK: the version of each image
+// family and the checksum of every sealed key blob. Counter is the value of the FPGA's monotonic counter
+// once the record is written, so an older record cannot be replayed, and with it neither can an older or
+// deleted key blob.
+type stateRecord struct {
+	Versions map[string]uint32 `json:"versions"`
+	Keys     map[string]string `json:"keys"`
+	Counter  uint32            `json:"counter"`
+	Tag      []byte            `json:"tag,omitempty"`
+}
+
+// ImageVersions returns the anti-rollback version of each image family: the newest version installed.
+// Older images of a family are refused by LoadImage.
+func (ks *EnclaveKeyStore) ImageVersions() map[string]uint32 {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return maps.Clone(ks.versions)
+}
+
+// checkVersionLocked refuses an image older than the anti-rollback version of its family
+func (ks *EnclaveKeyStore) checkVersionLocked(family string, version uint32) error {
+	if installed := ks.versions[family]; version < installed {
+		return fmt.Errorf("%w: %s version %d, installed %d", ErrRollback, family, version, installed)
+	}
+	return nil
+}
+
+// advanceVersionLocked raises the anti-rollback version of a family once an image is installed. The
+// version is persisted before it takes effect, so a failed write leaves the old version in place, and the
+// monotonic counter is advanced once the record is written.
+func (ks *EnclaveKeyStore) advanceVersionLocked(family string, version uint32) error {
+	previous, ok := ks.versions[family]
+	if ok && version <= previous {
+		return nil
+	}
+	versions := maps.Clone(ks.versions)
+	if versions == nil {
+		versions = make(map[string]uint32)
+	}
+	versions[family] = version
+	if ks.blobs != nil {
+		if err := ks.storeStateLocked(versions, ks.sealed); err != nil {
+			return err
+		}
+	}
+	ks.versions = versions
+	return ks.auditLocked(AuditEvent{Type: "image.version", Details: map[string]any{
+		"family":   family,
+		"version":  version,
+		"previous": previous,
+	}})
+}
+
+// storeStateLocked persists the anti-rollback state under the next value of the monotonic counter,
+// authenticated under the KEK, then advances the counter
+func (ks *EnclaveKeyStore) storeStateLocked(versions map[string]uint32, sealed map[string]string) error {
+	counter, err := fpga.ReadCounter(counterOffset, ks.mappedMem)
+	if err != nil {
+		return err
+	}
+	record := &stateRecord{Versions: versions, Keys: sealed, Counter: counter + 1}
+	tag, err := ks.device.tag(record.authenticated())
+	if err != nil {
+		return fmt.Errorf("failed to authenticate anti-rollback state: %v", err)
+	}
+	record.Tag = tag
+
+	encoded, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode anti-rollback state: %v", err)
+	}
+	if err := ks.blobs.Put(stateStorageKey, encoded); err != nil {
+		return fmt.Errorf("failed to store anti-rollback state: %v", err)
+	}
+	if _, err := fpga.IncrementCounter(counterOffset, ks.mappedMem); err != nil {
+		return fmt.Errorf("failed to advance anti-rollback counter: %v", err)
+	}
+	return nil
+}
+
+// loadStateLocked restores the persisted anti-rollback state, if there is one, and returns the checksum
+// of each sealed key blob it anchors. The record must match the monotonic counter: a record older than the
+// counter has been replayed, and a missing record has been deleted once any state was written. A record
+// one ahead was written by an update interrupted before the counter advanced, so the counter catches up.
+// A key store that never wrote the state has no anchored blobs, and nil is returned.
+func (ks *EnclaveKeyStore) loadStateLocked(blobs storage.Backend) (map[string]string, error) {
+	counter, err := fpga.ReadCounter(counterOffset, ks.mappedMem)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := blobs.Get(stateStorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		if counter > 0 {
+			return nil, fmt.Errorf("%w: anti-rollback state is missing after %d updates", ErrSealedKeyCorrupt, counter)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read anti-rollback state: %v", err)
+	}
+
+	var record stateRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return nil, fmt.Errorf("%w: anti-rollback state: %v", ErrSealedKeyCorrupt, err)
+	}
+	if !ks.device.checkTag(record.authenticated(), record.Tag) {
+		return nil, fmt.Errorf("%w: anti-rollback state failed authentication", ErrSealedKeyCorrupt)
+	}
+	switch {
+	case record.Counter < counter:
+		return nil, fmt.Errorf("%w: %w: anti-rollback state was written at counter %d, the counter is %d", ErrSealedKeyCorrupt, ErrRollback, record.Counter, counter)
+	case record.Counter == counter+1:
+		if _, err := fpga.IncrementCounter(counterOffset, ks.mappedMem); err != nil {
+			return nil, fmt.Errorf("failed to advance anti-rollback counter: %v", err)
+		}
+	case record.Counter != counter:
+		return nil, fmt.Errorf("%w: anti-rollback state was written at counter %d, the counter is %d", ErrSealedKeyCorrupt, record.Counter, counter)
+	}
+	ks.versions = record.Versions
+	if record.Keys == nil {
+		record.Keys = make(map[string]string)
+	}
+	return record.Keys, nil
+}
+
+// anchorSealedKeysLocked checks sealed key blobs against the checksums in the anti-rollback state. A blob
+// that differs from the one last written has been replayed, and a missing one has been deleted. A blob the
+// state does not list belongs to a deleted key, or to a key whose creation never completed, and is skipped.
+// Without an anchored state every blob is accepted and anchored by the next write.
+func (ks *EnclaveKeyStore) anchorSealedKeysLocked(records []*sealedKey, anchored map[string]string) ([]*sealedKey, error) {
+	if anchored == nil {
+		ks.sealed = make(map[string]string, len(records))
+		for _, record := range records {
+			ks.sealed[record.ID] = record.Checksum
+		}
+		return records, nil
+	}
+
+	var current []*sealedKey
+	for _, record := range records {
+		checksum, ok := anchored[record.ID]
+		switch {
+		case !ok:
+			continue
+		case subtle.ConstantTimeCompare([]byte(checksum), []byte(record.Checksum)) != 1:
+			return nil, fmt.Errorf("%w: %w: key %s is not the blob last written", ErrSealedKeyCorrupt, ErrRollback, record.ID)
+		}
+		current = append(current, record)
+	}
+	if len(current) != len(anchored) {
+		return nil, fmt.Errorf("%w: %d sealed keys are missing", ErrSealedKeyCorrupt, len(anchored)-len(current))
+	}
+	ks.sealed = anchored
+	return current, nil
+}
+
+// authenticated returns the encoding of the record covered by its tag
+func (record *stateRecord) authenticated() []byte {
+	versions, _ := json.Marshal(record.Versions)
+	keys, _ := json.Marshal(record.Keys)
+	return fmt.Appendf(nil, "anti-rollback state:%d:%s:%s", record.Counter, versions, keys)
+}
@@ -0,0 +1,105 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadVersionedImage builds and loads a test image of the given family and version
+func loadVersionedImage(t *testing.T, keyStore *EnclaveKeyStore, family string, version uint32) error {
+	image := buildTestImage(t, family, version, []byte("hello from the enclave"))
+	return keyStore.LoadImage(image, testVendorKey.Public(), importImageKey(t, keyStore), make([]byte, 4096), 0)
+}
+
+func TestImageRollback(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	assert.Empty(t, keyStore.ImageVersions())
+
+	assert.NoError(t, loadVersionedImage(t, keyStore, "hello", 2))
+	assert.NoError(t, loadVersionedImage(t, keyStore, "hello", 2))
+	assert.NoError(t, loadVersionedImage(t, keyStore, "other", 1))
+	assert.ErrorIs(t, loadVersionedImage(t, keyStore, "hello", 1), ErrRollback)
+	assert.NoError(t, loadVersionedImage(t, keyStore, "hello", 3))
+	assert.Equal(t, map[string]uint32{"hello": 3, "other": 1}, keyStore.ImageVersions())
+	versions := 0
+	for _, event := range eventTypes(log.Events()) {
+		if event == "image.version" {
+			versions++
+		}
+	}
+	assert.Equal(t, 3, versions)
+
+	// Quotes report the anti-rollback versions
+	quote, err := keyStore.Quote([]byte("0123456789abcdef"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"hello": 3, "other": 1}, quote.Versions)
+}
+
+func TestImageVersionsSurviveReload(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	open := func(mappedMem []byte) (*EnclaveKeyStore, error) {
+		return OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	}
+	edit := func(change func(backend storage.Backend)) {
+		backend, err := storage.OpenFileBackend(dir)
+		assert.NoError(t, err)
+		change(backend)
+		assert.NoError(t, backend.Close())
+	}
+	keyStore, err := open(mappedMem)
+	assert.NoError(t, err)
+	assert.NoError(t, loadVersionedImage(t, keyStore, "hello", 5))
+	assert.NoError(t, keyStore.Destroy())
+
+	var old, current []byte
+	edit(func(backend storage.Backend) {
+		old, err = backend.Get(stateStorageKey)
+		assert.NoError(t, err)
+	})
+
+	keyStore, err = open(mappedMem)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"hello": 5}, keyStore.ImageVersions())
+	assert.ErrorIs(t, loadVersionedImage(t, keyStore, "hello", 4), ErrRollback)
+	interrupted := bytes.Clone(mappedMem)
+	assert.NoError(t, loadVersionedImage(t, keyStore, "hello", 6))
+	assert.NoError(t, keyStore.Destroy())
+	edit(func(backend storage.Backend) {
+		current, err = backend.Get(stateStorageKey)
+		assert.NoError(t, err)
+		assert.NoError(t, backend.Put(stateStorageKey, old))
+	})
+
+	// Replaying an older record is detected by the monotonic counter
+	_, err = open(mappedMem)
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+	assert.ErrorIs(t, err, ErrRollback)
+	edit(func(backend storage.Backend) { assert.NoError(t, backend.Put(stateStorageKey, current)) })
+
+	// A record written just before the counter advanced is accepted, and the counter catches up
+	keyStore, err = open(interrupted)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint32{"hello": 6}, keyStore.ImageVersions())
+	assert.NoError(t, keyStore.Destroy())
+	assert.Equal(t, mappedMem[counterOffset:counterOffset+4], interrupted[counterOffset:counterOffset+4])
+
+	// Lowering a version on disk is detected
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal(current, &record))
+	record["versions"] = map[string]uint32{"hello": 1}
+	data, err := json.Marshal(record)
+	assert.NoError(t, err)
+	edit(func(backend storage.Backend) { assert.NoError(t, backend.Put(stateStorageKey, data)) })
+	_, err = open(mappedMem)
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+
+	// Deleting the record once versions have been written is detected
+	edit(func(backend storage.Backend) { assert.NoError(t, backend.Delete(stateStorageKey)) })
+	_, err = open(mappedMem)
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+}
@@ -1,52 +1,89 @@
 package enclave
 
 import (
+	"crypto"
 	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
+	"math/big"
 
 	"github.com/hashicorp/vault/shamir"
-	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
 )
 
-// InitializeRSAKey generates a random RSA key, splits it using Shamir Secret Sharing, and loads both full and partial keys into FPGA
-func InitializeRSAKey(mappedMem []byte) ([]byte, []byte, error) {
-	// Generate a random RSA key (256 bytes for 2048-bit RSA)
-	rsaFullKey := make([]byte, rsaKeySize)
-	_, err := rand.Read(rsaFullKey)
+// generateRSAKey generates an RSA-2048 key and splits its key slot material using Shamir Secret Sharing
+func generateRSAKey() ([]byte, []byte, crypto.PublicKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeySize*8)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate RSA key: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to generate RSA key: %v", err)
 	}
 
+	// The key slot holds the two primes (128 bytes each for 2048-bit RSA); the public exponent is fixed
+	rsaFullKey := make([]byte, rsaKeySize)
+	key.Primes[0].FillBytes(rsaFullKey[:rsaKeySize/2])
+	key.Primes[1].FillBytes(rsaFullKey[rsaKeySize/2:])
+
 	// Split the RSA key using Shamir Secret Sharing
 	// n = total shares, threshold = minimum number of shares to reassemble the key
 	shares, err := shamir.Split(rsaFullKey, numShares, threshold)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to split RSA key using Shamir: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to split RSA key using Shamir: %v", err)
 	}
 
 	// Use the first share as the partial key shard
-	rsaPartialKey := shares[0]
+	return rsaFullKey, shares[0], &key.PublicKey, nil
+}
 
-	// Load the full RSA key into the FPGA
-	err = fpga.LoadKeyToFPGA(rsaFullKey, 0x2000, mappedMem)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load RSA full key to FPGA: %v", err)
+// rsaPrivateKey rebuilds an RSA private key from the primes held in its key slot
+func rsaPrivateKey(material []byte) (*rsa.PrivateKey, error) {
+	if len(material) != rsaKeySize {
+		return nil, fmt.Errorf("invalid RSA key material length %d", len(material))
 	}
 
-	// Load the partial RSA key into the FPGA
-	err = fpga.LoadKeyToFPGA(rsaPartialKey, 0x2100, mappedMem)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load RSA partial key to FPGA: %v", err)
+	p := new(big.Int).SetBytes(material[:rsaKeySize/2])
+	q := new(big.Int).SetBytes(material[rsaKeySize/2:])
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: new(big.Int).Mul(p, q), E: 65537},
+		Primes:    []*big.Int{p, q},
+	}
+
+	// Derive D from the primes and the fixed public exponent
+	one := big.NewInt(1)
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	key.D = new(big.Int).ModInverse(big.NewInt(int64(key.E)), phi)
+	if key.D == nil {
+		return nil, fmt.Errorf("invalid RSA key material")
 	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid RSA key material: %v", err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// RSASign performs a full RSA PKCS #1 v1.5 signature over the SHA-256 digest of a message using the complete
+// private key
+func RSASign(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	return RSASignHash(message, crypto.SHA256, PaddingPKCS1v15, keyStore, keyID)
+}
 
-	fmt.Println("RSA full and partial keys successfully loaded into the FPGA")
-	return rsaFullKey, rsaPartialKey, nil
+// RSASignPSS performs a full RSA-PSS signature over the SHA-256 digest of a message using the complete private key
+func RSASignPSS(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	return RSASignHash(message, crypto.SHA256, PaddingPSS, keyStore, keyID)
 }
 
-// RSASign performs a full RSA signature using the complete private key
-func RSASign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+// RSASignHash performs a full RSA signature with a padding over the digest of a message with SHA-256, SHA-384
+// or SHA-512
+func RSASignHash(message []byte, hash crypto.Hash, padding Padding, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	if err := checkRSASignature(hash, padding); err != nil {
+		return nil, err
+	}
+	key, err := keyStore.activeKey(keyID, AlgorithmRSA2048, Usage{Operation: OperationSign, Hash: hash, Padding: padding, Message: message})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load full RSA private key into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.RSAFullKey, 0x2000, nil)
+	err = keyStore.loadFullKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load full RSA key: %v", err)
 	}
@@ -55,14 +92,18 @@ func RSASign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
 	signature := make([]byte, 256) // Placeholder for actual signature
 	copy(signature, message)       // Just copying message for testing
 
-	fmt.Println("Performing RSA full signing")
 	return signature, nil
 }
 
 // RSAPartialSign performs a partial RSA signature using a key shard (threshold signing)
-func RSAPartialSign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
+func RSAPartialSign(message []byte, keyStore *EnclaveKeyStore, keyID string) ([]byte, error) {
+	key, err := keyStore.activeKey(keyID, AlgorithmRSA2048, Usage{Operation: OperationSign, Hash: crypto.SHA256, Padding: PaddingPKCS1v15, Message: message})
+	if err != nil {
+		return nil, err
+	}
+
 	// Load RSA partial key shard into FPGA
-	err := fpga.LoadKeyToFPGA(keyStore.RSAPartial, 0x2100, nil)
+	err = keyStore.loadPartialKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load RSA partial key: %v", err)
 	}
@@ -71,6 +112,40 @@ func RSAPartialSign(message []byte, keyStore *EnclaveKeyStore) ([]byte, error) {
 	partialSignature := make([]byte, 256) // Placeholder for partial signature
 	copy(partialSignature, message)       // Just copying message for testing
 
-	fmt.Println("Performing RSA partial signing")
 	return partialSignature, nil
 }
+
+// RSAVerify verifies an RSA signature with a padding over the digest of a message with the key's public key
+func RSAVerify(message, signature []byte, hash crypto.Hash, padding Padding, keyStore *EnclaveKeyStore, keyID string) error {
+	if err := checkRSASignature(hash, padding); err != nil {
+		return err
+	}
+	key, err := keyStore.activeKey(keyID, AlgorithmRSA2048, Usage{Operation: OperationVerify, Hash: hash, Padding: padding, Message: message})
+	if err != nil {
+		return err
+	}
+	public, ok := key.handle.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoPublicKey, keyID)
+	}
+
+	digest := hash.New()
+	digest.Write(message)
+	if padding == PaddingPSS {
+		err = rsa.VerifyPSS(public, hash, digest.Sum(nil), signature, nil)
+	} else {
+		err = rsa.VerifyPKCS1v15(public, hash, digest.Sum(nil), signature)
+	}
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// checkRSASignature refuses a hash or padding RSA keys cannot sign with
+func checkRSASignature(hash crypto.Hash, padding Padding) error {
+	if padding != PaddingPKCS1v15 && padding != PaddingPSS {
+		return fmt.Errorf("unsupported RSA padding %q", padding)
+	}
+	return checkSignatureHash(hash)
+}
@@ -0,0 +1,476 @@
+package enclave
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/secmem"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+)
+
+const (
+	sealedKeyVersion = 1       // Version of the sealed key blob format
+	sealedKeyPrefix  = "keys/" // Storage prefix of sealed key blobs
+	sealedKeyExt     = ".key"  // Suffix of sealed key blobs in schema version 1
+)
+
+var (
+	// ErrSealedKeyCorrupt is returned when a sealed key blob is malformed or fails its checksum
+	ErrSealedKeyCorrupt = errors.New("sealed key blob is corrupt")
+
+	// ErrSealedKeyUnwrap is returned when a sealed key cannot be unwrapped, because it was sealed under a
+	// different key-encryption key or its metadata was altered
+	ErrSealedKeyUnwrap = errors.New("sealed key failed to unwrap")
+)
+
+// KeyStoreConfig configures a sealed, persistent key store. Blobs are kept in Storage, or in a file
+// backend on Dir if Storage is nil.
+type KeyStoreConfig struct {
+	Storage       storage.Backend // Backend holding the sealed key blobs; the caller closes it
+	Dir           string          // Directory of a file backend opened and closed by the key store
+	KEK           []byte          // AES key-encryption key, loaded into the FPGA; OpenKeyStore wipes this slice
+	NonExportable bool            // Generate new keys inside the FPGA; see NewNonExportableKeyStore
+
+	// DeviceSecret is the 32-byte device secret from which the device identity and sealing keys are
+	// derived; OpenKeyStore wipes this slice. If it is nil, the host generates a secret on first open and
+	// keeps it in storage wrapped under the KEK. Either way the secret passes through host memory on its way
+	// to the key engine: the FPGA has no fuse or PUF interface, so the device identity is rooted in the host
+	// that provisions it, not in the silicon.
+	DeviceSecret []byte
+}
+
+// deviceSecretStorageKey is the storage key of the device secret generated for key stores without one
+const deviceSecretStorageKey = "device-secret"
+
+// deviceSecretRecord is the persisted device secret, wrapped under the KEK
+type deviceSecretRecord struct {
+	Version int    `json:"version"`
+	Secret  []byte `json:"secret"`
+}
+
+// sealedKey is the persisted form of a key: its metadata and its slot contents wrapped under the KEK
+type sealedKey struct {
+	Version    int            `json:"version"`
+	ID         string         `json:"id"`
+	Label      string         `json:"label"`
+	Algorithm  Algorithm      `json:"algorithm"`
+	Size       int            `json:"size"`
+	State      KeyState       `json:"state"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Exportable bool           `json:"exportable"`
+	Origin     KeyOrigin      `json:"origin,omitempty"`
+	PublicKey  []byte         `json:"public_key,omitempty"` // PKIX DER
+	Policy     *KeyPolicy     `json:"policy,omitempty"`
+	Uses       uint64         `json:"uses,omitempty"`
+	Signing    *SigningPolicy `json:"signing_policy,omitempty"`
+	Material   []byte         `json:"material,omitempty"` // Full key slot, wrapped with AES-KWP
+	Partial    []byte         `json:"partial,omitempty"`  // Partial key slot, wrapped with AES-KWP
+	Checksum   string         `json:"checksum,omitempty"` // SHA-256 of the blob with an empty checksum
+}
+
+// OpenKeyStore opens a sealed key store, migrating its storage to the current schema. The KEK is loaded
+// into the FPGA, and every sealed key is unwrapped into a hardware key slot. The caller's KEK and device
+// secret slices are wiped before OpenKeyStore returns, whether or not it succeeds.
+func OpenKeyStore(mappedMem []byte, config KeyStoreConfig) (*EnclaveKeyStore, error) {
+	defer wipe(config.KEK)
+	defer wipe(config.DeviceSecret)
+	switch len(config.KEK) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid key-encryption key length %d", len(config.KEK))
+	}
+	if config.DeviceSecret != nil && len(config.DeviceSecret) != keySize {
+		return nil, fmt.Errorf("invalid device secret length %d", len(config.DeviceSecret))
+	}
+
+	blobs := config.Storage
+	var closeStorage func() error
+	if blobs == nil {
+		backend, err := storage.OpenFileBackend(config.Dir)
+		if err != nil {
+			return nil, err
+		}
+		blobs, closeStorage = backend, backend.Close
+	}
+	if _, err := storage.Migrate(blobs, keyStoreMigrations); err != nil {
+		if closeStorage != nil {
+			closeStorage()
+		}
+		return nil, err
+	}
+
+	ks := NewKeyStore(mappedMem)
+	ks.exportable = !config.NonExportable
+	ks.closeStorage = closeStorage
+
+	// The KEK lives in the FPGA from here on
+	if err := ks.device.loadKEK(config.KEK); err != nil {
+		ks.Destroy()
+		return nil, fmt.Errorf("failed to load key-encryption key to FPGA: %v", err)
+	}
+
+	records, err := loadSealedKeys(blobs)
+	if err != nil {
+		ks.Destroy()
+		return nil, err
+	}
+	ks.mu.Lock()
+	err = ks.loadDeviceSecretLocked(blobs, config.DeviceSecret)
+	var anchored map[string]string
+	if err == nil {
+		anchored, err = ks.loadStateLocked(blobs)
+	}
+	if err == nil {
+		records, err = ks.anchorSealedKeysLocked(records, anchored)
+	}
+	for _, record := range records {
+		if err != nil {
+			break
+		}
+		err = ks.restoreLocked(record)
+	}
+	if err == nil {
+		err = ks.loadQuorumLocked(blobs)
+	}
+	ks.mu.Unlock()
+	if err != nil {
+		ks.Destroy()
+		return nil, err
+	}
+
+	ks.blobs = blobs
+	return ks, nil
+}
+
+// loadDeviceSecretLocked loads the device secret into the FPGA: the configured one, or else the one kept
+// in storage, which is generated and stored on first open
+func (ks *EnclaveKeyStore) loadDeviceSecretLocked(blobs storage.Backend, secret []byte) error {
+	if secret != nil {
+		if err := ks.device.loadRoot(secret); err != nil {
+			return fmt.Errorf("failed to load device secret: %v", err)
+		}
+		return nil
+	}
+
+	encoded, err := blobs.Get(deviceSecretStorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		record := &deviceSecretRecord{Version: sealedKeyVersion}
+		if record.Secret, err = ks.device.sealRoot(); err != nil {
+			return fmt.Errorf("failed to seal device secret: %v", err)
+		}
+		encoded, err := json.MarshalIndent(record, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode device secret: %v", err)
+		}
+		if err := blobs.Put(deviceSecretStorageKey, encoded); err != nil {
+			return fmt.Errorf("failed to store device secret: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read device secret: %v", err)
+	}
+
+	var record deviceSecretRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return fmt.Errorf("%w: device secret: %v", ErrSealedKeyCorrupt, err)
+	}
+	if record.Version != sealedKeyVersion {
+		return fmt.Errorf("%w: device secret has unsupported version %d", ErrSealedKeyCorrupt, record.Version)
+	}
+	if err := ks.device.unsealRoot(record.Secret); err != nil {
+		return fmt.Errorf("%w: device secret: %v", ErrSealedKeyUnwrap, err)
+	}
+	return nil
+}
+
+// restoreLocked unwraps a sealed key into hardware key slots
+func (ks *EnclaveKeyStore) restoreLocked(record *sealedKey) error {
+	handle := KeyHandle{
+		ID:        record.ID,
+		Label:     record.Label,
+		Algorithm: record.Algorithm,
+		Size:      record.Size,
+		CreatedAt: record.CreatedAt,
+		State:     record.State,
+		Origin:    record.Origin,
+	}
+	if len(record.PublicKey) > 0 {
+		public, err := x509.ParsePKIXPublicKey(record.PublicKey)
+		if err != nil {
+			return fmt.Errorf("%w: key %s: invalid public key: %v", ErrSealedKeyCorrupt, record.ID, err)
+		}
+		handle.PublicKey = public
+	}
+
+	err := ks.reserveSlotsLocked(&handle, record.Material != nil, record.Partial != nil)
+	if err != nil {
+		return err
+	}
+
+	// A key sealed as non-exportable stays non-exportable
+	handle.Exportable = ks.exportable && record.Exportable
+	if record.Signing != nil {
+		if err := record.Signing.compile(); err != nil {
+			return fmt.Errorf("%w: key %s: %v", ErrSealedKeyCorrupt, record.ID, err)
+		}
+	}
+
+	key := &enclaveKey{handle: handle, policy: record.Policy, uses: record.Uses, signing: record.Signing}
+	ks.keys[handle.ID] = key
+
+	// Restored policies are measured as if they had just been set
+	if record.Policy != nil {
+		err = ks.extendPolicyLocked("key policy", handle.ID, record.Policy)
+	}
+	if err == nil && record.Signing != nil {
+		err = ks.extendPolicyLocked("signing policy", handle.ID, record.Signing)
+	}
+	if err != nil {
+		ks.destroyKeyLocked(key)
+		delete(ks.keys, handle.ID)
+		return err
+	}
+
+	key.material, err = ks.unsealLocked(record, handle.Slot, record.Material, "material")
+	if err == nil {
+		key.partial, err = ks.unsealLocked(record, handle.PartialSlot, record.Partial, "partial")
+	}
+	if err != nil {
+		ks.destroyKeyLocked(key)
+		delete(ks.keys, handle.ID)
+		return err
+	}
+	return nil
+}
+
+// unsealLocked has the key engine unwrap a sealed slot into its key slot. The material of exportable keys
+// is also returned to the host, which loads it over AXI and keeps a locked copy.
+func (ks *EnclaveKeyStore) unsealLocked(record *sealedKey, slot int, blob []byte, role string) (*secmem.Buffer, error) {
+	if blob == nil {
+		return nil, nil
+	}
+
+	exportable := ks.keys[record.ID].handle.Exportable
+	material, err := ks.device.unseal(slot, blob, record.binding(role), exportable)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s %s: %v", ErrSealedKeyUnwrap, record.ID, role, err)
+	}
+	if !exportable {
+		return nil, nil
+	}
+
+	if err := ks.injectLocked(slot, material); err != nil {
+		wipe(material)
+		return nil, fmt.Errorf("failed to load %s key to FPGA: %v", record.Algorithm, err)
+	}
+	return lockedCopy(material)
+}
+
+// persistLocked seals a key's slots under the KEK and writes the blob, if the key store is persistent
+func (ks *EnclaveKeyStore) persistLocked(key *enclaveKey) error {
+	if ks.blobs == nil {
+		return nil
+	}
+
+	handle := key.handle
+	record := &sealedKey{
+		Version:    sealedKeyVersion,
+		ID:         handle.ID,
+		Label:      handle.Label,
+		Algorithm:  handle.Algorithm,
+		Size:       handle.Size,
+		State:      handle.State,
+		CreatedAt:  handle.CreatedAt,
+		Exportable: handle.Exportable,
+		Origin:     handle.Origin,
+		Policy:     key.policy,
+		Uses:       key.uses,
+		Signing:    key.signing,
+	}
+	if handle.PublicKey != nil {
+		der, err := x509.MarshalPKIXPublicKey(handle.PublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to encode public key of %s: %v", handle.ID, err)
+		}
+		record.PublicKey = der
+	}
+
+	var err error
+	if handle.Slot >= 0 {
+		if record.Material, err = ks.device.seal(handle.Slot, record.binding("material")); err != nil {
+			return fmt.Errorf("failed to seal key %s: %v", handle.ID, err)
+		}
+	}
+	if handle.PartialSlot >= 0 {
+		if record.Partial, err = ks.device.seal(handle.PartialSlot, record.binding("partial")); err != nil {
+			return fmt.Errorf("failed to seal partial key %s: %v", handle.ID, err)
+		}
+	}
+	if err := storeSealedKey(ks.blobs, record); err != nil {
+		return err
+	}
+
+	// The blob is anchored to the monotonic counter, so that it cannot be replaced by an older one
+	sealed := maps.Clone(ks.sealed)
+	if sealed == nil {
+		sealed = make(map[string]string)
+	}
+	sealed[handle.ID] = record.Checksum
+	if err := ks.storeStateLocked(ks.versions, sealed); err != nil {
+		return err
+	}
+	ks.sealed = sealed
+	return nil
+}
+
+// unpersistLocked drops a key from the anti-rollback state, so that its blob can no longer be restored,
+// then deletes the blob
+func (ks *EnclaveKeyStore) unpersistLocked(id string) error {
+	sealed := maps.Clone(ks.sealed)
+	delete(sealed, id)
+	if err := ks.storeStateLocked(ks.versions, sealed); err != nil {
+		return err
+	}
+	ks.sealed = sealed
+	return removeSealedKey(ks.blobs, id)
+}
+
+// binding returns the digest wrapped along with a slot, covering the metadata and the slot's role
+func (record *sealedKey) binding(role string) []byte {
+	metadata := *record
+	metadata.Material = nil
+	metadata.Partial = nil
+	metadata.Checksum = ""
+	encoded, _ := json.Marshal(&metadata)
+
+	digest := sha256.New()
+	digest.Write(encoded)
+	digest.Write([]byte(role))
+	return digest.Sum(nil)
+}
+
+// checksum returns the SHA-256 of the blob with an empty checksum field
+func (record *sealedKey) checksum() string {
+	unsummed := *record
+	unsummed.Checksum = ""
+	encoded, _ := json.Marshal(&unsummed)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// keyStoreMigrations upgrade sealed key storage to the current schema
+var keyStoreMigrations = []storage.Migration{
+	{
+		Version:     1,
+		Description: "sealed key blobs stored as <id>.key",
+		Migrate:     func(storage.Backend) error { return nil },
+	},
+	{
+		Version:     2,
+		Description: "sealed key blobs moved under keys/",
+		Migrate:     migrateKeysPrefix,
+	},
+}
+
+// migrateKeysPrefix moves version 1 blobs from <id>.key to keys/<id>
+func migrateKeysPrefix(b storage.Backend) error {
+	names, err := b.List("")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, sealedKeyExt) {
+			continue
+		}
+		data, err := b.Get(name)
+		if err != nil {
+			return err
+		}
+		// Write the new key before removing the old one so a crash never loses a blob
+		if err := b.Put(sealedKeyPrefix+strings.TrimSuffix(name, sealedKeyExt), data); err != nil {
+			return err
+		}
+		if err := b.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeSealedKey writes a blob with its checksum
+func storeSealedKey(b storage.Backend, record *sealedKey) error {
+	record.Checksum = record.checksum()
+	encoded, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sealed key %s: %v", record.ID, err)
+	}
+	if err := b.Put(sealedKeyPrefix+record.ID, encoded); err != nil {
+		return fmt.Errorf("failed to store sealed key %s: %v", record.ID, err)
+	}
+	return nil
+}
+
+// removeSealedKey deletes the blob of a key
+func removeSealedKey(b storage.Backend, id string) error {
+	if err := b.Delete(sealedKeyPrefix + id); err != nil {
+		return fmt.Errorf("failed to remove sealed key %s: %v", id, err)
+	}
+	return nil
+}
+
+// loadSealedKeys reads and verifies every blob, ordered by creation time
+func loadSealedKeys(b storage.Backend) ([]*sealedKey, error) {
+	names, err := b.List(sealedKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sealed keys: %v", err)
+	}
+
+	var records []*sealedKey
+	for _, name := range names {
+		data, err := b.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sealed key %s: %v", name, err)
+		}
+		record, err := decodeSealedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if name != sealedKeyPrefix+record.ID {
+			return nil, fmt.Errorf("%w: %s holds key %s", ErrSealedKeyCorrupt, name, record.ID)
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records, nil
+}
+
+// decodeSealedKey parses a blob and checks its version and checksum
+func decodeSealedKey(data []byte) (*sealedKey, error) {
+	var record sealedKey
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSealedKeyCorrupt, err)
+	}
+	if record.Version != sealedKeyVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrSealedKeyCorrupt, record.Version)
+	}
+	if subtle.ConstantTimeCompare([]byte(record.checksum()), []byte(record.Checksum)) != 1 {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSealedKeyCorrupt)
+	}
+	if record.ID == "" || (record.Material == nil && record.Partial == nil) {
+		return nil, fmt.Errorf("%w: missing key data", ErrSealedKeyCorrupt)
+	}
+	return &record, nil
+}
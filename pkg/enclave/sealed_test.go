@@ -0,0 +1,317 @@
+package enclave
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKEK returns a fresh copy of the test key-encryption key, since opening a key store wipes it
+func testKEK() []byte {
+	return bytes.Repeat([]byte{0x42}, keySize)
+}
+
+// testDeviceSecret returns the device secret of key stores opened with newDeviceKeyStore
+func testDeviceSecret() []byte {
+	return bytes.Repeat([]byte{0x5a}, keySize)
+}
+
+// newDeviceKeyStore opens an empty sealed key store on the device with the test device secret
+func newDeviceKeyStore(t *testing.T) *EnclaveKeyStore {
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: t.TempDir(), KEK: testKEK(), DeviceSecret: testDeviceSecret()})
+	assert.NoError(t, err)
+	t.Cleanup(func() { keyStore.Destroy() })
+	return keyStore
+}
+
+func TestSealedKeyStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+
+	keyStore, err := OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	_, err = createDefaultKeys(keyStore)
+	assert.NoError(t, err)
+
+	aesKey := keyID(t, keyStore, DefaultAESKeyLabel)
+	ecdsaKey := keyID(t, keyStore, DefaultECDSAKeyLabel)
+	assert.NoError(t, keyStore.DisableKey(ecdsaKey))
+
+	plaintext := []byte("Data that must survive a restart")
+	ciphertext, err := AESEncrypt(plaintext, keyStore, aesKey)
+	assert.NoError(t, err)
+	before := keyStore.ListKeys()
+	aesMaterial, err := keyStore.ExportPrivateKey(aesKey)
+	assert.NoError(t, err)
+
+	// No key material is stored in the clear
+	files, err := filepath.Glob(filepath.Join(dir, sealedKeyPrefix, "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 4)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(data, aesMaterial.([]byte)))
+	}
+	assert.NoError(t, keyStore.Destroy())
+
+	// Reopening restores the same keys with their metadata and state
+	kek := testKEK()
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: kek})
+	assert.NoError(t, err)
+	assert.Equal(t, make([]byte, len(kek)), kek, "The KEK should be wiped from the host")
+
+	after := keyStore.ListKeys()
+	assert.Len(t, after, len(before))
+	for i := range before {
+		assert.Equal(t, before[i].ID, after[i].ID)
+		assert.Equal(t, before[i].Label, after[i].Label)
+		assert.Equal(t, before[i].State, after[i].State)
+		assert.True(t, before[i].CreatedAt.Equal(after[i].CreatedAt))
+		if before[i].PublicKey != nil {
+			assert.Equal(t, before[i].PublicKey, after[i].PublicKey)
+		}
+	}
+
+	decrypted, err := AESDecrypt(ciphertext, keyStore, aesKey)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+	restored, err := keyStore.ExportPrivateKey(aesKey)
+	assert.NoError(t, err)
+	assert.Equal(t, aesMaterial, restored)
+
+	// Deleted keys stay deleted
+	assert.NoError(t, keyStore.DeleteKey(aesKey))
+	assert.NoError(t, keyStore.Destroy())
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	_, err = keyStore.GetKey(aesKey)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Len(t, keyStore.ListKeys(), 3)
+}
+
+func TestSealedKeyStoreNonExportable(t *testing.T) {
+	dir := t.TempDir()
+	config := KeyStoreConfig{Dir: dir, KEK: testKEK(), NonExportable: true}
+
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := OpenKeyStore(mappedMem, config)
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("signing", AlgorithmEd25519)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// Non-exportable keys are unsealed inside the FPGA, and stay non-exportable in an exportable key store
+	mappedMem = make([]byte, axiWindowSize)
+	keyStore, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	restored, err := keyStore.GetKey(key.ID)
+	assert.NoError(t, err)
+	assert.False(t, restored.Exportable)
+	assert.Equal(t, KeyOriginGenerated, restored.Origin)
+	assert.Equal(t, key.PublicKey, restored.PublicKey)
+	_, err = keyStore.ExportPrivateKey(key.ID)
+	assert.ErrorIs(t, err, ErrKeyNotExportable)
+	assert.Equal(t, make([]byte, numKeySlots*keySlotStride), mappedMem[keySlotBase:])
+
+	_, err = Ed25519Sign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+}
+
+func TestSealedKeyStoreCorruption(t *testing.T) {
+	dir := t.TempDir()
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("aes", AlgorithmAES256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// A different KEK cannot unwrap the keys
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: bytes.Repeat([]byte{0x24}, keySize)})
+	assert.ErrorIs(t, err, ErrSealedKeyUnwrap)
+
+	// Flipped bits are caught by the checksum
+	path := filepath.Join(dir, sealedKeyPrefix, key.ID)
+	original, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	corrupt := bytes.Replace(original, []byte(`"label": "aes"`), []byte(`"label": "aez"`), 1)
+	assert.NoError(t, os.WriteFile(path, corrupt, 0600))
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+
+	// Truncated writes are rejected
+	assert.NoError(t, os.WriteFile(path, original[:len(original)/2], 0600))
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+
+	// Leftover temporary files from an interrupted write are ignored
+	assert.NoError(t, os.WriteFile(path, original, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, sealedKeyPrefix, "."+key.ID+"-123.tmp"), []byte("partial"), 0600))
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	assert.Len(t, keyStore.ListKeys(), 1)
+}
+
+func TestSealedKeyMetadataBinding(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	keyStore, err := OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("disabled", AlgorithmAES256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.DisableKey(key.ID))
+	assert.NoError(t, keyStore.Destroy())
+
+	// Re-enabling a key by editing its blob and fixing the checksum breaks the unwrap, and the blob is no
+	// longer the one anchored to the monotonic counter
+	data, err := os.ReadFile(filepath.Join(dir, sealedKeyPrefix, key.ID))
+	assert.NoError(t, err)
+	record, err := decodeSealedKey(data)
+	assert.NoError(t, err)
+	record.State = KeyStateActive
+	backend, err := storage.OpenFileBackend(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, storeSealedKey(backend, record))
+	assert.NoError(t, backend.Close())
+
+	_, err = OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+	assert.ErrorIs(t, err, ErrRollback)
+	device := &keySlotRAM{mappedMem: make([]byte, axiWindowSize)}
+	assert.NoError(t, device.loadKEK(testKEK()))
+	_, err = device.unseal(0, record.Material, record.binding("material"), false)
+	assert.Error(t, err)
+}
+
+func TestSealedKeyReplay(t *testing.T) {
+	dir := t.TempDir()
+	mappedMem := make([]byte, axiWindowSize)
+	open := func() (*EnclaveKeyStore, error) {
+		return OpenKeyStore(mappedMem, KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	}
+	path := func(id string) string { return filepath.Join(dir, sealedKeyPrefix, id) }
+
+	keyStore, err := open()
+	assert.NoError(t, err)
+	limited, err := keyStore.CreateKey("limited", AlgorithmECDSAP256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.SetKeyPolicy(limited.ID, &KeyPolicy{Operations: []Operation{OperationSign}, MaxUses: 1}))
+	deleted, err := keyStore.CreateKey("deleted", AlgorithmAES256)
+	assert.NoError(t, err)
+	unused, err := os.ReadFile(path(limited.ID))
+	assert.NoError(t, err)
+	removed, err := os.ReadFile(path(deleted.ID))
+	assert.NoError(t, err)
+
+	_, err = ECDSASign([]byte("message"), keyStore, limited.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.DeleteKey(deleted.ID))
+	assert.NoError(t, keyStore.Destroy())
+	used, err := os.ReadFile(path(limited.ID))
+	assert.NoError(t, err)
+
+	// Replaying the blob from before the key was used would reset its use count
+	assert.NoError(t, os.WriteFile(path(limited.ID), unused, 0600))
+	_, err = open()
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+	assert.ErrorIs(t, err, ErrRollback)
+
+	// Restoring the blob of a deleted key does not bring it back
+	assert.NoError(t, os.WriteFile(path(limited.ID), used, 0600))
+	assert.NoError(t, os.WriteFile(path(deleted.ID), removed, 0600))
+	keyStore, err = open()
+	assert.NoError(t, err)
+	_, err = keyStore.GetKey(deleted.ID)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = ECDSASign([]byte("message"), keyStore, limited.ID)
+	assert.ErrorIs(t, err, ErrUsageLimitExceeded)
+	assert.NoError(t, keyStore.Destroy())
+
+	// Deleting the blob of a key is detected
+	assert.NoError(t, os.Remove(path(limited.ID)))
+	_, err = open()
+	assert.ErrorIs(t, err, ErrSealedKeyCorrupt)
+}
+
+func TestSealedKeyStoreBackends(t *testing.T) {
+	bolt, err := storage.OpenBoltBackend(filepath.Join(t.TempDir(), "keys.db"))
+	assert.NoError(t, err)
+	defer bolt.Close()
+
+	for name, backend := range map[string]storage.Backend{"memory": storage.NewMemoryBackend(), "bolt": bolt} {
+		t.Run(name, func(t *testing.T) {
+			keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Storage: backend, KEK: testKEK()})
+			assert.NoError(t, err)
+			key, err := keyStore.CreateKey("signing", AlgorithmECDSAP256)
+			assert.NoError(t, err)
+			assert.NoError(t, keyStore.Destroy())
+
+			// Caller-provided storage stays open and holds the current schema
+			version, err := storage.SchemaVersion(backend)
+			assert.NoError(t, err)
+			assert.Equal(t, len(keyStoreMigrations), version)
+
+			keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Storage: backend, KEK: testKEK()})
+			assert.NoError(t, err)
+			restored, err := keyStore.GetKey(key.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, key.PublicKey, restored.PublicKey)
+			assert.NoError(t, keyStore.Destroy())
+		})
+	}
+}
+
+func TestSealedKeyStoreLocking(t *testing.T) {
+	dir := t.TempDir()
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+
+	// Only one key store can use a directory at a time
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, storage.ErrLocked)
+
+	assert.NoError(t, keyStore.Destroy())
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// A key store that fails to open releases the directory, and the KEK is wiped either way
+	kek := testKEK()
+	_, err = OpenKeyStore(make([]byte, kekOffset), KeyStoreConfig{Dir: dir, KEK: kek})
+	assert.Error(t, err)
+	assert.Equal(t, make([]byte, len(kek)), kek)
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+}
+
+func TestSealedKeyStoreMigration(t *testing.T) {
+	dir := t.TempDir()
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	key, err := keyStore.CreateKey("aes", AlgorithmAES256)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// Rewrite the directory in the version 1 layout, which had no schema record
+	assert.NoError(t, os.Rename(filepath.Join(dir, sealedKeyPrefix, key.ID), filepath.Join(dir, key.ID+sealedKeyExt)))
+	assert.NoError(t, os.Remove(filepath.Join(dir, storage.SchemaKey)))
+
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	_, err = keyStore.GetKey(key.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	assert.FileExists(t, filepath.Join(dir, sealedKeyPrefix, key.ID))
+	assert.NoFileExists(t, filepath.Join(dir, key.ID+sealedKeyExt))
+
+	// Storage written by a newer schema is refused
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, storage.SchemaKey), []byte("99"), 0600))
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, storage.ErrSchemaTooNew)
+}
@@ -0,0 +1,189 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+)
+
+const (
+	sealedDataVersion = 1                                 // Version of the sealed data format
+	sealedDataContext = "fpga-secure-enclave sealed data" // HKDF info prefix of sealing keys
+)
+
+var (
+	// ErrMeasurementMismatch is returned by Unseal when the measurement registers differ from those the
+	// data was sealed to
+	ErrMeasurementMismatch = errors.New("measurement registers do not match the sealing policy")
+
+	// ErrSealedDataCorrupt is returned for sealed data that is malformed, was altered, or was sealed on
+	// another device
+	ErrSealedDataCorrupt = errors.New("sealed data is corrupt")
+)
+
+// SealedData is data encrypted under a key derived from the device root key and a set of measurement
+// register values. It can be stored anywhere; only this device, with the same register values, can
+// unseal it.
+type SealedData struct {
+	Version    int    `json:"version"`
+	Registers  []int  `json:"registers"`  // Registers the data is sealed to, in ascending order
+	Policy     []byte `json:"policy"`     // SHA-256 over the indexes and expected values of the registers
+	Salt       []byte `json:"salt"`       // HKDF salt of the sealing key
+	Nonce      []byte `json:"nonce"`      // AES-GCM nonce
+	Ciphertext []byte `json:"ciphertext"` // AES-256-GCM ciphertext and tag
+}
+
+// Seal encrypts data so that it can only be unsealed on this device while the given measurement
+// registers hold their current values. Sealing to no registers binds the data to the device alone.
+func (ks *EnclaveKeyStore) Seal(data []byte, registers ...int) (*SealedData, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	current, err := ks.device.readRegisters()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read measurement registers: %v", err)
+	}
+	values := make(map[int][]byte, len(registers))
+	for _, index := range registers {
+		if index < 0 || index >= attest.NumRegisters {
+			return nil, fmt.Errorf("unknown measurement register %d", index)
+		}
+		values[index] = current[index]
+	}
+	return ks.sealLocked(data, values)
+}
+
+// SealToRegisters encrypts data so that it can only be unsealed on this device once the registers hold
+// the given values, such as those attest.Replay computes for an approved update
+func (ks *EnclaveKeyStore) SealToRegisters(data []byte, values map[int][]byte) (*SealedData, error) {
+	for index, value := range values {
+		if index < 0 || index >= attest.NumRegisters {
+			return nil, fmt.Errorf("unknown measurement register %d", index)
+		}
+		if len(value) != sha256.Size {
+			return nil, fmt.Errorf("register %d value must be %d bytes, not %d", index, sha256.Size, len(value))
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.sealLocked(data, values)
+}
+
+// sealLocked seals data to a set of register values
+func (ks *EnclaveKeyStore) sealLocked(data []byte, values map[int][]byte) (*SealedData, error) {
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+
+	registers := make([]int, 0, len(values))
+	for index := range values {
+		registers = append(registers, index)
+	}
+	slices.Sort(registers)
+	sealed := &SealedData{
+		Version:   sealedDataVersion,
+		Registers: registers,
+		Policy:    sealingPolicy(registers, values),
+		Salt:      make([]byte, 32),
+		Nonce:     make([]byte, 12),
+	}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	ciphertext, err := ks.device.sealData(sealed.Salt, sealed.info(sealed.Policy), sealed.Nonce, data, sealed.aad())
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal data: %v", err)
+	}
+	sealed.Ciphertext = ciphertext
+
+	if err := ks.auditLocked(AuditEvent{Type: "data.seal", Details: map[string]any{"registers": registers}}); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// Unseal decrypts sealed data if the measurement registers hold the values it was sealed to
+func (ks *EnclaveKeyStore) Unseal(sealed *SealedData) ([]byte, error) {
+	if sealed.Version != sealedDataVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrSealedDataCorrupt, sealed.Version)
+	}
+	if !slices.IsSorted(sealed.Registers) || len(slices.Compact(slices.Clone(sealed.Registers))) != len(sealed.Registers) {
+		return nil, fmt.Errorf("%w: registers are not in ascending order", ErrSealedDataCorrupt)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	current, err := ks.device.readRegisters()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read measurement registers: %v", err)
+	}
+	values := make(map[int][]byte, len(sealed.Registers))
+	for _, index := range sealed.Registers {
+		if index < 0 || index >= attest.NumRegisters {
+			return nil, fmt.Errorf("%w: unknown measurement register %d", ErrSealedDataCorrupt, index)
+		}
+		values[index] = current[index]
+	}
+
+	// The key is derived from the current registers, so a forged policy cannot unseal the data
+	policy := sealingPolicy(sealed.Registers, values)
+	var data []byte
+	if !bytes.Equal(policy, sealed.Policy) {
+		err = ErrMeasurementMismatch
+	} else if data, err = ks.device.unsealData(sealed.Salt, sealed.info(policy), sealed.Nonce, sealed.Ciphertext, sealed.aad()); err != nil {
+		err = fmt.Errorf("%w: %v", ErrSealedDataCorrupt, err)
+	}
+
+	details := map[string]any{"registers": sealed.Registers, "allowed": err == nil}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	if auditErr := ks.auditLocked(AuditEvent{Type: "data.unseal", Details: details}); auditErr != nil && err == nil {
+		wipe(data)
+		err = auditErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// sealingPolicy returns the SHA-256 digest over the indexes and values of the sealed registers
+func sealingPolicy(registers []int, values map[int][]byte) []byte {
+	h := sha256.New()
+	for _, index := range registers {
+		binary.Write(h, binary.BigEndian, uint32(index))
+		h.Write(values[index])
+	}
+	return h.Sum(nil)
+}
+
+// info returns the HKDF info of the sealing key for a policy
+func (s *SealedData) info(policy []byte) []byte {
+	return append([]byte(sealedDataContext), policy...)
+}
+
+// aad returns the sealed data's header, authenticated along with the ciphertext
+func (s *SealedData) aad() []byte {
+	header, _ := json.Marshal(struct {
+		Version   int   `json:"version"`
+		Registers []int `json:"registers"`
+	}{s.Version, s.Registers})
+	return header
+}
@@ -0,0 +1,162 @@
+package enclave
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealToMeasurements(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	loadTestImage(t, keyStore)
+	secret := []byte("database password")
+
+	sealed, err := keyStore.Seal(secret, attest.RegisterImage, attest.RegisterConfig)
+	assert.NoError(t, err)
+	data, err := keyStore.Unseal(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, data)
+
+	// Sealed data can be stored and read back
+	encoded, err := json.Marshal(sealed)
+	assert.NoError(t, err)
+	var decoded SealedData
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+	data, err = keyStore.Unseal(&decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, data)
+
+	// Registers that are not part of the policy can change
+	digest := sha256.Sum256([]byte("application state"))
+	assert.NoError(t, keyStore.ExtendRegister(attest.RegisterApplication, digest[:], "application state"))
+	_, err = keyStore.Unseal(sealed)
+	assert.NoError(t, err)
+
+	// Running other code makes the data unavailable
+	loadTestImage(t, keyStore)
+	_, err = keyStore.Unseal(sealed)
+	assert.ErrorIs(t, err, ErrMeasurementMismatch)
+
+	// Claiming the current measurements does not help: the key is derived from them
+	forged := *sealed
+	forged.Policy = sealingPolicy(sealed.Registers, map[int][]byte{
+		attest.RegisterImage:  readRegisters(t, keyStore)[attest.RegisterImage],
+		attest.RegisterConfig: readRegisters(t, keyStore)[attest.RegisterConfig],
+	})
+	_, err = keyStore.Unseal(&forged)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+}
+
+func TestSealToFutureRegisters(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+
+	// Seal to the registers an approved image will produce before loading it
+	image := buildTestImage(t, "hello", 1, []byte("approved image"))
+	expected, err := attest.Replay([]attest.MeasurementEvent{{Register: attest.RegisterImage, Digest: image.Header.Measurement[:]}})
+	assert.NoError(t, err)
+	sealed, err := keyStore.SealToRegisters([]byte("secret"), map[int][]byte{attest.RegisterImage: expected[attest.RegisterImage]})
+	assert.NoError(t, err)
+
+	_, err = keyStore.Unseal(sealed)
+	assert.ErrorIs(t, err, ErrMeasurementMismatch)
+	assert.NoError(t, keyStore.LoadImage(image, testVendorKey.Public(), importImageKey(t, keyStore), make([]byte, 4096), 0))
+	data, err := keyStore.Unseal(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), data)
+
+	_, err = keyStore.SealToRegisters(nil, map[int][]byte{attest.NumRegisters: expected[0]})
+	assert.Error(t, err)
+	_, err = keyStore.SealToRegisters(nil, map[int][]byte{attest.RegisterImage: {1, 2, 3}})
+	assert.Error(t, err)
+	_, err = keyStore.Seal(nil, -1)
+	assert.Error(t, err)
+}
+
+func TestSealBoundToDevice(t *testing.T) {
+	keyStore := newDeviceKeyStore(t)
+	sealed, err := keyStore.Seal([]byte("secret"))
+	assert.NoError(t, err)
+
+	// Another key store on the same device can unseal
+	data, err := newDeviceKeyStore(t).Unseal(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), data)
+
+	// Another device cannot
+	_, err = newTestKeyStore(t).Unseal(sealed)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+	other := newDeviceKeyStore(t)
+	emulated(other).root = make([]byte, keySize)
+	_, err = other.Unseal(sealed)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+
+	// Nor can altered sealed data be unsealed
+	altered := *sealed
+	altered.Ciphertext = append([]byte(nil), sealed.Ciphertext...)
+	altered.Ciphertext[0] ^= 1
+	_, err = keyStore.Unseal(&altered)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+	altered = *sealed
+	altered.Version = 2
+	_, err = keyStore.Unseal(&altered)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+	altered = *sealed
+	altered.Registers = []int{attest.RegisterImage, attest.RegisterImage}
+	_, err = keyStore.Unseal(&altered)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+}
+
+func TestSealSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	sealed, err := keyStore.Seal([]byte("secret"))
+	assert.NoError(t, err)
+	deviceID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// The device secret generated on first open is kept in storage under the KEK
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	data, err := keyStore.Unseal(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), data)
+	reopenedID, err := keyStore.DeviceIDCertificate()
+	assert.NoError(t, err)
+	assert.Equal(t, deviceID.PublicKey, reopenedID.PublicKey)
+	assert.NoError(t, keyStore.Destroy())
+
+	// A stored secret that was altered or replaced with another blob wrapped under the KEK is refused
+	path := filepath.Join(dir, deviceSecretStorageKey)
+	original, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var record deviceSecretRecord
+	assert.NoError(t, json.Unmarshal(original, &record))
+	ram := &keySlotRAM{mappedMem: make([]byte, axiWindowSize)}
+	assert.NoError(t, ram.loadKEK(testKEK()))
+	record.Secret, err = ram.tag([]byte("known data"))
+	assert.NoError(t, err)
+	forged, err := json.Marshal(&record)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, forged, 0600))
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.ErrorIs(t, err, ErrSealedKeyUnwrap)
+	assert.NoError(t, os.WriteFile(path, original, 0600))
+
+	// A configured device secret takes the place of the stored one, and is wiped after use
+	secret := testDeviceSecret()
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK(), DeviceSecret: secret})
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	assert.Equal(t, make([]byte, keySize), secret)
+	_, err = keyStore.Unseal(sealed)
+	assert.ErrorIs(t, err, ErrSealedDataCorrupt)
+	_, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: t.TempDir(), KEK: testKEK(), DeviceSecret: make([]byte, 16)})
+	assert.Error(t, err)
+}
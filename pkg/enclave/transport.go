@@ -0,0 +1,347 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/jwk"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/keywrap"
+	"golang.org/x/crypto/hkdf"
+)
+
+// TransportAlgorithm is the way a key is wrapped to the enclave's transport key
+type TransportAlgorithm string
+
+const (
+	// TransportRSAOAEP256 encrypts a random AES-256 key-encryption key to an RSA-2048 transport key with
+	// RSA-OAEP and SHA-256
+	TransportRSAOAEP256 TransportAlgorithm = "RSA-OAEP-256"
+
+	// TransportECDHP256 derives an AES-256 key-encryption key from ECDH between an ephemeral key and a P-256
+	// transport key, using HKDF-SHA256. It resembles JOSE's ECDH-ES+A256KW but does not interoperate with it:
+	// the key derivation is HKDF rather than Concat KDF, and keys are wrapped with AES-KWP.
+	TransportECDHP256 TransportAlgorithm = "ECDH-P256-HKDF-SHA256+AES-KWP"
+)
+
+// wrappedKeyVersion is the version of the wrapped key format
+const wrappedKeyVersion = 1
+
+// ErrWrappedKeyInvalid is returned when a wrapped key does not unwrap with the enclave's transport key
+var ErrWrappedKeyInvalid = errors.New("wrapped key is invalid")
+
+// TransportKey is the public transport key published by the enclave for wrapped key import
+type TransportKey struct {
+	ID        string             `json:"id"` // RFC 7638 thumbprint of the public key
+	Algorithm TransportAlgorithm `json:"alg"`
+	PublicKey []byte             `json:"public_key"` // PKIX DER
+}
+
+// WrappedKey is a key wrapped to a transport key. The key material is wrapped with AES-KWP under a
+// key-encryption key that only the transport key can recover.
+type WrappedKey struct {
+	Version            int                `json:"version"`
+	Algorithm          TransportAlgorithm `json:"alg"`
+	TransportKeyID     string             `json:"transport_key_id"`
+	KeyAlgorithm       Algorithm          `json:"key_alg"`
+	Label              string             `json:"label"`
+	Shard              bool               `json:"shard,omitempty"`         // The key material is a Shamir key shard
+	EncryptedKey       []byte             `json:"encrypted_key,omitempty"` // RSA-OAEP encrypted key-encryption key
+	EphemeralPublicKey []byte             `json:"epk,omitempty"`           // PKIX DER of the ECDH ephemeral key
+	WrappedKey         []byte             `json:"wrapped_key"`
+}
+
+// TransportKey returns the enclave's transport key for alg. The key pair is generated inside the FPGA on
+// first use and kept until the key store is destroyed.
+func (ks *EnclaveKeyStore) TransportKey(alg TransportAlgorithm) (*TransportKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	public, err := ks.device.transportKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	return newTransportKey(alg, public)
+}
+
+// ImportWrappedKey unwraps a key inside the FPGA directly into hardware slots. The key never exists in the
+// clear on the host, so it is not exportable whatever the key store mode.
+func (ks *EnclaveKeyStore) ImportWrappedKey(wrapped *WrappedKey) (*KeyHandle, error) {
+	if wrapped.Version != wrappedKeyVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrWrappedKeyInvalid, wrapped.Version)
+	}
+	if wrapped.Shard {
+		return nil, fmt.Errorf("%w: a key shard cannot be imported as a key", ErrWrappedKeyInvalid)
+	}
+	size, err := wrapped.KeyAlgorithm.keySizeBits()
+	if err != nil {
+		return nil, err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return nil, ErrKeyStoreDestroyed
+	}
+	public, err := ks.device.transportKey(wrapped.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransportKey(wrapped.Algorithm, public)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped.TransportKeyID != transport.ID {
+		return nil, fmt.Errorf("%w: wrapped to transport key %s, not %s", ErrWrappedKeyInvalid, wrapped.TransportKeyID, transport.ID)
+	}
+
+	handle := KeyHandle{
+		Label:     wrapped.Label,
+		Algorithm: wrapped.KeyAlgorithm,
+		Size:      size,
+		Origin:    KeyOriginUnwrapped,
+	}
+	if err := ks.reserveSlotsLocked(&handle, true, handle.Algorithm != AlgorithmAES256); err != nil {
+		return nil, err
+	}
+	handle.Exportable = false
+
+	handle.PublicKey, err = ks.unwrapIntoSlotsLocked(wrapped, handle)
+	if err != nil {
+		ks.releaseSlotLocked(handle.Slot)
+		ks.releaseSlotLocked(handle.PartialSlot)
+		return nil, err
+	}
+
+	key := &enclaveKey{handle: handle}
+	ks.keys[handle.ID] = key
+	if err := ks.persistLocked(key); err != nil {
+		ks.destroyKeyLocked(key)
+		delete(ks.keys, handle.ID)
+		return nil, err
+	}
+
+	h := handle
+	event := keyEvent("key.unwrap", &handle)
+	event.Details["transport_key_id"] = wrapped.TransportKeyID
+	return &h, ks.auditLocked(event)
+}
+
+// unwrapIntoSlotsLocked has the FPGA unwrap a key and install it into the handle's slots
+func (ks *EnclaveKeyStore) unwrapIntoSlotsLocked(wrapped *WrappedKey, handle KeyHandle) (crypto.PublicKey, error) {
+	public, err := ks.device.unwrap(wrapped, handle.Algorithm, handle.Slot, handle.PartialSlot)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrappedKeyInvalid, err)
+	}
+	return public, nil
+}
+
+// WrapKey wraps a private key to an enclave transport key; it runs on the provisioning server. Supported
+// keys are the same as for ImportPrivateKey.
+func WrapKey(transport *TransportKey, label string, key crypto.PrivateKey) (*WrappedKey, error) {
+	alg, material, _, err := materialFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(material)
+	return wrapMaterial(transport, &WrappedKey{KeyAlgorithm: alg, Label: label}, material)
+}
+
+// wrapMaterial wraps key material to a transport key, filling in the header of wrapped
+func wrapMaterial(transport *TransportKey, wrapped *WrappedKey, material []byte) (*WrappedKey, error) {
+	public, err := transport.Public()
+	if err != nil {
+		return nil, err
+	}
+	wrapped.Version = wrappedKeyVersion
+	wrapped.Algorithm = transport.Algorithm
+	wrapped.TransportKeyID = transport.ID
+	aad := wrapped.aad()
+
+	var kek []byte
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		kek = make([]byte, keySize)
+		if _, err := io.ReadFull(rand.Reader, kek); err != nil {
+			return nil, fmt.Errorf("failed to generate key-encryption key: %v", err)
+		}
+		wrapped.EncryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, kek, aad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt key-encryption key: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ephemeral key: %v", err)
+		}
+		if wrapped.EphemeralPublicKey, err = x509.MarshalPKIXPublicKey(&ephemeral.PublicKey); err != nil {
+			return nil, fmt.Errorf("failed to encode ephemeral key: %v", err)
+		}
+		if kek, err = ecdhKEK(ephemeral, transport.PublicKey, aad); err != nil {
+			return nil, err
+		}
+	}
+	defer wipe(kek)
+
+	if wrapped.WrappedKey, err = keywrap.WrapPad(kek, material); err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// UnwrapKey unwraps the key material of a wrapped key with the private half of the transport key it was
+// wrapped to, such as a quorum export recipient key. Keys are returned as by ExportPrivateKey and key
+// shards as by ExportKeyShard.
+func UnwrapKey(wrapped *WrappedKey, private crypto.PrivateKey) (crypto.PrivateKey, error) {
+	if wrapped.Version != wrappedKeyVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrWrappedKeyInvalid, wrapped.Version)
+	}
+	material, err := unwrapMaterial(private, wrapped, wrapped.aad())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrappedKeyInvalid, err)
+	}
+	if wrapped.Shard || wrapped.KeyAlgorithm == AlgorithmAES256 {
+		return material, nil
+	}
+	defer wipe(material)
+	key, err := privateKeyFromMaterial(wrapped.KeyAlgorithm, material)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWrappedKeyInvalid, err)
+	}
+	return key, nil
+}
+
+// unwrapMaterial recovers a key-encryption key with a transport private key and unwraps key material with it
+func unwrapMaterial(private crypto.PrivateKey, wrapped *WrappedKey, aad []byte) ([]byte, error) {
+	var kek []byte
+	var err error
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if wrapped.Algorithm != TransportRSAOAEP256 {
+			return nil, fmt.Errorf("RSA transport key cannot be used for %s", wrapped.Algorithm)
+		}
+		kek, err = rsa.DecryptOAEP(sha256.New(), nil, k, wrapped.EncryptedKey, aad)
+	case *ecdsa.PrivateKey:
+		if wrapped.Algorithm != TransportECDHP256 {
+			return nil, fmt.Errorf("ECDSA transport key cannot be used for %s", wrapped.Algorithm)
+		}
+		kek, err = ecdhKEK(k, wrapped.EphemeralPublicKey, aad)
+	default:
+		return nil, fmt.Errorf("unsupported transport private key %T", private)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(kek)
+	return keywrap.UnwrapPad(kek, wrapped.WrappedKey)
+}
+
+// NewTransportKey returns the transport key of an RSA-2048 or ECDSA P-256 public key held outside the
+// enclave, such as a quorum export recipient key
+func NewTransportKey(public crypto.PublicKey) (*TransportKey, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() != 2048 {
+			return nil, fmt.Errorf("RSA transport key must be 2048 bits, not %d", pub.N.BitLen())
+		}
+		return newTransportKey(TransportRSAOAEP256, public)
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ECDSA transport key must be on P-256")
+		}
+		return newTransportKey(TransportECDHP256, public)
+	default:
+		return nil, fmt.Errorf("unsupported transport public key %T", public)
+	}
+}
+
+// Public parses the transport public key and checks that it matches the transport algorithm
+func (t *TransportKey) Public() (crypto.PublicKey, error) {
+	public, err := x509.ParsePKIXPublicKey(t.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport public key: %v", err)
+	}
+	switch public.(type) {
+	case *rsa.PublicKey:
+		if t.Algorithm == TransportRSAOAEP256 {
+			return public, nil
+		}
+	case *ecdsa.PublicKey:
+		if t.Algorithm == TransportECDHP256 {
+			return public, nil
+		}
+	}
+	return nil, fmt.Errorf("transport public key %T cannot be used for %s", public, t.Algorithm)
+}
+
+// newTransportKey encodes a transport public key with its thumbprint
+func newTransportKey(alg TransportAlgorithm, public crypto.PublicKey) (*TransportKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode transport key: %v", err)
+	}
+	k, err := jwk.FromPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	id, err := k.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return &TransportKey{ID: id, Algorithm: alg, PublicKey: der}, nil
+}
+
+// aad returns the digest that binds the wrapped key's header to its key-encryption key; it is the
+// RSA-OAEP label or the HKDF info
+func (w *WrappedKey) aad() []byte {
+	digest := sha256.New()
+	for _, field := range []string{"enclave-wrapped-key", fmt.Sprint(w.Version), string(w.Algorithm), w.TransportKeyID, string(w.KeyAlgorithm), w.Label} {
+		fmt.Fprintf(digest, "%d:%s", len(field), field)
+	}
+	if w.Shard {
+		digest.Write([]byte("5:shard"))
+	}
+	return digest.Sum(nil)
+}
+
+// ecdhKEK derives an AES-256 key-encryption key from ECDH between a private key and a PKIX-encoded peer key
+func ecdhKEK(private *ecdsa.PrivateKey, peerDER, info []byte) ([]byte, error) {
+	peer, err := x509.ParsePKIXPublicKey(peerDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECDH public key: %v", err)
+	}
+	peerKey, ok := peer.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("ECDH public key is %T, not ECDSA", peer)
+	}
+	peerECDH, err := peerKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECDH public key: %v", err)
+	}
+	privateECDH, err := private.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECDH private key: %v", err)
+	}
+	shared, err := privateECDH.ECDH(peerECDH)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %v", err)
+	}
+	defer wipe(shared)
+
+	kek := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), kek); err != nil {
+		return nil, fmt.Errorf("failed to derive key-encryption key: %v", err)
+	}
+	return kek, nil
+}
@@ -0,0 +1,136 @@
+package enclave
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportWrappedKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	keys := []struct {
+		alg Algorithm
+		key crypto.PrivateKey
+	}{
+		{AlgorithmRSA2048, rsaKey},
+		{AlgorithmECDSAP256, ecdsaKey},
+		{AlgorithmEd25519, ed25519Key},
+		{AlgorithmAES256, make([]byte, keySize)},
+	}
+
+	for _, transportAlg := range []TransportAlgorithm{TransportRSAOAEP256, TransportECDHP256} {
+		for _, k := range keys {
+			t.Run(string(transportAlg)+"/"+string(k.alg), func(t *testing.T) {
+				mappedMem := make([]byte, axiWindowSize)
+				keyStore := NewKeyStore(mappedMem)
+
+				transport, err := keyStore.TransportKey(transportAlg)
+				assert.NoError(t, err)
+				wrapped, err := WrapKey(transport, "provisioned", k.key)
+				assert.NoError(t, err)
+
+				key, err := keyStore.ImportWrappedKey(wrapped)
+				assert.NoError(t, err)
+				if err != nil {
+					return
+				}
+				assert.Equal(t, k.alg, key.Algorithm)
+				assert.Equal(t, "provisioned", key.Label)
+
+				// The key only exists inside the FPGA, even in an exportable key store
+				assert.False(t, key.Exportable)
+				_, err = keyStore.ExportPrivateKey(key.ID)
+				assert.ErrorIs(t, err, ErrKeyNotExportable)
+				assert.Equal(t, make([]byte, axiWindowSize), mappedMem)
+
+				if signer, ok := k.key.(crypto.Signer); ok {
+					assert.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.PublicKey))
+				}
+			})
+		}
+	}
+}
+
+func TestImportWrappedKeyRejected(t *testing.T) {
+	keyStore := NewKeyStore(make([]byte, axiWindowSize))
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	for _, transportAlg := range []TransportAlgorithm{TransportRSAOAEP256, TransportECDHP256} {
+		transport, err := keyStore.TransportKey(transportAlg)
+		assert.NoError(t, err)
+		wrap := func() *WrappedKey {
+			wrapped, err := WrapKey(transport, "provisioned", ecdsaKey)
+			assert.NoError(t, err)
+			return wrapped
+		}
+
+		// The header is bound to the key-encryption key
+		wrapped := wrap()
+		wrapped.Label = "renamed"
+		_, err = keyStore.ImportWrappedKey(wrapped)
+		assert.ErrorIs(t, err, ErrWrappedKeyInvalid)
+
+		wrapped = wrap()
+		wrapped.WrappedKey[len(wrapped.WrappedKey)-1] ^= 1
+		_, err = keyStore.ImportWrappedKey(wrapped)
+		assert.ErrorIs(t, err, ErrWrappedKeyInvalid)
+
+		wrapped = wrap()
+		wrapped.KeyAlgorithm = AlgorithmEd25519
+		_, err = keyStore.ImportWrappedKey(wrapped)
+		assert.ErrorIs(t, err, ErrWrappedKeyInvalid)
+	}
+
+	// A key wrapped to another enclave's transport key is refused
+	other := NewKeyStore(make([]byte, axiWindowSize))
+	transport, err := other.TransportKey(TransportECDHP256)
+	assert.NoError(t, err)
+	wrapped, err := WrapKey(transport, "provisioned", ecdsaKey)
+	assert.NoError(t, err)
+	_, err = keyStore.ImportWrappedKey(wrapped)
+	assert.ErrorIs(t, err, ErrWrappedKeyInvalid)
+
+	// Failed imports leave no keys or reserved slots behind
+	assert.Empty(t, keyStore.ListKeys())
+	assert.Equal(t, [numKeySlots]string{}, keyStore.slots)
+}
+
+func TestWrappedKeySurvivesReload(t *testing.T) {
+	dir := t.TempDir()
+	keyStore, err := OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+
+	ed25519Public, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	transport, err := keyStore.TransportKey(TransportECDHP256)
+	assert.NoError(t, err)
+	wrapped, err := WrapKey(transport, "provisioned", ed25519Key)
+	assert.NoError(t, err)
+	key, err := keyStore.ImportWrappedKey(wrapped)
+	assert.NoError(t, err)
+	assert.NoError(t, keyStore.Destroy())
+
+	// The key stays non-exportable after a restart
+	keyStore, err = OpenKeyStore(make([]byte, axiWindowSize), KeyStoreConfig{Dir: dir, KEK: testKEK()})
+	assert.NoError(t, err)
+	defer keyStore.Destroy()
+	restored, err := keyStore.GetKey(key.ID)
+	assert.NoError(t, err)
+	assert.False(t, restored.Exportable)
+	assert.True(t, ed25519Public.Equal(restored.PublicKey))
+	_, err = Ed25519Sign([]byte("message"), keyStore, key.ID)
+	assert.NoError(t, err)
+}
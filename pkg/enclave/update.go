@@ -0,0 +1,312 @@
+package enclave
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+)
+
+var (
+	// ErrUpdateReverted is returned when an activated image is abandoned and the previous image restored
+	ErrUpdateReverted = errors.New("update reverted to the previous image")
+
+	// ErrNoStagedImage is returned when an update is activated before an image is staged
+	ErrNoStagedImage = errors.New("no image is staged")
+)
+
+const (
+	// defaultHealthDeadline is how long an activated image has to report healthy when the configuration does not say
+	defaultHealthDeadline = 30 * time.Second
+
+	// defaultHealthInterval is the time between health checks when the configuration does not say
+	defaultHealthInterval = time.Second
+)
+
+// UpdateConfig describes the A/B image slots in FPGA memory and how updated images are checked
+type UpdateConfig struct {
+	Slots        [2]uint32 // AXI offsets of image slots A and B
+	SlotSize     uint32    // Size of each slot; larger images are refused
+	SelectOffset uint32    // Offset of the image slot register
+	VendorKey    crypto.PublicKey
+	ImageKeyID   string                          // Non-exportable AES key the FPGA decrypts images with; see LoadImage
+	HealthCheck  func(ctx context.Context) error // Returns nil once the running image is healthy
+	Deadline     time.Duration                   // How long an activated image has to report healthy; 30 seconds if zero
+	Interval     time.Duration                   // Time between health checks; a second if zero
+}
+
+// UpdateManager installs images into A/B slots: an image is staged into the inactive slot, the slots are
+// switched, and the previous slot is restored unless the image reports healthy before the deadline.
+type UpdateManager struct {
+	ks     *EnclaveKeyStore
+	mem    []byte
+	config UpdateConfig
+
+	mu     sync.Mutex
+	active int                     // Active slot, fpga.SlotA or fpga.SlotB
+	images [2]*container.Container // Image in each slot, if loaded by this manager
+	staged bool                    // Whether the inactive slot holds a staged image
+}
+
+// NewUpdateManager returns an update manager for the image slots in mappedMem. A slot left on trial, by an
+// update interrupted before its health check passed, is reverted.
+func (ks *EnclaveKeyStore) NewUpdateManager(mappedMem []byte, config UpdateConfig) (*UpdateManager, error) {
+	if err := config.validate(len(mappedMem)); err != nil {
+		return nil, err
+	}
+
+	value, err := fpga.ReadSlot(config.SelectOffset, mappedMem)
+	if err != nil {
+		return nil, err
+	}
+	m := &UpdateManager{ks: ks, mem: mappedMem, config: config, active: int(value &^ fpga.SlotTrial)}
+	if m.active != fpga.SlotA && m.active != fpga.SlotB {
+		return nil, fmt.Errorf("image slot register holds unknown slot %d", m.active)
+	}
+	if value&fpga.SlotTrial != 0 {
+		if err := m.revert(1-m.active, fmt.Errorf("update was interrupted")); !errors.Is(err, ErrUpdateReverted) {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Active returns the active slot, fpga.SlotA or fpga.SlotB
+func (m *UpdateManager) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// Stage verifies an image and loads it into the inactive slot, replacing any image staged before. Images
+// are refused as by LoadImage, or if they do not fit in a slot.
+func (m *UpdateManager) Stage(image *container.Container) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size := uint64(container.HeaderSize) + uint64(len(image.Ciphertext)); size > uint64(m.config.SlotSize) {
+		return fmt.Errorf("image of %d bytes does not fit in a %d byte slot", size, m.config.SlotSize)
+	}
+
+	ks := m.ks
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	if err := ks.checkVersionLocked(image.Header.Family, image.Header.ImageVersion); err != nil {
+		return err
+	}
+	slot := 1 - m.active
+	if err := ks.loadImageLocked(image, m.config.VendorKey, m.config.ImageKeyID, m.mem, m.config.Slots[slot]); err != nil {
+		return fmt.Errorf("failed to stage image: %w", err)
+	}
+	m.images[slot] = image
+	m.staged = true
+
+	details := imageDetails(image, image.Image().Measure())
+	details["slot"] = slotName(slot)
+	return ks.auditLocked(AuditEvent{Type: "image.stage", Details: details})
+}
+
+// Activate switches to the staged image and waits for it to report healthy, then commits it and advances
+// the anti-rollback version of its family. If the image does not report healthy before the deadline, the
+// previous slot is restored and the error matches ErrUpdateReverted.
+func (m *UpdateManager) Activate(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.staged {
+		return ErrNoStagedImage
+	}
+	previous, next := m.active, 1-m.active
+	image := m.images[next]
+	if selected, err := m.switchSlot(next, image); err != nil {
+		if selected {
+			m.staged = false
+			return m.revert(previous, err)
+		}
+		return err
+	}
+	m.active = next
+	m.staged = false
+
+	if err := m.awaitHealthy(ctx); err != nil {
+		return m.revert(previous, err)
+	}
+	if err := m.commit(image); err != nil {
+		return m.revert(previous, err)
+	}
+	return nil
+}
+
+// switchSlot marks a slot on trial, makes it active and measures its image. It reports whether the slot
+// register was switched, in which case a failure must be reverted.
+func (m *UpdateManager) switchSlot(slot int, image *container.Container) (bool, error) {
+	ks := m.ks
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return false, ErrKeyStoreDestroyed
+	}
+	if err := ks.checkVersionLocked(image.Header.Family, image.Header.ImageVersion); err != nil {
+		return false, err
+	}
+	if err := fpga.SelectSlot(uint32(slot)|fpga.SlotTrial, m.config.SelectOffset, m.mem); err != nil {
+		return false, err
+	}
+	measurement, err := ks.measureImageLocked(image)
+	if err != nil {
+		return true, err
+	}
+
+	details := imageDetails(image, measurement)
+	details["slot"] = slotName(slot)
+	return true, ks.auditLocked(AuditEvent{Type: "image.activate", Details: details})
+}
+
+// awaitHealthy runs the health check until it passes, returning its last error if the deadline passes first
+func (m *UpdateManager) awaitHealthy(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.config.Deadline)
+	defer cancel()
+
+	for {
+		err := m.config.HealthCheck(ctx)
+		if err == nil {
+			return nil
+		}
+		timer := time.NewTimer(m.config.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// commit advances the anti-rollback version of the active image and clears its trial mark
+func (m *UpdateManager) commit(image *container.Container) error {
+	ks := m.ks
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	if err := ks.advanceVersionLocked(image.Header.Family, image.Header.ImageVersion); err != nil {
+		return err
+	}
+	if err := fpga.SelectSlot(uint32(m.active), m.config.SelectOffset, m.mem); err != nil {
+		return err
+	}
+
+	return ks.auditLocked(AuditEvent{Type: "image.commit", Details: map[string]any{
+		"slot":    slotName(m.active),
+		"family":  image.Header.Family,
+		"version": image.Header.ImageVersion,
+	}})
+}
+
+// revert makes a slot active again after an update failed with cause. The measurement registers and DICE
+// layer of the abandoned image are reset, and the slot's image is measured again. After a restart, the
+// image is read back from its slot and measured once the image key verifies its tags; a slot that holds no
+// valid image leaves the registers reset.
+func (m *UpdateManager) revert(slot int, cause error) error {
+	ks := m.ks
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.destroyed {
+		return ErrKeyStoreDestroyed
+	}
+	if err := fpga.SelectSlot(uint32(slot), m.config.SelectOffset, m.mem); err != nil {
+		return err
+	}
+	m.active = slot
+	details := map[string]any{"slot": slotName(slot), "reason": cause.Error()}
+	image := m.images[slot]
+	if image == nil {
+		var err error
+		if image, err = m.loadedImageLocked(slot); err != nil {
+			details["unmeasured"] = err.Error()
+		}
+	}
+	if image != nil {
+		if _, err := ks.measureImageLocked(image); err != nil {
+			return err
+		}
+	} else if err := ks.resetImageLocked(); err != nil {
+		return err
+	}
+
+	if err := ks.auditLocked(AuditEvent{Type: "image.revert", Details: details}); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrUpdateReverted, cause)
+}
+
+// loadedImageLocked reads back the image a previous run loaded into a slot and has the key engine check its
+// tags with the image key, so it can be measured. The vendor signature is not kept in FPGA memory.
+func (m *UpdateManager) loadedImageLocked(slot int) (*container.Container, error) {
+	offset := m.config.Slots[slot]
+	image, err := container.ParseLoaded(m.mem[offset : offset+m.config.SlotSize])
+	if err != nil {
+		return nil, err
+	}
+	key, err := m.ks.activeKeyLocked(m.config.ImageKeyID, AlgorithmAES256, Usage{Operation: OperationDecrypt})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ks.device.checkImage(key.handle.Slot, image, offset); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// validate checks the slot layout against a mapped region of size bytes and fills in defaults
+func (c *UpdateConfig) validate(size int) error {
+	if c.HealthCheck == nil {
+		return fmt.Errorf("invalid update config: no health check")
+	}
+	if c.VendorKey == nil {
+		return fmt.Errorf("invalid update config: no vendor key")
+	}
+	if c.ImageKeyID == "" {
+		return fmt.Errorf("invalid update config: no image key")
+	}
+	if c.SlotSize < container.HeaderSize {
+		return fmt.Errorf("invalid update config: slot size %d is smaller than an image header", c.SlotSize)
+	}
+	for i, offset := range c.Slots {
+		if uint64(offset)+uint64(c.SlotSize) > uint64(size) {
+			return fmt.Errorf("invalid update config: slot %s at offset 0x%x exceeds mapped memory", slotName(i), offset)
+		}
+		if c.SelectOffset+4 > offset && c.SelectOffset < offset+c.SlotSize {
+			return fmt.Errorf("invalid update config: slot register overlaps slot %s", slotName(i))
+		}
+	}
+	low, high := min(c.Slots[0], c.Slots[1]), max(c.Slots[0], c.Slots[1])
+	if low+c.SlotSize > high {
+		return fmt.Errorf("invalid update config: slots overlap")
+	}
+	if c.Deadline <= 0 {
+		c.Deadline = defaultHealthDeadline
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultHealthInterval
+	}
+	return nil
+}
+
+// slotName returns the name of an image slot
+func slotName(slot int) string {
+	return string(rune('A' + slot))
+}
@@ -0,0 +1,235 @@
+package enclave
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/container"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/fpga"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSelectOffset is the offset of the image slot register in test update managers
+const testSelectOffset = 0x100
+
+// newTestUpdateManager returns an update manager with two 16 KiB slots, using health as its health check
+func newTestUpdateManager(t *testing.T, keyStore *EnclaveKeyStore, mappedMem []byte, health func(context.Context) error) *UpdateManager {
+	manager, err := keyStore.NewUpdateManager(mappedMem, UpdateConfig{
+		Slots:        [2]uint32{0x1000, 0x5000},
+		SlotSize:     0x4000,
+		SelectOffset: testSelectOffset,
+		VendorKey:    testVendorKey.Public(),
+		ImageKeyID:   importImageKey(t, keyStore),
+		HealthCheck:  health,
+		Deadline:     50 * time.Millisecond,
+		Interval:     time.Millisecond,
+	})
+	assert.NoError(t, err)
+	return manager
+}
+
+// slotRegister reads the image slot register
+func slotRegister(t *testing.T, mappedMem []byte) uint32 {
+	value, err := fpga.ReadSlot(testSelectOffset, mappedMem)
+	assert.NoError(t, err)
+	return value
+}
+
+func TestUpdateCommit(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	mappedMem := make([]byte, 0x9000)
+	var trial []uint32
+	manager := newTestUpdateManager(t, keyStore, mappedMem, func(context.Context) error {
+		trial = append(trial, slotRegister(t, mappedMem))
+		return nil
+	})
+	assert.Equal(t, fpga.SlotA, manager.Active())
+	assert.ErrorIs(t, manager.Activate(context.Background()), ErrNoStagedImage)
+
+	// Each update is staged into the inactive slot and switched to
+	v1 := buildTestImage(t, "hello", 1, []byte("hello from version 1"))
+	assert.NoError(t, manager.Stage(v1))
+	assert.Equal(t, fpga.SlotA, manager.Active())
+	assert.NoError(t, manager.Activate(context.Background()))
+	assert.Equal(t, fpga.SlotB, manager.Active())
+	assert.Equal(t, uint32(fpga.SlotB), slotRegister(t, mappedMem))
+	assert.Equal(t, v1.Header.Marshal(), mappedMem[0x5000:0x5000+container.HeaderSize])
+
+	v2 := buildTestImage(t, "hello", 2, []byte("hello from version 2"))
+	assert.NoError(t, manager.Stage(v2))
+	assert.NoError(t, manager.Activate(context.Background()))
+	assert.Equal(t, fpga.SlotA, manager.Active())
+	assert.Equal(t, uint32(fpga.SlotA), slotRegister(t, mappedMem))
+	assert.Equal(t, []uint32{fpga.SlotB | fpga.SlotTrial, fpga.SlotA | fpga.SlotTrial}, trial)
+
+	measurement, err := keyStore.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, v2.Image().Measure(), measurement)
+	assert.Equal(t, map[string]uint32{"hello": 2}, keyStore.ImageVersions())
+
+	// Committed versions cannot be rolled back, and images must fit in a slot
+	assert.ErrorIs(t, manager.Stage(v1), ErrRollback)
+	assert.Error(t, manager.Stage(buildTestImage(t, "hello", 3, make([]byte, 0x4000))))
+	assert.ErrorIs(t, manager.Activate(context.Background()), ErrNoStagedImage)
+
+	types := eventTypes(log.Events())
+	assert.Contains(t, types, "image.stage")
+	assert.Contains(t, types, "image.activate")
+	assert.Contains(t, types, "image.commit")
+	assert.NotContains(t, types, "image.revert")
+}
+
+func TestUpdateRevert(t *testing.T) {
+	keyStore, log := auditedKeyStore(t)
+	mappedMem := make([]byte, 0x9000)
+	healthy := true
+	checks := 0
+	manager := newTestUpdateManager(t, keyStore, mappedMem, func(ctx context.Context) error {
+		checks++
+		if !healthy {
+			return errors.New("no heartbeat")
+		}
+		return nil
+	})
+	v1 := buildTestImage(t, "hello", 1, []byte("hello from version 1"))
+	assert.NoError(t, manager.Stage(v1))
+	assert.NoError(t, manager.Activate(context.Background()))
+	registers := readRegisters(t, keyStore)
+	chain, err := keyStore.IdentityChain()
+	assert.NoError(t, err)
+
+	// An image that never reports healthy is abandoned for the previous slot
+	healthy = false
+	checks = 0
+	assert.NoError(t, manager.Stage(buildTestImage(t, "hello", 2, []byte("hello from version 2"))))
+	err = manager.Activate(context.Background())
+	assert.ErrorIs(t, err, ErrUpdateReverted)
+	assert.ErrorContains(t, err, "no heartbeat")
+	assert.Greater(t, checks, 1)
+	assert.Equal(t, fpga.SlotB, manager.Active())
+	assert.Equal(t, uint32(fpga.SlotB), slotRegister(t, mappedMem))
+
+	measurement, err := keyStore.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, v1.Image().Measure(), measurement)
+	assert.Equal(t, map[string]uint32{"hello": 1}, keyStore.ImageVersions())
+	assert.Contains(t, eventTypes(log.Events()), "image.revert")
+
+	// The registers and DICE layer of the abandoned image are reset rather than extended
+	assert.Equal(t, registers, readRegisters(t, keyStore))
+	replayed, err := attest.Replay(keyStore.MeasurementLog())
+	assert.NoError(t, err)
+	assert.Equal(t, registers, replayed)
+	reverted, err := keyStore.IdentityChain()
+	assert.NoError(t, err)
+	assert.Len(t, reverted, 2)
+	assert.Equal(t, chain[1].PublicKey, reverted[1].PublicKey)
+
+	// The failed version is not installed, so it can be fixed and staged again
+	assert.ErrorIs(t, manager.Activate(context.Background()), ErrNoStagedImage)
+	healthy = true
+	assert.NoError(t, manager.Stage(buildTestImage(t, "hello", 2, []byte("hello from version 2"))))
+	assert.NoError(t, manager.Activate(context.Background()))
+	assert.Equal(t, map[string]uint32{"hello": 2}, keyStore.ImageVersions())
+
+	// A cancelled activation is reverted too
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	healthy = false
+	assert.NoError(t, manager.Stage(buildTestImage(t, "hello", 3, []byte("hello from version 3"))))
+	assert.ErrorIs(t, manager.Activate(ctx), ErrUpdateReverted)
+	assert.Equal(t, map[string]uint32{"hello": 2}, keyStore.ImageVersions())
+}
+
+// eventFailingAuditLog refuses the next event of a type, then keeps events again
+type eventFailingAuditLog struct {
+	MemoryAuditLog
+	failType string
+}
+
+func (l *eventFailingAuditLog) Append(event AuditEvent) error {
+	if event.Type == l.failType {
+		l.failType = ""
+		return failingAuditLog{}.Append(event)
+	}
+	return l.MemoryAuditLog.Append(event)
+}
+
+func TestUpdateSwitchFailure(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	log := &eventFailingAuditLog{}
+	assert.NoError(t, keyStore.SetAuditLog(log))
+	mappedMem := make([]byte, 0x9000)
+	manager := newTestUpdateManager(t, keyStore, mappedMem, func(context.Context) error { return nil })
+	v1 := buildTestImage(t, "hello", 1, []byte("hello from version 1"))
+	assert.NoError(t, manager.Stage(v1))
+	assert.NoError(t, manager.Activate(context.Background()))
+	registers := readRegisters(t, keyStore)
+
+	// A slot whose image cannot be measured once the slot register is switched is reverted
+	log.failType = "identity.extend"
+	assert.NoError(t, manager.Stage(buildTestImage(t, "hello", 2, []byte("hello from version 2"))))
+	err := manager.Activate(context.Background())
+	assert.ErrorIs(t, err, ErrUpdateReverted)
+	assert.ErrorContains(t, err, "disk full")
+	assert.Equal(t, fpga.SlotB, manager.Active())
+	assert.Equal(t, uint32(fpga.SlotB), slotRegister(t, mappedMem))
+	measurement, err := keyStore.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, v1.Image().Measure(), measurement)
+	assert.Equal(t, registers, readRegisters(t, keyStore))
+	assert.Equal(t, map[string]uint32{"hello": 1}, keyStore.ImageVersions())
+}
+
+func TestUpdateInterrupted(t *testing.T) {
+	keyStore := newTestKeyStore(t)
+	mappedMem := make([]byte, 0x9000)
+
+	// A slot still on trial when the manager starts never reported healthy
+	assert.NoError(t, fpga.SelectSlot(fpga.SlotB|fpga.SlotTrial, testSelectOffset, mappedMem))
+	manager := newTestUpdateManager(t, keyStore, mappedMem, func(context.Context) error { return nil })
+	assert.Equal(t, fpga.SlotA, manager.Active())
+	assert.Equal(t, uint32(fpga.SlotA), slotRegister(t, mappedMem))
+	_, err := keyStore.Measurement()
+	assert.ErrorIs(t, err, ErrNoImage, "an empty slot is not measured")
+
+	// After a restart, the image the previous run committed is read back from its slot and measured again
+	v1 := buildTestImage(t, "hello", 1, []byte("hello from version 1"))
+	assert.NoError(t, manager.Stage(v1))
+	assert.NoError(t, manager.Activate(context.Background()))
+	assert.NoError(t, manager.Stage(buildTestImage(t, "hello", 2, []byte("hello from version 2"))))
+	assert.NoError(t, fpga.SelectSlot(fpga.SlotA|fpga.SlotTrial, testSelectOffset, mappedMem))
+	restarted, log := auditedKeyStore(t)
+	manager = newTestUpdateManager(t, restarted, mappedMem, func(context.Context) error { return nil })
+	assert.Equal(t, fpga.SlotB, manager.Active())
+	measurement, err := restarted.Measurement()
+	assert.NoError(t, err)
+	assert.Equal(t, v1.Image().Measure(), measurement)
+	assert.Contains(t, eventTypes(log.Events()), "image.revert")
+
+	// An image altered in its slot is not measured
+	mappedMem[0x5000+container.HeaderSize] ^= 1
+	assert.NoError(t, fpga.SelectSlot(fpga.SlotA|fpga.SlotTrial, testSelectOffset, mappedMem))
+	restarted = newTestKeyStore(t)
+	manager = newTestUpdateManager(t, restarted, mappedMem, func(context.Context) error { return nil })
+	assert.Equal(t, fpga.SlotB, manager.Active())
+	_, err = restarted.Measurement()
+	assert.ErrorIs(t, err, ErrNoImage)
+
+	// Slots must fit in mapped memory without overlapping each other or the slot register
+	for _, config := range []UpdateConfig{
+		{Slots: [2]uint32{0x1000, 0x3000}, SlotSize: 0x4000},
+		{Slots: [2]uint32{0x1000, 0x8000}, SlotSize: 0x4000},
+		{Slots: [2]uint32{0x0, 0x5000}, SlotSize: 0x4000},
+		{Slots: [2]uint32{0x1000, 0x5000}, SlotSize: 0x10},
+	} {
+		config.SelectOffset = testSelectOffset
+		config.VendorKey = testVendorKey.Public()
+		config.HealthCheck = func(context.Context) error { return nil }
+		_, err := keyStore.NewUpdateManager(mappedMem, config)
+		assert.Error(t, err)
+	}
+}
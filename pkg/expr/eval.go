@@ -0,0 +1,577 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrEval is returned when an expression cannot be evaluated, for example on a missing field or a type
+// mismatch
+var ErrEval = errors.New("expression evaluation error")
+
+// Program is a compiled expression
+type Program struct {
+	source string
+	root   node
+}
+
+// Compile parses an expression
+func Compile(source string) (*Program, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+	}
+	return &Program{source: source, root: root}, nil
+}
+
+// String returns the source of the expression
+func (p *Program) String() string {
+	return p.source
+}
+
+// Eval evaluates the expression with the given variables
+func (p *Program) Eval(vars map[string]any) (any, error) {
+	return p.root.eval(&scope{vars: vars})
+}
+
+// EvalBool evaluates an expression that must produce a boolean
+func (p *Program) EvalBool(vars map[string]any) (bool, error) {
+	value, err := p.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%w: expression produced %s, not bool", ErrEval, typeName(value))
+	}
+	return b, nil
+}
+
+// scope holds variables, with macro variables shadowing the outer scope
+type scope struct {
+	vars   map[string]any
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (any, bool) {
+	for ; s != nil; s = s.parent {
+		if value, ok := s.vars[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// node is a compiled expression tree node
+type node interface {
+	eval(s *scope) (any, error)
+}
+
+type literalNode struct{ value any }
+
+func (n *literalNode) eval(*scope) (any, error) { return n.value, nil }
+
+type identNode struct{ name string }
+
+func (n *identNode) eval(s *scope) (any, error) {
+	value, ok := s.lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("%w: undeclared variable %q", ErrEval, n.name)
+	}
+	return value, nil
+}
+
+type listNode struct{ elements []node }
+
+func (n *listNode) eval(s *scope) (any, error) {
+	list := make([]any, len(n.elements))
+	for i, element := range n.elements {
+		value, err := element.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+type selectNode struct {
+	operand node
+	field   string
+}
+
+func (n *selectNode) eval(s *scope) (any, error) {
+	value, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot select %q from %s", ErrEval, n.field, typeName(value))
+	}
+	field, ok := m[n.field]
+	if !ok {
+		return nil, fmt.Errorf("%w: no such key %q", ErrEval, n.field)
+	}
+	return field, nil
+}
+
+// hasNode tests whether a field is present without failing on a missing one
+type hasNode struct{ sel *selectNode }
+
+func (n *hasNode) eval(s *scope) (any, error) {
+	value, err := n.sel.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]any)
+	if !ok {
+		return false, nil
+	}
+	_, ok = m[n.sel.field]
+	return ok, nil
+}
+
+type indexNode struct{ operand, index node }
+
+func (n *indexNode) eval(s *scope) (any, error) {
+	value, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map index must be string, not %s", ErrEval, typeName(index))
+		}
+		field, ok := v[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: no such key %q", ErrEval, key)
+		}
+		return field, nil
+	case []any:
+		i, err := toInt(index)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("%w: index %d out of range for list of size %d", ErrEval, i, len(v))
+		}
+		return v[i], nil
+	case string:
+		i, err := toInt(index)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= len(v) {
+			return nil, fmt.Errorf("%w: index %d out of range for string of size %d", ErrEval, i, len(v))
+		}
+		return v[i : i+1], nil
+	default:
+		return nil, fmt.Errorf("%w: cannot index %s", ErrEval, typeName(value))
+	}
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(s *scope) (any, error) {
+	value, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w: ! needs bool, not %s", ErrEval, typeName(value))
+		}
+		return !b, nil
+	default:
+		f, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%w: - needs number, not %s", ErrEval, typeName(value))
+		}
+		return -f, nil
+	}
+}
+
+type conditionalNode struct{ cond, then, otherwise node }
+
+func (n *conditionalNode) eval(s *scope) (any, error) {
+	cond, err := evalBool(n.cond, s, "?:")
+	if err != nil {
+		return nil, err
+	}
+	if cond {
+		return n.then.eval(s)
+	}
+	return n.otherwise.eval(s)
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(s *scope) (any, error) {
+	// Logical operators short-circuit
+	if n.op == "&&" || n.op == "||" {
+		left, err := evalBool(n.left, s, n.op)
+		if err != nil {
+			return nil, err
+		}
+		if left == (n.op == "||") {
+			return left, nil
+		}
+		return evalBool(n.right, s, n.op)
+	}
+
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []any:
+			for _, element := range container {
+				if equal(left, element) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]any:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = container[key]
+			return ok, nil
+		default:
+			return nil, fmt.Errorf("%w: in needs list or map, not %s", ErrEval, typeName(right))
+		}
+	case "<", "<=", ">", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "+":
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []any:
+			if r, ok := right.([]any); ok {
+				return append(append([]any{}, l...), r...), nil
+			}
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%w: %s not defined for %s and %s", ErrEval, n.op, typeName(left), typeName(right))
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("%w: division by zero", ErrEval)
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, fmt.Errorf("%w: modulus by zero", ErrEval)
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+// macroNode evaluates list.all(v, predicate) or list.exists(v, predicate)
+type macroNode struct {
+	all       bool
+	list      node
+	variable  string
+	predicate node
+}
+
+func (n *macroNode) eval(s *scope) (any, error) {
+	value, err := n.list.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	var elements []any
+	switch v := value.(type) {
+	case []any:
+		elements = v
+	case map[string]any:
+		for key := range v {
+			elements = append(elements, key)
+		}
+	default:
+		return nil, fmt.Errorf("%w: cannot iterate over %s", ErrEval, typeName(value))
+	}
+
+	inner := &scope{vars: map[string]any{}, parent: s}
+	for _, element := range elements {
+		inner.vars[n.variable] = element
+		ok, err := evalBool(n.predicate, inner, "macro predicate")
+		if err != nil {
+			return nil, err
+		}
+		if ok != n.all {
+			return ok, nil
+		}
+	}
+	return n.all, nil
+}
+
+// callNode calls a built-in function; methods receive their target as the first argument
+type callNode struct {
+	name string
+	fn   func(args []any) (any, error)
+	args []node
+}
+
+func (n *callNode) eval(s *scope) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return n.fn(args)
+}
+
+// functions are the built-in functions by name and argument count
+var functions = map[string]struct {
+	arity int
+	fn    func(args []any) (any, error)
+}{
+	"size":       {1, size},
+	"int":        {1, toIntValue},
+	"string":     {1, toStringValue},
+	"startsWith": {2, stringFunction(strings.HasPrefix)},
+	"endsWith":   {2, stringFunction(strings.HasSuffix)},
+	"contains":   {2, stringFunction(strings.Contains)},
+	"matches":    {2, nil}, // Compiled per call site so a constant pattern is parsed once
+}
+
+// newCall resolves a built-in function call
+func newCall(name string, args []node, pos int) (node, error) {
+	f, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown function %q at %d", ErrSyntax, name, pos)
+	}
+	if len(args) != f.arity {
+		return nil, fmt.Errorf("%w: %s takes %d arguments, not %d at %d", ErrSyntax, name, f.arity, len(args), pos)
+	}
+	if name == "matches" {
+		return newMatches(args, pos)
+	}
+	return &callNode{name: name, fn: f.fn, args: args}, nil
+}
+
+// newMatches compiles s.matches(re), precompiling a constant pattern
+func newMatches(args []node, pos int) (node, error) {
+	if literal, ok := args[1].(*literalNode); ok {
+		pattern, ok := literal.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: matches needs a string pattern at %d", ErrSyntax, pos)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid pattern at %d: %v", ErrSyntax, pos, err)
+		}
+		return &callNode{name: "matches", args: args[:1], fn: func(args []any) (any, error) {
+			s, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: matches needs string, not %s", ErrEval, typeName(args[0]))
+			}
+			return re.MatchString(s), nil
+		}}, nil
+	}
+	return &callNode{name: "matches", args: args, fn: func(args []any) (any, error) {
+		s, sok := args[0].(string)
+		pattern, pok := args[1].(string)
+		if !sok || !pok {
+			return nil, fmt.Errorf("%w: matches needs strings, not %s and %s", ErrEval, typeName(args[0]), typeName(args[1]))
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid pattern: %v", ErrEval, err)
+		}
+		return re.MatchString(s), nil
+	}}, nil
+}
+
+func stringFunction(f func(s, arg string) bool) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		s, sok := args[0].(string)
+		arg, aok := args[1].(string)
+		if !sok || !aok {
+			return nil, fmt.Errorf("%w: needs strings, not %s and %s", ErrEval, typeName(args[0]), typeName(args[1]))
+		}
+		return f(s, arg), nil
+	}
+}
+
+func size(args []any) (any, error) {
+	switch v := args[0].(type) {
+	case string:
+		return float64(len(v)), nil
+	case []any:
+		return float64(len(v)), nil
+	case map[string]any:
+		return float64(len(v)), nil
+	default:
+		return nil, fmt.Errorf("%w: size not defined for %s", ErrEval, typeName(v))
+	}
+}
+
+func toIntValue(args []any) (any, error) {
+	switch v := args[0].(type) {
+	case float64:
+		return math.Trunc(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && (i > maxExactInteger || i < -maxExactInteger) {
+			err = fmt.Errorf("cannot be represented exactly")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: int(%q): %v", ErrEval, v, err)
+		}
+		return float64(i), nil
+	default:
+		return nil, fmt.Errorf("%w: int not defined for %s", ErrEval, typeName(v))
+	}
+}
+
+func toStringValue(args []any) (any, error) {
+	switch v := args[0].(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return nil, fmt.Errorf("%w: string not defined for %s", ErrEval, typeName(v))
+	}
+}
+
+// evalBool evaluates an operand that must be a boolean
+func evalBool(n node, s *scope, op string) (bool, error) {
+	value, err := n.eval(s)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%w: %s needs bool, not %s", ErrEval, op, typeName(value))
+	}
+	return b, nil
+}
+
+// equal compares values structurally
+func equal(a, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two numbers or two strings
+func compare(a, b any) (int, error) {
+	switch l := a.(type) {
+	case float64:
+		if r, ok := b.(float64); ok {
+			switch {
+			case l < r:
+				return -1, nil
+			case l > r:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if r, ok := b.(string); ok {
+			return strings.Compare(l, r), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: cannot compare %s and %s", ErrEval, typeName(a), typeName(b))
+}
+
+// toInt converts an integral number to an index
+func toInt(value any) (int, error) {
+	f, ok := value.(float64)
+	if !ok || f != math.Trunc(f) {
+		return 0, fmt.Errorf("%w: index must be an integer, not %v", ErrEval, value)
+	}
+	return int(f), nil
+}
+
+// typeName names a value's type in error messages
+func typeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
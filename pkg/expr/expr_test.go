@@ -0,0 +1,293 @@
+package expr
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEval(t *testing.T) {
+	var payload any
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"release": {"version": "1.4.2", "channel": "stable", "build": 812},
+		"artifacts": [
+			{"name": "enclave.bit", "digest": {"sha256": "ab12"}},
+			{"name": "firmware.elf", "digest": {"sha256": "cd34"}}
+		],
+		"draft": false
+	}`), &payload))
+	vars := map[string]any{"payload": payload, "message": "release 1.4.2"}
+
+	cases := []struct {
+		expr string
+		want any
+	}{
+		{`payload.release.channel == "stable"`, true},
+		{`payload["release"]["build"] >= 800 && !payload.draft`, true},
+		{`payload.release.channel in ["stable", "lts"]`, true},
+		{`"beta" in ["stable", "lts"]`, false},
+		{`"release" in payload`, true},
+		{`payload.artifacts.size() == 2 && size(payload.artifacts[1].name) == 12`, true},
+		{`payload.artifacts.all(a, has(a.digest.sha256))`, true},
+		{`payload.artifacts.exists(a, a.name.endsWith(".bit"))`, true},
+		{`payload.artifacts.all(a, a.name.startsWith("enclave"))`, false},
+		{`payload.release.version.matches("^[0-9]+\\.[0-9]+\\.[0-9]+$")`, true},
+		{`message.contains('1.4') ? "yes" : "no"`, "yes"},
+		{`has(payload.signed)`, false},
+		{`int("12") + 3 * 2 - 10 / 5 % 3`, 16.0},
+		{`string(payload.release.build) + "-" + payload.release.channel`, "812-stable"},
+		{`[1, 2] + [3] == [1, 2, 3]`, true},
+		{`-payload.release.build < 0 || payload.missing`, true},
+	}
+	for _, c := range cases {
+		program, err := Compile(c.expr)
+		if !assert.NoError(t, err, c.expr) {
+			continue
+		}
+		value, err := program.Eval(vars)
+		assert.NoError(t, err, c.expr)
+		assert.Equal(t, c.want, value, c.expr)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`payload.`,
+		`a == `,
+		`(a`,
+		`"unterminated`,
+		`a # b`,
+		`unknown(a)`,
+		`size(a, b)`,
+		`has(a)`,
+		`a.matches("[")`,
+		`a b`,
+	} {
+		_, err := Compile(source)
+		assert.ErrorIs(t, err, ErrSyntax, source)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	vars := map[string]any{"payload": map[string]any{"n": 1.0, "s": "text"}}
+	for _, source := range []string{
+		`missing`,
+		`payload.absent == 1`,
+		`payload.n.field`,
+		`payload.n + payload.s`,
+		`payload.n < payload.s`,
+		`payload.n && true`,
+		`payload.s[10]`,
+		`payload.n / 0`,
+	} {
+		program, err := Compile(source)
+		if !assert.NoError(t, err, source) {
+			continue
+		}
+		_, err = program.Eval(vars)
+		assert.ErrorIs(t, err, ErrEval, source)
+	}
+
+	program, err := Compile(`payload.n`)
+	assert.NoError(t, err)
+	_, err = program.EvalBool(vars)
+	assert.ErrorIs(t, err, ErrEval)
+}
+
+func TestPrecedence(t *testing.T) {
+	cases := []struct {
+		expr string
+		want any
+	}{
+		{`1 + 2 * 3`, 7.0},
+		{`(1 + 2) * 3`, 9.0},
+		{`10 - 4 - 3`, 3.0},
+		{`12 / 2 / 3`, 2.0},
+		{`7 % 4 * 2`, 6.0},
+		{`-2 * 3`, -6.0},
+		{`--2`, 2.0},
+		{`!true || true`, true},
+		{`!(true || true)`, false},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`1 + 1 == 2 && 3 > 2`, true},
+		{`1 < 2 == true`, true},
+		{`"a" in ["a"] && !("b" in ["a"])`, true},
+		{`true ? 1 : 2 + 10`, 1.0},
+		{`false ? 1 : true ? 2 : 3`, 2.0},
+		{`false && missing`, false},
+		{`true || missing`, true},
+	}
+	for _, c := range cases {
+		program, err := Compile(c.expr)
+		if !assert.NoError(t, err, c.expr) {
+			continue
+		}
+		value, err := program.Eval(nil)
+		assert.NoError(t, err, c.expr)
+		assert.Equal(t, c.want, value, c.expr)
+	}
+}
+
+func TestTypeErrors(t *testing.T) {
+	vars := map[string]any{"payload": map[string]any{"n": 1.0, "s": "text", "b": true, "l": []any{1.0}, "m": map[string]any{}}}
+	for _, source := range []string{
+		`!payload.n`,
+		`-payload.s`,
+		`payload.b + 1`,
+		`payload.l - payload.l`,
+		`payload.m * 2`,
+		`payload.s * 2`,
+		`payload.b < payload.b`,
+		`payload.l > payload.l`,
+		`payload.n || true`,
+		`payload.s ? 1 : 2`,
+		`1 in payload.n`,
+		`payload.l[0.5]`,
+		`payload.l["0"]`,
+		`payload.m[1]`,
+		`size(payload.n)`,
+		`int(payload.b)`,
+		`int("1.5")`,
+		`string(payload.l)`,
+		`payload.n.startsWith("1")`,
+		`payload.s.contains(1)`,
+		`payload.n.all(x, true)`,
+		`payload.l.all(x, x)`,
+		`payload.l.exists(x, "yes")`,
+	} {
+		program, err := Compile(source)
+		if !assert.NoError(t, err, source) {
+			continue
+		}
+		_, err = program.Eval(vars)
+		assert.ErrorIs(t, err, ErrEval, source)
+	}
+}
+
+func TestMissingFields(t *testing.T) {
+	payload, err := DecodeJSON([]byte(`{"release": {"channel": "stable", "tags": []}, "empty": null}`))
+	assert.NoError(t, err)
+	vars := map[string]any{"payload": payload}
+
+	// Missing fields are errors rather than null, so a rule about them cannot pass by accident
+	for _, source := range []string{
+		`payload.release.version == "1.0"`,
+		`payload.release.version != "1.0"`,
+		`payload.missing.channel`,
+		`payload["missing"]`,
+		`payload.release.tags[0]`,
+		`payload.empty.field`,
+		`payload.release.tags.all(t, t.name == "x") && payload.other`,
+	} {
+		program, err := Compile(source)
+		if !assert.NoError(t, err, source) {
+			continue
+		}
+		_, err = program.Eval(vars)
+		assert.ErrorIs(t, err, ErrEval, source)
+	}
+
+	// has tests for a field without failing, and quantifiers over empty lists are vacuous
+	for source, want := range map[string]bool{
+		`has(payload.release.version)`:                  false,
+		`has(payload.release.channel)`:                  true,
+		`!has(payload.missing) || payload.missing`:      true,
+		`payload.release.tags.all(t, t.name == "x")`:    true,
+		`payload.release.tags.exists(t, t.name == "x")`: false,
+		`payload.empty == null`:                         true,
+	} {
+		program, err := Compile(source)
+		if !assert.NoError(t, err, source) {
+			continue
+		}
+		value, err := program.EvalBool(vars)
+		assert.NoError(t, err, source)
+		assert.Equal(t, want, value, source)
+	}
+}
+
+func TestLargeIntegers(t *testing.T) {
+	// Integers up to 2^53 are exact
+	payload, err := DecodeJSON([]byte(`{"serial": 9007199254740992, "negative": -9007199254740992, "ratio": 1e300}`))
+	assert.NoError(t, err)
+	vars := map[string]any{"payload": payload}
+	for _, source := range []string{
+		`payload.serial == 9007199254740992`,
+		`payload.negative == -9007199254740992`,
+		`payload.ratio > 1e299`,
+		`int("9007199254740992") == payload.serial`,
+	} {
+		program, err := Compile(source)
+		if !assert.NoError(t, err, source) {
+			continue
+		}
+		value, err := program.EvalBool(vars)
+		assert.NoError(t, err, source)
+		assert.True(t, value, source)
+	}
+
+	// Larger integers would be rounded, so 9007199254740993 would equal 9007199254740992
+	for _, document := range []string{
+		`{"serial": 9007199254740993}`,
+		`{"list": [1, -9007199254740993]}`,
+		`{"nested": {"id": 18446744073709551616}}`,
+	} {
+		_, err := DecodeJSON([]byte(document))
+		assert.Error(t, err, document)
+	}
+	_, err = Compile(`payload.serial == 9007199254740993`)
+	assert.ErrorIs(t, err, ErrSyntax)
+	program, err := Compile(`int("9007199254740993")`)
+	assert.NoError(t, err)
+	_, err = program.Eval(nil)
+	assert.ErrorIs(t, err, ErrEval)
+}
+
+func TestMalformedInput(t *testing.T) {
+	for _, source := range []string{
+		`1 +`,
+		`* 2`,
+		`1 2`,
+		`[1, 2`,
+		`[1,, 2]`,
+		`payload[`,
+		`payload["a"`,
+		`payload..a`,
+		`a ? b`,
+		`a ? b :`,
+		`(`,
+		`)`,
+		`'unterminated`,
+		`"escape at end\`,
+		`1.2.3`,
+		`1e`,
+		`a.all(1, true)`,
+		`a.all(x)`,
+		`a.startsWith()`,
+		`has(1)`,
+		`int()`,
+		`&&`,
+		`a = b`,
+		`a & b`,
+		"a\x00",
+	} {
+		_, err := Compile(source)
+		assert.ErrorIs(t, err, ErrSyntax, source)
+	}
+
+	for _, document := range []string{
+		``,
+		`{`,
+		`{"a": }`,
+		`{"a": 1,}`,
+		`{"a": 1} {"b": 2}`,
+		`{"a": 1} trailing`,
+		`{"a": NaN}`,
+	} {
+		_, err := DecodeJSON([]byte(document))
+		assert.Error(t, err, document)
+	}
+}
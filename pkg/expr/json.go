@@ -0,0 +1,70 @@
+package expr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxExactInteger is the largest magnitude below which every integer is exactly a float64
+const maxExactInteger = 1 << 53
+
+// DecodeJSON decodes a JSON document into the values expressions work with. Numbers are float64, so an
+// integer too large to be represented exactly is an error rather than silently rounded, which would let
+// a rule compare against a different number than the document holds.
+func DecodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return convertNumbers(value)
+}
+
+// convertNumbers replaces every json.Number in a decoded value with its float64
+func convertNumbers(value any) (any, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return parseNumber(v.String())
+	case []any:
+		for i, item := range v {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	case map[string]any:
+		for key, item := range v {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+	}
+	return value, nil
+}
+
+// parseNumber parses a number, refusing integers that a float64 cannot hold exactly
+func parseNumber(text string) (float64, error) {
+	if !strings.ContainsAny(text, ".eE") {
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err == nil && (i > maxExactInteger || i < -maxExactInteger) {
+			err = errors.New("out of range")
+		}
+		if err != nil {
+			return 0, fmt.Errorf("integer %s cannot be represented exactly: %v", text, err)
+		}
+		return float64(i), nil
+	}
+	return strconv.ParseFloat(text, 64)
+}
@@ -0,0 +1,368 @@
+// Package expr implements a small CEL-like expression language over JSON values. Expressions are compiled
+// once and evaluated against a set of variables; values are the types produced by encoding/json: nil,
+// bool, float64, string, []any and map[string]any. DecodeJSON decodes documents into these types, refusing
+// integers that a float64 cannot hold exactly.
+//
+// Supported syntax:
+//
+//	literals      null true false 1.5 "text" 'text' [1, 2]
+//	selection     payload.release.channel  payload["channel"]  payload.artifacts[0]
+//	operators     ! - * / % + < <= > >= == != in && || ?:
+//	functions     size(x) has(a.b) int(x) string(x)
+//	methods       s.startsWith(p) s.endsWith(p) s.contains(p) s.matches(re) x.size()
+//	macros        list.all(v, expr) list.exists(v, expr)
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrSyntax is returned for expressions that do not parse
+var ErrSyntax = errors.New("expression syntax error")
+
+// tokenKind classifies lexer tokens
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value any
+	pos   int
+}
+
+// lex splits an expression into tokens
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], pos: start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				((src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E'))) {
+				i++
+			}
+			value, err := parseNumber(src[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid number %q at %d: %v", ErrSyntax, src[start:i], start, err)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[start:i], value: value, pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, start)
+			}
+			i++
+			quoted := src[start:i]
+			if c == '\'' {
+				quoted = `"` + strings.ReplaceAll(strings.ReplaceAll(quoted[1:len(quoted)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid string at %d: %v", ErrSyntax, start, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: src[start:i], value: value, pos: start})
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ",", "?", ":"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, c, i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// parser is a recursive descent parser producing an expression tree
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the operator or keyword if it is next
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		return fmt.Errorf("%w: expected %q at %d", ErrSyntax, text, t.pos)
+	}
+	return nil
+}
+
+// parseExpr parses a conditional expression, the lowest precedence level
+func (p *parser) parseExpr() (node, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &conditionalNode{cond, then, otherwise}, nil
+}
+
+// precedence lists binary operators from the lowest to the highest precedence
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// parseBinary parses left-associative binary operators at a precedence level and above
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range precedence[level] {
+			if p.accept(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &unaryNode{op, operand}, nil
+		}
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses field selection, indexing and method calls
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("%w: expected field name at %d", ErrSyntax, name.pos)
+			}
+			if !p.accept("(") {
+				n = &selectNode{n, name.text}
+				continue
+			}
+			if name.text == "all" || name.text == "exists" {
+				if n, err = p.parseMacro(n, name.text); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			if n, err = newCall(name.text, append([]node{n}, args...), name.pos); err != nil {
+				return nil, err
+			}
+		case p.accept("["):
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{n, index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// parseMacro parses the variable and predicate of list.all(v, expr) or list.exists(v, expr)
+func (p *parser) parseMacro(list node, name string) (node, error) {
+	variable := p.next()
+	if variable.kind != tokenIdent {
+		return nil, fmt.Errorf("%w: expected variable name at %d", ErrSyntax, variable.pos)
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	predicate, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &macroNode{all: name == "all", list: list, variable: variable.text, predicate: predicate}, nil
+}
+
+// parseArgs parses a call's arguments after the opening parenthesis
+func (p *parser) parseArgs() ([]node, error) {
+	var args []node
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return &literalNode{t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if !p.accept("(") {
+			return &identNode{t.text}, nil
+		}
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "has" {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%w: has() takes one field selection at %d", ErrSyntax, t.pos)
+			}
+			sel, ok := args[0].(*selectNode)
+			if !ok {
+				return nil, fmt.Errorf("%w: has() takes a field selection at %d", ErrSyntax, t.pos)
+			}
+			return &hasNode{sel}, nil
+		}
+		return newCall(t.text, args, t.pos)
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			var elements []node
+			if p.accept("]") {
+				return &listNode{elements}, nil
+			}
+			for {
+				element, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				elements = append(elements, element)
+				if p.accept("]") {
+					return &listNode{elements}, nil
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if t.kind == tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected end of expression", ErrSyntax)
+	}
+	return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+}
@@ -1,12 +1,17 @@
 package fpga
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
 
-// LoadKeyToFPGA loads a key into the FPGA memory via AXI
+// LoadKeyToFPGA loads a key into the FPGA memory via AXI, one key byte in the low byte of each 32-bit
+// little-endian word
 func LoadKeyToFPGA(key []byte, axiOffset uint32, mappedMem []byte) error {
 
 	// Get the page size once and store it in a variable
@@ -17,46 +22,165 @@ func LoadKeyToFPGA(key []byte, axiOffset uint32, mappedMem []byte) error {
 		return fmt.Errorf("key size exceeds mapped memory size")
 	}
 
+	// Ensure the key slot lies within the mapped region
+	if int(axiOffset)+len(key)*4 > len(mappedMem) {
+		return fmt.Errorf("key slot at offset 0x%x exceeds mapped memory", axiOffset)
+	}
+
 	// Access the memory mapped region and load the key into the FPGA memory
-	for i := 0; i < len(key); i++ {
-		axiMem := (*[1 << 30]uint32)(unsafe.Pointer(&mappedMem[0])) // Using a large array length for maximum compatibility
-		axiMem[axiOffset/4+uint32(i)] = uint32(key[i])
+	for i, b := range key {
+		binary.LittleEndian.PutUint32(mappedMem[int(axiOffset)+i*4:], uint32(b))
+	}
+
+	return nil
+}
+
+// ZeroizeCommand is the value written to the key control register to zeroize key slots
+const ZeroizeCommand = 0x5A
+
+// ZeroizeKeySlots sends a command to the FPGA to zeroize every key slot set in slotMask
+func ZeroizeKeySlots(slotMask uint32, commandOffset uint32, mappedMem []byte) error {
+	// The control register is followed by the slot mask register, both 32-bit words
+	if commandOffset%4 != 0 || int(commandOffset)+8 > len(mappedMem) {
+		return fmt.Errorf("key control register at offset 0x%x is outside mapped memory", commandOffset)
 	}
 
+	binary.LittleEndian.PutUint32(mappedMem[commandOffset+4:], slotMask)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mappedMem[commandOffset])), ZeroizeCommand)
 	return nil
 }
 
-// LoadEncryptedCode loads encrypted code into FPGA memory via AXI
-func LoadEncryptedCode(encryptedCode []byte, iv []byte, axiOffset uint32, mappedMem []byte) error {
-	// Ensure code and IV fit into mapped memory
-	if len(encryptedCode)+len(iv) > len(mappedMem) {
+// LoadEncryptedCode writes an encrypted image to FPGA memory via AXI: its marshalled container header,
+// which carries the IV, tag and entry point, followed by the encrypted code or program. It only moves
+// bytes; callers check the image's signature and layout before loading it, as enclave.LoadImage does.
+func LoadEncryptedCode(header, ciphertext []byte, axiOffset uint32, mappedMem []byte) error {
+	// Ensure the header and code fit into mapped memory
+	if uint64(axiOffset)+uint64(len(header)+len(ciphertext)) > uint64(len(mappedMem)) {
 		return fmt.Errorf("encrypted code size exceeds mapped memory")
 	}
 
-	// Load IV to memory (you can set a specific memory region for IV if needed)
-	for i := 0; i < len(iv); i++ {
-		mappedMem[axiOffset+uint32(i)] = iv[i]
+	copy(mappedMem[axiOffset:], header)
+	copy(mappedMem[axiOffset+uint32(len(header)):], ciphertext)
+	return nil
+}
+
+// SelectImageKey atomically writes the index of the key slot holding the image key to the image key register
+// at keyOffset, which enclave_registers implements at 0x0208
+func SelectImageKey(slot uint32, keyOffset uint32, mappedMem []byte) error {
+	if keyOffset%4 != 0 || int(keyOffset)+4 > len(mappedMem) {
+		return fmt.Errorf("image key register at offset 0x%x is outside mapped memory", keyOffset)
+	}
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mappedMem[keyOffset])), slot)
+	return nil
+}
+
+// Image slot register values. The enclave core boots the image in the selected slot; a slot marked with
+// SlotTrial is abandoned for the other slot if the core is reset before the mark is cleared, which
+// enclave_registers does in hardware.
+const (
+	SlotA     = 0
+	SlotB     = 1
+	SlotTrial = 1 << 31
+)
+
+// SelectSlot atomically writes the image slot register at selectOffset, which enclave_registers implements at
+// 0x020C
+func SelectSlot(value uint32, selectOffset uint32, mappedMem []byte) error {
+	if selectOffset%4 != 0 || int(selectOffset)+4 > len(mappedMem) {
+		return fmt.Errorf("slot register at offset 0x%x is outside mapped memory", selectOffset)
 	}
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mappedMem[selectOffset])), value)
+	return nil
+}
 
-	// Load encrypted code to FPGA memory
-	for i := 0; i < len(encryptedCode); i++ {
-		mappedMem[axiOffset+uint32(i+len(iv))] = encryptedCode[i]
+// ReadSlot atomically reads the image slot register at selectOffset
+func ReadSlot(selectOffset uint32, mappedMem []byte) (uint32, error) {
+	if selectOffset%4 != 0 || int(selectOffset)+4 > len(mappedMem) {
+		return 0, fmt.Errorf("slot register at offset 0x%x is outside mapped memory", selectOffset)
 	}
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&mappedMem[selectOffset]))), nil
+}
 
+// BlowFuses sets the bits of mask in the one-time programmable fuse register at fuseOffset. Blown fuses
+// cannot be cleared, so the register only ever gains bits. enclave_registers enforces this at 0x0200 but
+// clears the register at power-on: one-time programmable fuses behind it are required hardware that the
+// design does not include yet.
+func BlowFuses(mask uint32, fuseOffset uint32, mappedMem []byte) error {
+	if fuseOffset%4 != 0 || int(fuseOffset)+4 > len(mappedMem) {
+		return fmt.Errorf("fuse register at offset 0x%x is outside mapped memory", fuseOffset)
+	}
+	atomic.OrUint32((*uint32)(unsafe.Pointer(&mappedMem[fuseOffset])), mask)
 	return nil
 }
 
-// ExecuteDecryptedCode sends a command to the FPGA to decrypt and execute code
+// ReadFuses atomically reads the fuse register at fuseOffset
+func ReadFuses(fuseOffset uint32, mappedMem []byte) (uint32, error) {
+	if fuseOffset%4 != 0 || int(fuseOffset)+4 > len(mappedMem) {
+		return 0, fmt.Errorf("fuse register at offset 0x%x is outside mapped memory", fuseOffset)
+	}
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&mappedMem[fuseOffset]))), nil
+}
+
+// IncrementCounter atomically increments the monotonic counter register at counterOffset and returns its
+// new value. The counter cannot be decremented or reset. enclave_registers enforces this at 0x0204 but
+// clears the counter at power-on: a non-volatile counter behind it is required hardware that the design
+// does not include yet.
+func IncrementCounter(counterOffset uint32, mappedMem []byte) (uint32, error) {
+	if counterOffset%4 != 0 || int(counterOffset)+4 > len(mappedMem) {
+		return 0, fmt.Errorf("counter register at offset 0x%x is outside mapped memory", counterOffset)
+	}
+	return atomic.AddUint32((*uint32)(unsafe.Pointer(&mappedMem[counterOffset])), 1), nil
+}
+
+// ReadCounter atomically reads the monotonic counter register at counterOffset
+func ReadCounter(counterOffset uint32, mappedMem []byte) (uint32, error) {
+	if counterOffset%4 != 0 || int(counterOffset)+4 > len(mappedMem) {
+		return 0, fmt.Errorf("counter register at offset 0x%x is outside mapped memory", counterOffset)
+	}
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&mappedMem[counterOffset]))), nil
+}
+
+// Execution status values, written by the FPGA to the status register when the execution command clears
+const (
+	StatusOK               = 0 // The code was authenticated and ran
+	StatusIntegrityFailure = 1 // The code failed its tag check; no instruction was executed
+	StatusTamper           = 2 // Execution was stopped by tamper detection
+)
+
+// StatusOffset is the offset of the execution status register from the execution command register
+const StatusOffset = 4
+
+// ErrIntegrityFailure is returned when the FPGA refuses to execute code whose tag does not verify
+var ErrIntegrityFailure = errors.New("enclave code failed integrity check")
+
+// ExecuteDecryptedCode sends a command to the FPGA to decrypt and execute code. The rocket_chip_enclave only
+// executes code once its aes256_gcm_tag unit has verified the tag of the image, or of every segment of a
+// program, and reports the outcome in the status register.
 func ExecuteDecryptedCode(mappedMem []byte, commandOffset uint32) error {
+	// The command register is followed by the status register, both 32-bit words
+	if commandOffset%4 != 0 || int(commandOffset)+StatusOffset+4 > len(mappedMem) {
+		return fmt.Errorf("execution command register at offset 0x%x is outside mapped memory", commandOffset)
+	}
+	command := (*uint32)(unsafe.Pointer(&mappedMem[commandOffset]))
+	status := (*uint32)(unsafe.Pointer(&mappedMem[commandOffset+StatusOffset]))
+
 	// Write to the control register (this address may vary based on your FPGA design)
-	mappedMem[commandOffset] = 1 // Set '1' to start decryption and execution
-
-	// Optionally wait for completion (polling or interrupts can be used here)
-	// For polling example:
-	for {
-		if mappedMem[commandOffset] == 0 {
-			break
-		}
+	atomic.StoreUint32(status, StatusOK)
+	atomic.StoreUint32(command, 1) // Set '1' to start decryption and execution
+
+	// Poll until the FPGA clears the command
+	for atomic.LoadUint32(command) != 0 {
+		runtime.Gosched()
+	}
+
+	switch code := atomic.LoadUint32(status); code {
+	case StatusOK:
+	case StatusIntegrityFailure:
+		return ErrIntegrityFailure
+	case StatusTamper:
+		return fmt.Errorf("execution stopped by tamper detection")
+	default:
+		return fmt.Errorf("execution failed with status %d", code)
 	}
 
 	fmt.Println("Decryption and execution completed on FPGA")
@@ -1,7 +1,12 @@
 package fpga
 
 import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,22 +21,48 @@ func TestLoadKeyToFPGA(t *testing.T) {
 
 	err := LoadKeyToFPGA(key, axiOffset, mappedMem)
 	assert.Nil(t, err)
-	assert.Equal(t, key, mappedMem[axiOffset:axiOffset+uint32(len(key))])
+
+	// Each key byte occupies the low byte of a 32-bit word
+	for i, b := range key {
+		assert.Equal(t, []byte{b, 0, 0, 0}, mappedMem[int(axiOffset)+i*4:int(axiOffset)+i*4+4])
+	}
+	assert.Equal(t, make([]byte, len(mappedMem)-len(key)*4), mappedMem[len(key)*4:])
+
+	// The key slot must lie within the mapped region
+	err = LoadKeyToFPGA(key, uint32(len(mappedMem)-len(key)*4+4), mappedMem)
+	assert.Error(t, err)
 }
 
 func TestLoadEncryptedCode(t *testing.T) {
 	// Simulated FPGA memory
 	mappedMem := make([]byte, 1024)
+	header := bytes.Repeat([]byte{0x48}, 64)
+	ciphertext := []byte("Encrypted enclave code")
+	axiOffset := uint32(16)
 
-	// Example encrypted code and IV
-	encryptedCode := []byte("Encrypted code data")
-	iv := []byte("InitializationVec")
-	axiOffset := uint32(0)
-
-	err := LoadEncryptedCode(encryptedCode, iv, axiOffset, mappedMem)
+	// The header is followed by the encrypted code
+	err := LoadEncryptedCode(header, ciphertext, axiOffset, mappedMem)
 	assert.Nil(t, err)
-	assert.Equal(t, iv, mappedMem[axiOffset:axiOffset+uint32(len(iv))])
-	assert.Equal(t, encryptedCode, mappedMem[axiOffset+uint32(len(iv)):axiOffset+uint32(len(iv)+len(encryptedCode))])
+	assert.Equal(t, header, mappedMem[axiOffset:axiOffset+uint32(len(header))])
+	assert.Equal(t, ciphertext, mappedMem[axiOffset+uint32(len(header)):axiOffset+uint32(len(header)+len(ciphertext))])
+
+	// The image must fit in mapped memory
+	assert.Error(t, LoadEncryptedCode(header, ciphertext, 1000, mappedMem))
+
+	// The image key register selects a key slot
+	assert.Nil(t, SelectImageKey(3, 0x200, mappedMem))
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(mappedMem[0x200:]))
+	assert.Error(t, SelectImageKey(3, 0x202, mappedMem))
+}
+
+// simulateExecution answers one execution command like the FPGA, reporting status
+func simulateExecution(mappedMem []byte, commandOffset uint32, status uint32) {
+	command := (*uint32)(unsafe.Pointer(&mappedMem[commandOffset]))
+	for atomic.LoadUint32(command) != 1 {
+		runtime.Gosched()
+	}
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&mappedMem[commandOffset+StatusOffset])), status)
+	atomic.StoreUint32(command, 0)
 }
 
 func TestExecuteDecryptedCode(t *testing.T) {
@@ -42,7 +73,97 @@ func TestExecuteDecryptedCode(t *testing.T) {
 	commandOffset := uint32(500)
 
 	// Test executing code on FPGA
+	go simulateExecution(mappedMem, commandOffset, StatusOK)
 	err := ExecuteDecryptedCode(mappedMem, commandOffset)
 	assert.Nil(t, err)
 	assert.Equal(t, byte(0), mappedMem[commandOffset]) // Ensure command is reset after execution
+
+	// Code that fails its tag check is reported, not run
+	go simulateExecution(mappedMem, commandOffset, StatusIntegrityFailure)
+	err = ExecuteDecryptedCode(mappedMem, commandOffset)
+	assert.ErrorIs(t, err, ErrIntegrityFailure)
+	go simulateExecution(mappedMem, commandOffset, StatusTamper)
+	err = ExecuteDecryptedCode(mappedMem, commandOffset)
+	assert.ErrorContains(t, err, "tamper")
+
+	// The command and status registers must lie within the mapped region
+	err = ExecuteDecryptedCode(mappedMem, 1020)
+	assert.Error(t, err)
+	err = ExecuteDecryptedCode(mappedMem, 501)
+	assert.Error(t, err)
+}
+
+func TestZeroizeKeySlots(t *testing.T) {
+	// Simulated FPGA memory
+	mappedMem := make([]byte, 1024)
+	commandOffset := uint32(0x100)
+
+	err := ZeroizeKeySlots(0b101, commandOffset, mappedMem)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(ZeroizeCommand), mappedMem[commandOffset])
+	assert.Equal(t, byte(0b101), mappedMem[commandOffset+4])
+
+	// The control register must lie within the mapped region
+	err = ZeroizeKeySlots(1, uint32(len(mappedMem)), mappedMem)
+	assert.Error(t, err)
+}
+
+func TestSelectSlot(t *testing.T) {
+	// Simulated FPGA memory
+	mappedMem := make([]byte, 1024)
+	selectOffset := uint32(0x200)
+
+	assert.Nil(t, SelectSlot(SlotB|SlotTrial, selectOffset, mappedMem))
+	slot, err := ReadSlot(selectOffset, mappedMem)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(SlotB|SlotTrial), slot)
+	assert.Equal(t, uint32(SlotB|SlotTrial), binary.LittleEndian.Uint32(mappedMem[selectOffset:]))
+
+	// The register must be aligned and lie within the mapped region
+	assert.Error(t, SelectSlot(SlotA, selectOffset+2, mappedMem))
+	_, err = ReadSlot(uint32(len(mappedMem)), mappedMem)
+	assert.Error(t, err)
+}
+
+func TestBlowFuses(t *testing.T) {
+	// Simulated FPGA memory
+	mappedMem := make([]byte, 1024)
+	fuseOffset := uint32(0x200)
+
+	assert.Nil(t, BlowFuses(1, fuseOffset, mappedMem))
+	assert.Nil(t, BlowFuses(4, fuseOffset, mappedMem))
+	fuses, err := ReadFuses(fuseOffset, mappedMem)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), fuses)
+
+	// Blowing a fuse again leaves the others set
+	assert.Nil(t, BlowFuses(1, fuseOffset, mappedMem))
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(mappedMem[fuseOffset:]))
+
+	// The register must be aligned and lie within the mapped region
+	assert.Error(t, BlowFuses(1, fuseOffset+2, mappedMem))
+	_, err = ReadFuses(uint32(len(mappedMem)), mappedMem)
+	assert.Error(t, err)
+}
+
+func TestIncrementCounter(t *testing.T) {
+	// Simulated FPGA memory
+	mappedMem := make([]byte, 1024)
+	counterOffset := uint32(0x204)
+
+	value, err := ReadCounter(counterOffset, mappedMem)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), value)
+	for i := uint32(1); i <= 3; i++ {
+		value, err = IncrementCounter(counterOffset, mappedMem)
+		assert.Nil(t, err)
+		assert.Equal(t, i, value)
+	}
+	assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(mappedMem[counterOffset:]))
+
+	// The register must be aligned and lie within the mapped region
+	_, err = IncrementCounter(counterOffset+2, mappedMem)
+	assert.Error(t, err)
+	_, err = ReadCounter(uint32(len(mappedMem)), mappedMem)
+	assert.Error(t, err)
 }
@@ -0,0 +1,132 @@
+package fpga
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// KeyCommand is a command for the key engine, the FPGA block that generates keys into the key slots, seals
+// and unseals them under the key-encryption key, and holds the transport, audit and DICE identity keys, so
+// that none of them is ever on the host. The key engine is required hardware: the RTL under verilog/ does
+// not implement it yet.
+type KeyCommand uint32
+
+// Key engine commands. Arguments are passed in the argument registers, and byte strings in the data buffer.
+const (
+	KeyGenerate         KeyCommand = 1  // Generate a key into a slot and its shard into a partial slot
+	KeyUnwrap           KeyCommand = 2  // Unwrap a transport-wrapped key into a slot and partial slot
+	KeySeal             KeyCommand = 3  // Wrap a slot under the key-encryption key
+	KeyUnseal           KeyCommand = 4  // Unwrap a sealed slot under the key-encryption key
+	KeyTag              KeyCommand = 5  // Authenticate a digest under the key-encryption key
+	KeyCheckTag         KeyCommand = 6  // Verify a tag made by KeyTag
+	KeyTransport        KeyCommand = 7  // Return the public transport key, generating it on first use
+	KeyClearTransport   KeyCommand = 8  // Zeroize the transport keys
+	KeyAudit            KeyCommand = 9  // Return the public audit key, deriving it on first use
+	KeySignAudit        KeyCommand = 10 // Sign a digest with the audit key
+	KeyClearAudit       KeyCommand = 11 // Zeroize the audit key
+	KeyDeviceIdentity   KeyCommand = 12 // Return the public device identity key, deriving it on first use
+	KeyExtendIdentity   KeyCommand = 13 // Add a DICE layer for a measurement and return its alias key
+	KeySignIdentity     KeyCommand = 14 // Sign with the identity key of a DICE layer
+	KeyTruncateIdentity KeyCommand = 15 // Zeroize the DICE layers above a count
+	KeyExtend           KeyCommand = 16 // Extend a measurement register
+	KeyResetRegister    KeyCommand = 17 // Return a measurement register to zero
+	KeyReadRegisters    KeyCommand = 18 // Read every measurement register
+	KeyLoadRoot         KeyCommand = 19 // Load the device root key supplied by the host
+	KeySealRoot         KeyCommand = 20 // Wrap the device root key under the key-encryption key
+	KeyUnsealRoot       KeyCommand = 21 // Unwrap a device root key sealed with KeySealRoot
+	KeyClearRoot        KeyCommand = 22 // Zeroize the device root key
+	KeySealData         KeyCommand = 23 // Encrypt data under a key derived from the device root key
+	KeyUnsealData       KeyCommand = 24 // Decrypt data sealed with KeySealData
+	KeyCheckImage       KeyCommand = 25 // Check the tags of the image in FPGA memory with an image key
+)
+
+// Key engine registers, as offsets from the key command register
+const (
+	KeyStatusOffset = 0x04  // Status of the last command, one of the KeyStatus values
+	KeyArgsOffset   = 0x08  // Argument registers
+	KeyLengthOffset = 0x18  // Length of the data in the buffer, written by whoever filled it
+	KeyIDOffset     = 0x1C  // Read-only identification register, KeyEngineID when the key engine is present
+	KeyDataOffset   = 0x20  // Data buffer
+	KeyDataSize     = 0x3E0 // Size of the data buffer
+	KeyArgs         = 4     // Number of argument registers
+)
+
+// Key engine status values, written to the status register when the command register clears
+const (
+	KeyStatusOK       = 0 // The command completed and any result is in the data buffer
+	KeyStatusRejected = 1 // Input failed authentication, such as a sealed blob, tag or image
+	KeyStatusInvalid  = 2 // The command or its arguments are invalid, or a slot it uses is empty
+)
+
+// KeyEngineID is the value of the identification register of a key engine. Without a key engine the
+// register reads zero, as it does with the current RTL.
+const KeyEngineID = 0x4B454E47 // "KENG"
+
+// ErrKeyRejected is returned when the key engine refuses input that fails authentication
+var ErrKeyRejected = errors.New("key engine rejected the input")
+
+// KeyEnginePresent reports whether the identification register of the key engine at commandOffset reads
+// KeyEngineID
+func KeyEnginePresent(commandOffset uint32, mappedMem []byte) bool {
+	if commandOffset%4 != 0 || int(commandOffset)+KeyIDOffset+4 > len(mappedMem) {
+		return false
+	}
+	id := (*uint32)(unsafe.Pointer(&mappedMem[commandOffset+KeyIDOffset]))
+	return atomic.LoadUint32(id) == KeyEngineID
+}
+
+// ExecuteKeyCommand runs a key engine command with the key command register at commandOffset. Arguments
+// are written to the argument registers and input to the data buffer; the output the engine leaves in the
+// data buffer is returned. Like ExecuteDecryptedCode, it polls until the FPGA clears the command register.
+func ExecuteKeyCommand(command KeyCommand, args []uint32, input []byte, commandOffset uint32, mappedMem []byte) ([]byte, error) {
+	if commandOffset%4 != 0 || int(commandOffset)+KeyDataOffset+KeyDataSize > len(mappedMem) {
+		return nil, fmt.Errorf("key command register at offset 0x%x is outside mapped memory", commandOffset)
+	}
+	if len(args) > KeyArgs {
+		return nil, fmt.Errorf("key command %d has %d arguments, at most %d", command, len(args), KeyArgs)
+	}
+	if len(input) > KeyDataSize {
+		return nil, fmt.Errorf("key command %d input of %d bytes exceeds the data buffer", command, len(input))
+	}
+	registers := mappedMem[commandOffset:]
+
+	for i := 0; i < KeyArgs; i++ {
+		var arg uint32
+		if i < len(args) {
+			arg = args[i]
+		}
+		binary.LittleEndian.PutUint32(registers[KeyArgsOffset+4*i:], arg)
+	}
+	binary.LittleEndian.PutUint32(registers[KeyLengthOffset:], uint32(len(input)))
+	copy(registers[KeyDataOffset:], input)
+
+	status := (*uint32)(unsafe.Pointer(&registers[KeyStatusOffset]))
+	start := (*uint32)(unsafe.Pointer(&registers[0]))
+	atomic.StoreUint32(status, KeyStatusOK)
+	atomic.StoreUint32(start, uint32(command))
+
+	// Poll until the FPGA clears the command
+	for atomic.LoadUint32(start) != 0 {
+		runtime.Gosched()
+	}
+
+	// The data buffer may have held key material or the sealed form of it
+	defer clear(registers[KeyDataOffset : KeyDataOffset+KeyDataSize])
+	switch code := atomic.LoadUint32(status); code {
+	case KeyStatusOK:
+	case KeyStatusRejected:
+		return nil, fmt.Errorf("key command %d: %w", command, ErrKeyRejected)
+	default:
+		return nil, fmt.Errorf("key command %d failed with status %d", command, code)
+	}
+
+	length := binary.LittleEndian.Uint32(registers[KeyLengthOffset:])
+	if length > KeyDataSize {
+		return nil, fmt.Errorf("key command %d output of %d bytes exceeds the data buffer", command, length)
+	}
+	return append([]byte(nil), registers[KeyDataOffset:KeyDataOffset+length]...), nil
+}
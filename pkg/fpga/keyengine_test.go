@@ -0,0 +1,66 @@
+package fpga
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// simulateKeyEngine answers one key command by reversing the input and appending the first argument
+func simulateKeyEngine(mappedMem []byte, commandOffset uint32, status uint32) {
+	registers := mappedMem[commandOffset:]
+	command := (*uint32)(unsafe.Pointer(&registers[0]))
+	for atomic.LoadUint32(command) == 0 {
+		runtime.Gosched()
+	}
+
+	length := binary.LittleEndian.Uint32(registers[KeyLengthOffset:])
+	output := bytes.Clone(registers[KeyDataOffset : KeyDataOffset+length])
+	for i, j := 0, len(output)-1; i < j; i, j = i+1, j-1 {
+		output[i], output[j] = output[j], output[i]
+	}
+	output = append(output, registers[KeyArgsOffset])
+	binary.LittleEndian.PutUint32(registers[KeyLengthOffset:], uint32(len(output)))
+	copy(registers[KeyDataOffset:], output)
+
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&registers[KeyStatusOffset])), status)
+	atomic.StoreUint32(command, 0)
+}
+
+func TestExecuteKeyCommand(t *testing.T) {
+	mappedMem := make([]byte, 2048)
+	commandOffset := uint32(0x400)
+
+	go simulateKeyEngine(mappedMem, commandOffset, KeyStatusOK)
+	output, err := ExecuteKeyCommand(KeySeal, []uint32{7}, []byte{1, 2, 3}, commandOffset, mappedMem)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{3, 2, 1, 7}, output)
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(mappedMem[commandOffset:]))
+
+	// The data buffer is cleared once the output has been read
+	assert.Equal(t, make([]byte, KeyDataSize), mappedMem[commandOffset+KeyDataOffset:commandOffset+KeyDataOffset+KeyDataSize])
+
+	// Rejected input and other failures are reported
+	go simulateKeyEngine(mappedMem, commandOffset, KeyStatusRejected)
+	_, err = ExecuteKeyCommand(KeyUnseal, nil, []byte{1}, commandOffset, mappedMem)
+	assert.ErrorIs(t, err, ErrKeyRejected)
+	go simulateKeyEngine(mappedMem, commandOffset, KeyStatusInvalid)
+	_, err = ExecuteKeyCommand(KeyGenerate, nil, nil, commandOffset, mappedMem)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrKeyRejected)
+
+	// Commands must fit the registers and the data buffer
+	_, err = ExecuteKeyCommand(KeySeal, nil, make([]byte, KeyDataSize+1), commandOffset, mappedMem)
+	assert.Error(t, err)
+	_, err = ExecuteKeyCommand(KeySeal, make([]uint32, KeyArgs+1), nil, commandOffset, mappedMem)
+	assert.Error(t, err)
+	_, err = ExecuteKeyCommand(KeySeal, nil, nil, 0x700, mappedMem)
+	assert.Error(t, err)
+	_, err = ExecuteKeyCommand(KeySeal, nil, nil, 0x402, mappedMem)
+	assert.Error(t, err)
+}
@@ -0,0 +1,316 @@
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrInvalidKey is returned for malformed or inconsistent JSON Web Keys
+var ErrInvalidKey = errors.New("invalid JSON Web Key")
+
+// Key is a JSON Web Key (RFC 7517) for the RSA, EC, OKP and oct key types
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA (RFC 7518 section 6.3)
+	N  string `json:"n,omitempty"`
+	E  string `json:"e,omitempty"`
+	P  string `json:"p,omitempty"`
+	Q  string `json:"q,omitempty"`
+	Dp string `json:"dp,omitempty"`
+	Dq string `json:"dq,omitempty"`
+	Qi string `json:"qi,omitempty"`
+
+	// EC (RFC 7518 section 6.2) and OKP (RFC 8037)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	// Private exponent, scalar or seed
+	D string `json:"d,omitempty"`
+
+	// Symmetric key (RFC 7518 section 6.4)
+	K string `json:"k,omitempty"`
+}
+
+// Parse decodes a JSON Web Key
+func Parse(data []byte) (*Key, error) {
+	var key Key
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if key.Kty == "" {
+		return nil, fmt.Errorf("%w: missing kty", ErrInvalidKey)
+	}
+	return &key, nil
+}
+
+// PrivateKey returns the private key: an *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, or a
+// []byte for symmetric keys. The public members are checked against the private key.
+func (k *Key) PrivateKey() (crypto.PrivateKey, error) {
+	switch k.Kty {
+	case "RSA":
+		return k.rsaPrivateKey()
+	case "EC":
+		return k.ecdsaPrivateKey()
+	case "OKP":
+		return k.ed25519PrivateKey()
+	case "oct":
+		secret, err := decode("k", k.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%w: empty symmetric key", ErrInvalidKey)
+		}
+		return secret, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %q", ErrInvalidKey, k.Kty)
+	}
+}
+
+// rsaPrivateKey rebuilds an RSA key; the primes are required
+func (k *Key) rsaPrivateKey() (*rsa.PrivateKey, error) {
+	if k.D == "" {
+		return nil, fmt.Errorf("%w: not a private key", ErrInvalidKey)
+	}
+	if k.P == "" || k.Q == "" {
+		return nil, fmt.Errorf("%w: RSA key without prime factors", ErrInvalidKey)
+	}
+
+	values := make(map[string]*big.Int)
+	for name, encoded := range map[string]string{"n": k.N, "e": k.E, "d": k.D, "p": k.P, "q": k.Q} {
+		value, err := decodeInt(name, encoded)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	if !values["e"].IsInt64() || values["e"].Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("%w: RSA exponent out of range", ErrInvalidKey)
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: values["n"], E: int(values["e"].Int64())},
+		D:         values["d"],
+		Primes:    []*big.Int{values["p"], values["q"]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// ecdsaPrivateKey rebuilds an EC key and checks its public point
+func (k *Key) ecdsaPrivateKey() (*ecdsa.PrivateKey, error) {
+	curve, err := curveByName(k.Crv)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.Params().BitSize + 7) / 8
+
+	d, err := decode("d", k.D)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != size {
+		return nil, fmt.Errorf("%w: %s private key must be %d bytes", ErrInvalidKey, k.Crv, size)
+	}
+	x, err := decodeInt("x", k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeInt("y", k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = curve
+	if key.D.Sign() == 0 || key.D.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("%w: private scalar out of range", ErrInvalidKey)
+	}
+	key.X, key.Y = curve.ScalarBaseMult(d)
+	if key.X.Cmp(x) != 0 || key.Y.Cmp(y) != 0 {
+		return nil, fmt.Errorf("%w: public point does not match the private key", ErrInvalidKey)
+	}
+	return key, nil
+}
+
+// ed25519PrivateKey rebuilds an Ed25519 key from its seed and checks its public key
+func (k *Key) ed25519PrivateKey() (ed25519.PrivateKey, error) {
+	if k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("%w: unsupported OKP curve %q", ErrInvalidKey, k.Crv)
+	}
+	seed, err := decode("d", k.D)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: Ed25519 private key must be %d bytes", ErrInvalidKey, ed25519.SeedSize)
+	}
+	x, err := decode("x", k.X)
+	if err != nil {
+		return nil, err
+	}
+
+	key := ed25519.NewKeyFromSeed(seed)
+	if subtle.ConstantTimeCompare(key.Public().(ed25519.PublicKey), x) != 1 {
+		return nil, fmt.Errorf("%w: public key does not match the private key", ErrInvalidKey)
+	}
+	return key, nil
+}
+
+// curveByName returns the NIST curve for a JWK curve name
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported EC curve %q", ErrInvalidKey, name)
+	}
+}
+
+// decode decodes a required base64url member
+func decode(name, encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("%w: missing %q", ErrInvalidKey, name)
+	}
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %q: %v", ErrInvalidKey, name, err)
+	}
+	return value, nil
+}
+
+// decodeInt decodes a required base64url big-endian integer member
+func decodeInt(name, encoded string) (*big.Int, error) {
+	value, err := decode(name, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(value), nil
+}
+
+// Set is a JSON Web Key Set (RFC 7517 section 5)
+type Set struct {
+	Keys []*Key `json:"keys"`
+}
+
+// FromPublicKey returns the JWK of an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func FromPublicKey(public crypto.PublicKey) (*Key, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return &Key{
+			Kty: "RSA",
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return &Key{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   b64(pub.X.FillBytes(make([]byte, size))),
+			Y:   b64(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return &Key{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   b64(pub),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported public key type %T", ErrInvalidKey, public)
+	}
+}
+
+// Thumbprint returns the RFC 7638 SHA-256 thumbprint of the key, base64url encoded. It only covers the
+// required public members, so it is the same for a private key and its public key.
+func (k *Key) Thumbprint() (string, error) {
+	// The members are in lexicographic order with no whitespace, as RFC 7638 requires
+	var canonical string
+	switch k.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, k.Crv, k.X)
+	case "oct":
+		canonical = fmt.Sprintf(`{"k":%q,"kty":"oct"}`, k.K)
+	default:
+		return "", fmt.Errorf("%w: unsupported key type %q", ErrInvalidKey, k.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// PublicKey returns the public key of an RSA, EC or OKP key
+func (k *Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("%w: RSA exponent out of range", ErrInvalidKey)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, err := curveByName(k.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeInt("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("%w: point is not on %s", ErrInvalidKey, k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w: unsupported OKP curve %q", ErrInvalidKey, k.Crv)
+		}
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: Ed25519 public key must be %d bytes", ErrInvalidKey, ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("%w: key type %q has no public key", ErrInvalidKey, k.Kty)
+	}
+}
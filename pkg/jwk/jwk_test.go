@@ -0,0 +1,127 @@
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePrivateKeys(t *testing.T) {
+	// Ed25519 key from RFC 8037 appendix A.1
+	key, err := Parse([]byte(`{"kty":"OKP","crv":"Ed25519",
+		"d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A",
+		"x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`))
+	assert.NoError(t, err)
+	private, err := key.PrivateKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+		hex.EncodeToString(private.(ed25519.PrivateKey).Seed()))
+
+	// EC key from RFC 7517 appendix A.2
+	key, err = Parse([]byte(`{"kty":"EC","crv":"P-256",
+		"x":"MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4",
+		"y":"4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM",
+		"d":"870MB6gfuTJ4HtUnUvYMyJpr5eUZNP4Bk43bVdj3eAE"}`))
+	assert.NoError(t, err)
+	private, err = key.PrivateKey()
+	assert.NoError(t, err)
+	assert.IsType(t, &ecdsa.PrivateKey{}, private)
+
+	// Symmetric key from RFC 7517 appendix A.3
+	key, err = Parse([]byte(`{"kty":"oct","alg":"A128KW","k":"GawgguFyGrWKav7AX4VKUg"}`))
+	assert.NoError(t, err)
+	private, err = key.PrivateKey()
+	assert.NoError(t, err)
+	assert.Len(t, private, 16)
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	// RSA key from RFC 7517 appendix A.2, without the CRT parameters
+	key, err := Parse([]byte(`{"kty":"RSA",
+		"n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		"e":"AQAB",
+		"d":"X4cTteJY_gn4FYPsXB8rdXix5vwsg1FLN5E3EaG6RJoVH-HLLKD9M7dx5oo7GURknchnrRweUkC7hT5fJLM0WbFAKNLWY2vv7B6NqXSzUvxT0_YSfqijwp3RTzlBaCxWp4doFk5N2o8Gy_nHNKroADIkJ46pRUohsXywbReAdYaMwFs9tv8d_cPVY3i07a3t8MN6TNwm0dSawm9v47UiCl3Sk5ZiG7xojPLu4sbg1U2jx4IBTNBznbJSzFHK66jT8bgkuqsk0GjskDJk19Z4qwjwbsnn4j2WBii3RL-Us2lGVkY8fkFzme1z0HbIkfz0Y6mqnOYtqc0X4jfcKoAC8Q",
+		"p":"83i-7IvMGXoMXCskv73TKr8637FiO7Z27zv8oj6pbWUQyLPQBQxtPVnwD20R-60eTDmD2ujnMt5PoqMrm8RfmNhVWDtjjMmCMjOpSXicFHj7XOuVIYQyqVWlWEh6dN36GVZYk93N8Bc9vY41xy8B9RzzOGVQzXvNEvn7O0nVbfs",
+		"q":"3dfOR9cuYq-0S-mkFLzgItgMEfFzB2q3hWehMuG0oCuqnb3vobLyumqjVZQO1dIrdwgTnCdpYzBcOfW5r370AFXjiWft_NGEiovonizhKpo9VVS78TzFgxkIdrecRezsZ-1kYd_s1qDbxtkDEgfAITAG9LUnADun4vIcb6yelxk"}`))
+	assert.NoError(t, err)
+	private, err := key.PrivateKey()
+	assert.NoError(t, err)
+	assert.Equal(t, 2048, private.(*rsa.PrivateKey).N.BitLen())
+
+	// The primes are required
+	key.P = ""
+	_, err = key.PrivateKey()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestParseInvalidKeys(t *testing.T) {
+	invalid := []string{
+		`not json`,
+		`{"k":"GawgguFyGrWKav7AX4VKUg"}`,
+		`{"kty":"unknown"}`,
+		// Public key only
+		`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+		// Mismatched public key
+		`{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`,
+		`{"kty":"EC","crv":"P-256","x":"MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4","y":"AAAA","d":"870MB6gfuTJ4HtUnUvYMyJpr5eUZNP4Bk43bVdj3eAE"}`,
+		`{"kty":"EC","crv":"secp256k1","x":"AA","y":"AA","d":"AA"}`,
+	}
+	for _, data := range invalid {
+		key, err := Parse([]byte(data))
+		if err == nil {
+			_, err = key.PrivateKey()
+		}
+		assert.ErrorIs(t, err, ErrInvalidKey, "Key %s should be rejected", data)
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// Example from RFC 7638 section 3.1
+	key := &Key{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+		Alg: "RS256",
+		Kid: "2011-04-29",
+	}
+	thumbprint, err := key.Thumbprint()
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+
+	// Example from RFC 8037 appendix A.3
+	key = &Key{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	thumbprint, err = key.Thumbprint()
+	assert.NoError(t, err)
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", thumbprint)
+}
+
+func TestPublicKeyRoundTrip(t *testing.T) {
+	private, err := Parse([]byte(`{"kty":"EC","crv":"P-256",
+		"x":"MKBCTNIcKUSDii11ySs3526iDZ8AiTo7Tu6KPAqv7D4",
+		"y":"4Etl6SRW2YiLUrN5vfvVHuhp7x8PxltmWWlbbM4IFyM",
+		"d":"870MB6gfuTJ4HtUnUvYMyJpr5eUZNP4Bk43bVdj3eAE"}`))
+	assert.NoError(t, err)
+	key, err := private.PrivateKey()
+	assert.NoError(t, err)
+
+	public, err := FromPublicKey(key.(*ecdsa.PrivateKey).Public())
+	assert.NoError(t, err)
+	assert.Equal(t, private.X, public.X)
+	assert.Equal(t, private.Y, public.Y)
+	assert.Empty(t, public.D)
+
+	parsed, err := public.PublicKey()
+	assert.NoError(t, err)
+	assert.True(t, key.(*ecdsa.PrivateKey).PublicKey.Equal(parsed))
+
+	// Private and public keys share a thumbprint
+	privateThumbprint, err := private.Thumbprint()
+	assert.NoError(t, err)
+	publicThumbprint, err := public.Thumbprint()
+	assert.NoError(t, err)
+	assert.Equal(t, privateThumbprint, publicThumbprint)
+}
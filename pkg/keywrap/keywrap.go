@@ -0,0 +1,162 @@
+package keywrap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrUnwrap is returned when wrapped key data fails its integrity check, either because it was
+// corrupted or because it was wrapped under a different key-encryption key
+var ErrUnwrap = errors.New("key unwrap integrity check failed")
+
+// defaultIV is the RFC 3394 initial value
+var defaultIV = [8]byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// paddingIVPrefix is the constant half of the RFC 5649 alternative initial value
+var paddingIVPrefix = [4]byte{0xA6, 0x59, 0x59, 0xA6}
+
+// Wrap wraps key data with AES-KW (RFC 3394). The key data must be a multiple of 8 bytes and at least 16 bytes.
+func Wrap(kek, plaintext []byte) ([]byte, error) {
+	if len(plaintext) < 16 || len(plaintext)%8 != 0 {
+		return nil, fmt.Errorf("AES-KW key data must be a multiple of 8 bytes and at least 16 bytes, got %d", len(plaintext))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key-encryption key: %v", err)
+	}
+	return wrap(block, defaultIV, plaintext), nil
+}
+
+// Unwrap unwraps key data wrapped with AES-KW (RFC 3394)
+func Unwrap(kek, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 24 || len(ciphertext)%8 != 0 {
+		return nil, fmt.Errorf("%w: invalid wrapped key length %d", ErrUnwrap, len(ciphertext))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key-encryption key: %v", err)
+	}
+
+	iv, plaintext := unwrap(block, ciphertext)
+	if subtle.ConstantTimeCompare(iv[:], defaultIV[:]) != 1 {
+		return nil, ErrUnwrap
+	}
+	return plaintext, nil
+}
+
+// WrapPad wraps key data of any non-zero length with AES-KWP (RFC 5649)
+func WrapPad(kek, plaintext []byte) ([]byte, error) {
+	if len(plaintext) == 0 || uint64(len(plaintext)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("invalid AES-KWP key data length %d", len(plaintext))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key-encryption key: %v", err)
+	}
+
+	var iv [8]byte
+	copy(iv[:4], paddingIVPrefix[:])
+	binary.BigEndian.PutUint32(iv[4:], uint32(len(plaintext)))
+
+	padded := make([]byte, (len(plaintext)+7)/8*8)
+	copy(padded, plaintext)
+
+	// A single padded block is encrypted directly with the initial value
+	if len(padded) == 8 {
+		out := make([]byte, 16)
+		copy(out, iv[:])
+		copy(out[8:], padded)
+		block.Encrypt(out, out)
+		return out, nil
+	}
+	return wrap(block, iv, padded), nil
+}
+
+// UnwrapPad unwraps key data wrapped with AES-KWP (RFC 5649)
+func UnwrapPad(kek, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 16 || len(ciphertext)%8 != 0 {
+		return nil, fmt.Errorf("%w: invalid wrapped key length %d", ErrUnwrap, len(ciphertext))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key-encryption key: %v", err)
+	}
+
+	var iv [8]byte
+	var padded []byte
+	if len(ciphertext) == 16 {
+		out := make([]byte, 16)
+		block.Decrypt(out, ciphertext)
+		copy(iv[:], out[:8])
+		padded = out[8:]
+	} else {
+		iv, padded = unwrap(block, ciphertext)
+	}
+
+	// Check the initial value, the message length and that the padding is zero
+	valid := subtle.ConstantTimeCompare(iv[:4], paddingIVPrefix[:])
+	length := int(binary.BigEndian.Uint32(iv[4:]))
+	if length <= len(padded)-8 || length > len(padded) {
+		valid = 0
+		length = len(padded)
+	}
+	var padding byte
+	for _, b := range padded[length:] {
+		padding |= b
+	}
+	valid &= subtle.ConstantTimeByteEq(padding, 0)
+	if valid != 1 {
+		return nil, ErrUnwrap
+	}
+	return padded[:length], nil
+}
+
+// wrap runs the RFC 3394 wrapping process over 64-bit blocks
+func wrap(block cipher.Block, iv [8]byte, plaintext []byte) []byte {
+	n := len(plaintext) / 8
+	out := make([]byte, 8+len(plaintext))
+	copy(out[8:], plaintext)
+
+	a := iv
+	var buf [16]byte
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], a[:])
+			copy(buf[8:], out[i*8:i*8+8])
+			block.Encrypt(buf[:], buf[:])
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a[:], binary.BigEndian.Uint64(buf[:8])^t)
+			copy(out[i*8:], buf[8:])
+		}
+	}
+	copy(out, a[:])
+	return out
+}
+
+// unwrap runs the RFC 3394 unwrapping process and returns the recovered initial value and key data
+func unwrap(block cipher.Block, ciphertext []byte) ([8]byte, []byte) {
+	n := len(ciphertext)/8 - 1
+	out := make([]byte, n*8)
+	copy(out, ciphertext[8:])
+
+	var a [8]byte
+	copy(a[:], ciphertext[:8])
+	var buf [16]byte
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a[:])^t)
+			copy(buf[8:], out[(i-1)*8:i*8])
+			block.Decrypt(buf[:], buf[:])
+
+			copy(a[:], buf[:8])
+			copy(out[(i-1)*8:], buf[8:])
+		}
+	}
+	return a, out
+}
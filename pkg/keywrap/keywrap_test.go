@@ -0,0 +1,111 @@
+package keywrap
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestWrapVectors(t *testing.T) {
+	// Test vectors from RFC 3394 section 4
+	vectors := []struct {
+		kek, plaintext, ciphertext string
+	}{
+		{
+			"000102030405060708090A0B0C0D0E0F",
+			"00112233445566778899AABBCCDDEEFF",
+			"1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F1011121314151617",
+			"00112233445566778899AABBCCDDEEFF0001020304050607",
+			"031D33264E15D33268F24EC260743EDCE1C6C7DDEE725A936BA814915C6762D2",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			"28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+
+	for _, v := range vectors {
+		wrapped, err := Wrap(mustHex(v.kek), mustHex(v.plaintext))
+		assert.NoError(t, err)
+		assert.Equal(t, mustHex(v.ciphertext), wrapped)
+
+		unwrapped, err := Unwrap(mustHex(v.kek), wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, mustHex(v.plaintext), unwrapped)
+	}
+}
+
+func TestWrapPadVectors(t *testing.T) {
+	// Test vectors from RFC 5649 section 6
+	kek := mustHex("5840DF6E29B02AF1AB493B705BF16EA1AE8338F4DCC176A8")
+	vectors := []struct {
+		plaintext, ciphertext string
+	}{
+		{
+			"C37B7E6492584340BED12207808941155068F738",
+			"138BDEAA9B8FA7FC61F97742E72248EE5AE6AE5360D1AE6A5F54F373FA543B6A",
+		},
+		{
+			"466F7250617369",
+			"AFBEB0F07DFBF5419200F2CCB50BB24F",
+		},
+	}
+
+	for _, v := range vectors {
+		wrapped, err := WrapPad(kek, mustHex(v.plaintext))
+		assert.NoError(t, err)
+		assert.Equal(t, mustHex(v.ciphertext), wrapped)
+
+		unwrapped, err := UnwrapPad(kek, wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, mustHex(v.plaintext), unwrapped)
+	}
+}
+
+func TestUnwrapIntegrity(t *testing.T) {
+	kek := mustHex("000102030405060708090A0B0C0D0E0F")
+	otherKEK := mustHex("0F0E0D0C0B0A09080706050403020100")
+
+	wrapped, err := Wrap(kek, mustHex("00112233445566778899AABBCCDDEEFF"))
+	assert.NoError(t, err)
+	_, err = Unwrap(otherKEK, wrapped)
+	assert.ErrorIs(t, err, ErrUnwrap)
+
+	// Every length from a single block upwards round-trips and detects tampering
+	for length := 1; length <= 40; length++ {
+		plaintext := make([]byte, length)
+		for i := range plaintext {
+			plaintext[i] = byte(i + 1)
+		}
+		wrapped, err := WrapPad(kek, plaintext)
+		assert.NoError(t, err)
+
+		unwrapped, err := UnwrapPad(kek, wrapped)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, unwrapped)
+
+		wrapped[len(wrapped)-1] ^= 1
+		_, err = UnwrapPad(kek, wrapped)
+		assert.ErrorIs(t, err, ErrUnwrap, "Tampered data of length %d should be rejected", length)
+		_, err = UnwrapPad(otherKEK, wrapped)
+		assert.ErrorIs(t, err, ErrUnwrap)
+	}
+
+	_, err = Wrap(kek, []byte("short"))
+	assert.Error(t, err)
+	_, err = WrapPad(kek, nil)
+	assert.Error(t, err)
+}
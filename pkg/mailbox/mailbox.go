@@ -0,0 +1,282 @@
+// Package mailbox implements the ecall/ocall ABI between the host and a program running on the
+// rocket_chip_enclave, over a mailbox in shared FPGA memory.
+//
+// The host makes an ecall by writing the call number and arguments into the mailbox buffer and ringing
+// the doorbell. While serving it, the program can make ocalls back to handlers registered on the host.
+// The mailbox is half-duplex: one frame occupies the buffer at a time. The layout is mirrored for enclave
+// programs in secure-enclave-hello-world/mailbox.h.
+package mailbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Offsets of the 32-bit little-endian mailbox fields, followed by the buffer at HeaderSize
+const (
+	StateOffset    = 0  // Doorbell, one of the State values
+	SequenceOffset = 4  // Sequence number of the ecall, echoed in its response
+	NumberOffset   = 8  // Ecall or ocall number
+	StatusOffset   = 12 // Return code of a response
+	LengthOffset   = 16 // Length of the frame in the buffer
+	CapacityOffset = 20 // Size of the buffer, written by the host
+	HeaderSize     = 32 // Size of the mailbox header; the rest is reserved
+)
+
+// Mailbox states. Each is written only after the frame it announces, by the side named.
+const (
+	StateIdle        = 0 // No call in progress
+	StateEcall       = 1 // Host: an ecall request is in the buffer
+	StateOcall       = 2 // Enclave: an ocall request is in the buffer
+	StateOcallReturn = 3 // Host: the ocall response is in the buffer
+	StateEcallReturn = 4 // Enclave: the ecall response is in the buffer
+)
+
+// Reserved call numbers. Programs number their own ecalls and ocalls from FirstUserCall.
+const (
+	EcallExit     = 0 // Asks the program to leave its ecall loop and return from main
+	OcallPrint    = 1 // Writes the buffer to the host console
+	FirstUserCall = 16
+)
+
+// Return codes. Programs may return their own codes from FirstUserStatus.
+const (
+	StatusOK              = 0
+	StatusUnknownCall     = 1 // No ecall or ocall has the number
+	StatusInvalidArgument = 2 // The arguments were malformed
+	StatusBufferTooSmall  = 3 // The response did not fit in the buffer
+	StatusFailed          = 4 // The call failed
+	FirstUserStatus       = 16
+)
+
+var (
+	// ErrCallFailed is returned when an ecall or ocall completes with a status other than StatusOK
+	ErrCallFailed = errors.New("call failed")
+
+	// ErrUnknownCall is the reason for calls to numbers with no ecall or ocall
+	ErrUnknownCall = errors.New("unknown call")
+
+	// ErrInvalidArgument is the reason for calls with malformed arguments
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrBufferTooSmall is returned when a request or response does not fit in the mailbox buffer
+	ErrBufferTooSmall = errors.New("mailbox buffer too small")
+
+	// ErrProtocol is returned when the enclave leaves the mailbox in an unexpected state
+	ErrProtocol = errors.New("mailbox protocol error")
+)
+
+// CallError reports the return code of a failed call. It matches ErrCallFailed, and the reason for the
+// reserved return codes, with errors.Is.
+type CallError struct {
+	Number uint32
+	Status uint32
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%v: call %d returned status %d", ErrCallFailed, e.Number, e.Status)
+}
+
+// Unwrap returns ErrCallFailed and the reason for the return code, if it is reserved
+func (e *CallError) Unwrap() []error {
+	switch e.Status {
+	case StatusUnknownCall:
+		return []error{ErrCallFailed, ErrUnknownCall}
+	case StatusInvalidArgument:
+		return []error{ErrCallFailed, ErrInvalidArgument}
+	case StatusBufferTooSmall:
+		return []error{ErrCallFailed, ErrBufferTooSmall}
+	default:
+		return []error{ErrCallFailed}
+	}
+}
+
+// OcallHandler serves an ocall, returning its response. Errors are returned to the enclave as their
+// return code: the Status of a CallError, StatusUnknownCall, StatusInvalidArgument or StatusFailed.
+// Handlers must not make ecalls.
+type OcallHandler func(args []byte) ([]byte, error)
+
+// Mailbox is the host side of a mailbox in mapped FPGA memory
+type Mailbox struct {
+	mem      []byte
+	capacity uint32
+
+	mu       sync.Mutex
+	sequence uint32
+	handlers map[uint32]OcallHandler
+}
+
+// New returns the host side of the mailbox of size bytes at offset in mappedMem, and resets it
+func New(mappedMem []byte, offset, size uint32) (*Mailbox, error) {
+	if offset%4 != 0 || size <= HeaderSize || uint64(offset)+uint64(size) > uint64(len(mappedMem)) {
+		return nil, fmt.Errorf("mailbox of %d bytes at offset 0x%x is outside mapped memory", size, offset)
+	}
+	m := &Mailbox{
+		mem:      mappedMem[offset : offset+size],
+		capacity: size - HeaderSize,
+		handlers: make(map[uint32]OcallHandler),
+	}
+	clear(m.mem[:HeaderSize])
+	binary.LittleEndian.PutUint32(m.mem[CapacityOffset:], m.capacity)
+	atomic.StoreUint32(m.state(), StateIdle)
+	return m, nil
+}
+
+// Capacity returns the size of the buffer: the largest request or response
+func (m *Mailbox) Capacity() int {
+	return int(m.capacity)
+}
+
+// Handle registers the handler of an ocall, replacing any handler registered before
+func (m *Mailbox) Handle(number uint32, handler OcallHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if handler == nil {
+		delete(m.handlers, number)
+		return
+	}
+	m.handlers[number] = handler
+}
+
+// Call makes an ecall with args and returns its response, serving any ocalls the enclave makes meanwhile.
+// Ecalls that do not return StatusOK fail with a CallError. If ctx is done before the enclave responds,
+// Call returns its error and the mailbox must be reset with New before it is used again.
+func (m *Mailbox) Call(ctx context.Context, number uint32, args []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(args) > int(m.capacity) {
+		return nil, fmt.Errorf("%w: %d byte arguments, %d byte buffer", ErrBufferTooSmall, len(args), m.capacity)
+	}
+	if state := atomic.LoadUint32(m.state()); state != StateIdle {
+		return nil, fmt.Errorf("%w: mailbox is busy in state %d", ErrProtocol, state)
+	}
+
+	m.sequence++
+	m.writeFrame(number, StatusOK, args)
+	binary.LittleEndian.PutUint32(m.mem[SequenceOffset:], m.sequence)
+	atomic.StoreUint32(m.state(), StateEcall)
+
+	for {
+		state, err := m.await(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch state {
+		case StateOcall:
+			m.serveOcall()
+		case StateEcallReturn:
+			return m.finish(number)
+		default:
+			return nil, fmt.Errorf("%w: unexpected state %d", ErrProtocol, state)
+		}
+	}
+}
+
+// Exit asks the program to leave its ecall loop
+func (m *Mailbox) Exit(ctx context.Context) error {
+	_, err := m.Call(ctx, EcallExit, nil)
+	return err
+}
+
+// await polls the doorbell until the enclave answers the request or ocall response written by the host
+func (m *Mailbox) await(ctx context.Context) (uint32, error) {
+	for {
+		state := atomic.LoadUint32(m.state())
+		if state != StateEcall && state != StateOcallReturn {
+			return state, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+// serveOcall runs the handler of the ocall in the buffer and writes its response
+func (m *Mailbox) serveOcall() {
+	number, _, args := m.readFrame()
+	var response []byte
+	var status uint32 = StatusInvalidArgument
+	if args != nil {
+		response, status = m.dispatch(number, args)
+	}
+	if len(response) > int(m.capacity) {
+		response, status = nil, StatusBufferTooSmall
+	}
+	m.writeFrame(number, status, response)
+	atomic.StoreUint32(m.state(), StateOcallReturn)
+}
+
+// dispatch runs the handler of an ocall, returning its response and return code
+func (m *Mailbox) dispatch(number uint32, args []byte) ([]byte, uint32) {
+	handler, ok := m.handlers[number]
+	if !ok {
+		return nil, StatusUnknownCall
+	}
+	response, err := handler(args)
+	var callErr *CallError
+	switch {
+	case err == nil:
+		return response, StatusOK
+	case errors.As(err, &callErr):
+		return nil, callErr.Status
+	case errors.Is(err, ErrUnknownCall):
+		return nil, StatusUnknownCall
+	case errors.Is(err, ErrInvalidArgument):
+		return nil, StatusInvalidArgument
+	default:
+		return nil, StatusFailed
+	}
+}
+
+// finish reads the response to an ecall and returns the mailbox to idle
+func (m *Mailbox) finish(number uint32) ([]byte, error) {
+	defer atomic.StoreUint32(m.state(), StateIdle)
+
+	if sequence := binary.LittleEndian.Uint32(m.mem[SequenceOffset:]); sequence != m.sequence {
+		return nil, fmt.Errorf("%w: response to ecall %d, not %d", ErrProtocol, sequence, m.sequence)
+	}
+	_, status, response := m.readFrame()
+	if response == nil {
+		return nil, fmt.Errorf("%w: response length exceeds the buffer", ErrProtocol)
+	}
+	if status != StatusOK {
+		return nil, &CallError{Number: number, Status: status}
+	}
+	return response, nil
+}
+
+// writeFrame writes a call number, return code and payload into the mailbox
+func (m *Mailbox) writeFrame(number, status uint32, payload []byte) {
+	binary.LittleEndian.PutUint32(m.mem[NumberOffset:], number)
+	binary.LittleEndian.PutUint32(m.mem[StatusOffset:], status)
+	binary.LittleEndian.PutUint32(m.mem[LengthOffset:], uint32(len(payload)))
+	copy(m.mem[HeaderSize:], payload)
+}
+
+// readFrame reads the call number, return code and a copy of the payload from the mailbox. The payload
+// is nil if its length exceeds the buffer.
+func (m *Mailbox) readFrame() (number, status uint32, payload []byte) {
+	number = binary.LittleEndian.Uint32(m.mem[NumberOffset:])
+	status = binary.LittleEndian.Uint32(m.mem[StatusOffset:])
+	length := binary.LittleEndian.Uint32(m.mem[LengthOffset:])
+	if length > m.capacity {
+		return number, status, nil
+	}
+	return number, status, append([]byte{}, m.mem[HeaderSize:HeaderSize+length]...)
+}
+
+// state returns the doorbell
+func (m *Mailbox) state() *uint32 {
+	return (*uint32)(unsafe.Pointer(&m.mem[StateOffset]))
+}
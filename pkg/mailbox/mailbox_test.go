@@ -0,0 +1,184 @@
+package mailbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	ecallHello = FirstUserCall     // Greets its arguments, printing the greeting with an ocall
+	ecallEcho  = FirstUserCall + 1 // Returns its arguments
+	ocallName  = FirstUserCall     // Returns a name to greet
+)
+
+// simulatedEnclave serves ecalls on the mailbox at mem the way mailbox_serve does in mailbox.h
+type simulatedEnclave struct {
+	mem []byte
+}
+
+func (e *simulatedEnclave) state() *uint32 {
+	return (*uint32)(unsafe.Pointer(&e.mem[StateOffset]))
+}
+
+func (e *simulatedEnclave) wait(state uint32) {
+	for atomic.LoadUint32(e.state()) != state {
+		runtime.Gosched()
+	}
+}
+
+func (e *simulatedEnclave) post(state, number, status uint32, payload []byte) {
+	binary.LittleEndian.PutUint32(e.mem[NumberOffset:], number)
+	binary.LittleEndian.PutUint32(e.mem[StatusOffset:], status)
+	binary.LittleEndian.PutUint32(e.mem[LengthOffset:], uint32(len(payload)))
+	copy(e.mem[HeaderSize:], payload)
+	atomic.StoreUint32(e.state(), state)
+}
+
+func (e *simulatedEnclave) frame() (number, status uint32, payload []byte) {
+	length := binary.LittleEndian.Uint32(e.mem[LengthOffset:])
+	return binary.LittleEndian.Uint32(e.mem[NumberOffset:]), binary.LittleEndian.Uint32(e.mem[StatusOffset:]),
+		append([]byte{}, e.mem[HeaderSize:HeaderSize+length]...)
+}
+
+func (e *simulatedEnclave) ocall(number uint32, args []byte) (uint32, []byte) {
+	e.post(StateOcall, number, StatusOK, args)
+	e.wait(StateOcallReturn)
+	_, status, response := e.frame()
+	return status, response
+}
+
+func (e *simulatedEnclave) serve(done chan<- struct{}) {
+	defer close(done)
+	for {
+		e.wait(StateEcall)
+		number, _, args := e.frame()
+		var status uint32
+		var response []byte
+		switch number {
+		case EcallExit:
+			e.post(StateEcallReturn, number, StatusOK, nil)
+			return
+		case ecallHello:
+			if len(args) == 0 {
+				if status, args = e.ocall(ocallName, nil); status != StatusOK {
+					break
+				}
+			}
+			response = append([]byte("Hello, "), args...)
+			status, _ = e.ocall(OcallPrint, response)
+		case ecallEcho:
+			response = args
+		default:
+			status = StatusUnknownCall
+		}
+		e.post(StateEcallReturn, number, status, response)
+	}
+}
+
+// startEnclave returns a mailbox served by a simulated enclave, which stops on EcallExit
+func startEnclave(t *testing.T, size uint32) (*Mailbox, <-chan struct{}) {
+	mappedMem := make([]byte, 0x1000)
+	mailbox, err := New(mappedMem, 0x100, size)
+	assert.NoError(t, err)
+	assert.Equal(t, int(size-HeaderSize), mailbox.Capacity())
+	assert.Equal(t, size-HeaderSize, binary.LittleEndian.Uint32(mappedMem[0x100+CapacityOffset:]))
+
+	enclave := &simulatedEnclave{mem: mappedMem[0x100 : 0x100+size]}
+	done := make(chan struct{})
+	go enclave.serve(done)
+	return mailbox, done
+}
+
+func TestCall(t *testing.T) {
+	mailbox, done := startEnclave(t, 0x200)
+	ctx := context.Background()
+	var printed []string
+	mailbox.Handle(OcallPrint, func(args []byte) ([]byte, error) {
+		printed = append(printed, string(args))
+		return nil, nil
+	})
+
+	response, err := mailbox.Call(ctx, ecallEcho, []byte("ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ping"), response)
+	response, err = mailbox.Call(ctx, ecallEcho, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, response)
+
+	// Ocalls are served by their handlers while the ecall runs
+	response, err = mailbox.Call(ctx, ecallHello, []byte("Alice"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, Alice", string(response))
+	mailbox.Handle(ocallName, func([]byte) ([]byte, error) { return []byte("Secure Enclave"), nil })
+	response, err = mailbox.Call(ctx, ecallHello, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, Secure Enclave", string(response))
+	assert.Equal(t, []string{"Hello, Alice", "Hello, Secure Enclave"}, printed)
+
+	assert.NoError(t, mailbox.Exit(ctx))
+	<-done
+}
+
+func TestCallErrors(t *testing.T) {
+	mailbox, done := startEnclave(t, 0x40)
+	ctx := context.Background()
+
+	// Return codes are reported as call errors
+	_, err := mailbox.Call(ctx, FirstUserCall+9, nil)
+	assert.ErrorIs(t, err, ErrCallFailed)
+	assert.ErrorIs(t, err, ErrUnknownCall)
+	var callErr *CallError
+	assert.True(t, errors.As(err, &callErr))
+	assert.Equal(t, &CallError{Number: FirstUserCall + 9, Status: StatusUnknownCall}, callErr)
+
+	// Ocall errors are returned to the enclave as return codes
+	_, err = mailbox.Call(ctx, ecallHello, nil)
+	assert.ErrorIs(t, err, ErrUnknownCall)
+	mailbox.Handle(ocallName, func([]byte) ([]byte, error) { return nil, errors.New("no name") })
+	_, err = mailbox.Call(ctx, ecallHello, nil)
+	assert.Equal(t, &CallError{Number: ecallHello, Status: StatusFailed}, err)
+	mailbox.Handle(ocallName, func([]byte) ([]byte, error) { return nil, &CallError{Status: FirstUserStatus} })
+	_, err = mailbox.Call(ctx, ecallHello, nil)
+	assert.Equal(t, &CallError{Number: ecallHello, Status: FirstUserStatus}, err)
+	mailbox.Handle(ocallName, func([]byte) ([]byte, error) { return make([]byte, 0x40), nil })
+	_, err = mailbox.Call(ctx, ecallHello, nil)
+	assert.ErrorIs(t, err, ErrBufferTooSmall)
+	mailbox.Handle(ocallName, nil)
+	_, err = mailbox.Call(ctx, ecallHello, nil)
+	assert.ErrorIs(t, err, ErrUnknownCall)
+
+	// Arguments must fit in the buffer
+	_, err = mailbox.Call(ctx, ecallEcho, make([]byte, mailbox.Capacity()+1))
+	assert.ErrorIs(t, err, ErrBufferTooSmall)
+	_, err = mailbox.Call(ctx, ecallEcho, make([]byte, mailbox.Capacity()))
+	assert.NoError(t, err)
+
+	assert.NoError(t, mailbox.Exit(ctx))
+	<-done
+
+	// Calls give up when their context is done
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = mailbox.Call(ctx, ecallEcho, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = mailbox.Call(context.Background(), ecallEcho, nil)
+	assert.ErrorIs(t, err, ErrProtocol)
+}
+
+func TestNew(t *testing.T) {
+	mappedMem := make([]byte, 0x100)
+	_, err := New(mappedMem, 0x80, 0x100)
+	assert.Error(t, err)
+	_, err = New(mappedMem, 0x82, 0x40)
+	assert.Error(t, err)
+	_, err = New(mappedMem, 0, HeaderSize)
+	assert.Error(t, err)
+}
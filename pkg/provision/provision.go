@@ -0,0 +1,243 @@
+// Package provision delivers keys from a provisioning server to boards without the keys appearing in the
+// clear on the host. The board publishes its enclave transport key with a statement, signed by its device
+// identity for a server nonce, that the key is held in the enclave. The server checks the statement, wraps
+// the requested key to the transport key, and the enclave unwraps it directly into a hardware key slot.
+package provision
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/attest"
+	"github.com/jeremyhahn/fpga-secure-enclave/pkg/enclave"
+)
+
+const (
+	maxRequestSize = 64 << 10    // Bounds transport key and wrapped key documents
+	nonceSize      = 32          // Size of the nonces the server issues
+	nonceLifetime  = time.Minute // How long an issued nonce can be used for
+)
+
+var (
+	// ErrKeyNotFound is returned when the server has no key of the requested name
+	ErrKeyNotFound = errors.New("provisioning key not found")
+
+	// ErrTransportKeyNotAttested is returned when a transport key is not shown to be held in a trusted enclave
+	ErrTransportKeyNotAttested = errors.New("transport key not attested")
+)
+
+// Nonce is the response to POST /nonces
+type Nonce struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// Request is the body of POST /keys/{name}: the transport key to wrap to and the statement, for a nonce
+// issued by the server, that the enclave holds it
+type Request struct {
+	TransportKey *enclave.TransportKey `json:"transport_key"`
+	Statement    *attest.KeyStatement  `json:"statement"`
+}
+
+// Server is a reference provisioning server holding keys by name. It is an http.Handler serving
+// POST /nonces, which issues a single-use nonce, and POST /keys/{name}, which takes a Request and returns
+// the key wrapped to its transport key. Keys are only wrapped to transport keys whose statement the
+// verifier accepts.
+type Server struct {
+	verifier *attest.KeyVerifier
+
+	mu     sync.RWMutex
+	keys   map[string]crypto.PrivateKey
+	nonces map[string]time.Time
+	mux    *http.ServeMux
+}
+
+// NewServer returns a provisioning server with no keys, wrapping only to transport keys attested by a
+// device the verifier trusts. The verifier's Roots must be set.
+func NewServer(verifier *attest.KeyVerifier) (*Server, error) {
+	if verifier == nil || verifier.Roots == nil {
+		return nil, errors.New("provisioning server requires a key verifier with roots")
+	}
+	s := &Server{verifier: verifier, keys: make(map[string]crypto.PrivateKey), nonces: make(map[string]time.Time)}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("POST /nonces", s.handleNonce)
+	s.mux.HandleFunc("POST /keys/{name}", s.handleWrap)
+	return s, nil
+}
+
+// AddKey makes a key available under name; any key accepted by enclave.ImportPrivateKey can be served
+func (s *Server) AddKey(name string, key crypto.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[name] = key
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleNonce issues a nonce for the next key request
+func (s *Server) handleNonce(w http.ResponseWriter, r *http.Request) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate nonce: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for issued, expiry := range s.nonces {
+		if now.After(expiry) {
+			delete(s.nonces, issued)
+		}
+	}
+	s.nonces[string(nonce)] = now.Add(nonceLifetime)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&Nonce{Nonce: nonce})
+}
+
+// handleWrap wraps the named key to the attested transport key in the request body
+func (s *Server) handleWrap(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.mu.RLock()
+	key, ok := s.keys[name]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v: %s", ErrKeyNotFound, name), http.StatusNotFound)
+		return
+	}
+
+	var request Request
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if request.TransportKey == nil || request.Statement == nil {
+		http.Error(w, "request requires a transport key and its statement", http.StatusBadRequest)
+		return
+	}
+	if err := s.checkAttestation(request.TransportKey, request.Statement); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	wrapped, err := enclave.WrapKey(request.TransportKey, name, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to wrap key: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wrapped)
+}
+
+// checkAttestation consumes the statement's nonce, which must have been issued by the server, and checks
+// that the statement is trusted by the verifier and attests the transport key
+func (s *Server) checkAttestation(transport *enclave.TransportKey, statement *attest.KeyStatement) error {
+	s.mu.Lock()
+	expiry, ok := s.nonces[string(statement.Nonce)]
+	delete(s.nonces, string(statement.Nonce))
+	s.mu.Unlock()
+	if !ok || time.Now().After(expiry) {
+		return fmt.Errorf("%w: nonce was not issued by this server or has expired", ErrTransportKeyNotAttested)
+	}
+
+	if _, err := s.verifier.Verify(statement, statement.Nonce); err != nil {
+		return fmt.Errorf("%w: %w", ErrTransportKeyNotAttested, err)
+	}
+	if statement.KeyID != transport.ID || statement.Algorithm != string(transport.Algorithm) || !bytes.Equal(statement.PublicKey, transport.PublicKey) {
+		return fmt.Errorf("%w: statement is about another key", ErrTransportKeyNotAttested)
+	}
+	return nil
+}
+
+// Client requests keys from a provisioning server
+type Client struct {
+	URL        string       // Base URL of the provisioning server
+	HTTPClient *http.Client // Defaults to http.DefaultClient
+}
+
+// NewClient returns a client for the provisioning server at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{URL: baseURL}
+}
+
+// Provision fetches the named key wrapped to the enclave's transport key for alg and imports it into the
+// key store, where it is non-exportable. The transport key is attested for a nonce from the server.
+func (c *Client) Provision(ctx context.Context, keyStore *enclave.EnclaveKeyStore, name string, alg enclave.TransportAlgorithm) (*enclave.KeyHandle, error) {
+	var nonce Nonce
+	if err := c.post(ctx, "/nonces", nil, &nonce); err != nil {
+		return nil, fmt.Errorf("failed to request nonce: %w", err)
+	}
+	transport, err := keyStore.TransportKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := keyStore.AttestTransportKey(alg, nonce.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapped enclave.WrappedKey
+	if err := c.post(ctx, "/keys/"+url.PathEscape(name), &Request{TransportKey: transport, Statement: statement}, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to request key %s: %w", name, err)
+	}
+	if wrapped.Label != name {
+		return nil, fmt.Errorf("%w: requested %s but received %s", enclave.ErrWrappedKeyInvalid, name, wrapped.Label)
+	}
+	return keyStore.ImportWrappedKey(&wrapped)
+}
+
+// post sends a JSON request body to path on the server and decodes the JSON response into response
+func (c *Client) post(ctx context.Context, path string, request, response any) error {
+	var body io.Reader = http.NoBody
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxRequestSize))
+		err := fmt.Errorf("provisioning server returned %s: %s", resp.Status, bytes.TrimSpace(message))
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %v", ErrKeyNotFound, err)
+		case http.StatusForbidden:
+			return fmt.Errorf("%w: %v", ErrTransportKeyNotAttested, err)
+		}
+		return err
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRequestSize)).Decode(response); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
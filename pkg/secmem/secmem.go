@@ -0,0 +1,148 @@
+package secmem
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// ErrDestroyed is returned when a destroyed buffer is used
+var ErrDestroyed = errors.New("buffer has been destroyed")
+
+// wipeHook is called with the buffer contents after they are zeroed and before they are unmapped. Tests
+// use it to observe that buffers released by the finalizer were wiped.
+var wipeHook func(data []byte)
+
+// Buffer is a secret held outside the Go heap. The data pages are locked into RAM so they are never
+// swapped, and are surrounded by inaccessible guard pages so overruns fault instead of reading or
+// writing neighbouring memory.
+type Buffer struct {
+	mu     sync.Mutex
+	region []byte // Guard page, data pages, guard page
+	data   []byte // The secret, placed at the end of the data pages
+}
+
+// New allocates a locked buffer of size bytes
+func New(size int) (*Buffer, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid buffer size %d", size)
+	}
+
+	pageSize := syscall.Getpagesize()
+	dataPages := (size + pageSize - 1) / pageSize
+	region, err := syscall.Mmap(-1, 0, (dataPages+2)*pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map locked buffer: %v", err)
+	}
+
+	inner := region[pageSize : len(region)-pageSize]
+	if err := setupRegion(region, inner, pageSize); err != nil {
+		syscall.Munmap(region)
+		return nil, err
+	}
+
+	// Align the secret with the trailing guard page so overruns hit it immediately
+	b := &Buffer{
+		region: region,
+		data:   inner[len(inner)-size:],
+	}
+	runtime.SetFinalizer(b, (*Buffer).Destroy)
+	return b, nil
+}
+
+// setupRegion turns the first and last pages of region into guard pages and locks the pages in between
+func setupRegion(region, inner []byte, pageSize int) error {
+	if err := syscall.Mprotect(region[:pageSize], syscall.PROT_NONE); err != nil {
+		return fmt.Errorf("failed to protect guard page: %v", err)
+	}
+	if err := syscall.Mprotect(region[len(region)-pageSize:], syscall.PROT_NONE); err != nil {
+		return fmt.Errorf("failed to protect guard page: %v", err)
+	}
+	if err := syscall.Mlock(inner); err != nil {
+		return fmt.Errorf("failed to lock buffer into memory: %v", err)
+	}
+	return nil
+}
+
+// FromBytes allocates a locked buffer holding a copy of src and wipes src
+func FromBytes(src []byte) (*Buffer, error) {
+	b, err := New(len(src))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.data, src)
+	Wipe(src)
+	return b, nil
+}
+
+// WithBytes calls fn with the secret. The slice is only valid during the call: it must not be kept or
+// returned, since the pages are unmapped when the buffer is destroyed. The buffer cannot be destroyed
+// while fn runs.
+func (b *Buffer) WithBytes(fn func(data []byte) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.region == nil {
+		return ErrDestroyed
+	}
+	err := fn(b.data)
+	// Keep the finalizer from unmapping the pages while fn still uses them
+	runtime.KeepAlive(b)
+	return err
+}
+
+// Copy returns a copy of the secret on the Go heap; the caller is responsible for wiping it
+func (b *Buffer) Copy() ([]byte, error) {
+	var data []byte
+	err := b.WithBytes(func(secret []byte) error {
+		data = append([]byte(nil), secret...)
+		return nil
+	})
+	return data, err
+}
+
+// Len returns the size of the secret, or 0 once the buffer is destroyed
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.data)
+}
+
+// Destroy zeroes the secret, unlocks and unmaps its pages. It is safe to call more than once.
+func (b *Buffer) Destroy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.region == nil {
+		return
+	}
+	Wipe(b.data)
+	if wipeHook != nil {
+		wipeHook(b.data)
+	}
+
+	pageSize := syscall.Getpagesize()
+	syscall.Munlock(b.region[pageSize : len(b.region)-pageSize])
+	syscall.Munmap(b.region)
+	b.region = nil
+	b.data = nil
+	runtime.SetFinalizer(b, nil)
+}
+
+// Destroyed reports whether the buffer has been destroyed
+func (b *Buffer) Destroyed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.region == nil
+}
+
+// Wipe overwrites a buffer with zeros
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// Keep the writes from being optimized away as dead stores
+	runtime.KeepAlive(b)
+}
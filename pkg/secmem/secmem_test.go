@@ -0,0 +1,86 @@
+package secmem
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffer(t *testing.T) {
+	src := []byte("super secret key material")
+	b, err := FromBytes(src)
+	assert.NoError(t, err)
+
+	// The source is wiped once copied into the locked buffer
+	assert.Equal(t, make([]byte, len(src)), src)
+
+	assert.NoError(t, b.WithBytes(func(data []byte) error {
+		assert.Equal(t, []byte("super secret key material"), data)
+		return nil
+	}))
+	data, err := b.Copy()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("super secret key material"), data)
+	assert.Equal(t, len(src), b.Len())
+
+	// Errors from the callback are returned
+	assert.ErrorIs(t, b.WithBytes(func([]byte) error { return ErrDestroyed }), ErrDestroyed)
+
+	// Destroy zeroes the secret before unmapping it and can be repeated
+	var wiped []byte
+	wipeHook = func(data []byte) { wiped = append([]byte(nil), data...) }
+	defer func() { wipeHook = nil }()
+
+	b.Destroy()
+	b.Destroy()
+	assert.Equal(t, make([]byte, len(src)), wiped)
+	assert.True(t, b.Destroyed())
+	assert.Equal(t, 0, b.Len())
+	assert.ErrorIs(t, b.WithBytes(func([]byte) error { return nil }), ErrDestroyed)
+	_, err = b.Copy()
+	assert.ErrorIs(t, err, ErrDestroyed)
+}
+
+func TestBufferFinalizer(t *testing.T) {
+	var mu sync.Mutex
+	var wiped [][]byte
+	wipeHook = func(data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		wiped = append(wiped, append([]byte(nil), data...))
+	}
+	defer func() { wipeHook = nil }()
+
+	// Drop a buffer without destroying it
+	func() {
+		b, err := FromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+		assert.NoError(t, err)
+		assert.False(t, b.Destroyed())
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		mu.Lock()
+		n := len(wiped)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, wiped, 1, "The finalizer should destroy unreachable buffers") {
+		assert.Equal(t, make([]byte, 8), wiped[0])
+	}
+}
+
+func TestNewInvalidSize(t *testing.T) {
+	_, err := New(0)
+	assert.Error(t, err)
+}
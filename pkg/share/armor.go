@@ -0,0 +1,62 @@
+package share
+
+import (
+	"encoding/pem"
+	"fmt"
+	"strconv"
+)
+
+// ArmorType is the PEM block type used for armored shares
+const ArmorType = "ENCLAVE KEY SHARE"
+
+// EncodeArmor encodes the share as PEM-like armored text suitable for printing or email
+func EncodeArmor(s *Share) ([]byte, error) {
+	body, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	// The headers are informational; the binary body is authoritative and checksummed
+	block := &pem.Block{
+		Type: ArmorType,
+		Headers: map[string]string{
+			"Key-ID":    s.KeyID,
+			"Scheme":    s.Scheme.String(),
+			"Threshold": strconv.Itoa(int(s.Threshold)),
+			"Index":     strconv.Itoa(int(s.Index)),
+		},
+		Bytes: body,
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// DecodeArmor decodes an armored share, rejecting corrupted bodies and headers that disagree with the body
+func DecodeArmor(data []byte) (*Share, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no armored share found", ErrInvalidShare)
+	}
+	if block.Type != ArmorType {
+		return nil, fmt.Errorf("%w: unexpected armor type %q", ErrInvalidShare, block.Type)
+	}
+
+	s := &Share{}
+	if err := s.UnmarshalBinary(block.Bytes); err != nil {
+		return nil, err
+	}
+
+	expected := map[string]string{
+		"Key-ID":    s.KeyID,
+		"Scheme":    s.Scheme.String(),
+		"Threshold": strconv.Itoa(int(s.Threshold)),
+		"Index":     strconv.Itoa(int(s.Index)),
+	}
+	for name, value := range block.Headers {
+		want, known := expected[name]
+		if known && value != want {
+			return nil, fmt.Errorf("%w: armor header %s=%q does not match share contents", ErrMismatch, name, value)
+		}
+	}
+
+	return s, nil
+}
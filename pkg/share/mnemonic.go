@@ -0,0 +1,159 @@
+package share
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	radixBits      = 10              // Bits encoded by each mnemonic word
+	radixWords     = 1 << radixBits  // Number of words in the wordlist
+	checksumWords  = 3               // RS1024 checksum length in words
+	customization  = "enclave-share" // RS1024 customization string, keeps our mnemonics distinct from SLIP-39 wallets
+	wordPrefixSize = 4               // Words may be abbreviated to their first four letters
+)
+
+// wordIndex maps every word and its four letter prefix to its position in the wordlist
+var wordIndex = func() map[string]int {
+	index := make(map[string]int, 2*radixWords)
+	for i, word := range wordlist {
+		index[word] = i
+		index[word[:wordPrefixSize]] = i
+	}
+	return index
+}()
+
+// EncodeMnemonic encodes the share as a SLIP-39 style list of words for paper backups
+func EncodeMnemonic(s *Share) ([]string, error) {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	values := bytesToWords(data)
+	values = append(values, rs1024Checksum(values)...)
+
+	words := make([]string, len(values))
+	for i, v := range values {
+		words[i] = wordlist[v]
+	}
+	return words, nil
+}
+
+// DecodeMnemonic decodes a word list produced by EncodeMnemonic, rejecting unknown words and bad checksums
+func DecodeMnemonic(words []string) (*Share, error) {
+	if len(words) <= checksumWords {
+		return nil, fmt.Errorf("%w: mnemonic too short", ErrInvalidShare)
+	}
+
+	values := make([]int, len(words))
+	for i, word := range words {
+		v, ok := wordIndex[strings.ToLower(strings.TrimSpace(word))]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown word %q at position %d", ErrInvalidShare, word, i+1)
+		}
+		values[i] = v
+	}
+
+	if !rs1024Verify(values) {
+		return nil, ErrChecksum
+	}
+
+	data, err := wordsToBytes(values[:len(values)-checksumWords])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Share{}
+	if err := s.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// bytesToWords converts data to 10-bit word values, left-padding with zero bits
+func bytesToWords(data []byte) []int {
+	count := (len(data)*8 + radixBits - 1) / radixBits
+	padding := count*radixBits - len(data)*8
+
+	values := make([]int, count)
+	for bit := 0; bit < len(data)*8; bit++ {
+		if data[bit/8]&(0x80>>(bit%8)) == 0 {
+			continue
+		}
+		pos := bit + padding
+		values[pos/radixBits] |= 1 << (radixBits - 1 - pos%radixBits)
+	}
+	return values
+}
+
+// wordsToBytes reverses bytesToWords; the binary encoding never starts with a zero byte, so a
+// leading zero byte can only be padding
+func wordsToBytes(values []int) ([]byte, error) {
+	bits := len(values) * radixBits
+	data := make([]byte, bits/8)
+	padding := bits % 8
+
+	for pos := 0; pos < bits; pos++ {
+		if values[pos/radixBits]&(1<<(radixBits-1-pos%radixBits)) == 0 {
+			continue
+		}
+		if pos < padding {
+			return nil, fmt.Errorf("%w: non-zero mnemonic padding", ErrInvalidShare)
+		}
+		bit := pos - padding
+		data[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	if len(data) > 0 && data[0] == 0 {
+		data = data[1:]
+	}
+	return data, nil
+}
+
+// rs1024Polymod computes the SLIP-39 Reed-Solomon checksum polynomial over GF(1024)
+func rs1024Polymod(values []int) int {
+	gen := [10]int{
+		0xE0E040, 0x1C1C080, 0x3838100, 0x7070200, 0xE0E0009,
+		0x1C0C2412, 0x38086C24, 0x3090FC48, 0x21B1F890, 0x3F3F120,
+	}
+
+	chk := 1
+	for _, v := range values {
+		b := chk >> 20
+		chk = (chk&0xFFFFF)<<10 ^ v
+		for i := 0; i < 10; i++ {
+			if (b>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// rs1024Checksum returns the checksum words for the given values
+func rs1024Checksum(values []int) []int {
+	input := make([]int, 0, len(customization)+len(values)+checksumWords)
+	for _, c := range customization {
+		input = append(input, int(c))
+	}
+	input = append(input, values...)
+	input = append(input, make([]int, checksumWords)...)
+
+	polymod := rs1024Polymod(input) ^ 1
+	checksum := make([]int, checksumWords)
+	for i := range checksum {
+		checksum[i] = (polymod >> (radixBits * (checksumWords - 1 - i))) & (radixWords - 1)
+	}
+	return checksum
+}
+
+// rs1024Verify reports whether the values end with a valid checksum
+func rs1024Verify(values []int) bool {
+	input := make([]int, 0, len(customization)+len(values))
+	for _, c := range customization {
+		input = append(input, int(c))
+	}
+	input = append(input, values...)
+	return rs1024Polymod(input) == 1
+}
@@ -0,0 +1,238 @@
+package share
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/hashicorp/vault/shamir"
+)
+
+const (
+	formatVersion = 1 // Binary share encoding version
+	checksumSize  = 4 // Truncated SHA-256 checksum appended to every encoded share
+	maxKeyIDSize  = 255
+)
+
+// Scheme identifies the secret sharing scheme a share belongs to
+type Scheme uint8
+
+const (
+	// SchemeShamirGF256 is byte-wise Shamir Secret Sharing over GF(2^8) as implemented by shamir.Split
+	SchemeShamirGF256 Scheme = 1
+	// SchemeFeldmanP256 is a P-256 scalar share from distributed key generation; it is never recombined
+	SchemeFeldmanP256 Scheme = 2
+	// SchemeFeldmanEd25519 is an Ed25519 scalar share from distributed key generation; it is never recombined
+	SchemeFeldmanEd25519 Scheme = 3
+)
+
+// String returns the name of the sharing scheme
+func (s Scheme) String() string {
+	switch s {
+	case SchemeShamirGF256:
+		return "shamir-gf256"
+	case SchemeFeldmanP256:
+		return "feldman-p256"
+	case SchemeFeldmanEd25519:
+		return "feldman-ed25519"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// schemes lists every known sharing scheme
+var schemes = []Scheme{SchemeShamirGF256, SchemeFeldmanP256, SchemeFeldmanEd25519}
+
+// ParseScheme returns the Scheme with the given name
+func ParseScheme(name string) (Scheme, error) {
+	for _, s := range schemes {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: unknown scheme %q", ErrInvalidShare, name)
+}
+
+var (
+	// ErrInvalidShare is returned when an encoded share is malformed
+	ErrInvalidShare = errors.New("share: invalid share")
+
+	// ErrChecksum is returned when an encoded share fails its integrity check
+	ErrChecksum = errors.New("share: checksum mismatch")
+
+	// ErrMismatch is returned when shares that do not belong together are combined
+	ErrMismatch = errors.New("share: shares do not belong to the same secret")
+)
+
+// Share is a single self-describing share of a split secret
+type Share struct {
+	KeyID     string // Identifier of the key the share was split from
+	Scheme    Scheme // Sharing scheme used to produce the share
+	Threshold uint8  // Minimum number of shares required to recover the secret
+	Index     uint8  // Share index (the x-coordinate for Shamir shares)
+	Value     []byte // Share value without the index byte
+}
+
+// FromShamir wraps a raw share returned by shamir.Split, which carries its x-coordinate as the last byte
+func FromShamir(keyID string, threshold int, raw []byte) (*Share, error) {
+	if len(raw) <= shamir.ShareOverhead {
+		return nil, fmt.Errorf("%w: raw share too short", ErrInvalidShare)
+	}
+	if threshold < 2 || threshold > 255 {
+		return nil, fmt.Errorf("%w: threshold %d out of range", ErrInvalidShare, threshold)
+	}
+	if len(keyID) > maxKeyIDSize {
+		return nil, fmt.Errorf("%w: key ID exceeds %d bytes", ErrInvalidShare, maxKeyIDSize)
+	}
+
+	value := make([]byte, len(raw)-shamir.ShareOverhead)
+	copy(value, raw)
+
+	return &Share{
+		KeyID:     keyID,
+		Scheme:    SchemeShamirGF256,
+		Threshold: uint8(threshold),
+		Index:     raw[len(raw)-1],
+		Value:     value,
+	}, nil
+}
+
+// Split splits a secret with shamir.Split and wraps every resulting share
+func Split(keyID string, secret []byte, parts, threshold int) ([]*Share, error) {
+	raw, err := shamir.Split(secret, parts, threshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split secret using Shamir: %v", err)
+	}
+
+	shares := make([]*Share, len(raw))
+	for i, r := range raw {
+		shares[i], err = FromShamir(keyID, threshold, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shares, nil
+}
+
+// Shamir returns the share in the raw layout expected by shamir.Combine
+func (s *Share) Shamir() []byte {
+	raw := make([]byte, len(s.Value)+shamir.ShareOverhead)
+	copy(raw, s.Value)
+	raw[len(s.Value)] = s.Index
+	return raw
+}
+
+// Combine recovers the secret from a set of shares, rejecting shares that do not belong together
+func Combine(shares []*Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("%w: no shares provided", ErrMismatch)
+	}
+
+	first := shares[0]
+	if len(shares) < int(first.Threshold) {
+		return nil, fmt.Errorf("%w: %d shares provided, threshold is %d", ErrMismatch, len(shares), first.Threshold)
+	}
+
+	seen := make(map[uint8]bool, len(shares))
+	raw := make([][]byte, len(shares))
+	for i, s := range shares {
+		if s.KeyID != first.KeyID {
+			return nil, fmt.Errorf("%w: key ID %q does not match %q", ErrMismatch, s.KeyID, first.KeyID)
+		}
+		if s.Scheme != first.Scheme || s.Threshold != first.Threshold || len(s.Value) != len(first.Value) {
+			return nil, fmt.Errorf("%w: share %d has different parameters", ErrMismatch, s.Index)
+		}
+		if seen[s.Index] {
+			return nil, fmt.Errorf("%w: duplicate share index %d", ErrMismatch, s.Index)
+		}
+		seen[s.Index] = true
+		raw[i] = s.Shamir()
+	}
+
+	if first.Scheme != SchemeShamirGF256 {
+		return nil, fmt.Errorf("%w: unsupported scheme %s", ErrInvalidShare, first.Scheme)
+	}
+
+	secret, err := shamir.Combine(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine shares using Shamir: %v", err)
+	}
+	return secret, nil
+}
+
+// MarshalBinary encodes the share with its metadata and a trailing checksum
+func (s *Share) MarshalBinary() ([]byte, error) {
+	if len(s.KeyID) > maxKeyIDSize {
+		return nil, fmt.Errorf("%w: key ID exceeds %d bytes", ErrInvalidShare, maxKeyIDSize)
+	}
+	if len(s.Value) == 0 || len(s.Value) > 0xFFFF {
+		return nil, fmt.Errorf("%w: share value length %d out of range", ErrInvalidShare, len(s.Value))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(formatVersion)
+	buf.WriteByte(byte(s.Scheme))
+	buf.WriteByte(s.Threshold)
+	buf.WriteByte(s.Index)
+	buf.WriteByte(byte(len(s.KeyID)))
+	buf.WriteString(s.KeyID)
+	binary.Write(&buf, binary.BigEndian, uint16(len(s.Value)))
+	buf.Write(s.Value)
+
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:checksumSize])
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a share produced by MarshalBinary, verifying its checksum
+func (s *Share) UnmarshalBinary(data []byte) error {
+	// version, scheme, threshold, index, key ID length, value length and checksum
+	if len(data) < 7+checksumSize {
+		return fmt.Errorf("%w: encoding too short", ErrInvalidShare)
+	}
+
+	body, checksum := data[:len(data)-checksumSize], data[len(data)-checksumSize:]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:checksumSize], checksum) {
+		return ErrChecksum
+	}
+
+	if body[0] != formatVersion {
+		return fmt.Errorf("%w: unsupported format version %d", ErrInvalidShare, body[0])
+	}
+
+	idLen := int(body[4])
+	if len(body) < 5+idLen+2 {
+		return fmt.Errorf("%w: truncated key ID", ErrInvalidShare)
+	}
+	keyID := string(body[5 : 5+idLen])
+
+	rest := body[5+idLen:]
+	valueLen := int(binary.BigEndian.Uint16(rest))
+	if valueLen == 0 || len(rest) != 2+valueLen {
+		return fmt.Errorf("%w: share value length mismatch", ErrInvalidShare)
+	}
+
+	threshold := body[2]
+	if threshold < 2 {
+		return fmt.Errorf("%w: threshold %d out of range", ErrInvalidShare, threshold)
+	}
+	scheme := Scheme(body[1])
+	if !slices.Contains(schemes, scheme) {
+		return fmt.Errorf("%w: unknown scheme %s", ErrInvalidShare, scheme)
+	}
+	// Index 0 is the x-coordinate of the secret itself
+	if body[3] == 0 {
+		return fmt.Errorf("%w: share index 0 is reserved", ErrInvalidShare)
+	}
+
+	s.KeyID = keyID
+	s.Scheme = scheme
+	s.Threshold = threshold
+	s.Index = body[3]
+	s.Value = append([]byte(nil), rest[2:]...)
+	return nil
+}
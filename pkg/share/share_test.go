@@ -0,0 +1,143 @@
+package share
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/shamir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromShamirRoundTrip(t *testing.T) {
+	secret := []byte("ThisIsA32ByteKeyForAES256Encrypt")
+
+	raw, err := shamir.Split(secret, 5, 3)
+	assert.NoError(t, err)
+
+	// Wrap the raw shares and recombine a threshold subset
+	shares := make([]*Share, len(raw))
+	for i, r := range raw {
+		shares[i], err = FromShamir("rsa-1", 3, r)
+		assert.NoError(t, err)
+		assert.Equal(t, r, shares[i].Shamir())
+	}
+
+	recovered, err := Combine(shares[1:4])
+	assert.NoError(t, err)
+	assert.Equal(t, secret, recovered)
+
+	// Too few shares must be rejected
+	_, err = Combine(shares[:2])
+	assert.ErrorIs(t, err, ErrMismatch)
+}
+
+func TestCombineRejectsMismatchedShares(t *testing.T) {
+	a, err := Split("key-a", []byte("secret number one"), 3, 2)
+	assert.NoError(t, err)
+	b, err := Split("key-b", []byte("secret number two"), 3, 2)
+	assert.NoError(t, err)
+
+	_, err = Combine([]*Share{a[0], b[1]})
+	assert.ErrorIs(t, err, ErrMismatch)
+
+	_, err = Combine([]*Share{a[0], a[0]})
+	assert.ErrorIs(t, err, ErrMismatch)
+}
+
+func TestArmorRoundTrip(t *testing.T) {
+	shares, err := Split("ecdsa-1", []byte("armored share secret"), 3, 2)
+	assert.NoError(t, err)
+
+	armored, err := EncodeArmor(shares[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(armored), "BEGIN "+ArmorType)
+
+	decoded, err := DecodeArmor(armored)
+	assert.NoError(t, err)
+	assert.Equal(t, shares[0], decoded)
+}
+
+func TestArmorRejectsCorruption(t *testing.T) {
+	shares, err := Split("ecdsa-1", []byte("armored share secret"), 3, 2)
+	assert.NoError(t, err)
+
+	// Corrupt a byte of the binary body
+	body, err := shares[0].MarshalBinary()
+	assert.NoError(t, err)
+	body[len(body)/2] ^= 0x01
+	corrupted := &Share{}
+	assert.ErrorIs(t, corrupted.UnmarshalBinary(body), ErrChecksum)
+
+	// Tamper with a header so it disagrees with the body
+	armored, err := EncodeArmor(shares[0])
+	assert.NoError(t, err)
+	tampered := strings.Replace(string(armored), "Key-ID: ecdsa-1", "Key-ID: ecdsa-2", 1)
+	_, err = DecodeArmor([]byte(tampered))
+	assert.ErrorIs(t, err, ErrMismatch)
+}
+
+func TestUnmarshalRejectsInvalidFields(t *testing.T) {
+	shares, err := Split("ecdsa-1", []byte("share field secret"), 3, 2)
+	assert.NoError(t, err)
+
+	// Both fields are covered by the checksum, so re-encode the tampered shares
+	for _, tamper := range []func(s *Share){
+		func(s *Share) { s.Index = 0 },
+		func(s *Share) { s.Scheme = 0 },
+		func(s *Share) { s.Scheme = 42 },
+	} {
+		tampered := *shares[0]
+		tamper(&tampered)
+		body, err := tampered.MarshalBinary()
+		assert.NoError(t, err)
+		assert.ErrorIs(t, (&Share{}).UnmarshalBinary(body), ErrInvalidShare)
+	}
+}
+
+func TestMnemonicRoundTrip(t *testing.T) {
+	// Exercise several value lengths so every padding width is covered
+	for size := 16; size <= 20; size++ {
+		secret := make([]byte, size)
+		for i := range secret {
+			secret[i] = byte(i * 7)
+		}
+
+		shares, err := Split("ed25519-1", secret, 3, 2)
+		assert.NoError(t, err)
+
+		words, err := EncodeMnemonic(shares[2])
+		assert.NoError(t, err)
+
+		decoded, err := DecodeMnemonic(words)
+		assert.NoError(t, err)
+		assert.Equal(t, shares[2], decoded)
+	}
+}
+
+func TestMnemonicRejectsCorruption(t *testing.T) {
+	shares, err := Split("ed25519-1", []byte("mnemonic share secret"), 3, 2)
+	assert.NoError(t, err)
+
+	words, err := EncodeMnemonic(shares[0])
+	assert.NoError(t, err)
+
+	// Swap a single word for its neighbour in the wordlist
+	corrupted := append([]string(nil), words...)
+	corrupted[4] = wordlist[(wordIndex[corrupted[4]]+1)%radixWords]
+	_, err = DecodeMnemonic(corrupted)
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	// Unknown words are rejected outright
+	corrupted[4] = "enclave"
+	_, err = DecodeMnemonic(corrupted)
+	assert.ErrorIs(t, err, ErrInvalidShare)
+
+	// Four letter abbreviations are accepted
+	abbreviated := make([]string, len(words))
+	for i, w := range words {
+		abbreviated[i] = w[:wordPrefixSize]
+	}
+	decoded, err := DecodeMnemonic(abbreviated)
+	assert.NoError(t, err)
+	assert.Equal(t, shares[0], decoded)
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket holding every value
+var boltBucket = []byte("enclave")
+
+// BoltBackend stores values in an embedded bbolt key-value database. Every Put is its own fsynced
+// transaction, and bbolt locks the database file against other processes.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// OpenBoltBackend opens or creates the database file at path
+func OpenBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 100 * time.Millisecond})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create database bucket: %v", err)
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+// Get returns the value of key
+func (b *BoltBackend) Get(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		// Values are only valid for the life of the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, b.wrap(err)
+}
+
+// Put stores value under key
+func (b *BoltBackend) Put(key string, value []byte) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+	return b.wrap(b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), value)
+	}))
+}
+
+// Delete removes key; deleting a missing key is not an error
+func (b *BoltBackend) Delete(key string) error {
+	return b.wrap(b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	}))
+}
+
+// List returns the keys starting with prefix
+func (b *BoltBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, b.wrap(err)
+}
+
+// Close closes the database and releases its file lock
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+// wrap maps bbolt errors onto the storage errors
+func (b *BoltBackend) wrap(err error) error {
+	switch {
+	case err == nil, errors.Is(err, ErrNotFound):
+		return err
+	case errors.Is(err, bolt.ErrDatabaseNotOpen):
+		return ErrClosed
+	default:
+		return fmt.Errorf("database error: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// lockFileName is the file holding the exclusive lock on a file backend directory
+const lockFileName = ".lock"
+
+// FileBackend stores each value in its own file below a directory. Writes go to a temporary file that is
+// synced and renamed over the old value, and the directory is held under an exclusive lock so only one
+// process uses it at a time.
+type FileBackend struct {
+	mu   sync.Mutex
+	dir  string
+	lock *os.File
+}
+
+// OpenFileBackend opens the directory, creating it if needed, and locks it
+func OpenFileBackend(dir string) (*FileBackend, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no storage directory configured")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, fmt.Errorf("failed to lock storage directory: %v", err)
+	}
+
+	return &FileBackend{dir: dir, lock: lock}, nil
+}
+
+// Get reads the value of key
+func (f *FileBackend) Get(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// Put atomically replaces the value of key
+func (f *FileBackend) Put(key string, value []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", key, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %v", key, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %v", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", key, err)
+	}
+	return syncDir(dir)
+}
+
+// Delete removes key; deleting a missing key is not an error
+func (f *FileBackend) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %v", key, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// List returns the keys starting with prefix, skipping hidden and temporary files
+func (f *FileBackend) List(prefix string) ([]string, error) {
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err := filepath.WalkDir(f.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != f.dir {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage directory: %v", err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Close releases the directory lock
+func (f *FileBackend) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lock == nil {
+		return nil
+	}
+	err := f.lock.Close()
+	f.lock = nil
+	return err
+}
+
+// path returns the file holding key
+func (f *FileBackend) path(key string) (string, error) {
+	if err := f.checkOpen(); err != nil {
+		return "", err
+	}
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(key)), nil
+}
+
+// checkOpen returns ErrClosed once the backend is closed
+func (f *FileBackend) checkOpen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lock == nil {
+		return ErrClosed
+	}
+	return nil
+}
+
+// syncDir flushes directory entries to disk so renames and removals survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %v", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %v", dir, err)
+	}
+	return nil
+}
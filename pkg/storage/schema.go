@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// SchemaKey holds the schema version of the data in a backend
+const SchemaKey = "schema"
+
+// ErrSchemaTooNew is returned when a backend holds data written by a newer schema than the code knows
+var ErrSchemaTooNew = errors.New("storage schema is newer than supported")
+
+// Migration upgrades the data in a backend from schema Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(Backend) error
+}
+
+// SchemaVersion returns the schema version recorded in a backend, or 0 if none is recorded
+func SchemaVersion(b Backend) (int, error) {
+	value, err := b.Get(SchemaKey)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(value))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid schema version %q", value)
+	}
+	return version, nil
+}
+
+// Migrate brings a backend up to the version of the last migration. Pending migrations run in order and
+// the version is recorded after each one, so an interrupted upgrade resumes where it stopped. Migrations
+// must be numbered consecutively from 1.
+func Migrate(b Backend, migrations []Migration) (int, error) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return 0, fmt.Errorf("migration %d has version %d", i+1, m.Version)
+		}
+	}
+
+	version, err := SchemaVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return version, fmt.Errorf("%w: version %d, latest %d", ErrSchemaTooNew, version, len(migrations))
+	}
+
+	for _, m := range migrations[version:] {
+		if err := m.Migrate(b); err != nil {
+			return version, fmt.Errorf("schema migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		if err := b.Put(SchemaKey, []byte(strconv.Itoa(m.Version))); err != nil {
+			return version, fmt.Errorf("failed to record schema version %d: %v", m.Version, err)
+		}
+		version = m.Version
+		fmt.Printf("Storage schema successfully migrated to version %d: %s\n", m.Version, m.Description)
+	}
+	return version, nil
+}
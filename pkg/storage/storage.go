@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when a key has no value
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidKey is returned for keys a backend cannot store
+	ErrInvalidKey = errors.New("invalid storage key")
+
+	// ErrLocked is returned when another process holds the storage
+	ErrLocked = errors.New("storage is locked by another process")
+
+	// ErrClosed is returned when a closed backend is used
+	ErrClosed = errors.New("storage is closed")
+)
+
+// Backend stores opaque values under slash-separated keys such as "keys/<id>". Put must be atomic: after a
+// crash a key holds either its old or its new value.
+type Backend interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	List(prefix string) ([]string, error) // Keys starting with prefix, sorted
+	Close() error
+}
+
+// ValidateKey checks that a key is a relative slash-separated path of non-empty segments that are not
+// hidden, using letters, digits, '-', '_' and '.'
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment[0] == '.' {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+		for _, c := range segment {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+			default:
+				return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// backends returns one of each backend, each in its own temporary location
+func backends(t *testing.T) map[string]Backend {
+	file, err := OpenFileBackend(t.TempDir())
+	assert.NoError(t, err)
+	bolt, err := OpenBoltBackend(filepath.Join(t.TempDir(), "enclave.db"))
+	assert.NoError(t, err)
+	return map[string]Backend{
+		"memory": NewMemoryBackend(),
+		"file":   file,
+		"bolt":   bolt,
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := b.Get("keys/missing")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			assert.NoError(t, b.Put("keys/b", []byte("second")))
+			assert.NoError(t, b.Put("keys/a", []byte("first")))
+			assert.NoError(t, b.Put("other", []byte("other")))
+			assert.NoError(t, b.Put("keys/a", []byte("replaced")))
+
+			value, err := b.Get("keys/a")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("replaced"), value)
+
+			keys, err := b.List("keys/")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"keys/a", "keys/b"}, keys)
+			keys, err = b.List("")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"keys/a", "keys/b", "other"}, keys)
+
+			assert.NoError(t, b.Delete("keys/a"))
+			assert.NoError(t, b.Delete("keys/a"), "Deleting a missing key should succeed")
+			_, err = b.Get("keys/a")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			for _, key := range []string{"", "../escape", "keys/.hidden", "keys//a", "keys/a b"} {
+				assert.ErrorIs(t, b.Put(key, []byte("x")), ErrInvalidKey, "Key %q should be rejected", key)
+			}
+
+			assert.NoError(t, b.Close())
+			_, err = b.Get("keys/b")
+			assert.ErrorIs(t, err, ErrClosed)
+		})
+	}
+}
+
+func TestFileBackendLocking(t *testing.T) {
+	dir := t.TempDir()
+	first, err := OpenFileBackend(dir)
+	assert.NoError(t, err)
+
+	_, err = OpenFileBackend(dir)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	// The lock is released on close
+	assert.NoError(t, first.Close())
+	second, err := OpenFileBackend(dir)
+	assert.NoError(t, err)
+
+	// Leftover temporary files from an interrupted write are not keys
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".value-123.tmp"), []byte("partial"), 0600))
+	assert.NoError(t, second.Put("value", []byte("complete")))
+	keys, err := second.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"value"}, keys)
+	assert.NoError(t, second.Close())
+}
+
+func TestBoltBackendLocking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enclave.db")
+	first, err := OpenBoltBackend(path)
+	assert.NoError(t, err)
+	assert.NoError(t, first.Put("value", []byte("persisted")))
+
+	_, err = OpenBoltBackend(path)
+	assert.ErrorIs(t, err, ErrLocked)
+
+	assert.NoError(t, first.Close())
+	second, err := OpenBoltBackend(path)
+	assert.NoError(t, err)
+	value, err := second.Get("value")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("persisted"), value)
+	assert.NoError(t, second.Close())
+}
+
+func TestMigrate(t *testing.T) {
+	b := NewMemoryBackend()
+	var applied []int
+	migration := func(version int) Migration {
+		return Migration{
+			Version:     version,
+			Description: "test",
+			Migrate: func(Backend) error {
+				applied = append(applied, version)
+				return nil
+			},
+		}
+	}
+
+	version, err := Migrate(b, []Migration{migration(1), migration(2)})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+	assert.Equal(t, []int{1, 2}, applied)
+
+	// Only pending migrations run
+	version, err = Migrate(b, []Migration{migration(1), migration(2), migration(3)})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, version)
+	assert.Equal(t, []int{1, 2, 3}, applied)
+
+	// Data from a newer schema is refused
+	_, err = Migrate(b, []Migration{migration(1)})
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+
+	// Migrations must be numbered consecutively
+	_, err = Migrate(NewMemoryBackend(), []Migration{migration(2)})
+	assert.Error(t, err)
+}
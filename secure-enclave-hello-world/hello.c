@@ -1,6 +1,38 @@
-#include <stdio.h>
+#include "mailbox.h"
+
+#define ECALL_HELLO MAILBOX_FIRST_USER_CALL
+
+/* Greets the name passed as arguments, printing the greeting on the host console too */
+static uint32_t hello(const uint8_t *args, uint32_t length, uint8_t *response,
+                      uint32_t capacity, uint32_t *response_length)
+{
+    static const char prefix[] = "Hello, ";
+    uint32_t size = sizeof(prefix) - 1;
+
+    if (length == 0) {
+        args = (const uint8_t *)"Secure Enclave";
+        length = 14;
+    }
+    if (size + length + 2 > capacity) {
+        return MAILBOX_STATUS_BUFFER_TOO_SMALL;
+    }
+    memcpy(response, prefix, size);
+    memcpy(response + size, args, length);
+    size += length;
+    response[size++] = '!';
+    response[size] = '\0';
+
+    ocall_print((const char *)response);
+    ocall_print("\n");
+    *response_length = size;
+    return MAILBOX_STATUS_OK;
+}
 
 int main() {
-    printf("Hello, Secure Enclave!\n");
+    static const struct ecall_entry ecalls[] = {
+        {ECALL_HELLO, hello},
+    };
+
+    mailbox_serve(ecalls, sizeof(ecalls) / sizeof(ecalls[0]));
     return 0;
-}
\ No newline at end of file
+}
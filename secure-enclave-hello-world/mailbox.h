@@ -0,0 +1,182 @@
+/*
+ * Enclave side of the ecall/ocall mailbox ABI, mirroring the host side in pkg/mailbox.
+ *
+ * The host makes an ecall by writing a request into the mailbox and setting its state to
+ * MAILBOX_STATE_ECALL. mailbox_serve() runs the matching handler and writes the response, and the
+ * handler may make ocalls back to the host meanwhile. All fields are 32-bit little-endian words.
+ */
+#ifndef ENCLAVE_MAILBOX_H
+#define ENCLAVE_MAILBOX_H
+
+#include <stddef.h>
+#include <stdint.h>
+#include <string.h>
+
+/* Address of the mailbox in enclave memory */
+#ifndef MAILBOX_BASE
+#define MAILBOX_BASE 0x60000000UL
+#endif
+
+/* Largest request or response a handler sees; requests larger than this are refused */
+#ifndef MAILBOX_BUFFER_SIZE
+#define MAILBOX_BUFFER_SIZE 4096
+#endif
+
+/* Mailbox states. Each is written only after the frame it announces, by the side named. */
+#define MAILBOX_STATE_IDLE         0 /* No call in progress */
+#define MAILBOX_STATE_ECALL        1 /* Host: an ecall request is in the buffer */
+#define MAILBOX_STATE_OCALL        2 /* Enclave: an ocall request is in the buffer */
+#define MAILBOX_STATE_OCALL_RETURN 3 /* Host: the ocall response is in the buffer */
+#define MAILBOX_STATE_ECALL_RETURN 4 /* Enclave: the ecall response is in the buffer */
+
+/* Reserved call numbers. Programs number their own ecalls and ocalls from MAILBOX_FIRST_USER_CALL. */
+#define ECALL_EXIT              0 /* Leave mailbox_serve() */
+#define OCALL_PRINT             1 /* Write the buffer to the host console */
+#define MAILBOX_FIRST_USER_CALL 16
+
+/* Return codes. Programs may return their own codes from MAILBOX_FIRST_USER_STATUS. */
+#define MAILBOX_STATUS_OK               0
+#define MAILBOX_STATUS_UNKNOWN_CALL     1 /* No ecall or ocall has the number */
+#define MAILBOX_STATUS_INVALID_ARGUMENT 2 /* The arguments were malformed */
+#define MAILBOX_STATUS_BUFFER_TOO_SMALL 3 /* The response did not fit in the buffer */
+#define MAILBOX_STATUS_FAILED           4 /* The call failed */
+#define MAILBOX_FIRST_USER_STATUS       16
+
+struct mailbox {
+    volatile uint32_t state;    /* One of the MAILBOX_STATE values */
+    volatile uint32_t sequence; /* Sequence number of the ecall, left unchanged in its response */
+    volatile uint32_t number;   /* Ecall or ocall number */
+    volatile uint32_t status;   /* Return code of a response */
+    volatile uint32_t length;   /* Length of the frame in the buffer */
+    volatile uint32_t capacity; /* Size of the buffer, written by the host */
+    uint32_t reserved[2];
+    volatile uint8_t buffer[];
+};
+
+/*
+ * An ecall handler reads length bytes of arguments and writes at most capacity bytes of response,
+ * setting *response_length, and returns a return code. The response is only sent with
+ * MAILBOX_STATUS_OK.
+ */
+typedef uint32_t (*ecall_handler)(const uint8_t *args, uint32_t length, uint8_t *response,
+                                  uint32_t capacity, uint32_t *response_length);
+
+struct ecall_entry {
+    uint32_t number;
+    ecall_handler handler;
+};
+
+static inline struct mailbox *mailbox_get(void)
+{
+    return (struct mailbox *)MAILBOX_BASE;
+}
+
+/* Publishes a frame: the fields and buffer must be visible to the host before the new state */
+static inline void mailbox_post(struct mailbox *mb, uint32_t state)
+{
+    __sync_synchronize();
+    mb->state = state;
+}
+
+/* Waits for the host to set the mailbox to state, then orders the reads of its frame after it */
+static inline void mailbox_wait(struct mailbox *mb, uint32_t state)
+{
+    while (mb->state != state) {
+    }
+    __sync_synchronize();
+}
+
+/*
+ * Makes an ocall to the host handler registered for number, copying at most capacity bytes of its
+ * response into response. Returns the handler's return code. Ocalls overwrite the mailbox buffer.
+ */
+static inline uint32_t ocall(uint32_t number, const void *args, uint32_t length, void *response,
+                             uint32_t capacity, uint32_t *response_length)
+{
+    struct mailbox *mb = mailbox_get();
+    uint32_t status, received;
+
+    if (length > mb->capacity) {
+        return MAILBOX_STATUS_BUFFER_TOO_SMALL;
+    }
+    memcpy((void *)mb->buffer, args, length);
+    mb->number = number;
+    mb->status = MAILBOX_STATUS_OK;
+    mb->length = length;
+    mailbox_post(mb, MAILBOX_STATE_OCALL);
+    mailbox_wait(mb, MAILBOX_STATE_OCALL_RETURN);
+
+    status = mb->status;
+    received = mb->length;
+    if (status != MAILBOX_STATUS_OK) {
+        return status;
+    }
+    if (received > capacity || received > mb->capacity) {
+        return MAILBOX_STATUS_BUFFER_TOO_SMALL;
+    }
+    if (response != NULL && received > 0) {
+        memcpy(response, (const void *)mb->buffer, received);
+    }
+    if (response_length != NULL) {
+        *response_length = received;
+    }
+    return MAILBOX_STATUS_OK;
+}
+
+/* Prints a string on the host console */
+static inline uint32_t ocall_print(const char *s)
+{
+    return ocall(OCALL_PRINT, s, (uint32_t)strlen(s), NULL, 0, NULL);
+}
+
+/*
+ * Serves ecalls with the handlers in ecalls until the host makes ECALL_EXIT. Arguments and responses
+ * are copied out of the mailbox, so handlers may make ocalls.
+ */
+static inline void mailbox_serve(const struct ecall_entry *ecalls, size_t count)
+{
+    static uint8_t args[MAILBOX_BUFFER_SIZE];
+    static uint8_t response[MAILBOX_BUFFER_SIZE];
+    struct mailbox *mb = mailbox_get();
+
+    for (;;) {
+        uint32_t number, length, status, capacity, response_length = 0;
+        size_t i;
+
+        mailbox_wait(mb, MAILBOX_STATE_ECALL);
+        number = mb->number;
+        length = mb->length;
+        capacity = mb->capacity < sizeof(response) ? mb->capacity : sizeof(response);
+
+        if (number == ECALL_EXIT) {
+            mb->status = MAILBOX_STATUS_OK;
+            mb->length = 0;
+            mailbox_post(mb, MAILBOX_STATE_ECALL_RETURN);
+            return;
+        }
+
+        status = MAILBOX_STATUS_UNKNOWN_CALL;
+        if (length > sizeof(args) || length > mb->capacity) {
+            status = MAILBOX_STATUS_INVALID_ARGUMENT;
+        } else {
+            memcpy(args, (const void *)mb->buffer, length);
+            for (i = 0; i < count; i++) {
+                if (ecalls[i].number == number) {
+                    status = ecalls[i].handler(args, length, response, capacity, &response_length);
+                    break;
+                }
+            }
+        }
+        if (status != MAILBOX_STATUS_OK || response_length > capacity) {
+            response_length = 0;
+        }
+
+        memcpy((void *)mb->buffer, response, response_length);
+        mb->number = number;
+        mb->status = status;
+        mb->length = response_length;
+        mailbox_post(mb, MAILBOX_STATE_ECALL_RETURN);
+    }
+}
+
+#endif /* ENCLAVE_MAILBOX_H */
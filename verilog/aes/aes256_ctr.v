@@ -1,40 +1,100 @@
+// AES-256 in the CTR mode used by AES-GCM. An image's 96-bit IV is loaded with load; the first block is
+// then XORed with AES_K(J0 + 1), where J0 = IV || 0^31 || 1, and each following block with the next value
+// of the 32-bit counter, matching the keystream of Go's crypto/cipher GCM.
+//
+// This module only decrypts. aes256_gcm_tag checks the GCM tag, and rocket_chip_enclave only executes code
+// once it has verified.
 module aes256_ctr (
     input wire clk,
-    input wire rst,
-    input wire [127:0] plaintext,
-    input wire [255:0] key,
-    output wire [127:0] ciphertext,
-    output wire done
+    input wire reset,
+    input wire load,                 // Loads the key and IV of a new image and expands the key
+    input wire [255:0] key,          // AES-256 image key from the selected key slot
+    input wire [95:0] iv,            // 96-bit GCM IV from the image header
+    input wire start,                // Requests the next block once the key is expanded
+    input wire [127:0] data_in,      // Ciphertext block
+    output reg [127:0] data_out,     // Plaintext block
+    output reg done                  // Pulses when data_out holds the decrypted block
 );
 
-    wire ready;
+    localparam CTR_IDLE  = 3'd0;
+    localparam CTR_INIT  = 3'd1;
+    localparam CTR_KEY   = 3'd2;
+    localparam CTR_NEXT  = 3'd3;
+    localparam CTR_BLOCK = 3'd4;
+
+    reg [2:0] state;
+    reg [127:0] counter;
+    reg key_loaded;
     reg init;
     reg next;
 
-    // AES core instantiation from secworks library
+    wire ready;
+    wire result_valid;
+    wire [127:0] keystream;
+
+    // AES core instantiation from secworks library; CTR mode only ever enciphers the counter
     aes_core aes_inst (
         .clk(clk),
-        .reset_n(~rst),
+        .reset_n(~reset),
+        .encdec(1'b1),
         .init(init),
         .next(next),
+        .ready(ready),
         .key(key),
         .keylen(1'b1),         // 256-bit AES
-        .block(plaintext),
-        .ready(ready),
-        .result(ciphertext),
-        .done(done)
+        .block(counter),
+        .result(keystream),
+        .result_valid(result_valid)
     );
 
-    // Control logic for AES operation
-    always @(posedge clk or posedge rst) begin
-        if (rst) begin
-            init <= 1'b1;
+    always @(posedge clk or posedge reset) begin
+        if (reset) begin
+            state <= CTR_IDLE;
+            counter <= 128'b0;
+            key_loaded <= 1'b0;
+            init <= 1'b0;
             next <= 1'b0;
-        end else if (ready && !done) begin
-            next <= 1'b1;
+            data_out <= 128'b0;
+            done <= 1'b0;
         end else begin
-            next <= 1'b0;
+            case (state)
+                CTR_IDLE: begin
+                    done <= 1'b0;
+                    if (load) begin
+                        counter <= {iv, 32'd2};  // inc32(J0): counter 1 is reserved for the tag
+                        key_loaded <= 1'b0;
+                        init <= 1'b1;
+                        state <= CTR_INIT;
+                    end else if (start && key_loaded) begin
+                        next <= 1'b1;
+                        state <= CTR_NEXT;
+                    end
+                end
+                CTR_INIT: begin
+                    init <= 1'b0;  // The core drops ready while it expands the key
+                    state <= CTR_KEY;
+                end
+                CTR_KEY: begin
+                    if (ready) begin
+                        key_loaded <= 1'b1;
+                        state <= CTR_IDLE;
+                    end
+                end
+                CTR_NEXT: begin
+                    next <= 1'b0;
+                    state <= CTR_BLOCK;
+                end
+                CTR_BLOCK: begin
+                    if (ready && result_valid) begin
+                        data_out <= data_in ^ keystream;
+                        counter[31:0] <= counter[31:0] + 32'd1;  // GCM increments only the low 32 bits
+                        done <= 1'b1;
+                        state <= CTR_IDLE;
+                    end
+                end
+                default: state <= CTR_IDLE;
+            endcase
         end
     end
 
-endmodule
\ No newline at end of file
+endmodule
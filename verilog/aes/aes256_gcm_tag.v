@@ -0,0 +1,179 @@
+// AES-256-GCM tag check for one message: an image, or one segment of a program. load starts a message with
+// its key, IV and the expected tag from the image header or segment table. The unit then computes
+// H = AES_K(0^128) and AES_K(J0), where J0 = IV || 0^31 || 1, and raises ready. The associated data and
+// then the ciphertext are streamed in as 128-bit blocks, the last block of each zero-padded, followed by
+// the length block {len(A) * 8, len(C) * 8} with last set. Each block is folded into GHASH_H with a
+// bit-serial GF(2^128) multiplier, one bit per clock (NIST SP 800-38D, algorithm 1), and once the length
+// block has been folded in, AES_K(J0) ^ GHASH is compared with the expected tag. Blocks, the IV and the
+// tag are big-endian: the first byte is in the most significant bits.
+module aes256_gcm_tag (
+    input wire clk,
+    input wire reset,
+    input wire load,                 // Starts a message; clears valid and match
+    input wire [255:0] key,          // AES-256 image key from the selected key slot
+    input wire [95:0] iv,            // 96-bit GCM IV of the message
+    input wire [127:0] tag,          // Expected tag of the message
+    input wire block_valid,          // block holds the next block; it is taken while ready is set
+    input wire [127:0] block,        // Associated data, ciphertext or length block
+    input wire last,                 // block is the length block, which ends the message
+    output wire ready,               // The unit can take a block
+    output reg valid,                // The check has completed
+    output reg match                 // The tag verified; only meaningful once valid is set
+);
+
+    localparam TAG_IDLE     = 4'd0;
+    localparam TAG_INIT     = 4'd1;
+    localparam TAG_KEY      = 4'd2;
+    localparam TAG_H_NEXT   = 4'd3;
+    localparam TAG_H        = 4'd4;
+    localparam TAG_J0_NEXT  = 4'd5;
+    localparam TAG_J0       = 4'd6;
+    localparam TAG_ABSORB   = 4'd7;
+    localparam TAG_MULTIPLY = 4'd8;
+    localparam TAG_FOLD     = 4'd9;
+    localparam TAG_COMPARE  = 4'd10;
+
+    // Reduction constant of the GCM field, x^128 + x^7 + x^2 + x + 1, in GCM's reflected bit order
+    localparam [127:0] GCM_R = {8'hE1, 120'b0};
+
+    reg [3:0] state;
+    reg [127:0] aes_block;
+    reg init;
+    reg next;
+    reg [127:0] h;              // Hash subkey AES_K(0^128)
+    reg [127:0] ek_j0;          // AES_K(J0), which masks the tag
+    reg [127:0] expected;       // Expected tag
+    reg [127:0] y;              // GHASH accumulator
+    reg [127:0] x;              // Multiplier operand y ^ block, consumed from its most significant bit
+    reg [127:0] v;              // H times x^i
+    reg [127:0] z;              // Product so far
+    reg [6:0] bit_count;
+    reg final_block;
+
+    wire aes_ready;
+    wire result_valid;
+    wire [127:0] aes_result;
+
+    // A second AES core, so the tag can be checked while aes256_ctr decrypts
+    aes_core aes_inst (
+        .clk(clk),
+        .reset_n(~reset),
+        .encdec(1'b1),
+        .init(init),
+        .next(next),
+        .ready(aes_ready),
+        .key(key),
+        .keylen(1'b1),         // 256-bit AES
+        .block(aes_block),
+        .result(aes_result),
+        .result_valid(result_valid)
+    );
+
+    assign ready = (state == TAG_ABSORB);
+
+    always @(posedge clk or posedge reset) begin
+        if (reset) begin
+            state <= TAG_IDLE;
+            aes_block <= 128'b0;
+            init <= 1'b0;
+            next <= 1'b0;
+            h <= 128'b0;
+            ek_j0 <= 128'b0;
+            expected <= 128'b0;
+            y <= 128'b0;
+            x <= 128'b0;
+            v <= 128'b0;
+            z <= 128'b0;
+            bit_count <= 7'd0;
+            final_block <= 1'b0;
+            valid <= 1'b0;
+            match <= 1'b0;
+        end else if (load) begin
+            // A new message restarts the unit in any state and forgets the previous message's subkeys
+            h <= 128'b0;
+            ek_j0 <= 128'b0;
+            y <= 128'b0;
+            expected <= tag;
+            aes_block <= {iv, 32'd1};  // J0 is enciphered after H, so keep the IV until then
+            valid <= 1'b0;
+            match <= 1'b0;
+            init <= 1'b1;
+            next <= 1'b0;
+            state <= TAG_INIT;
+        end else begin
+            case (state)
+                TAG_INIT: begin
+                    init <= 1'b0;  // The core drops ready while it expands the key
+                    state <= TAG_KEY;
+                end
+                TAG_KEY: begin
+                    if (aes_ready) begin
+                        x <= aes_block;  // Park J0 while the core enciphers the zero block
+                        aes_block <= 128'b0;
+                        next <= 1'b1;
+                        state <= TAG_H_NEXT;
+                    end
+                end
+                TAG_H_NEXT: begin
+                    next <= 1'b0;
+                    state <= TAG_H;
+                end
+                TAG_H: begin
+                    if (aes_ready && result_valid) begin
+                        h <= aes_result;
+                        aes_block <= x;
+                        next <= 1'b1;
+                        state <= TAG_J0_NEXT;
+                    end
+                end
+                TAG_J0_NEXT: begin
+                    next <= 1'b0;
+                    state <= TAG_J0;
+                end
+                TAG_J0: begin
+                    if (aes_ready && result_valid) begin
+                        ek_j0 <= aes_result;
+                        aes_block <= 128'b0;
+                        x <= 128'b0;
+                        state <= TAG_ABSORB;
+                    end
+                end
+                TAG_ABSORB: begin
+                    if (block_valid) begin
+                        x <= y ^ block;
+                        v <= h;
+                        z <= 128'b0;
+                        bit_count <= 7'd0;
+                        final_block <= last;
+                        state <= TAG_MULTIPLY;
+                    end
+                end
+                TAG_MULTIPLY: begin
+                    // Bit 0 of the field element is the most significant bit of the block
+                    if (x[127])
+                        z <= z ^ v;
+                    v <= v[0] ? ((v >> 1) ^ GCM_R) : (v >> 1);
+                    x <= x << 1;
+                    bit_count <= bit_count + 7'd1;
+                    if (bit_count == 7'd127)
+                        state <= TAG_FOLD;
+                end
+                TAG_FOLD: begin
+                    y <= z;
+                    state <= final_block ? TAG_COMPARE : TAG_ABSORB;
+                end
+                TAG_COMPARE: begin
+                    match <= ((y ^ ek_j0) == expected);
+                    valid <= 1'b1;
+                    h <= 128'b0;
+                    ek_j0 <= 128'b0;
+                    v <= 128'b0;
+                    z <= 128'b0;
+                    state <= TAG_IDLE;
+                end
+                default: state <= TAG_IDLE;
+            endcase
+        end
+    end
+
+endmodule
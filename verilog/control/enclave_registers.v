@@ -0,0 +1,70 @@
+// AXI-mapped control registers of the enclave, at the offsets used by pkg/enclave:
+//
+//   0x0200  Fuse register: a write sets the bits it carries and never clears one, so the host's
+//           read-OR-write in fpga.BlowFuses can only blow fuses
+//   0x0204  Monotonic counter: a write is only taken if it carries the current value plus one, so the
+//           host's read-increment-write in fpga.IncrementCounter can only advance it
+//   0x0208  Image key register: the key slot whose key decrypts and authenticates the image
+//   0x020C  Image slot register: the image slot the enclave core boots, and fpga.SlotTrial (bit 31). If the
+//           enclave core is reset while the slot is on trial, the register switches to the other slot and
+//           clears the mark, so an update that never reported healthy is abandoned
+//
+// The fuse and counter registers only give their guarantees while the FPGA stays powered: fabric registers
+// return to zero at power-on. On a board they must be backed by one-time programmable fuses and a
+// non-volatile counter, which this design does not include.
+module enclave_registers (
+    input wire clk,
+    input wire reset,                // Power-on reset
+    input wire core_reset,           // Reset of the enclave core alone, such as by its watchdog
+    input wire write,                // AXI write strobe
+    input wire [15:0] write_address, // AXI byte offset of the write
+    input wire [31:0] write_data,
+    input wire [15:0] read_address,  // AXI byte offset of the read
+    output reg [31:0] read_data,
+    output reg [31:0] fuses,
+    output reg [31:0] counter,
+    output reg [3:0] image_key_slot, // One of the 16 key slots
+    output reg [31:0] image_slot
+);
+
+    localparam FUSE_OFFSET       = 16'h0200;
+    localparam COUNTER_OFFSET    = 16'h0204;
+    localparam IMAGE_KEY_OFFSET  = 16'h0208;
+    localparam IMAGE_SLOT_OFFSET = 16'h020C;
+    localparam SLOT_TRIAL        = 31;
+
+    always @(posedge clk or posedge reset) begin
+        if (reset) begin
+            fuses <= 32'b0;
+            counter <= 32'b0;
+            image_key_slot <= 4'b0;
+            image_slot <= 32'b0;
+        end else if (core_reset) begin
+            // The core reset before the host committed the trial slot: boot the other slot
+            if (image_slot[SLOT_TRIAL])
+                image_slot <= {31'b0, ~image_slot[0]};
+        end else if (write) begin
+            case (write_address)
+                FUSE_OFFSET: fuses <= fuses | write_data;
+                COUNTER_OFFSET: begin
+                    if (write_data == counter + 32'd1 && counter != 32'hFFFF_FFFF)
+                        counter <= write_data;
+                end
+                IMAGE_KEY_OFFSET: image_key_slot <= write_data[3:0];
+                IMAGE_SLOT_OFFSET: image_slot <= write_data;
+                default: ;
+            endcase
+        end
+    end
+
+    always @(*) begin
+        case (read_address)
+            FUSE_OFFSET: read_data = fuses;
+            COUNTER_OFFSET: read_data = counter;
+            IMAGE_KEY_OFFSET: read_data = {28'b0, image_key_slot};
+            IMAGE_SLOT_OFFSET: read_data = image_slot;
+            default: read_data = 32'b0;
+        endcase
+    end
+
+endmodule
@@ -1,31 +1,92 @@
+// The enclave only executes an image once aes256_gcm_tag has checked its GCM tag. After image_load, the
+// image reader starts one tag check per message with auth_load, setting auth_final for the last one: the
+// whole image, or each segment of a program in table order. It streams each message's associated data,
+// ciphertext and length block into the tag unit. Code runs once every message of the image has verified;
+// a single mismatch reports an integrity failure until the next image is loaded.
 module rocket_chip_enclave (
     input wire clk,
     input wire reset,
-    input wire [255:0] aes_key,          // AES encryption key for decrypting instructions
+    input wire [255:0] aes_key,          // AES image key from the key slot selected by the image key register
     input wire [127:0] encrypted_instr,  // Encrypted instruction memory
-    input wire [127:0] iv,               // AES IV for CTR mode
+    input wire [95:0] iv,                // 96-bit GCM IV from the image header
+    input wire image_load,               // Pulsed when a new image header has been written
     input wire instruction_valid,        // Valid signal for the instruction
     input wire tamper_detected,          // Tamper detection signal
+    input wire auth_load,                // Starts the tag check of the next message of the image
+    input wire auth_final,               // With auth_load: the message is the last of the image
+    input wire [95:0] auth_iv,           // With auth_load: IV of the message
+    input wire [127:0] auth_tag,         // With auth_load: expected tag of the message
+    input wire auth_block_valid,         // auth_block holds the next block of the message
+    input wire [127:0] auth_block,       // Associated data, ciphertext or length block
+    input wire auth_block_last,          // auth_block is the length block
+    output wire auth_ready,              // The tag unit can take a block
     output reg [63:0] result,            // Result of instruction execution
-    output reg done                      // Instruction execution complete signal
+    output reg done,                     // Instruction execution complete signal
+    output reg [1:0] status              // 0: ok, 1: integrity failure, 2: tamper (AXI status register)
 );
 
+    localparam STATUS_OK                = 2'd0;
+    localparam STATUS_INTEGRITY_FAILURE = 2'd1;
+    localparam STATUS_TAMPER            = 2'd2;
+
     wire [127:0] decrypted_instr;
     reg start_decryption;
     wire decryption_done;
 
-    // AES Decryption Block
+    // AES-256 CTR Decryption Block, starting at counter J0 + 1 as AES-GCM does
     aes256_ctr aes_decrypt (
         .clk(clk),
         .reset(reset),
-        .start(start_decryption),
+        .load(image_load),
         .key(aes_key),
-        .data_in(encrypted_instr),
         .iv(iv),
+        .start(start_decryption),
+        .data_in(encrypted_instr),
         .data_out(decrypted_instr),
         .done(decryption_done)
     );
 
+    // AES-256-GCM tag check of each message of the image
+    wire tag_valid;
+    wire tag_match;
+    aes256_gcm_tag tag_check (
+        .clk(clk),
+        .reset(reset),
+        .load(auth_load),
+        .key(aes_key),
+        .iv(auth_iv),
+        .tag(auth_tag),
+        .block_valid(auth_block_valid),
+        .block(auth_block),
+        .last(auth_block_last),
+        .ready(auth_ready),
+        .valid(tag_valid),
+        .match(tag_match)
+    );
+
+    // The image is authenticated once its final message verifies, and fails on any message that does not
+    reg final_message;
+    reg authenticated;
+    reg auth_failed;
+    always @(posedge clk or posedge reset) begin
+        if (reset) begin
+            final_message <= 1'b0;
+            authenticated <= 1'b0;
+            auth_failed <= 1'b0;
+        end else if (image_load) begin
+            final_message <= 1'b0;
+            authenticated <= 1'b0;
+            auth_failed <= 1'b0;
+        end else if (auth_load) begin
+            final_message <= auth_final;
+        end else if (tag_valid) begin
+            if (!tag_match)
+                auth_failed <= 1'b1;
+            else if (final_message && !auth_failed)
+                authenticated <= 1'b1;
+        end
+    end
+
     // Rocket Chip Core for Instruction Execution
     wire [63:0] exec_result;
     wire exec_done;
@@ -34,17 +95,28 @@ module rocket_chip_enclave (
         .resetn(~reset),
         .instruction_address(64'h0000_0000),   // Address of the instruction
         .instruction_data(decrypted_instr[63:0]),  // Decrypted instruction to be executed
-        .instruction_valid(instruction_valid),
+        .instruction_valid(instruction_valid && authenticated), // Nothing runs before the tag verifies
         .result(exec_result),
         .done(exec_done)
     );
 
     always @(posedge clk or posedge reset) begin
-        if (reset || tamper_detected) begin
-            result <= 64'b0;  // Clear result if tamper is detected
+        if (reset) begin
+            result <= 64'b0;
             done <= 1'b0;
+            status <= STATUS_OK;
+            start_decryption <= 1'b0;
+        end else if (tamper_detected) begin
+            result <= 64'b0;  // Clear result if tamper is detected
+            done <= 1'b1;
+            status <= STATUS_TAMPER;
+            start_decryption <= 1'b0;
+        end else if (auth_failed) begin
+            result <= 64'b0;  // Refuse to execute an image that failed authentication
+            done <= 1'b1;
+            status <= STATUS_INTEGRITY_FAILURE;
             start_decryption <= 1'b0;
-        end else if (instruction_valid) begin
+        end else if (instruction_valid && authenticated) begin
             start_decryption <= 1'b1;  // Start decryption process
             if (decryption_done) begin
                 result <= exec_result;  // Capture execution result
@@ -53,4 +125,4 @@ module rocket_chip_enclave (
             end
         end
     end
-endmodule
\ No newline at end of file
+endmodule